@@ -0,0 +1,129 @@
+package cdc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	driver "github.com/go-sql-driver/mysql"
+	"net"
+	"strconv"
+)
+
+// pendingLimit is how many pending rows are published at once before the binlog is first read.
+const pendingLimit = 100
+
+// Run reads the binlog of the server of dsn as the replica serverID until ctx is done. It goes on
+// from the saved position, without one the rows still pending are published first and the binlog
+// is read from the current position of the server.
+func (r *Relay) Run(ctx context.Context, dsn string, serverID uint32) error {
+	syncerConfig, err := newSyncerConfig(dsn, serverID)
+	if err != nil {
+		return err
+	}
+
+	position, ok, err := r.store.Load()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// rows inserted between the two are published twice rather than missed
+		position, err = r.currentPosition(ctx)
+		if err != nil {
+			return err
+		}
+		err = r.relayPending(ctx, pendingLimit)
+		if err != nil {
+			return err
+		}
+		err = r.store.Save(position)
+		if err != nil {
+			return err
+		}
+	}
+	r.position = position
+	r.pending = nil
+
+	syncer := replication.NewBinlogSyncer(syncerConfig)
+	defer syncer.Close()
+	streamer, err := syncer.StartSync(mysql.Position{Name: position.Name, Pos: position.Pos})
+	if err != nil {
+		return err
+	}
+	for {
+		event, err := streamer.GetEvent(ctx)
+		if err != nil {
+			return err
+		}
+		err = r.Handle(ctx, event)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func newSyncerConfig(dsn string, serverID uint32) (replication.BinlogSyncerConfig, error) {
+	conf, err := driver.ParseDSN(dsn)
+	if err != nil {
+		return replication.BinlogSyncerConfig{}, err
+	}
+	host, port, err := net.SplitHostPort(conf.Addr)
+	if err != nil {
+		return replication.BinlogSyncerConfig{}, fmt.Errorf("cdc: %s: %w", conf.Addr, err)
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return replication.BinlogSyncerConfig{}, fmt.Errorf("cdc: %s: %w", conf.Addr, err)
+	}
+	return replication.BinlogSyncerConfig{
+		ServerID:  serverID,
+		Flavor:    mysql.MySQLFlavor,
+		Host:      host,
+		Port:      uint16(portNumber),
+		User:      conf.User,
+		Password:  conf.Passwd,
+		TLSConfig: conf.TLS,
+		ParseTime: true,
+		// heartbeats keep Handle called while no row is written, for the retries
+		HeartbeatPeriod: retryInterval,
+	}, nil
+}
+
+// currentPosition is where the server writes its binlog now.
+func (r *Relay) currentPosition(ctx context.Context) (Position, error) {
+	rows, err := r.db.QueryContext(ctx, "SHOW MASTER STATUS")
+	if err != nil {
+		return Position{}, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return Position{}, err
+	}
+	if !rows.Next() {
+		if rows.Err() != nil {
+			return Position{}, rows.Err()
+		}
+		return Position{}, fmt.Errorf("cdc: binary logging is disabled: %w", sql.ErrNoRows)
+	}
+	var res Position
+	values := make([]interface{}, len(columns))
+	values[0] = &res.Name
+	values[1] = &res.Pos
+	for i := 2; i < len(values); i++ {
+		values[i] = new(sql.RawBytes)
+	}
+	err = rows.Scan(values...)
+	return res, err
+}
+
+// SchemaName returns the database dsn connects to, its outbox tables are the ones relayed.
+func SchemaName(dsn string) (string, error) {
+	conf, err := driver.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	return conf.DBName, nil
+}
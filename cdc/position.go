@@ -0,0 +1,58 @@
+package cdc
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Position is where the binlog is read from: the binlog file and the offset of the next event.
+type Position struct {
+	Name string `json:"name"`
+	Pos  uint32 `json:"pos"`
+}
+
+// FileStore keeps the position of a relay in a JSON file.
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load returns the saved position, false when none was saved yet.
+func (s *FileStore) Load() (Position, bool, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Position{}, false, nil
+	}
+	if err != nil {
+		return Position{}, false, err
+	}
+	var res Position
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return Position{}, false, err
+	}
+	return res, true, nil
+}
+
+// Save replaces the saved position, the file is renamed into place so a crash leaves the previous one.
+func (s *FileStore) Save(position Position) error {
+	data, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0o755)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,263 @@
+package cdc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/jmoiron/sqlx"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/relay"
+	"github.com/rafata1/sagas-pattern-thesis/tracing"
+	"time"
+)
+
+// retryInterval is how often the rows Kafka rejected are looked up for their next attempt, the
+// binlog only shows a row when it is inserted.
+const retryInterval = 5 * time.Second
+
+// Relay publishes the rows inserted into the outbox table of a service as the binlog shows them,
+// one push per committed transaction. The rows are then marked done like the polling relay does,
+// so either relay can take over from the other.
+type Relay struct {
+	schema    string
+	table     string
+	db        *sqlx.DB
+	outbox    relay.Repo
+	publisher *relay.Publisher
+	store     *FileStore
+	// columns are the names of the columns of table, by position in the binlog rows
+	columns   []string
+	position  Position
+	pending   []model.Outbox
+	lastRetry time.Time
+}
+
+// NewRelay relays table of schema. The column names of table are read from the binlog when
+// binlog_row_metadata is FULL, from the information schema of db otherwise.
+func NewRelay(
+	schema string, table string, db *sqlx.DB, outbox relay.Repo, publisher *relay.Publisher, store *FileStore,
+) *Relay {
+	return &Relay{
+		schema:    schema,
+		table:     table,
+		db:        db,
+		outbox:    outbox,
+		publisher: publisher,
+		store:     store,
+	}
+}
+
+// Position is where the relay is in the binlog, it is saved once the rows before it are published.
+func (r *Relay) Position() Position {
+	return r.position
+}
+
+// Handle reads one binlog event, the outbox rows of a transaction are published at its commit.
+// Every retry interval the rows Kafka rejected before are published again once due.
+func (r *Relay) Handle(ctx context.Context, event *replication.BinlogEvent) error {
+	if time.Since(r.lastRetry) >= retryInterval {
+		r.lastRetry = time.Now()
+		err := r.relayRetries(ctx, pendingLimit)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch e := event.Event.(type) {
+	case *replication.RotateEvent:
+		r.position = Position{Name: string(e.NextLogName), Pos: uint32(e.Position)}
+		// the previous binlog file may be purged, the position must not point into it
+		if event.Header.Timestamp != 0 {
+			return r.store.Save(r.position)
+		}
+	case *replication.RowsEvent:
+		if !isInsert(event.Header.EventType) || string(e.Table.Schema) != r.schema || string(e.Table.Table) != r.table {
+			return nil
+		}
+		for _, row := range e.Rows {
+			outbox, err := r.decode(ctx, e.Table, row)
+			if err != nil {
+				return err
+			}
+			r.pending = append(r.pending, outbox)
+		}
+	case *replication.XIDEvent:
+		r.position.Pos = event.Header.LogPos
+		if len(r.pending) == 0 {
+			return nil
+		}
+		err := r.publish(ctx, r.pending)
+		if err != nil {
+			return err
+		}
+		r.pending = nil
+		return r.store.Save(r.position)
+	}
+	return nil
+}
+
+func isInsert(eventType replication.EventType) bool {
+	switch eventType {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		return true
+	default:
+		return false
+	}
+}
+
+// publish pushes outboxes and marks them done, like RelayMessage of the services.
+func (r *Relay) publish(ctx context.Context, outboxes []model.Outbox) (err error) {
+	ctx, span := tracing.Start(ctx, r.table+" binlog relay")
+	defer func() { tracing.End(span, err) }()
+	return r.publisher.Publish(ctx, outboxes)
+}
+
+// relayRetries publishes the pending rows that were already attempted and are due again. Rows never
+// attempted are left to the binlog, which may not have shown them yet.
+func (r *Relay) relayRetries(ctx context.Context, limit int) error {
+	outboxes, err := r.outbox.GetRetriedOutbox(ctx, limit)
+	if err != nil || len(outboxes) == 0 {
+		return err
+	}
+	return r.publish(ctx, outboxes)
+}
+
+// relayPending publishes the rows still pending, limit at a time, before the binlog is read from
+// the current position. Rows Kafka rejected are left for their next attempt.
+func (r *Relay) relayPending(ctx context.Context, limit int) error {
+	for {
+		outboxes, err := r.outbox.GetPendingOutbox(ctx, limit)
+		if err != nil || len(outboxes) == 0 {
+			return err
+		}
+		err = r.publish(ctx, outboxes)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Relay) decode(ctx context.Context, table *replication.TableMapEvent, row []interface{}) (model.Outbox, error) {
+	columns := table.ColumnNameString()
+	if len(columns) != len(row) {
+		if len(r.columns) != len(row) {
+			err := r.loadColumns(ctx)
+			if err != nil {
+				return model.Outbox{}, err
+			}
+		}
+		columns = r.columns
+	}
+	if len(columns) != len(row) {
+		return model.Outbox{}, fmt.Errorf("cdc: %s has %d columns, the binlog row %d", r.table, len(columns), len(row))
+	}
+
+	var res model.Outbox
+	var err error
+	for i, column := range columns {
+		value := row[i]
+		switch column {
+		case "id":
+			res.ID, err = toInt64(value)
+		case "content":
+			res.Content = toBytes(value)
+		case "content_type":
+			res.ContentType = string(toBytes(value))
+		case "headers":
+			err = res.Headers.Scan(value)
+		case "status":
+			var status int64
+			status, err = toInt64(value)
+			res.Status = model.OutboxStatus(status)
+		case "attempts":
+			var attempts int64
+			attempts, err = toInt64(value)
+			res.Attempts = int(attempts)
+		case "last_error":
+			if value != nil {
+				res.LastError = sql.NullString{String: string(toBytes(value)), Valid: true}
+			}
+		case "next_attempt_at":
+			res.NextAttemptAt, err = toNullTime(value)
+		case "created_at":
+			res.CreatedAt, err = toNullTime(value)
+		case "updated_at":
+			res.UpdatedAt, err = toNullTime(value)
+		}
+		if err != nil {
+			return model.Outbox{}, fmt.Errorf("cdc: %s.%s: %w", r.table, column, err)
+		}
+	}
+	return res, nil
+}
+
+var columnsQuery = "SELECT column_name FROM information_schema.columns " +
+	"WHERE table_schema = ? AND table_name = ? ORDER BY ordinal_position"
+
+func (r *Relay) loadColumns(ctx context.Context) error {
+	if r.db == nil {
+		return fmt.Errorf("cdc: the binlog has no column names for %s", r.table)
+	}
+	var columns []string
+	err := r.db.SelectContext(ctx, &columns, columnsQuery, r.schema, r.table)
+	if err != nil {
+		return err
+	}
+	r.columns = columns
+	return nil
+}
+
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		return int64(v), nil
+	default:
+		return 0, fmt.Errorf("%T is not an integer", value)
+	}
+}
+
+func toBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return nil
+	}
+}
+
+// toNullTime reads a TIMESTAMP, decoded as a time with ParseTime and as text otherwise.
+func toNullTime(value interface{}) (sql.NullTime, error) {
+	switch v := value.(type) {
+	case nil:
+		return sql.NullTime{}, nil
+	case time.Time:
+		return sql.NullTime{Time: v, Valid: true}, nil
+	case string:
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", v, time.UTC)
+		if err != nil {
+			return sql.NullTime{}, err
+		}
+		return sql.NullTime{Time: t, Valid: true}, nil
+	default:
+		return sql.NullTime{}, fmt.Errorf("%T is not a time", value)
+	}
+}
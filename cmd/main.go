@@ -2,10 +2,8 @@ package main
 
 import (
 	"fmt"
-	"github.com/golang-migrate/migrate/v4"
-	_ "github.com/golang-migrate/migrate/v4/database/mysql"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/storage"
 	"github.com/spf13/cobra"
 	"os"
 	"time"
@@ -13,16 +11,33 @@ import (
 
 const versionTimeFormat = "20060102150405"
 
+// conf is loaded from --config and the environment before any command runs
+var conf config.Config
+
 func main() {
-	rootCmd := &cobra.Command{}
+	var configPath string
+	rootCmd := &cobra.Command{
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			conf, err = config.Load(configPath)
+			return err
+		},
+	}
+	rootCmd.PersistentFlags().StringVar(
+		&configPath, "config", os.Getenv("SAGA_CONFIG"), "path to a YAML or TOML config file",
+	)
 	rootCmd.AddCommand(
 		createMigrationCommand(),
 		migrateCommand(),
+		serveCommand(),
+		sagaCommand(),
+		schemaCommand(),
+		outboxCommand(),
 	)
 
 	err := rootCmd.Execute()
 	if err != nil {
-		panic(err)
+		os.Exit(1)
 	}
 }
 
@@ -31,27 +46,31 @@ func createMigrationCommand() *cobra.Command {
 		Use:   "migrate-create [service] [name]",
 		Short: "create sql migrations",
 		Args:  cobra.ExactArgs(2),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			now := time.Now()
 			version := now.Format(versionTimeFormat)
 			service := args[0]
 			name := args[1]
-			migrationDir, _ := getMigrationAndDatabase(service, config.DefaultConfig)
+			migrationDir, err := getMigrationDir(service, conf)
+			if err != nil {
+				return err
+			}
 			up := fmt.Sprintf("%s/%s_%s.up.sql", migrationDir, version, name)
 			down := fmt.Sprintf("%s/%s_%s.down.sql", migrationDir, version, name)
 
-			err := os.WriteFile(up, []byte{}, 0644)
+			err = os.WriteFile(up, []byte{}, 0644)
 			if err != nil {
-				panic(err)
+				return err
 			}
 
 			err = os.WriteFile(down, []byte{}, 0644)
 			if err != nil {
-				panic(err)
+				return err
 			}
 
 			fmt.Println("Created SQL up script:", up)
 			fmt.Println("Created SQL down script:", down)
+			return nil
 		},
 	}
 }
@@ -61,40 +80,31 @@ func migrateCommand() *cobra.Command {
 		Use:   "migrate-up [service]",
 		Short: "migrate all the way up",
 		Args:  cobra.ExactArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			service := args[0]
 
-			migrationDir, databaseDSN := getMigrationAndDatabase(service, config.DefaultConfig)
-			m, err := migrate.New(
-				fmt.Sprintf("file://%s", migrationDir),
-				fmt.Sprintf("mysql://%s", databaseDSN),
-			)
+			serviceConfig, ok := conf.Service(service)
+			if !ok {
+				return fmt.Errorf("unknown service %q", service)
+			}
+			changed, err := storage.MigrateUp(serviceConfig)
 			if err != nil {
-				panic(err)
+				return err
 			}
-
-			err = m.Up()
-			if err == migrate.ErrNoChange {
+			if !changed {
 				fmt.Println("No change in migration")
-				return
-			}
-			if err != nil {
-				panic(err)
+				return nil
 			}
 			fmt.Println("Migrated up")
+			return nil
 		},
 	}
 }
 
-func getMigrationAndDatabase(service string, conf config.Config) (string, string) {
-	if service == conf.OrderConfig.Name {
-		return conf.OrderConfig.MigrationDir, conf.OrderConfig.DatabaseDSN
-	}
-	if service == conf.InventoryConfig.Name {
-		return conf.InventoryConfig.MigrationDir, conf.InventoryConfig.DatabaseDSN
-	}
-	if service == conf.PaymentConfig.Name {
-		return conf.PaymentConfig.MigrationDir, conf.PaymentConfig.DatabaseDSN
+func getMigrationDir(service string, conf config.Config) (string, error) {
+	serviceConfig, ok := conf.Service(service)
+	if !ok {
+		return "", fmt.Errorf("unknown service %q", service)
 	}
-	return "", ""
+	return serviceConfig.MigrationDir, nil
 }
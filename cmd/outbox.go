@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/rafata1/sagas-pattern-thesis/retention"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/rafata1/sagas-pattern-thesis/service/shipping"
+	"github.com/rafata1/sagas-pattern-thesis/storage"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+func outboxCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "outbox",
+		Short: "maintain the outbox and inbox tables",
+	}
+	cmd.AddCommand(outboxPruneCommand())
+	return cmd
+}
+
+func outboxPruneCommand() *cobra.Command {
+	var olderThan, inboxOlderThan time.Duration
+	var batchSize int
+	cmd := &cobra.Command{
+		Use:   "prune [service...]",
+		Short: "delete completed outbox rows and old inbox messages of some services, or of every service",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// flags left out keep the retention of the config
+			policy := conf.Retention
+			if cmd.Flags().Changed("older-than") {
+				policy.Outbox = olderThan
+			}
+			if cmd.Flags().Changed("inbox-older-than") {
+				policy.Inbox = inboxOlderThan
+			}
+			if cmd.Flags().Changed("batch-size") {
+				policy.BatchSize = batchSize
+			}
+			if policy.Outbox < 0 || policy.Inbox < 0 || policy.BatchSize <= 0 {
+				return errors.New("retentions cannot be negative and the batch size must be positive")
+			}
+
+			names := args
+			if len(names) == 0 {
+				for _, serviceConfig := range conf.Services() {
+					names = append(names, serviceConfig.Name)
+				}
+			}
+			now := time.Now()
+			for _, name := range names {
+				serviceConfig, ok := conf.Service(name)
+				if !ok {
+					return fmt.Errorf("unknown service %q", name)
+				}
+				db, err := storage.Open(serviceConfig)
+				if err != nil {
+					return err
+				}
+				res, err := retention.Prune(cmd.Context(), retentionRepo(name, db), policy, now)
+				db.Close()
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				fmt.Printf("%s: deleted %d outbox rows and %d inbox messages\n", name, res.Outboxes, res.InboxMessages)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().DurationVar(&olderThan, "older-than", 0, "delete outbox rows completed before this long ago, retention.outbox by default")
+	cmd.Flags().DurationVar(&inboxOlderThan, "inbox-older-than", 0, "delete inbox messages received before this long ago, retention.inbox by default")
+	cmd.Flags().IntVar(&batchSize, "batch-size", 0, "rows deleted per statement, retention.batch_size by default")
+	return cmd
+}
+
+func retentionRepo(name string, db *sqlx.DB) retention.Repo {
+	switch name {
+	case conf.OrderConfig.Name:
+		return order.NewRepo(db)
+	case conf.InventoryConfig.Name:
+		return inventory.NewRepo(db)
+	case conf.PaymentConfig.Name:
+		return payment.NewRepo(db)
+	default:
+		return shipping.NewRepo(db)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/rafata1/sagas-pattern-thesis/service/shipping"
+	"github.com/rafata1/sagas-pattern-thesis/storage"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const timelineTimeFormat = "2006-01-02 15:04:05.000000"
+
+func sagaCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "saga",
+		Short: "inspect sagas",
+	}
+	cmd.AddCommand(sagaShowCommand())
+	return cmd
+}
+
+func sagaShowCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "show [orderID]",
+		Short: "print the timeline of an order across the databases of every service",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			orderID, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid order id %q", args[0])
+			}
+
+			orderDB, err := storage.Open(conf.OrderConfig)
+			if err != nil {
+				return err
+			}
+			defer orderDB.Close()
+			inventoryDB, err := storage.Open(conf.InventoryConfig)
+			if err != nil {
+				return err
+			}
+			defer inventoryDB.Close()
+			paymentDB, err := storage.Open(conf.PaymentConfig)
+			if err != nil {
+				return err
+			}
+			defer paymentDB.Close()
+			shippingDB, err := storage.Open(conf.ShippingConfig)
+			if err != nil {
+				return err
+			}
+			defer shippingDB.Close()
+
+			// only the repos are used, the timeline needs no Kafka
+			svc := order.NewService(order.NewRepo(orderDB), nil, nil, nil, nil, order.WithAuditSources(
+				inventory.NewRepo(inventoryDB),
+				payment.NewRepo(paymentDB),
+				shipping.NewRepo(shippingDB),
+			))
+			timeline, err := svc.GetTimeline(cmd.Context(), orderID)
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("order %d not found", orderID)
+			}
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tSERVICE\tKIND\tSTATUS\tDETAIL")
+			for _, entry := range timeline {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+					entry.OccurredAt.In(time.Local).Format(timelineTimeFormat),
+					entry.Service, entry.Kind, entry.Status, entry.Detail,
+				)
+			}
+			return w.Flush()
+		},
+	}
+}
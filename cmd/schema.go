@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/schema"
+	"github.com/spf13/cobra"
+)
+
+func schemaCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schema",
+		Short: "manage the schemas of the saga events",
+	}
+	cmd.AddCommand(schemaCheckCommand())
+	return cmd
+}
+
+func schemaCheckCommand() *cobra.Command {
+	var dir string
+	var write bool
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "check the saga_event structs are compatible with the registered schemas",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			registry, err := schema.LoadDir(dir)
+			if err != nil {
+				return err
+			}
+
+			events := saga_event.DefaultRegistry
+			if write {
+				for _, name := range events.Types() {
+					version, _ := events.Version(name)
+					if _, ok := registry.Get(name, version); ok {
+						continue
+					}
+					current, err := schema.Current(events, name)
+					if err != nil {
+						return err
+					}
+					err = schema.Write(dir, current)
+					if err != nil {
+						return err
+					}
+					registry.Add(name, version, current)
+					fmt.Println("Registered", schema.FileName(name, version))
+				}
+			}
+
+			errs := schema.Check(registry, events)
+			for _, err := range errs {
+				fmt.Println(err)
+			}
+			if len(errs) > 0 {
+				return errors.New("incompatible schemas")
+			}
+			fmt.Printf("%d event types are compatible with their schemas\n", len(events.Types()))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&dir, "dir", schema.Dir, "directory of the registered schemas")
+	cmd.Flags().BoolVar(&write, "write", false, "register the schema of the current version of event types that have none")
+	return cmd
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/rafata1/sagas-pattern-thesis/cdc"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/health"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/relay"
+	"github.com/rafata1/sagas-pattern-thesis/retention"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/schema"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/rafata1/sagas-pattern-thesis/service/shipping"
+	"github.com/rafata1/sagas-pattern-thesis/storage"
+	"github.com/rafata1/sagas-pattern-thesis/tracing"
+	"github.com/spf13/cobra"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const serveAll = "all"
+
+type serveOptions struct {
+	migrate       bool
+	httpAddr      string
+	relayInterval time.Duration
+	relayLimit    int
+}
+
+func serveCommand() *cobra.Command {
+	var opts serveOptions
+	cmd := &cobra.Command{
+		Use:   "serve [service|all]",
+		Short: "run the consumers and the outbox relay of a service, or of every service",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// the relay tickers panic on a non-positive interval, and a zero limit relays nothing
+			if opts.relayInterval <= 0 || opts.relayLimit <= 0 {
+				return errors.New("the relay interval and the relay limit must be positive")
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return serve(ctx, conf, args[0], opts)
+		},
+	}
+	cmd.Flags().BoolVar(&opts.migrate, "migrate", false, "migrate the databases up before serving")
+	cmd.Flags().StringVar(&opts.httpAddr, "http-addr", ":8080", "address of the health and metrics endpoints")
+	cmd.Flags().DurationVar(&opts.relayInterval, "relay-interval", time.Second, "how often the outbox is relayed")
+	cmd.Flags().IntVar(&opts.relayLimit, "relay-limit", 100, "max outbox messages relayed at once")
+	return cmd
+}
+
+// runtime owns what a served service opened, so everything is closed on shutdown.
+type runtime struct {
+	conf     config.Config
+	opts     serveOptions
+	logger   *slog.Logger
+	registry *health.Registry
+	mux      *http.ServeMux
+	closers  []io.Closer
+	// broker is set when kafka.in_memory is, it is shared by every service of the process
+	broker *memory.Broker
+}
+
+func serve(ctx context.Context, conf config.Config, name string, opts serveOptions) error {
+	names := []string{name}
+	if name == serveAll {
+		names = nil
+		for _, serviceConfig := range conf.Services() {
+			names = append(names, serviceConfig.Name)
+		}
+	}
+
+	logger, err := logging.New(conf.Logging, os.Stderr)
+	if err != nil {
+		return err
+	}
+	// what still logs through the default logger, like the payment callback, gets the same output
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(conf.Tracing, name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// the serve ctx is done by now, spans left are flushed with a fresh one
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := shutdownTracing(ctx)
+		if err != nil {
+			logger.Error("Failed to flush spans", slog.Any("error", err))
+		}
+	}()
+
+	rt := &runtime{
+		conf:     conf,
+		opts:     opts,
+		logger:   logger,
+		registry: health.NewRegistry(),
+		mux:      http.NewServeMux(),
+	}
+	defer rt.close()
+	if conf.Kafka.InMemory {
+		if name != serveAll {
+			return errors.New("kafka.in_memory only connects services of one process, use serve all")
+		}
+		rt.broker = memory.NewBroker()
+	}
+
+	// health is served before dialing, so probes see Kafka is still being waited for
+	rt.mux.Handle("/healthz", rt.registry.Handler())
+	rt.mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{Addr: opts.httpAddr, Handler: rt.mux}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server stopped", slog.Any("error", err))
+		}
+	}()
+	defer server.Close()
+
+	for _, name := range names {
+		err := rt.start(ctx, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func (rt *runtime) start(ctx context.Context, name string) error {
+	switch name {
+	case rt.conf.OrderConfig.Name:
+		return rt.startOrder(ctx)
+	case rt.conf.InventoryConfig.Name:
+		return rt.startInventory(ctx)
+	case rt.conf.PaymentConfig.Name:
+		return rt.startPayment(ctx)
+	case rt.conf.ShippingConfig.Name:
+		return rt.startShipping(ctx)
+	default:
+		return fmt.Errorf("unknown service %q", name)
+	}
+}
+
+func (rt *runtime) startOrder(ctx context.Context) error {
+	name := rt.conf.OrderConfig.Name
+	db, err := rt.openDB(name, rt.conf.OrderConfig)
+	if err != nil {
+		return err
+	}
+	producer, err := rt.producer(ctx, name, rt.conf.OrderCreatedTopic)
+	if err != nil {
+		return err
+	}
+	billConsumer, err := rt.consumer(ctx, name, rt.conf.OrderBillTopic)
+	if err != nil {
+		return err
+	}
+	inventoryConsumer, err := rt.consumer(ctx, name, rt.conf.PrepareInventoryTopic)
+	if err != nil {
+		return err
+	}
+	shipmentConsumer, err := rt.consumer(ctx, name, rt.conf.ShipmentTopic)
+	if err != nil {
+		return err
+	}
+
+	repo := order.NewRepo(db)
+	logger := rt.serviceLogger(name)
+	svc := order.NewService(
+		repo, producer, billConsumer, inventoryConsumer, shipmentConsumer,
+		order.WithLogger(logger),
+		order.WithCodec(rt.codec(rt.conf.OrderCreatedTopic)),
+		order.WithRelayRetry(rt.relayRetry()),
+		order.WithTimeouts(map[model.OrderStatus]time.Duration{
+			model.OrderStatusPending:  rt.conf.Watchdog.PendingTimeout,
+			model.OrderStatusPrepared: rt.conf.Watchdog.PreparedTimeout,
+		}),
+		order.WithAuditSources(rt.auditSources(name)...),
+	)
+	rt.mux.Handle(order.TimelinePath, order.NewTimelineHandler(svc, logger))
+	go svc.ConsumeBills(ctx, 0)
+	go svc.ConsumeInventory(ctx, 0)
+	go svc.ConsumeShipments(ctx, 0)
+	err = rt.startRelay(ctx, name, rt.conf.OrderConfig, "order_outboxes", db, repo, producer, svc.RelayMessage)
+	if err != nil {
+		return err
+	}
+	go rt.prune(ctx, name, repo)
+	go rt.watchdog(ctx, name, svc.TimeOutStuckOrders)
+	return nil
+}
+
+// auditSources opens the databases of the other participants for the timelines of the order
+// service, like saga show does. A database which cannot be opened is left out of the timelines.
+func (rt *runtime) auditSources(name string) []order.AuditSource {
+	var res []order.AuditSource
+	participants := []struct {
+		conf config.ServiceConfig
+		repo func(db *sqlx.DB) order.AuditSource
+	}{
+		{rt.conf.InventoryConfig, func(db *sqlx.DB) order.AuditSource { return inventory.NewRepo(db) }},
+		{rt.conf.PaymentConfig, func(db *sqlx.DB) order.AuditSource { return payment.NewRepo(db) }},
+		{rt.conf.ShippingConfig, func(db *sqlx.DB) order.AuditSource { return shipping.NewRepo(db) }},
+	}
+	for _, participant := range participants {
+		db, err := storage.Open(participant.conf)
+		if err != nil {
+			rt.logger.Warn("Timelines leave out a participant", slog.String("service", name),
+				slog.String("participant", participant.conf.Name), slog.Any("error", err))
+			continue
+		}
+		rt.closers = append(rt.closers, db)
+		res = append(res, participant.repo(db))
+	}
+	return res
+}
+
+func (rt *runtime) startInventory(ctx context.Context) error {
+	name := rt.conf.InventoryConfig.Name
+	db, err := rt.openDB(name, rt.conf.InventoryConfig)
+	if err != nil {
+		return err
+	}
+	ordersConsumer, err := rt.consumer(ctx, name, rt.conf.OrderCreatedTopic)
+	if err != nil {
+		return err
+	}
+	billConsumer, err := rt.consumer(ctx, name, rt.conf.OrderBillTopic)
+	if err != nil {
+		return err
+	}
+	shipmentConsumer, err := rt.consumer(ctx, name, rt.conf.ShipmentTopic)
+	if err != nil {
+		return err
+	}
+	producer, err := rt.producer(ctx, name, rt.conf.PrepareInventoryTopic)
+	if err != nil {
+		return err
+	}
+
+	repo := inventory.NewRepo(db)
+	svc := inventory.NewService(
+		repo, ordersConsumer, billConsumer, shipmentConsumer, producer,
+		inventory.WithLogger(rt.serviceLogger(name)),
+		inventory.WithCodec(rt.codec(rt.conf.PrepareInventoryTopic)),
+		inventory.WithRelayRetry(rt.relayRetry()),
+	)
+	go svc.ConsumeOrders(ctx, 0)
+	go svc.ConsumeBills(ctx, 0)
+	go svc.ConsumeShipments(ctx, 0)
+	err = rt.startRelay(ctx, name, rt.conf.InventoryConfig, "inventory_outboxes", db, repo, producer, svc.RelayMessage)
+	if err != nil {
+		return err
+	}
+	go rt.prune(ctx, name, repo)
+	return nil
+}
+
+func (rt *runtime) startPayment(ctx context.Context) error {
+	name := rt.conf.PaymentConfig.Name
+	db, err := rt.openDB(name, rt.conf.PaymentConfig)
+	if err != nil {
+		return err
+	}
+	orderConsumer, err := rt.consumer(ctx, name, rt.conf.PrepareInventoryTopic)
+	if err != nil {
+		return err
+	}
+	shipmentConsumer, err := rt.consumer(ctx, name, rt.conf.ShipmentTopic)
+	if err != nil {
+		return err
+	}
+	producer, err := rt.producer(ctx, name, rt.conf.OrderBillTopic)
+	if err != nil {
+		return err
+	}
+
+	repo := payment.NewRepo(db)
+	logger := rt.serviceLogger(name)
+	opts := []payment.Option{
+		payment.WithLogger(logger),
+		payment.WithCreditPolicy(rt.creditPolicy()),
+		payment.WithCodec(rt.codec(rt.conf.OrderBillTopic)),
+		payment.WithRelayRetry(rt.relayRetry()),
+	}
+	gateway := rt.conf.Gateway
+	if gateway.Enabled() {
+		// the fake gateway is the only provider yet
+		opts = append(opts, payment.WithGateway(payment.NewFakeGateway(gateway.Async), gateway.AuthorizationTimeout))
+	}
+	svc := payment.NewService(repo, orderConsumer, shipmentConsumer, producer, opts...)
+	go svc.ConsumePreparedOrders(ctx, 0)
+	go svc.ConsumeShipments(ctx, 0)
+	err = rt.startRelay(ctx, name, rt.conf.PaymentConfig, "payment_outboxes", db, repo, producer, svc.RelayMessage)
+	if err != nil {
+		return err
+	}
+	go rt.prune(ctx, name, repo)
+	if gateway.Enabled() {
+		rt.mux.Handle(gateway.CallbackPath, payment.NewCallbackHandler(svc, gateway.CallbackSecret, logger))
+		go rt.expireAuthorizations(ctx, name, svc.ExpireAuthorizations)
+	}
+	return nil
+}
+
+func (rt *runtime) startShipping(ctx context.Context) error {
+	name := rt.conf.ShippingConfig.Name
+	db, err := rt.openDB(name, rt.conf.ShippingConfig)
+	if err != nil {
+		return err
+	}
+	// the orders are shipped once the order service confirmed their bill
+	ordersConsumer, err := rt.consumer(ctx, name, rt.conf.OrderCreatedTopic)
+	if err != nil {
+		return err
+	}
+	producer, err := rt.producer(ctx, name, rt.conf.ShipmentTopic)
+	if err != nil {
+		return err
+	}
+
+	// there is no real carrier integration yet
+	repo := shipping.NewRepo(db)
+	svc := shipping.NewService(
+		repo, ordersConsumer, producer, shipping.NewFakeCarrier(),
+		shipping.WithLogger(rt.serviceLogger(name)),
+		shipping.WithCodec(rt.codec(rt.conf.ShipmentTopic)),
+		shipping.WithRelayRetry(rt.relayRetry()),
+	)
+	go svc.ConsumeOrders(ctx, 0)
+	err = rt.startRelay(ctx, name, rt.conf.ShippingConfig, "shipping_outboxes", db, repo, producer, svc.RelayMessage)
+	if err != nil {
+		return err
+	}
+	go rt.prune(ctx, name, repo)
+	return nil
+}
+
+func (rt *runtime) serviceLogger(name string) *slog.Logger {
+	return rt.logger.With(slog.String("service", name))
+}
+
+// codec returns how the events published on topic are encoded, events are checked against their
+// registered schema before they are written to the outbox.
+func (rt *runtime) codec(topic string) saga_event.Codec {
+	codec := saga_event.JSON
+	if rt.conf.Encoding(topic) == config.EncodingProtobuf {
+		codec = saga_event.Protobuf
+	}
+	return schema.Validating(codec, schema.Default, saga_event.DefaultRegistry)
+}
+
+// relayRetry is how the relays attempt the outbox rows Kafka rejected again.
+func (rt *runtime) creditPolicy() payment.ICreditPolicy {
+	policy := payment.NewStrictPrepaidPolicy()
+	if rt.conf.Credit.Policy == config.CreditOverdraft {
+		policy = payment.NewOverdraftPolicy()
+	}
+	if rt.conf.Credit.DailyCap {
+		policy = payment.NewDailyCapPolicy(policy)
+	}
+	return policy
+}
+
+func (rt *runtime) relayRetry() relay.Retry {
+	return relay.Retry{
+		MaxAttempts:    rt.conf.Relay.Retry.MaxAttempts,
+		InitialBackoff: rt.conf.Relay.Retry.InitialBackoff,
+		MaxBackoff:     rt.conf.Relay.Retry.MaxBackoff,
+	}
+}
+
+func (rt *runtime) openDB(name string, serviceConfig config.ServiceConfig) (*sqlx.DB, error) {
+	if rt.opts.migrate {
+		_, err := storage.MigrateUp(serviceConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: migrate: %w", name, err)
+		}
+	}
+
+	db, err := storage.Open(serviceConfig)
+	rt.registry.Set(name+".database", err)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	rt.closers = append(rt.closers, db)
+	return db, nil
+}
+
+func (rt *runtime) producer(ctx context.Context, name string, topic string) (kafka.IProducer, error) {
+	var producer kafka.IProducer
+	var err error
+	if rt.broker != nil {
+		producer = rt.broker.Producer(topic)
+	} else {
+		producer, err = kafka.DialProducer(ctx, rt.conf.Kafka, topic, rt.registry, name+".producer."+topic)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rt.closers = append(rt.closers, producer)
+	return producer, nil
+}
+
+func (rt *runtime) consumer(ctx context.Context, name string, topic string) (kafka.IConsumer, error) {
+	var consumer kafka.IConsumer
+	var err error
+	if rt.broker != nil {
+		consumer = rt.broker.Consumer(topic)
+	} else {
+		consumer, err = kafka.DialConsumer(ctx, rt.conf.Kafka, topic, rt.registry, name+".consumer."+topic)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rt.closers = append(rt.closers, consumer)
+	return consumer, nil
+}
+
+// startRelay relays the outbox table of the service name, from the binlog when relay.mode is binlog
+// and with relayMessage every relay interval otherwise.
+func (rt *runtime) startRelay(
+	ctx context.Context,
+	name string,
+	serviceConfig config.ServiceConfig,
+	table string,
+	db *sqlx.DB,
+	outbox relay.Repo,
+	producer kafka.IProducer,
+	relayMessage func(ctx context.Context, limit int) error,
+) error {
+	if !rt.conf.Relay.Binlog() {
+		go rt.relay(ctx, name, relayMessage)
+		return nil
+	}
+
+	schemaName, err := cdc.SchemaName(serviceConfig.DatabaseDSN)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	serverID := rt.conf.Relay.ServerID
+	for i, service := range rt.conf.Services() {
+		if service.Name == name {
+			serverID += uint32(i)
+		}
+	}
+	store := cdc.NewFileStore(filepath.Join(rt.conf.Relay.PositionDir, name+".json"))
+	publisher := relay.NewPublisher(table, outbox, producer, rt.relayRetry(), rt.serviceLogger(name))
+	binlog := cdc.NewRelay(schemaName, table, db, outbox, publisher, store)
+	go rt.binlogRelay(ctx, name, binlog, serviceConfig.DatabaseDSN, serverID)
+	return nil
+}
+
+// binlogRelay runs relay until ctx is done, after an error it starts again from the saved position.
+func (rt *runtime) binlogRelay(ctx context.Context, name string, binlog *cdc.Relay, dsn string, serverID uint32) {
+	for {
+		err := binlog.Run(ctx, dsn, serverID)
+		if ctx.Err() != nil {
+			return
+		}
+		rt.registry.Set(name+".relay", err)
+		rt.logger.Error("Failed to relay the binlog", slog.String("service", name), slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rt.opts.relayInterval):
+		}
+	}
+}
+
+// relay pushes the outbox every relay interval, the last error is reported as the relay health.
+func (rt *runtime) relay(ctx context.Context, name string, relayMessage func(ctx context.Context, limit int) error) {
+	ticker := time.NewTicker(rt.opts.relayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := relayMessage(ctx, rt.opts.relayLimit)
+			rt.registry.Set(name+".relay", err)
+			if err != nil {
+				rt.logger.Error("Failed to relay outbox", slog.String("service", name), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// prune deletes the outbox and inbox rows past their retention every retention interval.
+func (rt *runtime) prune(ctx context.Context, name string, repo retention.Repo) {
+	ticker := time.NewTicker(rt.conf.Retention.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := retention.Prune(ctx, repo, rt.conf.Retention, time.Now())
+			if err != nil {
+				rt.logger.Error("Failed to prune", slog.String("service", name), slog.Any("error", err))
+				continue
+			}
+			if res.Outboxes > 0 || res.InboxMessages > 0 {
+				rt.logger.Info("Pruned",
+					slog.String("service", name),
+					slog.Int("outboxes", res.Outboxes),
+					slog.Int("inbox_messages", res.InboxMessages),
+				)
+			}
+		}
+	}
+}
+
+// watchdog times out stuck orders every watchdog interval.
+func (rt *runtime) watchdog(ctx context.Context, name string, timeOut func(ctx context.Context, limit int) error) {
+	ticker := time.NewTicker(rt.conf.Watchdog.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := timeOut(ctx, rt.conf.Watchdog.BatchSize)
+			if err != nil {
+				rt.logger.Error("Failed to time out stuck orders", slog.String("service", name), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// expireAuthorizations voids the gateway authorizations not called back in time every gateway
+// expire interval.
+func (rt *runtime) expireAuthorizations(ctx context.Context, name string, expire func(ctx context.Context, limit int) error) {
+	ticker := time.NewTicker(rt.conf.Gateway.ExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := expire(ctx, rt.conf.Gateway.ExpireBatchSize)
+			if err != nil {
+				rt.logger.Error("Failed to expire authorizations", slog.String("service", name), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (rt *runtime) close() {
+	for i := len(rt.closers) - 1; i >= 0; i-- {
+		err := rt.closers[i].Close()
+		if err != nil {
+			rt.logger.Error("Failed to close", slog.Any("error", err))
+		}
+	}
+}
@@ -1,39 +1,134 @@
 package config
 
+import "time"
+
 type Config struct {
-	OrderConfig           ServiceConfig
-	PaymentConfig         ServiceConfig
-	InventoryConfig       ServiceConfig
-	KafkaHost             string
-	OrderCreatedTopic     string
-	PrepareInventoryTopic string
-	OrderBillTopic        string
+	OrderConfig           ServiceConfig   `yaml:"order" toml:"order"`
+	PaymentConfig         ServiceConfig   `yaml:"payment" toml:"payment"`
+	InventoryConfig       ServiceConfig   `yaml:"inventory" toml:"inventory"`
+	ShippingConfig        ServiceConfig   `yaml:"shipping" toml:"shipping"`
+	Kafka                 KafkaConfig     `yaml:"kafka" toml:"kafka"`
+	Tracing               TracingConfig   `yaml:"tracing" toml:"tracing"`
+	Logging               LoggingConfig   `yaml:"logging" toml:"logging"`
+	Watchdog              WatchdogConfig  `yaml:"watchdog" toml:"watchdog"`
+	Relay                 RelayConfig     `yaml:"relay" toml:"relay"`
+	Retention             RetentionConfig `yaml:"retention" toml:"retention"`
+	Gateway               GatewayConfig   `yaml:"gateway" toml:"gateway"`
+	Credit                CreditConfig    `yaml:"credit" toml:"credit"`
+	OrderCreatedTopic     string          `yaml:"order_created_topic" toml:"order_created_topic"`
+	PrepareInventoryTopic string          `yaml:"prepare_inventory_topic" toml:"prepare_inventory_topic"`
+	OrderBillTopic        string          `yaml:"order_bill_topic" toml:"order_bill_topic"`
+	ShipmentTopic         string          `yaml:"shipment_topic" toml:"shipment_topic"`
+	// Encodings maps a topic to the encoding of its events, json or protobuf
+	Encodings map[string]string `yaml:"encodings" toml:"encodings"`
 }
 
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// ServiceConfig Driver is mysql when empty, MigrationDir holds migrations written for that driver.
+// The DatabaseDSN of sqlite is a file path.
 type ServiceConfig struct {
-	Name         string
-	MigrationDir string
-	DatabaseDSN  string
+	Name            string `yaml:"name" toml:"name"`
+	Driver          string `yaml:"driver" toml:"driver"`
+	MigrationDir    string `yaml:"migration_dir" toml:"migration_dir"`
+	DatabaseDSN     string `yaml:"database_dsn" toml:"database_dsn"`
+	DatabaseDSNFile string `yaml:"database_dsn_file" toml:"database_dsn_file"`
 }
 
+// DefaultConfig is the base every loaded config overrides. It has no database DSN, config.mysql.yaml
+// sets those of the MySQL of docker-compose.yaml.
 var DefaultConfig = Config{
 	OrderConfig: ServiceConfig{
 		Name:         "order",
 		MigrationDir: "migration/order",
-		DatabaseDSN:  "root:1@tcp(localhost:3306)/saga_order?parseTime=true",
 	},
 	InventoryConfig: ServiceConfig{
 		Name:         "inventory",
 		MigrationDir: "migration/inventory",
-		DatabaseDSN:  "root:1@tcp(localhost:3306)/saga_inventory?parseTime=true",
 	},
 	PaymentConfig: ServiceConfig{
 		Name:         "payment",
 		MigrationDir: "migration/payment",
-		DatabaseDSN:  "root:1@tcp(localhost:3306)/saga_payment?parseTime=true",
 	},
-	KafkaHost:             "localhost:29092",
+	ShippingConfig: ServiceConfig{
+		Name:         "shipping",
+		MigrationDir: "migration/shipping",
+	},
+	Kafka: KafkaConfig{
+		Brokers:  []string{"localhost:29092"},
+		ClientID: "sagas-pattern-thesis",
+		Consumer: ConsumerConfig{
+			InitialOffset: "oldest",
+		},
+		Startup: StartupConfig{
+			InitialBackoff: 500 * time.Millisecond,
+			MaxBackoff:     30 * time.Second,
+		},
+	},
+	Logging: LoggingConfig{
+		Redact: []string{"promo_code", "password", "token", "card_number", "cvv"},
+	},
+	Watchdog: WatchdogConfig{
+		Interval:        30 * time.Second,
+		PendingTimeout:  10 * time.Minute,
+		PreparedTimeout: 10 * time.Minute,
+		BatchSize:       100,
+	},
+	Relay: RelayConfig{
+		Mode:        RelayPolling,
+		ServerID:    1001,
+		PositionDir: "data/binlog",
+		Retry: RelayRetryConfig{
+			MaxAttempts:    10,
+			InitialBackoff: time.Second,
+			MaxBackoff:     5 * time.Minute,
+		},
+	},
+	Retention: RetentionConfig{
+		Interval:  time.Hour,
+		Outbox:    7 * 24 * time.Hour,
+		Inbox:     30 * 24 * time.Hour,
+		BatchSize: 1000,
+	},
+	Gateway: GatewayConfig{
+		Provider:             GatewayNone,
+		CallbackPath:         "/payment/callback",
+		AuthorizationTimeout: 15 * time.Minute,
+		ExpireInterval:       time.Minute,
+		ExpireBatchSize:      100,
+	},
+	Credit: CreditConfig{
+		Policy: CreditStrict,
+	},
 	OrderCreatedTopic:     "ORDER_CREATED_TOPIC",
 	PrepareInventoryTopic: "PREPARED_INVENTORY_TOPIC",
 	OrderBillTopic:        "ORDER_BILL_TOPIC",
+	ShipmentTopic:         "SHIPMENT_TOPIC",
+}
+
+// Services lists the config of every saga participant.
+func (c Config) Services() []ServiceConfig {
+	return []ServiceConfig{c.OrderConfig, c.InventoryConfig, c.PaymentConfig, c.ShippingConfig}
+}
+
+// Service returns the config of the participant named name.
+func (c Config) Service(name string) (ServiceConfig, bool) {
+	for _, service := range c.Services() {
+		if service.Name == name {
+			return service, true
+		}
+	}
+	return ServiceConfig{}, false
+}
+
+// DriverName is the database/sql driver of the service.
+func (s ServiceConfig) DriverName() string {
+	if s.Driver == "" {
+		return DriverMySQL
+	}
+	return s.Driver
 }
@@ -0,0 +1,25 @@
+package config
+
+import "fmt"
+
+const (
+	CreditStrict    = "strict"
+	CreditOverdraft = "overdraft"
+)
+
+// CreditConfig decides which charges payment takes from the account balance, Policy is strict when
+// empty. strict charges only what the balance covers, overdraft lets the balance go negative down to
+// the account credit limit. DailyCap also rejects charges over the daily spending cap of the account.
+type CreditConfig struct {
+	Policy   string `yaml:"policy" toml:"policy"`
+	DailyCap bool   `yaml:"daily_cap" toml:"daily_cap"`
+}
+
+func (c CreditConfig) validate() []error {
+	switch c.Policy {
+	case "", CreditStrict, CreditOverdraft:
+		return nil
+	default:
+		return []error{fmt.Errorf("credit: unknown policy %q", c.Policy)}
+	}
+}
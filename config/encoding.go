@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+)
+
+// Encoding returns how the events published on topic are encoded, json unless Encodings says otherwise.
+// Consumers read both whatever the setting, the content type travels with every message.
+func (c Config) Encoding(topic string) string {
+	encoding, ok := c.Encodings[topic]
+	if !ok || encoding == "" {
+		return EncodingJSON
+	}
+	return encoding
+}
+
+func (c Config) validateEncodings() []error {
+	topics := map[string]bool{
+		c.OrderCreatedTopic:     true,
+		c.PrepareInventoryTopic: true,
+		c.OrderBillTopic:        true,
+		c.ShipmentTopic:         true,
+	}
+	keys := make([]string, 0, len(c.Encodings))
+	for topic := range c.Encodings {
+		keys = append(keys, topic)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, topic := range keys {
+		encoding := c.Encodings[topic]
+		if !topics[topic] {
+			errs = append(errs, fmt.Errorf("encodings: unknown topic %q", topic))
+		}
+		switch encoding {
+		case "", EncodingJSON, EncodingProtobuf:
+		default:
+			errs = append(errs, fmt.Errorf("encodings: unknown encoding %q for topic %q", encoding, topic))
+		}
+	}
+	return errs
+}
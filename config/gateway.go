@@ -0,0 +1,59 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	GatewayNone = "none"
+	GatewayFake = "fake"
+)
+
+// GatewayConfig makes payment charge orders through a payment gateway instead of the account
+// balance, Provider is none when empty. fake is the in-process gateway, Async leaves its
+// authorizations pending until a callback is posted to CallbackPath of the HTTP server. A callback
+// is signed with CallbackSecret, CallbackSecretFile is read into it. Pending authorizations not
+// called back within AuthorizationTimeout are voided every ExpireInterval, ExpireBatchSize at a time.
+type GatewayConfig struct {
+	Provider             string        `yaml:"provider" toml:"provider"`
+	Async                bool          `yaml:"async" toml:"async"`
+	CallbackPath         string        `yaml:"callback_path" toml:"callback_path"`
+	CallbackSecret       string        `yaml:"callback_secret" toml:"callback_secret"`
+	CallbackSecretFile   string        `yaml:"callback_secret_file" toml:"callback_secret_file"`
+	AuthorizationTimeout time.Duration `yaml:"authorization_timeout" toml:"authorization_timeout"`
+	ExpireInterval       time.Duration `yaml:"expire_interval" toml:"expire_interval"`
+	ExpireBatchSize      int           `yaml:"expire_batch_size" toml:"expire_batch_size"`
+}
+
+// Enabled tells whether payment charges orders through the gateway.
+func (g GatewayConfig) Enabled() bool {
+	return g.Provider != "" && g.Provider != GatewayNone
+}
+
+func (g GatewayConfig) validate() []error {
+	switch g.Provider {
+	case "", GatewayNone:
+		return nil
+	case GatewayFake:
+	default:
+		return []error{fmt.Errorf("gateway: unknown provider %q", g.Provider)}
+	}
+
+	var errs []error
+	if !strings.HasPrefix(g.CallbackPath, "/") {
+		errs = append(errs, errors.New("gateway: callback_path must start with /"))
+	}
+	if g.CallbackSecret == "" {
+		errs = append(errs, errors.New("gateway: callback_secret or callback_secret_file is required"))
+	}
+	if g.AuthorizationTimeout <= 0 || g.ExpireInterval <= 0 {
+		errs = append(errs, errors.New("gateway: authorization_timeout and expire_interval must be positive"))
+	}
+	if g.ExpireBatchSize <= 0 {
+		errs = append(errs, errors.New("gateway: expire_batch_size must be positive"))
+	}
+	return errs
+}
@@ -0,0 +1,77 @@
+package config
+
+import "time"
+
+const (
+	SASLMechanismPlain       = "PLAIN"
+	SASLMechanismScramSHA256 = "SCRAM-SHA-256"
+	SASLMechanismScramSHA512 = "SCRAM-SHA-512"
+)
+
+// KafkaConfig holds the broker list and the client settings shared by every producer and consumer.
+// Zero values keep the sarama defaults. InMemory replaces Kafka with kafka/memory, it only connects
+// services running in the same process.
+type KafkaConfig struct {
+	InMemory bool           `yaml:"in_memory" toml:"in_memory"`
+	Brokers  []string       `yaml:"brokers" toml:"brokers"`
+	ClientID string         `yaml:"client_id" toml:"client_id"`
+	Version  string         `yaml:"version" toml:"version"`
+	TLS      TLSConfig      `yaml:"tls" toml:"tls"`
+	SASL     SASLConfig     `yaml:"sasl" toml:"sasl"`
+	Producer ProducerConfig `yaml:"producer" toml:"producer"`
+	Consumer ConsumerConfig `yaml:"consumer" toml:"consumer"`
+	Startup  StartupConfig  `yaml:"startup" toml:"startup"`
+}
+
+type TLSConfig struct {
+	Enabled            bool   `yaml:"enabled" toml:"enabled"`
+	CAFile             string `yaml:"ca_file" toml:"ca_file"`
+	CertFile           string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile            string `yaml:"key_file" toml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+}
+
+// SASLConfig enables SASL authentication when Mechanism is set, PasswordFile is read into Password.
+type SASLConfig struct {
+	Mechanism    string `yaml:"mechanism" toml:"mechanism"`
+	Username     string `yaml:"username" toml:"username"`
+	Password     string `yaml:"password" toml:"password"`
+	PasswordFile string `yaml:"password_file" toml:"password_file"`
+}
+
+// ProducerConfig tunes the producers of the outbox relays. Idempotent keeps the retries of a
+// producer from writing a message twice. A TransactionalID makes each relay batch a Kafka
+// transaction, it implies Idempotent and must be unique per running process.
+type ProducerConfig struct {
+	MaxMessageBytes int           `yaml:"max_message_bytes" toml:"max_message_bytes"`
+	Retries         int           `yaml:"retries" toml:"retries"`
+	RetryBackoff    time.Duration `yaml:"retry_backoff" toml:"retry_backoff"`
+	Compression     string        `yaml:"compression" toml:"compression"`
+	Timeout         time.Duration `yaml:"timeout" toml:"timeout"`
+	Idempotent      bool          `yaml:"idempotent" toml:"idempotent"`
+	TransactionalID string        `yaml:"transactional_id" toml:"transactional_id"`
+}
+
+const (
+	IsolationReadUncommitted = "read_uncommitted"
+	IsolationReadCommitted   = "read_committed"
+)
+
+type ConsumerConfig struct {
+	// InitialOffset is oldest or newest
+	InitialOffset string        `yaml:"initial_offset" toml:"initial_offset"`
+	FetchMinBytes int32         `yaml:"fetch_min_bytes" toml:"fetch_min_bytes"`
+	FetchMaxWait  time.Duration `yaml:"fetch_max_wait" toml:"fetch_max_wait"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff" toml:"retry_backoff"`
+	// IsolationLevel is read_uncommitted or read_committed, read_committed skips the messages of
+	// aborted relay transactions
+	IsolationLevel string `yaml:"isolation_level" toml:"isolation_level"`
+}
+
+// StartupConfig controls how long a process waits for Kafka to become reachable.
+// The backoff doubles from InitialBackoff up to MaxBackoff, a zero Timeout retries until the process stops.
+type StartupConfig struct {
+	InitialBackoff time.Duration `yaml:"initial_backoff" toml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff" toml:"max_backoff"`
+	Timeout        time.Duration `yaml:"timeout" toml:"timeout"`
+}
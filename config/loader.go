@@ -0,0 +1,271 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const envPrefix = "SAGA_"
+
+// Load builds the config from DefaultConfig, the YAML or TOML file at path when
+// path is not empty, then SAGA_* environment variables. Every DSN, the Kafka SASL
+// password and the gateway callback secret can instead be read from a file, through
+// database_dsn_file or a SAGA_<SERVICE>_DSN_FILE variable, so passwords can be mounted as secrets.
+func Load(path string) (Config, error) {
+	conf := DefaultConfig
+
+	if path != "" {
+		err := loadFile(path, &conf)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	applyEnv(&conf)
+
+	err := loadSecrets(&conf)
+	if err != nil {
+		return Config{}, err
+	}
+
+	err = conf.Validate()
+	if err != nil {
+		return Config{}, err
+	}
+	return conf, nil
+}
+
+func loadFile(path string, conf *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, conf)
+	case ".toml":
+		_, err = toml.Decode(string(content), conf)
+	default:
+		return fmt.Errorf("config file %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func applyEnv(conf *Config) {
+	for _, service := range conf.servicePointers() {
+		name := strings.ToUpper(service.Name)
+		// a DSN from the environment wins over a dsn file from the config file
+		if setFromEnv(&service.DatabaseDSN, name+"_DSN") {
+			service.DatabaseDSNFile = ""
+		}
+		setFromEnv(&service.DatabaseDSNFile, name+"_DSN_FILE")
+		setFromEnv(&service.MigrationDir, name+"_MIGRATION_DIR")
+		setFromEnv(&service.Driver, name+"_DRIVER")
+	}
+	var brokers string
+	if setFromEnv(&brokers, "KAFKA_BROKERS") {
+		conf.Kafka.Brokers = splitList(brokers)
+	}
+	setFromEnv(&conf.Kafka.ClientID, "KAFKA_CLIENT_ID")
+	setFromEnv(&conf.Kafka.Version, "KAFKA_VERSION")
+	setFromEnv(&conf.Kafka.SASL.Mechanism, "KAFKA_SASL_MECHANISM")
+	setFromEnv(&conf.Kafka.SASL.Username, "KAFKA_SASL_USERNAME")
+	if setFromEnv(&conf.Kafka.SASL.Password, "KAFKA_SASL_PASSWORD") {
+		conf.Kafka.SASL.PasswordFile = ""
+	}
+	setFromEnv(&conf.Kafka.SASL.PasswordFile, "KAFKA_SASL_PASSWORD_FILE")
+	setFromEnv(&conf.Tracing.Exporter, "TRACING_EXPORTER")
+	setFromEnv(&conf.Gateway.Provider, "GATEWAY_PROVIDER")
+	if setFromEnv(&conf.Gateway.CallbackSecret, "GATEWAY_CALLBACK_SECRET") {
+		conf.Gateway.CallbackSecretFile = ""
+	}
+	setFromEnv(&conf.Gateway.CallbackSecretFile, "GATEWAY_CALLBACK_SECRET_FILE")
+	setFromEnv(&conf.Credit.Policy, "CREDIT_POLICY")
+	setFromEnv(&conf.Logging.Level, "LOG_LEVEL")
+	setFromEnv(&conf.Logging.Format, "LOG_FORMAT")
+	var redact string
+	if setFromEnv(&redact, "LOG_REDACT") {
+		conf.Logging.Redact = splitList(redact)
+	}
+	setFromEnv(&conf.OrderCreatedTopic, "ORDER_CREATED_TOPIC")
+	setFromEnv(&conf.PrepareInventoryTopic, "PREPARE_INVENTORY_TOPIC")
+	setFromEnv(&conf.OrderBillTopic, "ORDER_BILL_TOPIC")
+	setFromEnv(&conf.ShipmentTopic, "SHIPMENT_TOPIC")
+}
+
+func setFromEnv(field *string, key string) bool {
+	value, ok := os.LookupEnv(envPrefix + key)
+	if ok {
+		*field = value
+	}
+	return ok
+}
+
+func splitList(value string) []string {
+	var res []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func loadSecrets(conf *Config) error {
+	for _, service := range conf.servicePointers() {
+		if service.DatabaseDSNFile == "" {
+			continue
+		}
+
+		content, err := os.ReadFile(service.DatabaseDSNFile)
+		if err != nil {
+			return fmt.Errorf("%s: read database dsn file: %w", service.Name, err)
+		}
+		service.DatabaseDSN = strings.TrimSpace(string(content))
+	}
+
+	if conf.Kafka.SASL.PasswordFile != "" {
+		content, err := os.ReadFile(conf.Kafka.SASL.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("kafka: read sasl password file: %w", err)
+		}
+		conf.Kafka.SASL.Password = strings.TrimSpace(string(content))
+	}
+
+	if conf.Gateway.CallbackSecretFile != "" {
+		content, err := os.ReadFile(conf.Gateway.CallbackSecretFile)
+		if err != nil {
+			return fmt.Errorf("gateway: read callback secret file: %w", err)
+		}
+		conf.Gateway.CallbackSecret = strings.TrimSpace(string(content))
+	}
+	return nil
+}
+
+// Validate reports every missing or conflicting setting at once.
+func (c Config) Validate() error {
+	var errs []error
+	names := map[string]bool{}
+	for _, service := range c.Services() {
+		if service.Name == "" {
+			errs = append(errs, errors.New("service name is required"))
+			continue
+		}
+		if names[service.Name] {
+			errs = append(errs, fmt.Errorf("service name %q is used twice", service.Name))
+		}
+		names[service.Name] = true
+
+		if service.MigrationDir == "" {
+			errs = append(errs, fmt.Errorf("%s: migration_dir is required", service.Name))
+		}
+		if service.DatabaseDSN == "" {
+			errs = append(errs, fmt.Errorf("%s: database_dsn or database_dsn_file is required", service.Name))
+		}
+		switch service.Driver {
+		case "", DriverMySQL, DriverPostgres, DriverSQLite:
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown driver %q", service.Name, service.Driver))
+		}
+	}
+
+	errs = append(errs, c.Kafka.validate()...)
+	errs = append(errs, c.Watchdog.validate()...)
+	errs = append(errs, c.validateRelay()...)
+	errs = append(errs, c.Retention.validate()...)
+	errs = append(errs, c.Gateway.validate()...)
+	errs = append(errs, c.Credit.validate()...)
+
+	var level slog.Level
+	if c.Logging.Level != "" && level.UnmarshalText([]byte(c.Logging.Level)) != nil {
+		errs = append(errs, fmt.Errorf("logging: unknown level %q", c.Logging.Level))
+	}
+	switch c.Logging.Format {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("logging: unknown format %q", c.Logging.Format))
+	}
+
+	switch c.Tracing.Exporter {
+	case "", TracingExporterNone, TracingExporterStdout:
+	default:
+		errs = append(errs, fmt.Errorf("tracing: unknown exporter %q", c.Tracing.Exporter))
+	}
+
+	topics := map[string]string{
+		"order_created_topic":     c.OrderCreatedTopic,
+		"prepare_inventory_topic": c.PrepareInventoryTopic,
+		"order_bill_topic":        c.OrderBillTopic,
+		"shipment_topic":          c.ShipmentTopic,
+	}
+	usedBy := map[string]string{}
+	for _, key := range []string{"order_created_topic", "prepare_inventory_topic", "order_bill_topic", "shipment_topic"} {
+		topic := topics[key]
+		if topic == "" {
+			errs = append(errs, fmt.Errorf("%s is required", key))
+			continue
+		}
+		if other, ok := usedBy[topic]; ok {
+			errs = append(errs, fmt.Errorf("%s and %s both use topic %q", other, key, topic))
+		}
+		usedBy[topic] = key
+	}
+	errs = append(errs, c.validateEncodings()...)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (k KafkaConfig) validate() []error {
+	var errs []error
+	if len(k.Brokers) == 0 && !k.InMemory {
+		errs = append(errs, errors.New("kafka: brokers is required"))
+	}
+
+	switch k.SASL.Mechanism {
+	case "":
+	case SASLMechanismPlain, SASLMechanismScramSHA256, SASLMechanismScramSHA512:
+		if k.SASL.Username == "" {
+			errs = append(errs, errors.New("kafka: sasl username is required"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("kafka: unknown sasl mechanism %q", k.SASL.Mechanism))
+	}
+
+	if (k.TLS.CertFile == "") != (k.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("kafka: tls cert_file and key_file go together"))
+	}
+
+	switch k.Consumer.InitialOffset {
+	case "", "oldest", "newest":
+	default:
+		errs = append(errs, fmt.Errorf("kafka: unknown consumer initial_offset %q", k.Consumer.InitialOffset))
+	}
+	switch k.Consumer.IsolationLevel {
+	case "", IsolationReadUncommitted, IsolationReadCommitted:
+	default:
+		errs = append(errs, fmt.Errorf("kafka: unknown consumer isolation_level %q", k.Consumer.IsolationLevel))
+	}
+
+	if k.Startup.MaxBackoff > 0 && k.Startup.InitialBackoff > k.Startup.MaxBackoff {
+		errs = append(errs, errors.New("kafka: startup initial_backoff is greater than max_backoff"))
+	}
+	return errs
+}
+
+func (c *Config) servicePointers() []*ServiceConfig {
+	return []*ServiceConfig{&c.OrderConfig, &c.InventoryConfig, &c.PaymentConfig, &c.ShippingConfig}
+}
@@ -0,0 +1,14 @@
+package config
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LoggingConfig Level is one of debug, info, warn and error, info when empty. Format is text when empty.
+// Redact lists the payload fields and log attributes whose value is never written.
+type LoggingConfig struct {
+	Level  string   `yaml:"level" toml:"level"`
+	Format string   `yaml:"format" toml:"format"`
+	Redact []string `yaml:"redact" toml:"redact"`
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	RelayPolling = "polling"
+	RelayBinlog  = "binlog"
+)
+
+// RelayConfig picks how the outboxes reach Kafka. polling reads the pending rows every relay
+// interval, binlog tails the MySQL binlog for the inserted rows and keeps its position in a file of
+// PositionDir per service. ServerID identifies the binlog reader to MySQL, the services add their
+// index in Services to it so each one is unique.
+type RelayConfig struct {
+	Mode        string           `yaml:"mode" toml:"mode"`
+	ServerID    uint32           `yaml:"server_id" toml:"server_id"`
+	PositionDir string           `yaml:"position_dir" toml:"position_dir"`
+	Retry       RelayRetryConfig `yaml:"retry" toml:"retry"`
+}
+
+// RelayRetryConfig is how an outbox row Kafka rejected is attempted again, after InitialBackoff
+// doubled at every attempt up to MaxBackoff. The row is failed after MaxAttempts attempts.
+type RelayRetryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts" toml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" toml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff" toml:"max_backoff"`
+}
+
+// Binlog tells if the outboxes are relayed from the binlog.
+func (r RelayConfig) Binlog() bool {
+	return r.Mode == RelayBinlog
+}
+
+func (c Config) validateRelay() []error {
+	var errs []error
+	retry := c.Relay.Retry
+	if retry.MaxAttempts < 1 {
+		errs = append(errs, errors.New("relay: retry max_attempts must be positive"))
+	}
+	if retry.InitialBackoff <= 0 || retry.InitialBackoff > retry.MaxBackoff {
+		errs = append(errs, errors.New("relay: retry initial_backoff must be positive and not greater than max_backoff"))
+	}
+
+	switch c.Relay.Mode {
+	case "", RelayPolling:
+		return errs
+	case RelayBinlog:
+	default:
+		return append(errs, fmt.Errorf("relay: unknown mode %q", c.Relay.Mode))
+	}
+
+	if c.Relay.ServerID == 0 {
+		errs = append(errs, errors.New("relay: server_id is required by the binlog mode"))
+	}
+	if c.Relay.PositionDir == "" {
+		errs = append(errs, errors.New("relay: position_dir is required by the binlog mode"))
+	}
+	for _, service := range c.Services() {
+		if service.DriverName() != DriverMySQL {
+			errs = append(errs, fmt.Errorf("relay: the binlog mode needs MySQL, %s runs on %s", service.Name, service.DriverName()))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+// RetentionConfig makes every service delete, every Interval, the outbox rows completed for longer
+// than Outbox and the inbox messages received longer than Inbox ago, BatchSize rows per statement.
+// A zero retention keeps the table forever. A message redelivered after its inbox row is deleted is
+// handled again, so Inbox must outlast the retention of the topics.
+type RetentionConfig struct {
+	Interval  time.Duration `yaml:"interval" toml:"interval"`
+	Outbox    time.Duration `yaml:"outbox" toml:"outbox"`
+	Inbox     time.Duration `yaml:"inbox" toml:"inbox"`
+	BatchSize int           `yaml:"batch_size" toml:"batch_size"`
+}
+
+func (r RetentionConfig) validate() []error {
+	var errs []error
+	if r.Interval <= 0 {
+		errs = append(errs, errors.New("retention: interval must be positive"))
+	}
+	if r.Outbox < 0 || r.Inbox < 0 {
+		errs = append(errs, errors.New("retention: retentions cannot be negative"))
+	}
+	if r.BatchSize <= 0 {
+		errs = append(errs, errors.New("retention: batch_size must be positive"))
+	}
+	return errs
+}
@@ -0,0 +1,11 @@
+package config
+
+const (
+	TracingExporterNone   = "none"
+	TracingExporterStdout = "stdout"
+)
+
+// TracingConfig Exporter is none when empty, stdout prints every finished span as JSON.
+type TracingConfig struct {
+	Exporter string `yaml:"exporter" toml:"exporter"`
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+// WatchdogConfig makes the order service time out orders no participant answered for. Orders are
+// scanned every Interval, BatchSize orders per status at a time, a zero timeout never times out
+// orders in that status.
+type WatchdogConfig struct {
+	Interval        time.Duration `yaml:"interval" toml:"interval"`
+	PendingTimeout  time.Duration `yaml:"pending_timeout" toml:"pending_timeout"`
+	PreparedTimeout time.Duration `yaml:"prepared_timeout" toml:"prepared_timeout"`
+	BatchSize       int           `yaml:"batch_size" toml:"batch_size"`
+}
+
+func (w WatchdogConfig) validate() []error {
+	var errs []error
+	if w.Interval <= 0 {
+		errs = append(errs, errors.New("watchdog: interval must be positive"))
+	}
+	if w.PendingTimeout < 0 || w.PreparedTimeout < 0 {
+		errs = append(errs, errors.New("watchdog: timeouts cannot be negative"))
+	}
+	if w.BatchSize <= 0 {
+		errs = append(errs, errors.New("watchdog: batch_size must be positive"))
+	}
+	return errs
+}
@@ -0,0 +1,121 @@
+package consume
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/tracing"
+	"log/slog"
+	"time"
+)
+
+const (
+	initialRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 30 * time.Second
+)
+
+// Handler handles the event of a consumed message, ctx carries the span and the message id.
+type Handler func(ctx context.Context, event saga_event.OrderEvent) error
+
+// Loop hands the messages of consumer to handle until ctx is done, the consumer is closed or, when
+// stopAfter is not zero, stopAfter has passed. A message that cannot be decoded is logged, counted
+// and skipped. A message handle fails is handled again after a backoff until it succeeds, the
+// handlers keep an inbox so a step is not taken twice, and the loop never moves past a saga step.
+func Loop(
+	ctx context.Context,
+	consumer kafka.IConsumer,
+	stopAfter time.Duration,
+	service string,
+	name string,
+	logger *slog.Logger,
+	handle Handler,
+) {
+	var stop <-chan time.Time
+	if stopAfter != 0 {
+		timer := time.NewTimer(stopAfter)
+		defer timer.Stop()
+		stop = timer.C
+	}
+
+	errs := consumer.Errors()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case msg, ok := <-consumer.Messages():
+			if !ok {
+				return
+			}
+			if !handleMessage(ctx, stop, msg, service, name, logger, handle) {
+				return
+			}
+		case err, ok := <-errs:
+			if !ok {
+				// the errors are closed with the consumer, its messages tell when it is done
+				errs = nil
+				continue
+			}
+			logger.Error("Failed to consume message",
+				slog.String("topic", err.Topic), slog.Int64("partition", int64(err.Partition)), slog.Any("error", err.Err),
+			)
+		}
+	}
+}
+
+// handleMessage returns false when the loop stopped before handle succeeded.
+func handleMessage(
+	ctx context.Context,
+	stop <-chan time.Time,
+	msg *sarama.ConsumerMessage,
+	service string,
+	name string,
+	logger *slog.Logger,
+	handle Handler,
+) bool {
+	logger = logger.With(logging.Message(msg)...)
+	logger.Debug("Received message", slog.Any("payload", logging.Payload(msg.Value)))
+	msgCtx, span := tracing.StartConsume(ctx, service+"."+name, msg)
+	message, err := saga_event.DecodeMessage(kafka.ContentType(msg), msg.Value)
+	if err != nil {
+		tracing.End(span, err)
+		metrics.HandlerErrors.WithLabelValues(service, msg.Topic).Inc()
+		logger.Error("Failed to decode message", slog.Any("error", err))
+		return true
+	}
+
+	event := message.Event.OrderEvent()
+	msgCtx = saga_event.WithMessageID(msgCtx, message.ID)
+	logger = logger.With(logging.Order(event)...)
+	backoff := initialRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err = handle(msgCtx, event)
+		if err == nil {
+			break
+		}
+		metrics.HandlerErrors.WithLabelValues(service, msg.Topic).Inc()
+		logger.Error("Failed to handle message", slog.Int("attempt", attempt), slog.Duration("backoff", backoff),
+			slog.Any("error", err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			tracing.End(span, err)
+			return false
+		case <-stop:
+			timer.Stop()
+			tracing.End(span, err)
+			return false
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+	span.End()
+	logger.Info("Handled message")
+	return true
+}
@@ -0,0 +1,4 @@
+create database saga_order;
+create database saga_inventory;
+create database saga_payment;
+create database saga_shipping;
@@ -0,0 +1,83 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const statusOK = "ok"
+
+// Status is the state of every registered component, Healthy only when all of them are ok.
+type Status struct {
+	Healthy    bool              `json:"healthy"`
+	Components map[string]string `json:"components"`
+}
+
+// Registry collects the last known state of the components a process depends on.
+type Registry struct {
+	mu         sync.RWMutex
+	components map[string]error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		components: map[string]error{},
+	}
+}
+
+// Set records the state of component, a nil error means the component is healthy.
+// It is safe to call on a nil registry.
+func (r *Registry) Set(component string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.components[component] = err
+}
+
+func (r *Registry) Status() Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	status := Status{
+		Healthy:    true,
+		Components: make(map[string]string, len(r.components)),
+	}
+	for component, err := range r.components {
+		if err != nil {
+			status.Healthy = false
+			status.Components[component] = err.Error()
+			continue
+		}
+		status.Components[component] = statusOK
+	}
+	return status
+}
+
+// Names returns the registered components in order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var res []string
+	for component := range r.components {
+		res = append(res, component)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Handler answers 200 when every component is healthy and 503 otherwise, with the Status as body.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := r.Status()
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,192 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/xdg-go/scram"
+	"os"
+)
+
+func newSaramaConfig(conf config.KafkaConfig) (*sarama.Config, error) {
+	return newTopicSaramaConfig(conf, "")
+}
+
+// newTopicSaramaConfig is the config of the clients of topic, the producer of each topic has its
+// own transactional id.
+func newTopicSaramaConfig(conf config.KafkaConfig, topic string) (*sarama.Config, error) {
+	saramaConf := sarama.NewConfig()
+	if conf.ClientID != "" {
+		saramaConf.ClientID = conf.ClientID
+	}
+
+	if conf.Version != "" {
+		version, err := sarama.ParseKafkaVersion(conf.Version)
+		if err != nil {
+			return nil, err
+		}
+		saramaConf.Version = version
+	}
+
+	if conf.TLS.Enabled {
+		tlsConf, err := newTLSConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		saramaConf.Net.TLS.Enable = true
+		saramaConf.Net.TLS.Config = tlsConf
+	}
+
+	if conf.SASL.Mechanism != "" {
+		err := setSASL(saramaConf, conf.SASL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := setProducer(saramaConf, conf.Producer, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	setConsumer(saramaConf, conf.Consumer)
+	return saramaConf, saramaConf.Validate()
+}
+
+func newTLSConfig(conf config.TLSConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+
+	if conf.CAFile != "" {
+		ca, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read kafka ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("kafka ca file %s has no certificate", conf.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load kafka client certificate: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+func setSASL(saramaConf *sarama.Config, conf config.SASLConfig) error {
+	saramaConf.Net.SASL.Enable = true
+	saramaConf.Net.SASL.User = conf.Username
+	saramaConf.Net.SASL.Password = conf.Password
+	// brokers from 1.0 take the credentials in SaslAuthenticate requests instead of raw bytes
+	if saramaConf.Version.IsAtLeast(sarama.V1_0_0_0) {
+		saramaConf.Net.SASL.Version = sarama.SASLHandshakeV1
+	}
+
+	switch conf.Mechanism {
+	case config.SASLMechanismPlain:
+		saramaConf.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case config.SASLMechanismScramSHA256:
+		saramaConf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		saramaConf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: scram.SHA256}
+		}
+	case config.SASLMechanismScramSHA512:
+		saramaConf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		saramaConf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: scram.SHA512}
+		}
+	default:
+		return fmt.Errorf("unknown kafka sasl mechanism %q", conf.Mechanism)
+	}
+	return nil
+}
+
+func setProducer(saramaConf *sarama.Config, conf config.ProducerConfig, topic string) error {
+	saramaConf.Producer.Return.Successes = true
+	saramaConf.Producer.Return.Errors = true
+	saramaConf.Producer.RequiredAcks = sarama.WaitForAll
+
+	if conf.MaxMessageBytes != 0 {
+		saramaConf.Producer.MaxMessageBytes = conf.MaxMessageBytes
+	}
+	if conf.Retries != 0 {
+		saramaConf.Producer.Retry.Max = conf.Retries
+	}
+	if conf.RetryBackoff != 0 {
+		saramaConf.Producer.Retry.Backoff = conf.RetryBackoff
+	}
+	if conf.Timeout != 0 {
+		saramaConf.Producer.Timeout = conf.Timeout
+	}
+	if conf.Compression != "" {
+		err := saramaConf.Producer.Compression.UnmarshalText([]byte(conf.Compression))
+		if err != nil {
+			return err
+		}
+	}
+
+	// an idempotent producer keeps one request in flight so retries cannot reorder the messages
+	if conf.Idempotent || conf.TransactionalID != "" {
+		saramaConf.Producer.Idempotent = true
+		saramaConf.Net.MaxOpenRequests = 1
+	}
+	if conf.TransactionalID != "" && topic != "" {
+		saramaConf.Producer.Transaction.ID = conf.TransactionalID + "." + topic
+	}
+	return nil
+}
+
+func setConsumer(saramaConf *sarama.Config, conf config.ConsumerConfig) {
+	saramaConf.Consumer.Return.Errors = true
+
+	// consumers read their topic from the start unless told otherwise
+	saramaConf.Consumer.Offsets.Initial = sarama.OffsetOldest
+	if conf.InitialOffset == "newest" {
+		saramaConf.Consumer.Offsets.Initial = sarama.OffsetNewest
+	}
+	if conf.FetchMinBytes != 0 {
+		saramaConf.Consumer.Fetch.Min = conf.FetchMinBytes
+	}
+	if conf.FetchMaxWait != 0 {
+		saramaConf.Consumer.MaxWaitTime = conf.FetchMaxWait
+	}
+	if conf.RetryBackoff != 0 {
+		saramaConf.Consumer.Retry.Backoff = conf.RetryBackoff
+	}
+	if conf.IsolationLevel == config.IsolationReadCommitted {
+		saramaConf.Consumer.IsolationLevel = sarama.ReadCommitted
+	}
+}
+
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *scramClient) Begin(userName string, password string, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.ClientConversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
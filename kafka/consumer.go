@@ -1,26 +1,85 @@
 package kafka
 
 import (
+	"errors"
 	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
+	"strconv"
+	"sync"
 )
 
 type IConsumer interface {
 	Messages() <-chan *sarama.ConsumerMessage
 	Errors() <-chan *sarama.ConsumerError
+	Close() error
 }
 
-func NewConsumer(host string, topic string) IConsumer {
-	config := sarama.NewConfig()
-	config.Consumer.Return.Errors = true
-	conn, err := sarama.NewConsumer([]string{host}, config)
+type consumer struct {
+	sarama.PartitionConsumer
+	conn sarama.Consumer
+	// messages are forwarded from the partition consumer and the lag is recorded once one is taken,
+	// the channel is closed once forwarding stopped, like the partition consumer closes its own
+	messages  chan *sarama.ConsumerMessage
+	done      chan struct{}
+	forwarded chan struct{}
+	closeOnce sync.Once
+}
+
+func NewConsumer(conf config.KafkaConfig, topic string) (IConsumer, error) {
+	saramaConf, err := newSaramaConfig(conf)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	partitionConn, err := conn.ConsumePartition(topic, 0, sarama.OffsetOldest)
+	conn, err := sarama.NewConsumer(conf.Brokers, saramaConf)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	partitionConn, err := conn.ConsumePartition(topic, 0, saramaConf.Consumer.Offsets.Initial)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	c := &consumer{
+		PartitionConsumer: partitionConn,
+		conn:              conn,
+		messages:          make(chan *sarama.ConsumerMessage),
+		done:              make(chan struct{}),
+		forwarded:         make(chan struct{}),
 	}
+	go c.forward()
+	return c, nil
+}
+
+func (c *consumer) forward() {
+	defer close(c.forwarded)
+	defer close(c.messages)
+	for msg := range c.PartitionConsumer.Messages() {
+		select {
+		case c.messages <- msg:
+			lag := c.HighWaterMarkOffset() - msg.Offset - 1
+			metrics.ConsumerLag.WithLabelValues(msg.Topic, strconv.Itoa(int(msg.Partition))).Set(float64(lag))
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *consumer) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
 
-	return partitionConn
+// Close stops the partition consumer and returns once Messages() is closed, Errors() is closed by
+// the partition consumer itself.
+func (c *consumer) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = errors.Join(c.PartitionConsumer.Close(), c.conn.Close())
+		<-c.forwarded
+	})
+	return err
 }
@@ -0,0 +1,281 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed           = errors.New("memory: closed")
+	ErrUnknownPartition = errors.New("memory: unknown partition")
+)
+
+// Broker keeps topics in memory, it stands in for Kafka in tests. Topics are created with a single
+// partition on first use unless CreateTopic was called before.
+type Broker struct {
+	mu     sync.Mutex
+	topics map[string]*topic
+}
+
+type topic struct {
+	partitions [][]*sarama.ConsumerMessage
+	// changed is closed and replaced every time messages are appended
+	changed       chan struct{}
+	nextPartition int
+	pushErrors    []error
+	// maxMessageBytes rejects larger message values when it is positive
+	maxMessageBytes int
+	// transactional pushes store all of their messages or none
+	transactional bool
+	consumers     []*consumer
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		topics: map[string]*topic{},
+	}
+}
+
+// CreateTopic creates name with the given number of partitions, it fails if the topic already exists.
+func (b *Broker) CreateTopic(name string, partitions int) error {
+	if partitions < 1 {
+		return fmt.Errorf("memory: topic %s needs at least one partition", name)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.topics[name]; ok {
+		return fmt.Errorf("memory: topic %s already exists", name)
+	}
+	b.topics[name] = newTopic(partitions)
+	return nil
+}
+
+func newTopic(partitions int) *topic {
+	return &topic{
+		partitions: make([][]*sarama.ConsumerMessage, partitions),
+		changed:    make(chan struct{}),
+	}
+}
+
+// getTopic must be called with b.mu held
+func (b *Broker) getTopic(name string) *topic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = newTopic(1)
+		b.topics[name] = t
+	}
+	return t
+}
+
+// FailNextPush makes the next Push to topic return err without storing any message.
+// Calling it several times queues several failures.
+func (b *Broker) FailNextPush(topic string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.getTopic(topic)
+	t.pushErrors = append(t.pushErrors, err)
+}
+
+// SetMaxMessageBytes makes Push to topic reject the messages with a value larger than max, like
+// Kafka rejects messages too large. The other messages of the push are stored.
+func (b *Broker) SetMaxMessageBytes(topic string, max int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.getTopic(topic).maxMessageBytes = max
+}
+
+// SetTransactional makes Push to topic behave like a transactional producer: a rejected message
+// aborts the push, none of its messages is stored and the PushError tells it was aborted.
+func (b *Broker) SetTransactional(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.getTopic(topic).transactional = true
+}
+
+// InjectConsumerError delivers err on Errors() of every open consumer of the topic partition.
+func (b *Broker) InjectConsumerError(topic string, partition int32, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.getTopic(topic).consumers {
+		if c.partition != partition {
+			continue
+		}
+		select {
+		case c.errors <- &sarama.ConsumerError{Topic: topic, Partition: partition, Err: err}:
+		default:
+		}
+	}
+}
+
+// Messages returns a copy of what was pushed to the topic partition.
+func (b *Broker) Messages(topic string, partition int32) []*sarama.ConsumerMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.getTopic(topic)
+	if int(partition) >= len(t.partitions) {
+		return nil
+	}
+	var res []*sarama.ConsumerMessage
+	for _, msg := range t.partitions[partition] {
+		res = append(res, copyMessage(msg))
+	}
+	return res
+}
+
+// HighWaterMark is the offset of the next message pushed to the topic partition.
+func (b *Broker) HighWaterMark(topic string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.getTopic(topic)
+	if int(partition) >= len(t.partitions) {
+		return 0
+	}
+	return int64(len(t.partitions[partition]))
+}
+
+// Producer returns a producer spreading messages round-robin over the topic partitions.
+func (b *Broker) Producer(topic string) kafka.IProducer {
+	return &producer{broker: b, topic: topic}
+}
+
+// Consumer reads partition 0 of topic from the oldest offset, like kafka.NewConsumer does.
+func (b *Broker) Consumer(topic string) kafka.IConsumer {
+	c, _ := b.ConsumePartition(topic, 0, sarama.OffsetOldest)
+	return c
+}
+
+// ConsumePartition reads a topic partition from offset, which may be sarama.OffsetOldest or
+// sarama.OffsetNewest.
+func (b *Broker) ConsumePartition(topic string, partition int32, offset int64) (kafka.IConsumer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.getTopic(topic)
+	if partition < 0 || int(partition) >= len(t.partitions) {
+		return nil, ErrUnknownPartition
+	}
+
+	switch offset {
+	case sarama.OffsetOldest:
+		offset = 0
+	case sarama.OffsetNewest:
+		offset = int64(len(t.partitions[partition]))
+	}
+	if offset < 0 || offset > int64(len(t.partitions[partition])) {
+		return nil, sarama.ErrOffsetOutOfRange
+	}
+
+	c := &consumer{
+		broker:    b,
+		topic:     topic,
+		partition: partition,
+		offset:    offset,
+		messages:  make(chan *sarama.ConsumerMessage),
+		errors:    make(chan *sarama.ConsumerError, errorBufferSize),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	t.consumers = append(t.consumers, c)
+	go c.run()
+	return c, nil
+}
+
+func (b *Broker) push(topicName string, messages []kafka.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.getTopic(topicName)
+	if len(t.pushErrors) > 0 {
+		err := t.pushErrors[0]
+		t.pushErrors = t.pushErrors[1:]
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	var pushErr *kafka.PushError
+	for i, message := range messages {
+		if t.maxMessageBytes > 0 && len(message.Value) > t.maxMessageBytes {
+			if pushErr == nil {
+				pushErr = &kafka.PushError{Rejected: map[int]error{}, Aborted: t.transactional}
+			}
+			pushErr.Rejected[i] = sarama.ErrMessageSizeTooLarge
+		}
+	}
+	if pushErr != nil && pushErr.Aborted {
+		return pushErr
+	}
+
+	now := time.Now()
+	for i, message := range messages {
+		if pushErr != nil {
+			if _, rejected := pushErr.Rejected[i]; rejected {
+				continue
+			}
+		}
+		partition := t.nextPartition
+		t.nextPartition = (t.nextPartition + 1) % len(t.partitions)
+		t.partitions[partition] = append(t.partitions[partition], &sarama.ConsumerMessage{
+			Topic:     topicName,
+			Partition: int32(partition),
+			Offset:    int64(len(t.partitions[partition])),
+			Value:     append([]byte(nil), message.Value...),
+			Headers:   recordHeaders(message.Headers),
+			Timestamp: now,
+		})
+	}
+	close(t.changed)
+	t.changed = make(chan struct{})
+	if pushErr != nil {
+		return pushErr
+	}
+	return nil
+}
+
+// next returns the message at offset, or a channel closed once more messages are pushed.
+func (b *Broker) next(topicName string, partition int32, offset int64) (*sarama.ConsumerMessage, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.getTopic(topicName)
+	if offset < int64(len(t.partitions[partition])) {
+		return copyMessage(t.partitions[partition][offset]), nil
+	}
+	return nil, t.changed
+}
+
+func (b *Broker) removeConsumer(c *consumer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.getTopic(c.topic)
+	for i, other := range t.consumers {
+		if other == c {
+			t.consumers = append(t.consumers[:i], t.consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+func copyMessage(msg *sarama.ConsumerMessage) *sarama.ConsumerMessage {
+	res := *msg
+	res.Value = append([]byte(nil), msg.Value...)
+	res.Headers = nil
+	for _, header := range msg.Headers {
+		res.Headers = append(res.Headers, &sarama.RecordHeader{
+			Key:   append([]byte(nil), header.Key...),
+			Value: append([]byte(nil), header.Value...),
+		})
+	}
+	return &res
+}
+
+func recordHeaders(headers map[string]string) []*sarama.RecordHeader {
+	var res []*sarama.RecordHeader
+	for _, header := range kafka.RecordHeaders(headers) {
+		header := header
+		res = append(res, &header)
+	}
+	return res
+}
@@ -0,0 +1,94 @@
+package memory
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
+	"strconv"
+	"sync"
+)
+
+const errorBufferSize = 16
+
+type producer struct {
+	broker *Broker
+	topic  string
+	mu     sync.Mutex
+	closed bool
+}
+
+// Push stores all messages or none of them, except the messages rejected for their size, see
+// Broker.SetMaxMessageBytes, which abort the whole push on a transactional topic.
+func (p *producer) Push(messages []kafka.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	return p.broker.push(p.topic, messages)
+}
+
+func (p *producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+// consumer delivers one message at a time, so its offset is the next message a reader gets.
+// Close stops delivery and closes the channels, like a Kafka consumer does.
+type consumer struct {
+	broker    *Broker
+	topic     string
+	partition int32
+	offset    int64
+	messages  chan *sarama.ConsumerMessage
+	errors    chan *sarama.ConsumerError
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *consumer) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func (c *consumer) Errors() <-chan *sarama.ConsumerError {
+	return c.errors
+}
+
+func (c *consumer) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		// once removed no error is injected, and run closes the messages when it returns
+		c.broker.removeConsumer(c)
+		close(c.errors)
+		<-c.stopped
+	})
+	return nil
+}
+
+func (c *consumer) run() {
+	defer close(c.stopped)
+	defer close(c.messages)
+	for {
+		msg, changed := c.broker.next(c.topic, c.partition, c.offset)
+		if msg == nil {
+			select {
+			case <-changed:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+
+		select {
+		case c.messages <- msg:
+			c.offset++
+			lag := c.broker.HighWaterMark(c.topic, c.partition) - c.offset
+			metrics.ConsumerLag.WithLabelValues(c.topic, strconv.Itoa(int(c.partition))).Set(float64(lag))
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"sort"
+)
+
+// HeaderContentType tells consumers how the value of a message is encoded.
+const HeaderContentType = "content-type"
+
+// Message is what a producer pushes, Headers carry the trace context of the saga across the hop.
+type Message struct {
+	Value   []byte
+	Headers map[string]string
+}
+
+// Values wraps values into messages without headers.
+func Values(values ...[]byte) []Message {
+	res := make([]Message, 0, len(values))
+	for _, value := range values {
+		res = append(res, Message{Value: value})
+	}
+	return res
+}
+
+// Headers returns the headers of a consumed message, the last one wins when a key repeats.
+func Headers(msg *sarama.ConsumerMessage) map[string]string {
+	if len(msg.Headers) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(msg.Headers))
+	for _, header := range msg.Headers {
+		if header == nil {
+			continue
+		}
+		res[string(header.Key)] = string(header.Value)
+	}
+	return res
+}
+
+// ContentType returns the content type header of a consumed message, empty when it has none.
+func ContentType(msg *sarama.ConsumerMessage) string {
+	return Headers(msg)[HeaderContentType]
+}
+
+// RecordHeaders sorts the headers by key, so the same message is always encoded the same way.
+func RecordHeaders(headers map[string]string) []sarama.RecordHeader {
+	if len(headers) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := make([]sarama.RecordHeader, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, sarama.RecordHeader{Key: []byte(key), Value: []byte(headers[key])})
+	}
+	return res
+}
@@ -1,52 +1,133 @@
 package kafka
 
 import (
+	"errors"
+	"fmt"
 	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/config"
 )
 
 type IProducer interface {
-	Push(messages [][]byte) error
+	Push(messages []Message) error
+	Close() error
+}
+
+// PushError is returned by Push when Kafka rejected some of the messages, Rejected maps their index
+// in the pushed messages to why. The other messages were sent, unless Aborted tells the transaction
+// of the push was aborted and none of them was.
+type PushError struct {
+	Rejected map[int]error
+	Aborted  bool
+}
+
+func (e *PushError) Error() string {
+	first := -1
+	for i := range e.Rejected {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	if first < 0 {
+		return "kafka: no message rejected"
+	}
+	return fmt.Sprintf("kafka: %d messages rejected, message %d: %s", len(e.Rejected), first, e.Rejected[first])
 }
 
 type producer struct {
-	host  string
-	topic string
-	conn  sarama.SyncProducer
+	brokers []string
+	topic   string
+	client  sarama.Client
+	conn    sarama.SyncProducer
 }
 
-func NewProducer(host string, topic string) IProducer {
-	saramaConf := sarama.NewConfig()
-	saramaConf.Producer.Return.Successes = true
-	saramaConf.Producer.Return.Errors = true
-	saramaConf.Producer.RequiredAcks = sarama.WaitForAll
+func NewProducer(conf config.KafkaConfig, topic string) (IProducer, error) {
+	saramaConf, err := newTopicSaramaConfig(conf, topic)
+	if err != nil {
+		return nil, err
+	}
 
-	client, err := sarama.NewClient([]string{host}, saramaConf)
+	client, err := sarama.NewClient(conf.Brokers, saramaConf)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	conn, err := sarama.NewSyncProducerFromClient(client)
 	if err != nil {
-		panic(err)
+		_ = client.Close()
+		return nil, err
 	}
 
 	return &producer{
-		conn:  conn,
-		host:  host,
-		topic: topic,
+		client:  client,
+		conn:    conn,
+		brokers: conf.Brokers,
+		topic:   topic,
+	}, nil
+}
+
+// Push sends messages, in one transaction when the producer has a transactional id. Consumers
+// reading read_committed see all of them or, when the transaction is aborted, none.
+func (p producer) Push(messages []Message) error {
+	kafkaMessages := toKafkaMessages(messages, p.topic)
+	if !p.conn.IsTransactional() || len(messages) == 0 {
+		return toPushError(kafkaMessages, p.conn.SendMessages(kafkaMessages), false)
+	}
+
+	err := p.conn.BeginTxn()
+	if err != nil {
+		return err
+	}
+	err = p.conn.SendMessages(kafkaMessages)
+	if err != nil {
+		abortErr := p.conn.AbortTxn()
+		if abortErr != nil {
+			return errors.Join(err, abortErr)
+		}
+		return toPushError(kafkaMessages, err, true)
 	}
+	return p.conn.CommitTxn()
+}
+
+// toPushError tells which of sent Kafka rejected, errors of the whole push are returned as they are.
+func toPushError(sent []*sarama.ProducerMessage, err error, aborted bool) error {
+	var producerErrs sarama.ProducerErrors
+	if !errors.As(err, &producerErrs) {
+		return err
+	}
+	index := make(map[*sarama.ProducerMessage]int, len(sent))
+	for i, message := range sent {
+		index[message] = i
+	}
+	res := &PushError{Rejected: map[int]error{}, Aborted: aborted}
+	for _, producerErr := range producerErrs {
+		i, ok := index[producerErr.Msg]
+		if !ok {
+			return err
+		}
+		// once a message fails the transaction, the messages after it fail for the transaction only
+		if aborted && errors.Is(producerErr.Err, sarama.ErrTransactionNotReady) {
+			continue
+		}
+		res.Rejected[i] = producerErr.Err
+	}
+	if len(res.Rejected) == 0 {
+		return err
+	}
+	return res
 }
 
-func (p producer) Push(messages [][]byte) error {
-	return p.conn.SendMessages(toKafkaMessages(messages, p.topic))
+// Close flushes the producer and closes its client, the producer does not own the client in sarama.
+func (p producer) Close() error {
+	return errors.Join(p.conn.Close(), p.client.Close())
 }
 
-func toKafkaMessages(messages [][]byte, topic string) []*sarama.ProducerMessage {
+func toKafkaMessages(messages []Message, topic string) []*sarama.ProducerMessage {
 	var res []*sarama.ProducerMessage
 	for _, message := range messages {
 		res = append(res, &sarama.ProducerMessage{
-			Topic: topic,
-			Value: sarama.ByteEncoder(message),
+			Topic:   topic,
+			Value:   sarama.ByteEncoder(message.Value),
+			Headers: RecordHeaders(message.Headers),
 		})
 	}
 	return res
@@ -0,0 +1,75 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/health"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// DialProducer retries NewProducer with backoff until Kafka is reachable, reporting each attempt to
+// registry under component. registry may be nil.
+func DialProducer(ctx context.Context, conf config.KafkaConfig, topic string, registry *health.Registry, component string) (IProducer, error) {
+	var res IProducer
+	err := retry(ctx, conf.Startup, registry, component, func() error {
+		var err error
+		res, err = NewProducer(conf, topic)
+		return err
+	})
+	return res, err
+}
+
+// DialConsumer retries NewConsumer with backoff until Kafka is reachable, see DialProducer.
+func DialConsumer(ctx context.Context, conf config.KafkaConfig, topic string, registry *health.Registry, component string) (IConsumer, error) {
+	var res IConsumer
+	err := retry(ctx, conf.Startup, registry, component, func() error {
+		var err error
+		res, err = NewConsumer(conf, topic)
+		return err
+	})
+	return res, err
+}
+
+func retry(ctx context.Context, conf config.StartupConfig, registry *health.Registry, component string, connect func() error) error {
+	backoff := conf.InitialBackoff
+	if backoff <= 0 {
+		backoff = defaultInitialBackoff
+	}
+	maxBackoff := conf.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	if conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.Timeout)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			registry.Set(component, nil)
+			return nil
+		}
+		registry.Set(component, fmt.Errorf("connecting, attempt %d: %w", attempt, err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s: kafka unreachable after %d attempts: %w", component, attempt, err)
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// Payload is a JSON message value, the logger of New writes it with its sensitive fields redacted.
+type Payload []byte
+
+// New builds the logger of conf writing to w.
+func New(conf config.LoggingConfig, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if conf.Level != "" {
+		err := level.UnmarshalText([]byte(conf.Level))
+		if err != nil {
+			return nil, fmt.Errorf("logging: %w", err)
+		}
+	}
+
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: newRedactor(conf.Redact).replaceAttr,
+	}
+	switch conf.Format {
+	case "", config.LogFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case config.LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q", conf.Format)
+	}
+}
+
+// Default is the logger of services built without one, it logs text at info level to stderr
+// and redacts the fields of the default config.
+func Default() *slog.Logger {
+	logger, _ := New(config.DefaultConfig.Logging, os.Stderr)
+	return logger
+}
+
+// Message returns the fields locating a consumed message.
+func Message(msg *sarama.ConsumerMessage) []any {
+	return []any{
+		slog.String("topic", msg.Topic),
+		slog.Int64("partition", int64(msg.Partition)),
+		slog.Int64("offset", msg.Offset),
+	}
+}
+
+// Order returns the fields of the order a saga event is about.
+func Order(event saga_event.OrderEvent) []any {
+	return []any{
+		slog.Int64("order_id", event.OrderID),
+		slog.Int64("customer_id", event.CustomerID),
+		slog.String("status", string(event.Status)),
+	}
+}
+
+type redactor struct {
+	fields map[string]bool
+}
+
+func newRedactor(fields []string) redactor {
+	r := redactor{fields: map[string]bool{}}
+	for _, field := range fields {
+		r.fields[strings.ToLower(field)] = true
+	}
+	return r
+}
+
+func (r redactor) replaceAttr(groups []string, attr slog.Attr) slog.Attr {
+	if r.fields[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+	if payload, ok := attr.Value.Any().(Payload); ok {
+		return slog.String(attr.Key, r.payload(payload))
+	}
+	return attr
+}
+
+// payload redacts the fields of a JSON object at any depth, a value that is not JSON is not
+// written at all as there is no telling what it holds.
+func (r redactor) payload(payload Payload) string {
+	var value interface{}
+	err := json.Unmarshal(payload, &value)
+	if err != nil {
+		return fmt.Sprintf("[%d bytes, not JSON]", len(payload))
+	}
+	res, err := json.Marshal(r.redact(value))
+	if err != nil {
+		return redacted
+	}
+	return string(res)
+}
+
+func (r redactor) redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if r.fields[strings.ToLower(key)] {
+				v[key] = redacted
+				continue
+			}
+			v[key] = r.redact(field)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = r.redact(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"net/http"
+	"time"
+)
+
+const namespace = "saga"
+
+// Registry holds every collector of the process, it is served by Handler.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Orders counts the orders that reached a status, PENDING counts the created ones.
+	Orders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_total",
+		Help:      "Orders by the status they reached, PENDING counts created orders.",
+	}, []string{"status"})
+
+	// SagaDuration is the time from PENDING to a terminal status.
+	SagaDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "duration_seconds",
+		Help:      "Time from an order being created to its terminal status.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600},
+	}, []string{"status"})
+
+	// OutboxPending is the pending row count of an outbox table after its last relay.
+	OutboxPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "outbox_pending",
+		Help:      "Pending rows of an outbox table after its last relay.",
+	}, []string{"table"})
+
+	// RelayLatency is the time an outbox row waited before it was pushed to Kafka.
+	RelayLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "outbox_relay_latency_seconds",
+		Help:      "Time from an outbox row being written to it being pushed to Kafka.",
+		Buckets:   []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 300},
+	}, []string{"table"})
+
+	// OutboxRejected counts the outbox rows Kafka rejected, each attempt is counted.
+	OutboxRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_rejected_total",
+		Help:      "Attempts to relay an outbox row that Kafka rejected.",
+	}, []string{"table"})
+
+	// OutboxFailed counts the outbox rows the relay gave up on.
+	OutboxFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_failed_total",
+		Help:      "Outbox rows marked failed after their last attempt.",
+	}, []string{"table"})
+
+	// ConsumerLag is how many messages of a partition are not consumed yet.
+	ConsumerLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "consumer_lag",
+		Help:      "Messages of a partition behind its high water mark.",
+	}, []string{"topic", "partition"})
+
+	// HandlerErrors counts the messages a service failed to handle.
+	HandlerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handler_errors_total",
+		Help:      "Messages a service failed to decode or handle.",
+	}, []string{"service", "topic"})
+
+	// Compensations counts the compensating actions that were committed.
+	Compensations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "compensations_total",
+		Help:      "Compensating actions executed, by service and action.",
+	}, []string{"service", "action"})
+
+	// Timeouts counts the orders the watchdog timed out, by the status they were stuck in.
+	Timeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "timeouts_total",
+		Help:      "Orders timed out by the watchdog, by the status they were stuck in.",
+	}, []string{"status"})
+
+	// TimeoutErrors counts the stuck orders the watchdog failed to time out, they are tried again.
+	TimeoutErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "timeout_errors_total",
+		Help:      "Stuck orders the watchdog failed to time out, by the status they were stuck in.",
+	}, []string{"status"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Orders,
+		SagaDuration,
+		OutboxPending,
+		RelayLatency,
+		OutboxRejected,
+		OutboxFailed,
+		ConsumerLag,
+		HandlerErrors,
+		Compensations,
+		Timeouts,
+		TimeoutErrors,
+	)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ObserveRelay records the latency of the relayed outboxes and the rows left pending in table.
+func ObserveRelay(table string, relayed []model.Outbox, pending int) {
+	now := time.Now()
+	for _, outbox := range relayed {
+		if outbox.CreatedAt.Valid {
+			RelayLatency.WithLabelValues(table).Observe(now.Sub(outbox.CreatedAt.Time).Seconds())
+		}
+	}
+	OutboxPending.WithLabelValues(table).Set(float64(pending))
+}
@@ -0,0 +1,3 @@
+alter table `inventory`
+    drop column   currency,
+    modify column unit_price int not null;
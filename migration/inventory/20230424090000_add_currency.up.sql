@@ -0,0 +1,3 @@
+alter table `inventory`
+    modify column unit_price bigint                not null,
+    add column    currency   char(3) default 'USD' not null after unit_price;
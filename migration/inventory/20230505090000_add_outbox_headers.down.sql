@@ -0,0 +1,2 @@
+alter table `inventory_outboxes`
+    drop column headers;
@@ -0,0 +1,11 @@
+create table `saga_audit`
+(
+    id          int auto_increment primary key,
+    order_id    int                    not null,
+    service     varchar(50)            not null,
+    kind        varchar(20)            not null,
+    status      varchar(50) default '' not null,
+    detail      text                   not null,
+    occurred_at bigint                 not null,
+    INDEX       order_id_idx (order_id)
+)
@@ -0,0 +1,4 @@
+-- fails while protobuf content is left, it is not valid json
+alter table `inventory_outboxes`
+    drop column content_type,
+    modify column content json not null;
@@ -0,0 +1,13 @@
+create table `processed_orders`
+(
+    order_id   int unique                          not null,
+    created_at timestamp default CURRENT_TIMESTAMP not null
+);
+
+insert into `processed_orders` (order_id, created_at)
+select order_id, min(received_at)
+from `inbox`
+where event_type = 'OrderCreated'
+group by order_id;
+
+drop table `inbox`;
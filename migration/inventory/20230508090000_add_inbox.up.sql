@@ -0,0 +1,17 @@
+-- a message is received once per event type
+create table `inbox`
+(
+    message_id  varchar(64)                         not null,
+    event_type  varchar(64)                         not null,
+    order_id    int                                 not null,
+    received_at timestamp default CURRENT_TIMESTAMP not null,
+    primary key (message_id, event_type),
+    INDEX       order_id_idx (order_id, event_type)
+);
+
+-- a processed order was received, keyed like a message without an id
+insert into `inbox` (message_id, event_type, order_id, received_at)
+select concat('order:', order_id), 'OrderCreated', order_id, created_at
+from `processed_orders`;
+
+drop table `processed_orders`;
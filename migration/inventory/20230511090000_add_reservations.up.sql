@@ -0,0 +1,9 @@
+-- the stock taken for an order, released_at is set once it was put back
+create table `reservations`
+(
+    order_id    int unique                          not null,
+    product_id  int                                 not null,
+    amount      int                                 not null,
+    released_at timestamp                           null,
+    created_at  timestamp default CURRENT_TIMESTAMP not null
+);
@@ -0,0 +1,3 @@
+alter table `orders`
+    drop column promo_code,
+    drop column cost;
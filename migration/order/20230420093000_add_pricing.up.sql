@@ -0,0 +1,3 @@
+alter table `orders`
+    add column promo_code varchar(50) default '' not null after amount,
+    add column cost       int         default 0  not null after promo_code;
@@ -0,0 +1,2 @@
+alter table `orders`
+    add column failure_reason varchar(100) default '' not null after status;
@@ -0,0 +1,3 @@
+alter table `orders`
+    drop column   currency,
+    modify column cost int default 0 not null;
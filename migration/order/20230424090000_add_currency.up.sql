@@ -0,0 +1,3 @@
+alter table `orders`
+    modify column cost     bigint  default 0  not null,
+    add column    currency char(3) default '' not null after cost;
@@ -0,0 +1,2 @@
+alter table `order_outboxes`
+    add column headers json null after content;
@@ -0,0 +1,3 @@
+alter table `order_outboxes`
+    modify column content longblob not null,
+    add column content_type varchar(64) default 'application/json' not null after content;
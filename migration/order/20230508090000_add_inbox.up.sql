@@ -0,0 +1,10 @@
+-- a message is received once per event type
+create table `inbox`
+(
+    message_id  varchar(64)                         not null,
+    event_type  varchar(64)                         not null,
+    order_id    int                                 not null,
+    received_at timestamp default CURRENT_TIMESTAMP not null,
+    primary key (message_id, event_type),
+    INDEX       order_id_idx (order_id, event_type)
+);
@@ -0,0 +1,5 @@
+drop table `charges`;
+
+alter table `accounts`
+    drop column credit_limit,
+    drop column daily_spending_cap;
@@ -0,0 +1,12 @@
+alter table `accounts`
+    add column credit_limit       int default 0 not null after balance,
+    add column daily_spending_cap int default 0 not null after credit_limit;
+
+create table `charges`
+(
+    order_id    int unique                          not null,
+    customer_id int                                 not null,
+    cost        int                                 not null,
+    created_at  timestamp default CURRENT_TIMESTAMP not null,
+    INDEX       customer_created_idx (customer_id, created_at)
+);
@@ -0,0 +1,9 @@
+alter table `charges`
+    drop column   currency,
+    modify column cost int not null;
+
+alter table `accounts`
+    drop column   currency,
+    modify column balance            int           not null,
+    modify column credit_limit       int default 0 not null,
+    modify column daily_spending_cap int default 0 not null;
@@ -0,0 +1,9 @@
+alter table `accounts`
+    modify column balance            bigint                not null,
+    modify column credit_limit       bigint  default 0     not null,
+    modify column daily_spending_cap bigint  default 0     not null,
+    add column    currency           char(3) default 'USD' not null after balance;
+
+alter table `charges`
+    modify column cost     bigint                not null,
+    add column    currency char(3) default 'USD' not null after cost;
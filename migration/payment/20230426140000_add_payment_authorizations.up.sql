@@ -0,0 +1,14 @@
+create table `payment_authorizations`
+(
+    authorization_id varchar(100) unique                  not null,
+    order_id         int unique                           not null,
+    customer_id      int                                  not null,
+    cost             bigint                               not null,
+    currency         char(3)                              not null,
+    status           varchar(20)                          not null,
+    event            json                                 not null,
+    expires_at       timestamp                            null,
+    created_at       timestamp default CURRENT_TIMESTAMP  not null,
+    updated_at       timestamp ON UPDATE CURRENT_TIMESTAMP null,
+    INDEX            status_expires_idx (status, expires_at)
+);
@@ -0,0 +1,2 @@
+alter table `charges`
+    drop column refunded_at;
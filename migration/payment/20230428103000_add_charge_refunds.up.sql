@@ -0,0 +1,2 @@
+alter table `charges`
+    add column refunded_at timestamp null after currency;
@@ -0,0 +1,4 @@
+alter table `payment_outboxes`
+    drop column attempts,
+    drop column last_error,
+    drop column next_attempt_at;
@@ -0,0 +1,5 @@
+-- a row Kafka rejected waits for next_attempt_at, last_error is why it was rejected
+alter table `payment_outboxes`
+    add column attempts        int default 0 not null after status,
+    add column last_error      text          null after attempts,
+    add column next_attempt_at timestamp     null after last_error;
@@ -0,0 +1,4 @@
+drop table processed_orders;
+drop table inventory_outboxes;
+drop table inventory;
+drop function set_updated_at;
@@ -0,0 +1,44 @@
+-- ON UPDATE CURRENT_TIMESTAMP of MySQL is a trigger here, content is bytea since lib/pq sends []byte as bytea
+create function set_updated_at() returns trigger as
+$$
+begin
+    new.updated_at = current_timestamp;
+    return new;
+end;
+$$ language plpgsql;
+
+create table inventory
+(
+    product_id bigint unique                         not null,
+    unit_price bigint                                not null,
+    currency   varchar(3)  default 'USD'             not null,
+    amount     int                                   not null,
+    created_at timestamptz default current_timestamp not null,
+    updated_at timestamptz                           null
+);
+
+create trigger inventory_updated_at
+    before update on inventory
+    for each row execute function set_updated_at();
+
+create table inventory_outboxes
+(
+    id         bigserial primary key,
+    content    bytea                                 not null,
+    status     smallint    default 1                 not null,
+    created_at timestamptz default current_timestamp not null,
+    updated_at timestamptz                           null
+);
+
+create index inventory_outboxes_status_idx on inventory_outboxes (status);
+
+create trigger inventory_outboxes_updated_at
+    before update on inventory_outboxes
+    for each row execute function set_updated_at();
+
+create table processed_orders
+(
+    order_id   bigint unique                         not null,
+    created_at timestamptz default current_timestamp not null
+);
+
@@ -0,0 +1,13 @@
+-- occurred_at is in microseconds since the epoch so the audit of every database sorts together
+create table saga_audit
+(
+    id          bigserial primary key,
+    order_id    bigint                 not null,
+    service     varchar(50)            not null,
+    kind        varchar(20)            not null,
+    status      varchar(50) default '' not null,
+    detail      text                   not null,
+    occurred_at bigint                 not null
+);
+
+create index saga_audit_order_id_idx on saga_audit (order_id);
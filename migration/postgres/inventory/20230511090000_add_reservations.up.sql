@@ -0,0 +1,9 @@
+-- the stock taken for an order, released_at is set once it was put back
+create table reservations
+(
+    order_id    bigint unique                         not null,
+    product_id  bigint                                not null,
+    amount      integer                               not null,
+    released_at timestamptz                           null,
+    created_at  timestamptz default current_timestamp not null
+);
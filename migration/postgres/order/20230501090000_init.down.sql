@@ -0,0 +1,3 @@
+drop table order_outboxes;
+drop table orders;
+drop function set_updated_at;
@@ -0,0 +1,42 @@
+-- ON UPDATE CURRENT_TIMESTAMP of MySQL is a trigger here, content is bytea since lib/pq sends []byte as bytea
+create function set_updated_at() returns trigger as
+$$
+begin
+    new.updated_at = current_timestamp;
+    return new;
+end;
+$$ language plpgsql;
+
+create table orders
+(
+    id             bigserial primary key,
+    customer_id    bigint                                not null,
+    product_id     bigint                                not null,
+    amount         int                                   not null,
+    promo_code     varchar(50) default ''                not null,
+    cost           bigint      default 0                 not null,
+    currency       varchar(3)  default ''                not null,
+    status         varchar(50) default 'PENDING'         not null,
+    failure_reason varchar(100) default ''               not null,
+    created_at     timestamptz default current_timestamp not null,
+    updated_at     timestamptz                           null
+);
+
+create trigger orders_updated_at
+    before update on orders
+    for each row execute function set_updated_at();
+
+create table order_outboxes
+(
+    id         bigserial primary key,
+    content    bytea                                 not null,
+    status     smallint    default 1                 not null,
+    created_at timestamptz default current_timestamp not null,
+    updated_at timestamptz                           null
+);
+
+create index order_outboxes_status_idx on order_outboxes (status);
+
+create trigger order_outboxes_updated_at
+    before update on order_outboxes
+    for each row execute function set_updated_at();
@@ -0,0 +1 @@
+drop table saga_audit;
@@ -0,0 +1,6 @@
+drop table processed_orders;
+drop table payment_outboxes;
+drop table payment_authorizations;
+drop table charges;
+drop table accounts;
+drop function set_updated_at;
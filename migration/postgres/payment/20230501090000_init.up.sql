@@ -0,0 +1,77 @@
+-- ON UPDATE CURRENT_TIMESTAMP of MySQL is a trigger here, content and event are bytea since lib/pq sends []byte as bytea
+create function set_updated_at() returns trigger as
+$$
+begin
+    new.updated_at = current_timestamp;
+    return new;
+end;
+$$ language plpgsql;
+
+create table accounts
+(
+    customer_id        bigint unique                         not null,
+    balance            bigint                                not null,
+    currency           varchar(3)  default 'USD'             not null,
+    credit_limit       bigint      default 0                 not null,
+    daily_spending_cap bigint      default 0                 not null,
+    created_at         timestamptz default current_timestamp not null,
+    updated_at         timestamptz                           null
+);
+
+create trigger accounts_updated_at
+    before update on accounts
+    for each row execute function set_updated_at();
+
+create table charges
+(
+    order_id    bigint unique                         not null,
+    customer_id bigint                                not null,
+    cost        bigint                                not null,
+    currency    varchar(3)  default 'USD'             not null,
+    refunded_at timestamptz                           null,
+    created_at  timestamptz default current_timestamp not null
+);
+
+create index charges_customer_created_idx on charges (customer_id, created_at);
+
+create table payment_authorizations
+(
+    authorization_id varchar(100) unique                   not null,
+    order_id         bigint unique                         not null,
+    customer_id      bigint                                not null,
+    cost             bigint                                not null,
+    currency         varchar(3)                            not null,
+    status           varchar(20)                           not null,
+    event            bytea                                 not null,
+    expires_at       timestamptz                           null,
+    created_at       timestamptz default current_timestamp not null,
+    updated_at       timestamptz                           null
+);
+
+create index payment_authorizations_status_expires_idx on payment_authorizations (status, expires_at);
+
+create trigger payment_authorizations_updated_at
+    before update on payment_authorizations
+    for each row execute function set_updated_at();
+
+create table payment_outboxes
+(
+    id         bigserial primary key,
+    content    bytea                                 not null,
+    status     smallint    default 1                 not null,
+    created_at timestamptz default current_timestamp not null,
+    updated_at timestamptz                           null
+);
+
+create index payment_outboxes_status_idx on payment_outboxes (status);
+
+create trigger payment_outboxes_updated_at
+    before update on payment_outboxes
+    for each row execute function set_updated_at();
+
+create table processed_orders
+(
+    order_id   bigint unique                         not null,
+    created_at timestamptz default current_timestamp not null
+);
+
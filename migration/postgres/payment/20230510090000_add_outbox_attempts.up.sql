@@ -0,0 +1,5 @@
+-- a row Kafka rejected waits for next_attempt_at, last_error is why it was rejected
+alter table payment_outboxes
+    add column attempts        integer default 0 not null,
+    add column last_error      text              null,
+    add column next_attempt_at timestamptz       null;
@@ -0,0 +1,4 @@
+drop table processed_orders;
+drop table shipping_outboxes;
+drop table shipments;
+drop function set_updated_at;
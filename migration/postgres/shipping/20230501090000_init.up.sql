@@ -0,0 +1,47 @@
+-- ON UPDATE CURRENT_TIMESTAMP of MySQL is a trigger here, content is bytea since lib/pq sends []byte as bytea
+create function set_updated_at() returns trigger as
+$$
+begin
+    new.updated_at = current_timestamp;
+    return new;
+end;
+$$ language plpgsql;
+
+create table shipments
+(
+    order_id        bigint unique                          not null,
+    customer_id     bigint                                 not null,
+    product_id      bigint                                 not null,
+    amount          int                                    not null,
+    tracking_number varchar(100) default ''                not null,
+    status          varchar(50)                            not null,
+    failure_reason  varchar(100) default ''                not null,
+    created_at      timestamptz  default current_timestamp not null,
+    updated_at      timestamptz                            null
+);
+
+create trigger shipments_updated_at
+    before update on shipments
+    for each row execute function set_updated_at();
+
+create table shipping_outboxes
+(
+    id         bigserial primary key,
+    content    bytea                                 not null,
+    status     smallint    default 1                 not null,
+    created_at timestamptz default current_timestamp not null,
+    updated_at timestamptz                           null
+);
+
+create index shipping_outboxes_status_idx on shipping_outboxes (status);
+
+create trigger shipping_outboxes_updated_at
+    before update on shipping_outboxes
+    for each row execute function set_updated_at();
+
+create table processed_orders
+(
+    order_id   bigint unique                         not null,
+    created_at timestamptz default current_timestamp not null
+);
+
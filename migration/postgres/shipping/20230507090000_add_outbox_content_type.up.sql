@@ -0,0 +1,2 @@
+alter table shipping_outboxes
+    add column content_type varchar(64) default 'application/json' not null;
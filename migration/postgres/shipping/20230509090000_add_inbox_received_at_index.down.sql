@@ -0,0 +1 @@
+drop index inbox_received_at_idx;
@@ -0,0 +1,2 @@
+-- retention deletes the inbox by age
+create index inbox_received_at_idx on inbox (received_at);
@@ -0,0 +1,28 @@
+create table `shipments`
+(
+    order_id        int unique                            not null,
+    customer_id     int                                   not null,
+    product_id      int                                   not null,
+    amount          int                                   not null,
+    tracking_number varchar(100) default ''               not null,
+    status          varchar(50)                           not null,
+    failure_reason  varchar(100) default ''               not null,
+    created_at      timestamp    default CURRENT_TIMESTAMP not null,
+    updated_at      timestamp ON UPDATE CURRENT_TIMESTAMP  null
+);
+
+create table `shipping_outboxes`
+(
+    id         int auto_increment primary key,
+    content    json                                not null,
+    status     tinyint   default 1                 not null,
+    created_at timestamp default CURRENT_TIMESTAMP not null,
+    updated_at timestamp ON UPDATE CURRENT_TIMESTAMP null,
+    INDEX      status_idx (status)
+);
+
+create table `processed_orders`
+(
+    order_id   int unique                          not null,
+    created_at timestamp default CURRENT_TIMESTAMP not null
+);
@@ -0,0 +1,2 @@
+alter table `shipping_outboxes`
+    drop column headers;
@@ -0,0 +1 @@
+drop index received_at_idx on `inbox`;
@@ -0,0 +1,2 @@
+-- retention deletes the inbox by age
+create index received_at_idx on `inbox` (received_at);
@@ -0,0 +1,3 @@
+drop table processed_orders;
+drop table inventory_outboxes;
+drop table inventory;
@@ -0,0 +1,41 @@
+-- ON UPDATE CURRENT_TIMESTAMP of MySQL is a trigger here
+create table inventory
+(
+    product_id integer unique                      not null,
+    unit_price integer                             not null,
+    currency   varchar(3) default 'USD'            not null,
+    amount     integer                             not null,
+    created_at timestamp default current_timestamp not null,
+    updated_at timestamp                           null
+);
+
+create trigger inventory_updated_at
+    after update on inventory
+    for each row
+begin
+    update inventory set updated_at = current_timestamp where rowid = new.rowid;
+end;
+
+create table inventory_outboxes
+(
+    id         integer primary key autoincrement,
+    content    blob                                not null,
+    status     integer   default 1                 not null,
+    created_at timestamp default current_timestamp not null,
+    updated_at timestamp                           null
+);
+
+create index inventory_outboxes_status_idx on inventory_outboxes (status);
+
+create trigger inventory_outboxes_updated_at
+    after update on inventory_outboxes
+    for each row
+begin
+    update inventory_outboxes set updated_at = current_timestamp where rowid = new.rowid;
+end;
+
+create table processed_orders
+(
+    order_id   integer unique                      not null,
+    created_at timestamp default current_timestamp not null
+);
@@ -0,0 +1,2 @@
+alter table inventory_outboxes
+    add column headers text null;
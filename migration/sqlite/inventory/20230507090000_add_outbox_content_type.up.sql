@@ -0,0 +1,2 @@
+alter table inventory_outboxes
+    add column content_type text default 'application/json' not null;
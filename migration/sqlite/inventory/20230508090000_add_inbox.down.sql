@@ -0,0 +1,13 @@
+create table processed_orders
+(
+    order_id   integer unique                      not null,
+    created_at timestamp default current_timestamp not null
+);
+
+insert into processed_orders (order_id, created_at)
+select order_id, min(received_at)
+from inbox
+where event_type = 'OrderCreated'
+group by order_id;
+
+drop table inbox;
@@ -0,0 +1,9 @@
+-- the stock taken for an order, released_at is set once it was put back
+create table reservations
+(
+    order_id    integer unique                      not null,
+    product_id  integer                             not null,
+    amount      integer                             not null,
+    released_at timestamp                           null,
+    created_at  timestamp default current_timestamp not null
+);
@@ -0,0 +1,2 @@
+drop table order_outboxes;
+drop table orders;
@@ -0,0 +1,40 @@
+-- ON UPDATE CURRENT_TIMESTAMP of MySQL is a trigger here
+create table orders
+(
+    id             integer primary key autoincrement,
+    customer_id    integer                                not null,
+    product_id     integer                                not null,
+    amount         integer                                not null,
+    promo_code     varchar(50)  default ''                not null,
+    cost           integer      default 0                 not null,
+    currency       varchar(3)   default ''                not null,
+    status         varchar(50)  default 'PENDING'         not null,
+    failure_reason varchar(100) default ''                not null,
+    created_at     timestamp    default current_timestamp not null,
+    updated_at     timestamp                              null
+);
+
+create trigger orders_updated_at
+    after update on orders
+    for each row
+begin
+    update orders set updated_at = current_timestamp where rowid = new.rowid;
+end;
+
+create table order_outboxes
+(
+    id         integer primary key autoincrement,
+    content    blob                                not null,
+    status     integer   default 1                 not null,
+    created_at timestamp default current_timestamp not null,
+    updated_at timestamp                           null
+);
+
+create index order_outboxes_status_idx on order_outboxes (status);
+
+create trigger order_outboxes_updated_at
+    after update on order_outboxes
+    for each row
+begin
+    update order_outboxes set updated_at = current_timestamp where rowid = new.rowid;
+end;
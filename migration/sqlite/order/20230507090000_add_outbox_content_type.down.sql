@@ -0,0 +1,2 @@
+alter table order_outboxes
+    drop column content_type;
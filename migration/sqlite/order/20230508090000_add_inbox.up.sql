@@ -0,0 +1,11 @@
+-- a message is received once per event type
+create table inbox
+(
+    message_id  varchar(64)                         not null,
+    event_type  varchar(64)                         not null,
+    order_id    integer                             not null,
+    received_at timestamp default current_timestamp not null,
+    primary key (message_id, event_type)
+);
+
+create index inbox_order_id_idx on inbox (order_id, event_type);
@@ -0,0 +1,6 @@
+alter table order_outboxes
+    drop column attempts;
+alter table order_outboxes
+    drop column last_error;
+alter table order_outboxes
+    drop column next_attempt_at;
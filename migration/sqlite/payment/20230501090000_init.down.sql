@@ -0,0 +1,5 @@
+drop table processed_orders;
+drop table payment_outboxes;
+drop table payment_authorizations;
+drop table charges;
+drop table accounts;
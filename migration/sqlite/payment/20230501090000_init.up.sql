@@ -0,0 +1,77 @@
+-- ON UPDATE CURRENT_TIMESTAMP of MySQL is a trigger here
+create table accounts
+(
+    customer_id        integer unique                      not null,
+    balance            integer                             not null,
+    currency           varchar(3) default 'USD'            not null,
+    credit_limit       integer    default 0                not null,
+    daily_spending_cap integer    default 0                not null,
+    created_at         timestamp default current_timestamp not null,
+    updated_at         timestamp                           null
+);
+
+create trigger accounts_updated_at
+    after update on accounts
+    for each row
+begin
+    update accounts set updated_at = current_timestamp where rowid = new.rowid;
+end;
+
+create table charges
+(
+    order_id    integer unique                      not null,
+    customer_id integer                             not null,
+    cost        integer                             not null,
+    currency    varchar(3) default 'USD'            not null,
+    refunded_at timestamp                           null,
+    created_at  timestamp default current_timestamp not null
+);
+
+create index charges_customer_created_idx on charges (customer_id, created_at);
+
+create table payment_authorizations
+(
+    authorization_id varchar(100) unique                 not null,
+    order_id         integer unique                      not null,
+    customer_id      integer                             not null,
+    cost             integer                             not null,
+    currency         varchar(3)                          not null,
+    status           varchar(20)                         not null,
+    event            blob                                not null,
+    expires_at       timestamp                           null,
+    created_at       timestamp default current_timestamp not null,
+    updated_at       timestamp                           null
+);
+
+create index payment_authorizations_status_expires_idx on payment_authorizations (status, expires_at);
+
+create trigger payment_authorizations_updated_at
+    after update on payment_authorizations
+    for each row
+begin
+    update payment_authorizations set updated_at = current_timestamp where rowid = new.rowid;
+end;
+
+create table payment_outboxes
+(
+    id         integer primary key autoincrement,
+    content    blob                                not null,
+    status     integer   default 1                 not null,
+    created_at timestamp default current_timestamp not null,
+    updated_at timestamp                           null
+);
+
+create index payment_outboxes_status_idx on payment_outboxes (status);
+
+create trigger payment_outboxes_updated_at
+    after update on payment_outboxes
+    for each row
+begin
+    update payment_outboxes set updated_at = current_timestamp where rowid = new.rowid;
+end;
+
+create table processed_orders
+(
+    order_id   integer unique                      not null,
+    created_at timestamp default current_timestamp not null
+);
@@ -0,0 +1,2 @@
+alter table payment_outboxes
+    add column headers text null;
@@ -0,0 +1,12 @@
+create table saga_audit
+(
+    id          integer primary key autoincrement,
+    order_id    integer                not null,
+    service     varchar(50)            not null,
+    kind        varchar(20)            not null,
+    status      varchar(50) default '' not null,
+    detail      text                   not null,
+    occurred_at integer                not null
+);
+
+create index saga_audit_order_id_idx on saga_audit (order_id);
@@ -0,0 +1,18 @@
+-- a message is received once per event type
+create table inbox
+(
+    message_id  varchar(64)                         not null,
+    event_type  varchar(64)                         not null,
+    order_id    integer                             not null,
+    received_at timestamp default current_timestamp not null,
+    primary key (message_id, event_type)
+);
+
+create index inbox_order_id_idx on inbox (order_id, event_type);
+
+-- a processed order was received, keyed like a message without an id
+insert into inbox (message_id, event_type, order_id, received_at)
+select 'order:' || order_id, 'InventoryReserved', order_id, created_at
+from processed_orders;
+
+drop table processed_orders;
@@ -0,0 +1,6 @@
+alter table payment_outboxes
+    drop column attempts;
+alter table payment_outboxes
+    drop column last_error;
+alter table payment_outboxes
+    drop column next_attempt_at;
@@ -0,0 +1,3 @@
+drop table processed_orders;
+drop table shipping_outboxes;
+drop table shipments;
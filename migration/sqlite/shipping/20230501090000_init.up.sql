@@ -0,0 +1,44 @@
+-- ON UPDATE CURRENT_TIMESTAMP of MySQL is a trigger here
+create table shipments
+(
+    order_id        integer unique                        not null,
+    customer_id     integer                               not null,
+    product_id      integer                               not null,
+    amount          integer                               not null,
+    tracking_number varchar(100) default ''               not null,
+    status          varchar(50)                           not null,
+    failure_reason  varchar(100) default ''               not null,
+    created_at      timestamp   default current_timestamp not null,
+    updated_at      timestamp                             null
+);
+
+create trigger shipments_updated_at
+    after update on shipments
+    for each row
+begin
+    update shipments set updated_at = current_timestamp where rowid = new.rowid;
+end;
+
+create table shipping_outboxes
+(
+    id         integer primary key autoincrement,
+    content    blob                                not null,
+    status     integer   default 1                 not null,
+    created_at timestamp default current_timestamp not null,
+    updated_at timestamp                           null
+);
+
+create index shipping_outboxes_status_idx on shipping_outboxes (status);
+
+create trigger shipping_outboxes_updated_at
+    after update on shipping_outboxes
+    for each row
+begin
+    update shipping_outboxes set updated_at = current_timestamp where rowid = new.rowid;
+end;
+
+create table processed_orders
+(
+    order_id   integer unique                      not null,
+    created_at timestamp default current_timestamp not null
+);
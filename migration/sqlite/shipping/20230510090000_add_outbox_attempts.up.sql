@@ -0,0 +1,7 @@
+-- a row Kafka rejected waits for next_attempt_at, last_error is why it was rejected
+alter table shipping_outboxes
+    add column attempts integer default 0 not null;
+alter table shipping_outboxes
+    add column last_error text null;
+alter table shipping_outboxes
+    add column next_attempt_at timestamp null;
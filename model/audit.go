@@ -0,0 +1,69 @@
+package model
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type AuditKind string
+
+const (
+	AuditReceived    AuditKind = "RECEIVED"
+	AuditDecision    AuditKind = "DECISION"
+	AuditEmitted     AuditKind = "EMITTED"
+	AuditCompensated AuditKind = "COMPENSATED"
+)
+
+// AuditEntry is one step of a saga as seen by one participant, Status is the order status the
+// step received or emitted.
+type AuditEntry struct {
+	ID         int64       `db:"id"`
+	OrderID    int64       `db:"order_id"`
+	Service    string      `db:"service"`
+	Kind       AuditKind   `db:"kind"`
+	Status     OrderStatus `db:"status"`
+	Detail     string      `db:"detail"`
+	OccurredAt Micros      `db:"occurred_at"`
+}
+
+// NewAuditEntry returns an entry occurring now.
+func NewAuditEntry(orderID int64, service string, kind AuditKind, status OrderStatus, detail string) AuditEntry {
+	return AuditEntry{
+		OrderID:    orderID,
+		Service:    service,
+		Kind:       kind,
+		Status:     status,
+		Detail:     detail,
+		OccurredAt: Micros{Time: time.Now().UTC().Truncate(time.Microsecond)},
+	}
+}
+
+// Micros is a time stored as microseconds since the epoch, so the audit entries of databases
+// keeping times with different precisions still sort together.
+type Micros struct {
+	time.Time
+}
+
+func (m Micros) Value() (driver.Value, error) {
+	return m.UnixMicro(), nil
+}
+
+func (m *Micros) Scan(src interface{}) error {
+	var micros int64
+	switch v := src.(type) {
+	case int64:
+		micros = v
+	case []byte:
+		parsed, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return err
+		}
+		micros = parsed
+	default:
+		return fmt.Errorf("model: cannot scan %T into Micros", src)
+	}
+	m.Time = time.UnixMicro(micros).UTC()
+	return nil
+}
@@ -0,0 +1,13 @@
+package model
+
+import (
+	"database/sql"
+)
+
+// InboxMessage is a message a service received, a message is received once per event type.
+type InboxMessage struct {
+	MessageID  string       `db:"message_id"`
+	EventType  string       `db:"event_type"`
+	OrderID    int64        `db:"order_id"`
+	ReceivedAt sql.NullTime `db:"received_at"`
+}
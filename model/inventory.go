@@ -6,13 +6,17 @@ import (
 
 type Inventory struct {
 	ProductID int64        `db:"product_id"`
-	UnitPrice int          `db:"unit_price"`
+	UnitPrice Money        `db:"unit_price"`
 	Amount    int          `db:"amount"`
 	CreatedAt sql.NullTime `db:"created_at"`
 	UpdatedAt sql.NullTime `db:"updated_at"`
 }
 
-type ProcessedOrder struct {
-	OrderID   int64        `db:"order_id"`
-	CreatedAt sql.NullTime `db:"created_at"`
+// Reservation is the stock taken for an order, ReleasedAt is set once it was put back.
+type Reservation struct {
+	OrderID    int64        `db:"order_id"`
+	ProductID  int64        `db:"product_id"`
+	Amount     int          `db:"amount"`
+	ReleasedAt sql.NullTime `db:"released_at"`
+	CreatedAt  sql.NullTime `db:"created_at"`
 }
@@ -0,0 +1,63 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+const DefaultCurrency = "USD"
+
+var ErrCurrencyMismatch = errors.New("currency mismatch")
+
+// Money is an amount in the minor units of an ISO 4217 currency, e.g. cents for USD.
+type Money struct {
+	Amount   int64  `db:"amount" json:"amount" proto:"1"`
+	Currency string `db:"currency" json:"currency" proto:"2"`
+}
+
+func NewMoney(amount int64, currency string) Money {
+	return Money{
+		Amount:   amount,
+		Currency: currency,
+	}
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	return NewMoney(m.Amount+other.Amount, m.Currency), nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	return m.Add(NewMoney(-other.Amount, other.Currency))
+}
+
+func (m Money) Mul(n int) Money {
+	return NewMoney(m.Amount*int64(n), m.Currency)
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) String() string {
+	return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+}
+
+// minorUnitExponents lists the currencies whose minor unit is not 1/100.
+var minorUnitExponents = map[string]int{
+	"BHD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"VND": 0,
+}
+
+// MinorUnitExponent returns the number of decimals of the currency minor unit.
+func MinorUnitExponent(currency string) int {
+	if exponent, ok := minorUnitExponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
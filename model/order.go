@@ -10,14 +10,38 @@ const (
 	OrderStatusFailedOutOfStock        = "OUT_OF_STOCK"
 	OrderStatusBilled                  = "BILLED"
 	OrderStatusFailedExceedCreditLimit = "EXCEED_CREDIT_LIMIT"
+	OrderStatusFailedPaymentDeclined   = "PAYMENT_DECLINED"
+	OrderStatusFailedPaymentTimeout    = "PAYMENT_TIMED_OUT"
+	OrderStatusShipped                 = "SHIPPED"
+	OrderStatusFailedShipping          = "SHIPPING_FAILED"
+	// OrderStatusTimedOut is set by the order service when a participant did not answer in time
+	OrderStatusTimedOut = "TIMED_OUT"
 )
 
 type Order struct {
-	ID         int64        `db:"id"`
-	CustomerID int64        `db:"customer_id"`
-	ProductID  int64        `db:"product_id"`
-	Amount     int          `db:"amount"`
-	Status     OrderStatus  `db:"status"`
-	CreatedAt  sql.NullTime `db:"created_at"`
-	UpdatedAt  sql.NullTime `db:"updated_at"`
+	ID            int64        `db:"id"`
+	CustomerID    int64        `db:"customer_id"`
+	ProductID     int64        `db:"product_id"`
+	Amount        int          `db:"amount"`
+	PromoCode     string       `db:"promo_code"`
+	Cost          Money        `db:"cost"`
+	Status        OrderStatus  `db:"status"`
+	FailureReason string       `db:"failure_reason"`
+	CreatedAt     sql.NullTime `db:"created_at"`
+	UpdatedAt     sql.NullTime `db:"updated_at"`
+}
+
+// IsTerminal reports whether the saga of an order in status s has ended.
+func (s OrderStatus) IsTerminal() bool {
+	switch s {
+	case OrderStatusFailedOutOfStock,
+		OrderStatusFailedExceedCreditLimit,
+		OrderStatusFailedPaymentDeclined,
+		OrderStatusFailedPaymentTimeout,
+		OrderStatusShipped,
+		OrderStatusFailedShipping,
+		OrderStatusTimedOut:
+		return true
+	}
+	return false
 }
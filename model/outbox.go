@@ -1,18 +1,65 @@
 package model
 
-import "database/sql"
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
 
 type OutboxStatus int
 
+// An outbox row is Pending until it is relayed. A row Kafka rejected stays Pending until
+// NextAttemptAt, and is Failed once the relay gives up on it.
 const (
 	OutboxPending   OutboxStatus = 1
 	OutboxCompleted OutboxStatus = 2
+	OutboxFailed    OutboxStatus = 3
 )
 
 type Outbox struct {
-	ID        int64        `db:"id"`
-	Content   []byte       `db:"content"`
-	Status    OutboxStatus `db:"status"`
-	CreatedAt sql.NullTime `db:"created_at"`
-	UpdatedAt sql.NullTime `db:"updated_at"`
+	ID            int64          `db:"id"`
+	Content       []byte         `db:"content"`
+	ContentType   string         `db:"content_type"`
+	Headers       Headers        `db:"headers"`
+	Status        OutboxStatus   `db:"status"`
+	Attempts      int            `db:"attempts"`
+	LastError     sql.NullString `db:"last_error"`
+	NextAttemptAt sql.NullTime   `db:"next_attempt_at"`
+	CreatedAt     sql.NullTime   `db:"created_at"`
+	UpdatedAt     sql.NullTime   `db:"updated_at"`
+}
+
+// Headers are relayed as Kafka headers along with the outbox content, they are stored as JSON.
+type Headers map[string]string
+
+func (h Headers) Value() (driver.Value, error) {
+	if len(h) == 0 {
+		return nil, nil
+	}
+	res, err := json.Marshal(map[string]string(h))
+	if err != nil {
+		return nil, err
+	}
+	return string(res), nil
+}
+
+func (h *Headers) Scan(src interface{}) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*h = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("model: cannot scan %T into Headers", src)
+	}
+	if len(raw) == 0 {
+		*h = nil
+		return nil
+	}
+	return json.Unmarshal(raw, (*map[string]string)(h))
 }
@@ -2,9 +2,51 @@ package model
 
 import "database/sql"
 
+// Account credit limit and daily spending cap are minor units of the balance currency.
 type Account struct {
+	CustomerID       int64        `db:"customer_id"`
+	Balance          Money        `db:"balance"`
+	CreditLimit      int64        `db:"credit_limit"`
+	DailySpendingCap int64        `db:"daily_spending_cap"`
+	CreatedAt        sql.NullTime `db:"created_at"`
+	UpdatedAt        sql.NullTime `db:"updated_at"`
+}
+
+type Charge struct {
+	OrderID    int64        `db:"order_id"`
 	CustomerID int64        `db:"customer_id"`
-	Balance    int          `db:"balance"`
+	Cost       Money        `db:"cost"`
+	RefundedAt sql.NullTime `db:"refunded_at"`
 	CreatedAt  sql.NullTime `db:"created_at"`
-	UpdatedAt  sql.NullTime `db:"updated_at"`
+}
+
+type AuthorizationStatus string
+
+// AuthorizationRequested is recorded before the gateway is asked, the gateway has not answered yet.
+// Capturing, Voiding and Refunding are recorded before the gateway is asked to capture, void or
+// refund, they become Captured, Voided and Refunded once it did.
+const (
+	AuthorizationRequested AuthorizationStatus = "REQUESTED"
+	AuthorizationPending   AuthorizationStatus = "PENDING"
+	AuthorizationCapturing AuthorizationStatus = "CAPTURING"
+	AuthorizationCaptured  AuthorizationStatus = "CAPTURED"
+	AuthorizationDeclined  AuthorizationStatus = "DECLINED"
+	AuthorizationVoiding   AuthorizationStatus = "VOIDING"
+	AuthorizationVoided    AuthorizationStatus = "VOIDED"
+	AuthorizationRefunding AuthorizationStatus = "REFUNDING"
+	AuthorizationRefunded  AuthorizationStatus = "REFUNDED"
+)
+
+// PaymentAuthorization tracks an order paid through a payment gateway.
+// Event is the prepared order event, kept to answer once the gateway calls back.
+type PaymentAuthorization struct {
+	AuthorizationID string              `db:"authorization_id"`
+	OrderID         int64               `db:"order_id"`
+	CustomerID      int64               `db:"customer_id"`
+	Cost            Money               `db:"cost"`
+	Status          AuthorizationStatus `db:"status"`
+	Event           []byte              `db:"event"`
+	ExpiresAt       sql.NullTime        `db:"expires_at"`
+	CreatedAt       sql.NullTime        `db:"created_at"`
+	UpdatedAt       sql.NullTime        `db:"updated_at"`
 }
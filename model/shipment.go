@@ -0,0 +1,22 @@
+package model
+
+import "database/sql"
+
+type ShipmentStatus string
+
+const (
+	ShipmentStatusShipped ShipmentStatus = "SHIPPED"
+	ShipmentStatusFailed  ShipmentStatus = "FAILED"
+)
+
+type Shipment struct {
+	OrderID        int64          `db:"order_id"`
+	CustomerID     int64          `db:"customer_id"`
+	ProductID      int64          `db:"product_id"`
+	Amount         int            `db:"amount"`
+	TrackingNumber string         `db:"tracking_number"`
+	Status         ShipmentStatus `db:"status"`
+	FailureReason  string         `db:"failure_reason"`
+	CreatedAt      sql.NullTime   `db:"created_at"`
+	UpdatedAt      sql.NullTime   `db:"updated_at"`
+}
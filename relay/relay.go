@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/tracing"
+	"log/slog"
+	"time"
+)
+
+// Repo is what relaying needs of the repo of a service.
+type Repo interface {
+	GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error)
+	GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error)
+	CountPendingOutbox(ctx context.Context) (int, error)
+	MarkDoneOutboxes(ctx context.Context, ids []int64) error
+	RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error
+}
+
+// Retry is how a row Kafka rejected is attempted again: after InitialBackoff, doubled at every
+// attempt up to MaxBackoff. The row is failed after MaxAttempts.
+type Retry struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetry = Retry{
+	MaxAttempts:    10,
+	InitialBackoff: time.Second,
+	MaxBackoff:     5 * time.Minute,
+}
+
+// Backoff is how long to wait after the attempt-th rejected attempt.
+func (r Retry) Backoff(attempt int) time.Duration {
+	res := r.InitialBackoff
+	for i := 1; i < attempt && res < r.MaxBackoff; i++ {
+		res *= 2
+	}
+	if res > r.MaxBackoff {
+		return r.MaxBackoff
+	}
+	return res
+}
+
+// Publisher pushes the outbox rows of table to Kafka.
+type Publisher struct {
+	table    string
+	repo     Repo
+	producer kafka.IProducer
+	retry    Retry
+	logger   *slog.Logger
+}
+
+func NewPublisher(table string, repo Repo, producer kafka.IProducer, retry Retry, logger *slog.Logger) *Publisher {
+	return &Publisher{
+		table:    table,
+		repo:     repo,
+		producer: producer,
+		retry:    retry,
+		logger:   logger.With(slog.String("table", table)),
+	}
+}
+
+// Relay publishes at most limit pending rows due for an attempt.
+func (p *Publisher) Relay(ctx context.Context, limit int) (err error) {
+	ctx, span := tracing.Start(ctx, p.table+" relay")
+	defer func() { tracing.End(span, err) }()
+
+	outboxes, err := p.repo.GetPendingOutbox(ctx, limit)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx, outboxes)
+}
+
+// Publish pushes outboxes and marks the rows Kafka took done. A rejected row stays pending until its
+// next attempt, so it no longer holds back the rows after it, and is failed after the last one. When
+// the rejection aborted the transaction of the push, the other rows are pushed again right away. An
+// error of the whole push, like Kafka being unreachable, leaves the rows as they were.
+func (p *Publisher) Publish(ctx context.Context, outboxes []model.Outbox) error {
+	messages, endPublish := tracing.StartRelay(ctx, p.table, outboxes)
+	err := p.producer.Push(messages)
+	endPublish(err)
+	var pushErr *kafka.PushError
+	if err != nil && (!errors.As(err, &pushErr) || len(pushErr.Rejected) == 0) {
+		return err
+	}
+
+	var done, aborted []model.Outbox
+	now := time.Now()
+	for i, outbox := range outboxes {
+		if pushErr == nil {
+			done = append(done, outbox)
+			continue
+		}
+		rejectErr, rejected := pushErr.Rejected[i]
+		if !rejected {
+			if pushErr.Aborted {
+				aborted = append(aborted, outbox)
+			} else {
+				done = append(done, outbox)
+			}
+			continue
+		}
+		err = p.reject(ctx, outbox, rejectErr, now)
+		if err != nil {
+			return err
+		}
+	}
+	// the aborted rows were never attempted, the binlog relay only picks up rows attempted before,
+	// so they are not left behind. Every push rejects one row at least, so this ends.
+	if len(aborted) > 0 {
+		return p.Publish(ctx, aborted)
+	}
+
+	err = p.repo.MarkDoneOutboxes(ctx, extractIDs(done))
+	if err != nil {
+		return err
+	}
+
+	pending, err := p.repo.CountPendingOutbox(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.ObserveRelay(p.table, done, pending)
+	return nil
+}
+
+// reject records the rejected attempt of outbox, the row is failed when it was the last one.
+func (p *Publisher) reject(ctx context.Context, outbox model.Outbox, rejectErr error, now time.Time) error {
+	outbox.Attempts++
+	outbox.LastError = sql.NullString{String: rejectErr.Error(), Valid: true}
+	logger := p.logger.With(
+		slog.Int64("outbox_id", outbox.ID),
+		slog.Int("attempts", outbox.Attempts),
+		slog.Any("error", rejectErr),
+	)
+	if outbox.Attempts >= p.retry.MaxAttempts {
+		outbox.Status = model.OutboxFailed
+		outbox.NextAttemptAt = sql.NullTime{}
+		logger.Error("Gave up relaying an outbox row")
+		metrics.OutboxFailed.WithLabelValues(p.table).Inc()
+	} else {
+		outbox.NextAttemptAt = sql.NullTime{Time: now.Add(p.retry.Backoff(outbox.Attempts)), Valid: true}
+		logger.Warn("Kafka rejected an outbox row", slog.Time("next_attempt_at", outbox.NextAttemptAt.Time))
+	}
+	metrics.OutboxRejected.WithLabelValues(p.table).Inc()
+	return p.repo.RecordOutboxAttempt(ctx, outbox)
+}
+
+func extractIDs(outboxes []model.Outbox) []int64 {
+	var res []int64
+	for _, outbox := range outboxes {
+		res = append(res, outbox.ID)
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package retention
+
+import (
+	"context"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"time"
+)
+
+// Repo is what pruning needs of the repo of a service.
+type Repo interface {
+	DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error)
+	DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+// Result counts the rows a prune deleted.
+type Result struct {
+	Outboxes      int
+	InboxMessages int
+}
+
+// Prune deletes the outbox rows completed and the inbox messages received before now minus their
+// retention in conf. A zero retention skips its table.
+func Prune(ctx context.Context, repo Repo, conf config.RetentionConfig, now time.Time) (Result, error) {
+	var res Result
+	var err error
+	if conf.Outbox > 0 {
+		res.Outboxes, err = deleteBatches(ctx, now.Add(-conf.Outbox), conf.BatchSize, repo.DeleteCompletedOutboxes)
+		if err != nil {
+			return res, err
+		}
+	}
+	if conf.Inbox > 0 {
+		res.InboxMessages, err = deleteBatches(ctx, now.Add(-conf.Inbox), conf.BatchSize, repo.DeleteInboxMessages)
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// deleteBatches deletes batchSize rows per statement until a batch comes back short, so no
+// statement locks more than a batch of the table.
+func deleteBatches(
+	ctx context.Context,
+	before time.Time,
+	batchSize int,
+	deleteBatch func(ctx context.Context, before time.Time, limit int) (int, error),
+) (int, error) {
+	var res int
+	for {
+		deleted, err := deleteBatch(ctx, before, batchSize)
+		res += deleted
+		if err != nil || deleted < batchSize {
+			return res, err
+		}
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package saga_event
+
+import "fmt"
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Codec writes events for one content type, the content type travels with the outbox row and the
+// Kafka message so consumers know how to read them.
+type Codec interface {
+	ContentType() string
+	Marshal(event Event) ([]byte, error)
+	Unmarshal(data []byte) (Event, error)
+	UnmarshalMessage(data []byte) (Message, error)
+}
+
+var (
+	JSON     = NewJSONCodec(DefaultRegistry)
+	Protobuf = NewProtobufCodec(DefaultRegistry)
+)
+
+type jsonCodec struct {
+	registry *Registry
+}
+
+func NewJSONCodec(registry *Registry) Codec {
+	return jsonCodec{registry: registry}
+}
+
+func (c jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (c jsonCodec) Marshal(event Event) ([]byte, error) {
+	return c.registry.Marshal(event)
+}
+
+func (c jsonCodec) Unmarshal(data []byte) (Event, error) {
+	return c.registry.Unmarshal(data)
+}
+
+func (c jsonCodec) UnmarshalMessage(data []byte) (Message, error) {
+	return c.registry.UnmarshalMessage(data)
+}
+
+type protobufCodec struct {
+	registry *Registry
+}
+
+func NewProtobufCodec(registry *Registry) Codec {
+	return protobufCodec{registry: registry}
+}
+
+func (c protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (c protobufCodec) Marshal(event Event) ([]byte, error) {
+	return c.registry.MarshalProtobuf(event)
+}
+
+func (c protobufCodec) Unmarshal(data []byte) (Event, error) {
+	return c.registry.UnmarshalProtobuf(data)
+}
+
+func (c protobufCodec) UnmarshalMessage(data []byte) (Message, error) {
+	return c.registry.UnmarshalProtobufMessage(data)
+}
+
+// CodecFor returns the codec of DefaultRegistry for contentType, messages published before content
+// types have none and are JSON.
+func CodecFor(contentType string) (Codec, error) {
+	switch contentType {
+	case "", ContentTypeJSON:
+		return JSON, nil
+	case ContentTypeProtobuf:
+		return Protobuf, nil
+	default:
+		return nil, fmt.Errorf("saga_event: unknown content type %q", contentType)
+	}
+}
+
+// DecodeContent decodes data of contentType with DefaultRegistry into the view of the handlers.
+func DecodeContent(contentType string, data []byte) (OrderEvent, error) {
+	message, err := DecodeMessage(contentType, data)
+	if err != nil {
+		return OrderEvent{}, err
+	}
+	return message.Event.OrderEvent(), nil
+}
+
+// DecodeMessage decodes data of contentType with DefaultRegistry, keeping the ID of its envelope.
+func DecodeMessage(contentType string, data []byte) (Message, error) {
+	codec, err := CodecFor(contentType)
+	if err != nil {
+		return Message{}, err
+	}
+	return codec.UnmarshalMessage(data)
+}
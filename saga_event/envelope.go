@@ -0,0 +1,45 @@
+package saga_event
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Envelope is what is written to the outboxes and Kafka, Payload is the event of Type at Version.
+type Envelope struct {
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	ID         string          `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// DefaultRegistry holds every event type of the saga at its current version.
+var DefaultRegistry = NewRegistry()
+
+func init() {
+	DefaultRegistry.Register(1, func() Event { return &OrderCreated{} })
+	DefaultRegistry.Register(1, func() Event { return &OrderTimedOut{} })
+	DefaultRegistry.Register(1, func() Event { return &OrderConfirmed{} })
+	DefaultRegistry.Register(1, func() Event { return &InventoryReserved{} })
+	DefaultRegistry.Register(1, func() Event { return &InventoryRejected{} })
+	DefaultRegistry.Register(1, func() Event { return &PaymentCharged{} })
+	DefaultRegistry.Register(1, func() Event { return &PaymentRejected{} })
+	DefaultRegistry.Register(1, func() Event { return &ShipmentDispatched{} })
+	DefaultRegistry.Register(1, func() Event { return &ShipmentFailed{} })
+}
+
+// Marshal wraps event in an envelope with DefaultRegistry.
+func Marshal(event Event) ([]byte, error) {
+	return DefaultRegistry.Marshal(event)
+}
+
+// Unmarshal decodes an envelope with DefaultRegistry.
+func Unmarshal(data []byte) (Event, error) {
+	return DefaultRegistry.Unmarshal(data)
+}
+
+// Decode decodes a JSON envelope with DefaultRegistry into the view of the handlers.
+func Decode(data []byte) (OrderEvent, error) {
+	return DecodeContent(ContentTypeJSON, data)
+}
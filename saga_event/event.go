@@ -7,6 +7,8 @@ type OrderEvent struct {
 	CustomerID int64             `json:"customer_id"`
 	ProductID  int64             `json:"product_id"`
 	Amount     int               `json:"amount"`
-	Cost       int               `json:"cost"`
+	PromoCode  string            `json:"promo_code,omitempty"`
+	Cost       model.Money       `json:"cost"`
 	Status     model.OrderStatus `json:"status"`
+	Reason     string            `json:"reason,omitempty"`
 }
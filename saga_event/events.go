@@ -0,0 +1,232 @@
+package saga_event
+
+import "github.com/rafata1/sagas-pattern-thesis/model"
+
+const (
+	TypeOrderCreated       = "OrderCreated"
+	TypeOrderTimedOut      = "OrderTimedOut"
+	TypeOrderConfirmed     = "OrderConfirmed"
+	TypeInventoryReserved  = "InventoryReserved"
+	TypeInventoryRejected  = "InventoryRejected"
+	TypePaymentCharged     = "PaymentCharged"
+	TypePaymentRejected    = "PaymentRejected"
+	TypeShipmentDispatched = "ShipmentDispatched"
+	TypeShipmentFailed     = "ShipmentFailed"
+)
+
+// Event is a saga event with its own type, OrderEvent gives the status based view the handlers use.
+type Event interface {
+	EventType() string
+	OrderEvent() OrderEvent
+}
+
+// OrderCreated is published by the order service for inventory to reserve the stock.
+type OrderCreated struct {
+	OrderID    int64  `json:"order_id" proto:"1"`
+	CustomerID int64  `json:"customer_id" proto:"2"`
+	ProductID  int64  `json:"product_id" proto:"3"`
+	Amount     int    `json:"amount" proto:"4"`
+	PromoCode  string `json:"promo_code,omitempty" proto:"5"`
+}
+
+func (e OrderCreated) EventType() string { return TypeOrderCreated }
+
+func (e OrderCreated) OrderEvent() OrderEvent {
+	return OrderEvent{
+		OrderID:    e.OrderID,
+		CustomerID: e.CustomerID,
+		ProductID:  e.ProductID,
+		Amount:     e.Amount,
+		PromoCode:  e.PromoCode,
+		Status:     model.OrderStatusPending,
+	}
+}
+
+// OrderTimedOut is published by the order service when a participant did not answer in time,
+// every participant compensates what it did for the order.
+type OrderTimedOut struct {
+	OrderID    int64       `json:"order_id" proto:"1"`
+	CustomerID int64       `json:"customer_id" proto:"2"`
+	ProductID  int64       `json:"product_id" proto:"3"`
+	Amount     int         `json:"amount" proto:"4"`
+	Cost       model.Money `json:"cost" proto:"6"`
+	Reason     string      `json:"reason" proto:"8"`
+}
+
+func (e OrderTimedOut) EventType() string { return TypeOrderTimedOut }
+
+func (e OrderTimedOut) OrderEvent() OrderEvent {
+	return OrderEvent{
+		OrderID:    e.OrderID,
+		CustomerID: e.CustomerID,
+		ProductID:  e.ProductID,
+		Amount:     e.Amount,
+		Cost:       e.Cost,
+		Status:     model.OrderStatusTimedOut,
+		Reason:     e.Reason,
+	}
+}
+
+// OrderConfirmed is published by the order service once it took the bill of the order, which can
+// no longer time out then, for shipping to dispatch it. A bill coming after the timeout is not
+// confirmed, so shipping never dispatches an order that was compensated.
+type OrderConfirmed struct {
+	OrderID    int64       `json:"order_id" proto:"1"`
+	CustomerID int64       `json:"customer_id" proto:"2"`
+	ProductID  int64       `json:"product_id" proto:"3"`
+	Amount     int         `json:"amount" proto:"4"`
+	Cost       model.Money `json:"cost" proto:"6"`
+}
+
+func (e OrderConfirmed) EventType() string { return TypeOrderConfirmed }
+
+func (e OrderConfirmed) OrderEvent() OrderEvent {
+	return OrderEvent{
+		OrderID:    e.OrderID,
+		CustomerID: e.CustomerID,
+		ProductID:  e.ProductID,
+		Amount:     e.Amount,
+		Cost:       e.Cost,
+		Status:     model.OrderStatusBilled,
+	}
+}
+
+// InventoryReserved is published by inventory once the stock of the order is reserved and priced.
+type InventoryReserved struct {
+	OrderID    int64       `json:"order_id" proto:"1"`
+	CustomerID int64       `json:"customer_id" proto:"2"`
+	ProductID  int64       `json:"product_id" proto:"3"`
+	Amount     int         `json:"amount" proto:"4"`
+	PromoCode  string      `json:"promo_code,omitempty" proto:"5"`
+	Cost       model.Money `json:"cost" proto:"6"`
+}
+
+func (e InventoryReserved) EventType() string { return TypeInventoryReserved }
+
+func (e InventoryReserved) OrderEvent() OrderEvent {
+	return OrderEvent{
+		OrderID:    e.OrderID,
+		CustomerID: e.CustomerID,
+		ProductID:  e.ProductID,
+		Amount:     e.Amount,
+		PromoCode:  e.PromoCode,
+		Cost:       e.Cost,
+		Status:     model.OrderStatusPrepared,
+	}
+}
+
+// InventoryRejected is published by inventory when the product is out of stock.
+type InventoryRejected struct {
+	OrderID    int64 `json:"order_id" proto:"1"`
+	CustomerID int64 `json:"customer_id" proto:"2"`
+	ProductID  int64 `json:"product_id" proto:"3"`
+	Amount     int   `json:"amount" proto:"4"`
+}
+
+func (e InventoryRejected) EventType() string { return TypeInventoryRejected }
+
+func (e InventoryRejected) OrderEvent() OrderEvent {
+	return OrderEvent{
+		OrderID:    e.OrderID,
+		CustomerID: e.CustomerID,
+		ProductID:  e.ProductID,
+		Amount:     e.Amount,
+		Status:     model.OrderStatusFailedOutOfStock,
+	}
+}
+
+// PaymentCharged is published by payment once the order is paid, it carries the order lines so
+// shipping can dispatch them.
+type PaymentCharged struct {
+	OrderID    int64       `json:"order_id" proto:"1"`
+	CustomerID int64       `json:"customer_id" proto:"2"`
+	ProductID  int64       `json:"product_id" proto:"3"`
+	Amount     int         `json:"amount" proto:"4"`
+	Cost       model.Money `json:"cost" proto:"6"`
+}
+
+func (e PaymentCharged) EventType() string { return TypePaymentCharged }
+
+func (e PaymentCharged) OrderEvent() OrderEvent {
+	return OrderEvent{
+		OrderID:    e.OrderID,
+		CustomerID: e.CustomerID,
+		ProductID:  e.ProductID,
+		Amount:     e.Amount,
+		Cost:       e.Cost,
+		Status:     model.OrderStatusBilled,
+	}
+}
+
+// PaymentRejected is published by payment when the order cannot be paid, Status tells why:
+// EXCEED_CREDIT_LIMIT, PAYMENT_DECLINED or PAYMENT_TIMED_OUT.
+type PaymentRejected struct {
+	OrderID    int64             `json:"order_id" proto:"1"`
+	CustomerID int64             `json:"customer_id" proto:"2"`
+	ProductID  int64             `json:"product_id" proto:"3"`
+	Amount     int               `json:"amount" proto:"4"`
+	Cost       model.Money       `json:"cost" proto:"6"`
+	Status     model.OrderStatus `json:"status" proto:"7"`
+	Reason     string            `json:"reason" proto:"8"`
+}
+
+func (e PaymentRejected) EventType() string { return TypePaymentRejected }
+
+func (e PaymentRejected) OrderEvent() OrderEvent {
+	return OrderEvent{
+		OrderID:    e.OrderID,
+		CustomerID: e.CustomerID,
+		ProductID:  e.ProductID,
+		Amount:     e.Amount,
+		Cost:       e.Cost,
+		Status:     e.Status,
+		Reason:     e.Reason,
+	}
+}
+
+// ShipmentDispatched is published by shipping once the carrier took the order.
+type ShipmentDispatched struct {
+	OrderID    int64       `json:"order_id" proto:"1"`
+	CustomerID int64       `json:"customer_id" proto:"2"`
+	ProductID  int64       `json:"product_id" proto:"3"`
+	Amount     int         `json:"amount" proto:"4"`
+	Cost       model.Money `json:"cost" proto:"6"`
+}
+
+func (e ShipmentDispatched) EventType() string { return TypeShipmentDispatched }
+
+func (e ShipmentDispatched) OrderEvent() OrderEvent {
+	return OrderEvent{
+		OrderID:    e.OrderID,
+		CustomerID: e.CustomerID,
+		ProductID:  e.ProductID,
+		Amount:     e.Amount,
+		Cost:       e.Cost,
+		Status:     model.OrderStatusShipped,
+	}
+}
+
+// ShipmentFailed is published by shipping when the carrier rejected the order, payment refunds
+// the cost and inventory restores the stock.
+type ShipmentFailed struct {
+	OrderID    int64       `json:"order_id" proto:"1"`
+	CustomerID int64       `json:"customer_id" proto:"2"`
+	ProductID  int64       `json:"product_id" proto:"3"`
+	Amount     int         `json:"amount" proto:"4"`
+	Cost       model.Money `json:"cost" proto:"6"`
+	Reason     string      `json:"reason" proto:"8"`
+}
+
+func (e ShipmentFailed) EventType() string { return TypeShipmentFailed }
+
+func (e ShipmentFailed) OrderEvent() OrderEvent {
+	return OrderEvent{
+		OrderID:    e.OrderID,
+		CustomerID: e.CustomerID,
+		ProductID:  e.ProductID,
+		Amount:     e.Amount,
+		Cost:       e.Cost,
+		Status:     model.OrderStatusFailedShipping,
+		Reason:     e.Reason,
+	}
+}
@@ -0,0 +1,43 @@
+package saga_event
+
+import (
+	"context"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"time"
+)
+
+// Message is an event with what its envelope says about it. Bare OrderEvents, published before the
+// envelope, have no ID.
+type Message struct {
+	ID         string
+	OccurredAt time.Time
+	Event      Event
+}
+
+type messageIDKey struct{}
+
+// WithMessageID returns ctx for handling the message id, see InboxMessage.
+func WithMessageID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, messageIDKey{}, id)
+}
+
+// MessageID returns the id of the message ctx handles, "" when it has none.
+func MessageID(ctx context.Context) string {
+	id, _ := ctx.Value(messageIDKey{}).(string)
+	return id
+}
+
+// InboxMessage returns the inbox row of event, received in the message of ctx. Messages without an
+// ID are told apart by their order, as processed_orders did, so each is received once per type.
+func InboxMessage(ctx context.Context, event OrderEvent) (model.InboxMessage, error) {
+	typed, err := FromOrderEvent(event)
+	if err != nil {
+		return model.InboxMessage{}, err
+	}
+	id := MessageID(ctx)
+	if id == "" {
+		id = fmt.Sprintf("order:%d", event.OrderID)
+	}
+	return model.InboxMessage{MessageID: id, EventType: typed.EventType(), OrderID: event.OrderID}, nil
+}
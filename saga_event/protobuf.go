@@ -0,0 +1,188 @@
+package saga_event
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// protoEnvelope is Envelope as written by the protobuf codec, see events.proto.
+type protoEnvelope struct {
+	Type       string         `proto:"1"`
+	Version    int            `proto:"2"`
+	ID         string         `proto:"3"`
+	OccurredAt protoTimestamp `proto:"4"`
+	Payload    []byte         `proto:"5"`
+}
+
+// protoTimestamp is google.protobuf.Timestamp.
+type protoTimestamp struct {
+	Seconds int64 `proto:"1"`
+	Nanos   int   `proto:"2"`
+}
+
+func newProtoTimestamp(t time.Time) protoTimestamp {
+	return protoTimestamp{Seconds: t.Unix(), Nanos: t.Nanosecond()}
+}
+
+func (t protoTimestamp) Time() time.Time {
+	return time.Unix(t.Seconds, int64(t.Nanos)).UTC()
+}
+
+// marshalProto writes the fields of the struct v with a proto tag, the tag is the field number.
+// Like proto3, zero values are left out.
+func marshalProto(v interface{}) ([]byte, error) {
+	return appendProto(nil, reflect.ValueOf(v))
+}
+
+func appendProto(b []byte, value reflect.Value) ([]byte, error) {
+	if value.Kind() == reflect.Pointer {
+		value = value.Elem()
+	}
+	for i := 0; i < value.NumField(); i++ {
+		num, ok, err := protoNumber(value.Type().Field(i))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		field := value.Field(i)
+		if field.IsZero() {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(field.Int()))
+		case reflect.Bool:
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, protowire.EncodeBool(field.Bool()))
+		case reflect.String:
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, field.String())
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.Uint8 {
+				return nil, fmt.Errorf("saga_event: protobuf cannot encode %s", field.Type())
+			}
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendBytes(b, field.Bytes())
+		case reflect.Struct:
+			nested, err := appendProto(nil, field)
+			if err != nil {
+				return nil, err
+			}
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendBytes(b, nested)
+		default:
+			return nil, fmt.Errorf("saga_event: protobuf cannot encode %s", field.Type())
+		}
+	}
+	return b, nil
+}
+
+// unmarshalProto reads b into the struct v points to, fields it has no proto tag for are skipped
+// so older readers accept what newer writers added.
+func unmarshalProto(b []byte, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("saga_event: protobuf cannot decode into %T", v)
+	}
+	return consumeProto(b, value.Elem())
+}
+
+func consumeProto(b []byte, value reflect.Value) error {
+	fields := map[protowire.Number]int{}
+	for i := 0; i < value.NumField(); i++ {
+		num, ok, err := protoNumber(value.Type().Field(i))
+		if err != nil {
+			return err
+		}
+		if ok {
+			fields[num] = i
+		}
+	}
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		i, ok := fields[num]
+		if !ok {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		field := value.Field(i)
+		n, err := consumeProtoField(b, typ, field)
+		if err != nil {
+			return fmt.Errorf("saga_event: protobuf field %s: %w", value.Type().Field(i).Name, err)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeProtoField(b []byte, typ protowire.Type, field reflect.Value) (int, error) {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Bool:
+		if typ != protowire.VarintType {
+			return 0, fmt.Errorf("wire type %d is not varint", typ)
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		if field.Kind() == reflect.Bool {
+			field.SetBool(protowire.DecodeBool(v))
+		} else {
+			field.SetInt(int64(v))
+		}
+		return n, nil
+	}
+
+	if typ != protowire.BytesType {
+		return 0, fmt.Errorf("wire type %d is not length delimited", typ)
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(string(v))
+	case reflect.Slice:
+		field.SetBytes(append([]byte(nil), v...))
+	case reflect.Struct:
+		err := consumeProto(v, field)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("cannot decode into %s", field.Type())
+	}
+	return n, nil
+}
+
+// protoNumber returns the field number of the proto tag of field, false when it has none.
+func protoNumber(field reflect.StructField) (protowire.Number, bool, error) {
+	tag, ok := field.Tag.Lookup("proto")
+	if !ok {
+		return 0, false, nil
+	}
+	num, err := strconv.Atoi(tag)
+	if err != nil || !protowire.Number(num).IsValid() {
+		return 0, false, fmt.Errorf("saga_event: invalid proto tag %q on %s", tag, field.Name)
+	}
+	return protowire.Number(num), true, nil
+}
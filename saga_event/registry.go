@@ -0,0 +1,382 @@
+package saga_event
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Upcaster rewrites the payload of an event version into the payload of the next version.
+type Upcaster func(payload json.RawMessage) (json.RawMessage, error)
+
+type eventType struct {
+	version   int
+	newEvent  func() Event
+	upcasters map[int]Upcaster
+	// previous keeps the newEvent of the versions replaced by Register
+	previous map[int]func() Event
+}
+
+// Registry knows the current version of every event type, and how to bring older versions to it.
+type Registry struct {
+	types map[string]*eventType
+}
+
+func NewRegistry() *Registry {
+	return &Registry{types: map[string]*eventType{}}
+}
+
+// Register makes version the current version of the type of the events newEvent returns,
+// newEvent must return a pointer the payload can be decoded into. The version it replaces is kept
+// to read protobuf payloads of that version before they are upcast.
+func (r *Registry) Register(version int, newEvent func() Event) {
+	name := newEvent().EventType()
+	t, ok := r.types[name]
+	if !ok {
+		t = &eventType{upcasters: map[int]Upcaster{}}
+		r.types[name] = t
+	}
+	if t.newEvent != nil && t.version < version {
+		if t.previous == nil {
+			t.previous = map[int]func() Event{}
+		}
+		t.previous[t.version] = t.newEvent
+	}
+	t.version = version
+	t.newEvent = newEvent
+}
+
+// RegisterUpcaster registers how payloads of version from of the type name become version from+1.
+func (r *Registry) RegisterUpcaster(name string, from int, upcast Upcaster) {
+	t, ok := r.types[name]
+	if !ok {
+		t = &eventType{upcasters: map[int]Upcaster{}}
+		r.types[name] = t
+	}
+	t.upcasters[from] = upcast
+}
+
+// Types lists the registered event types by name.
+func (r *Registry) Types() []string {
+	var res []string
+	for name, t := range r.types {
+		if t.newEvent != nil {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Version returns the current version of the type name.
+func (r *Registry) Version(name string) (int, bool) {
+	t, ok := r.types[name]
+	if !ok || t.newEvent == nil {
+		return 0, false
+	}
+	return t.version, true
+}
+
+// New returns a zero event of the current version of the type name.
+func (r *Registry) New(name string) (Event, bool) {
+	t, ok := r.types[name]
+	if !ok || t.newEvent == nil {
+		return nil, false
+	}
+	return dereference(t.newEvent()), true
+}
+
+// HasUpcaster tells if payloads of version from of the type name can be brought to version from+1.
+func (r *Registry) HasUpcaster(name string, from int) bool {
+	t, ok := r.types[name]
+	if !ok {
+		return false
+	}
+	_, ok = t.upcasters[from]
+	return ok
+}
+
+// Marshal wraps event in an envelope of the current version of its type.
+func (r *Registry) Marshal(event Event) ([]byte, error) {
+	t, err := r.current(event)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{
+		Type:       event.EventType(),
+		Version:    t.version,
+		ID:         uuid.NewString(),
+		OccurredAt: time.Now().UTC(),
+		Payload:    payload,
+	})
+}
+
+// Unmarshal decodes an envelope, upcasting its payload to the current version of its type.
+// A bare OrderEvent, what was published before the envelope, is read as version 1 of the type its
+// status stands for.
+func (r *Registry) Unmarshal(data []byte) (Event, error) {
+	message, err := r.UnmarshalMessage(data)
+	return message.Event, err
+}
+
+// UnmarshalMessage is Unmarshal keeping the ID and the time of the envelope, a bare OrderEvent has
+// neither.
+func (r *Registry) UnmarshalMessage(data []byte) (Message, error) {
+	var envelope Envelope
+	err := json.Unmarshal(data, &envelope)
+	if err != nil {
+		return Message{}, err
+	}
+	if envelope.Type == "" {
+		event, err := r.unmarshalLegacy(data)
+		return Message{Event: event}, err
+	}
+
+	t, ok := r.types[envelope.Type]
+	if !ok || t.newEvent == nil {
+		return Message{}, fmt.Errorf("saga_event: unknown event type %q", envelope.Type)
+	}
+	if envelope.Version > t.version {
+		return Message{}, fmt.Errorf("saga_event: %s version %d is newer than %d", envelope.Type, envelope.Version, t.version)
+	}
+
+	payload, err := t.upcast(envelope.Type, envelope.Version, envelope.Payload)
+	if err != nil {
+		return Message{}, err
+	}
+
+	event := t.newEvent()
+	err = json.Unmarshal(payload, event)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{ID: envelope.ID, OccurredAt: envelope.OccurredAt, Event: dereference(event)}, nil
+}
+
+// MarshalProtobuf is Marshal with the envelope and the payload written as protobuf, see events.proto.
+func (r *Registry) MarshalProtobuf(event Event) ([]byte, error) {
+	t, err := r.current(event)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := marshalProto(event)
+	if err != nil {
+		return nil, err
+	}
+	return marshalProto(protoEnvelope{
+		Type:       event.EventType(),
+		Version:    t.version,
+		ID:         uuid.NewString(),
+		OccurredAt: newProtoTimestamp(time.Now()),
+		Payload:    payload,
+	})
+}
+
+// UnmarshalProtobuf decodes a protobuf envelope. An older version is read into the struct it was
+// registered with and upcast as JSON, like a JSON payload. Protobuf payloads are read by field
+// number, so an older version without a registered struct or upcaster decodes into the current type
+// as is.
+func (r *Registry) UnmarshalProtobuf(data []byte) (Event, error) {
+	message, err := r.UnmarshalProtobufMessage(data)
+	return message.Event, err
+}
+
+// UnmarshalProtobufMessage is UnmarshalProtobuf keeping the ID and the time of the envelope.
+func (r *Registry) UnmarshalProtobufMessage(data []byte) (Message, error) {
+	var envelope protoEnvelope
+	err := unmarshalProto(data, &envelope)
+	if err != nil {
+		return Message{}, err
+	}
+	if envelope.Type == "" {
+		return Message{}, errors.New("saga_event: protobuf envelope has no type")
+	}
+
+	t, ok := r.types[envelope.Type]
+	if !ok || t.newEvent == nil {
+		return Message{}, fmt.Errorf("saga_event: unknown event type %q", envelope.Type)
+	}
+	if envelope.Version > t.version {
+		return Message{}, fmt.Errorf("saga_event: %s version %d is newer than %d", envelope.Type, envelope.Version, t.version)
+	}
+
+	event := t.newEvent()
+	if envelope.Version < t.version {
+		err = t.upcastProtobuf(envelope.Type, envelope.Version, envelope.Payload, event)
+	} else {
+		err = unmarshalProto(envelope.Payload, event)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{ID: envelope.ID, OccurredAt: envelope.OccurredAt.Time(), Event: dereference(event)}, nil
+}
+
+// upcast brings the JSON payload of version to the current version.
+func (t *eventType) upcast(name string, version int, payload json.RawMessage) (json.RawMessage, error) {
+	var err error
+	for ; version < t.version; version++ {
+		upcast, ok := t.upcasters[version]
+		if !ok {
+			return nil, fmt.Errorf("saga_event: no upcaster for %s version %d", name, version)
+		}
+		payload, err = upcast(payload)
+		if err != nil {
+			return nil, fmt.Errorf("saga_event: upcast %s version %d: %w", name, version, err)
+		}
+	}
+	return payload, nil
+}
+
+// upcastProtobuf reads the protobuf payload of the older version into event. The payload is
+// decoded into the struct of its version, then upcast as JSON.
+func (t *eventType) upcastProtobuf(name string, version int, payload []byte, event Event) error {
+	newEvent, ok := t.previous[version]
+	if !ok {
+		if _, ok := t.upcasters[version]; ok {
+			return fmt.Errorf("saga_event: no struct registered to upcast %s version %d", name, version)
+		}
+		return unmarshalProto(payload, event)
+	}
+
+	older := newEvent()
+	err := unmarshalProto(payload, older)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(older)
+	if err != nil {
+		return err
+	}
+	content, err = t.upcast(name, version, content)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, event)
+}
+
+func (r *Registry) current(event Event) (*eventType, error) {
+	t, ok := r.types[event.EventType()]
+	if !ok || t.newEvent == nil {
+		return nil, fmt.Errorf("saga_event: unknown event type %q", event.EventType())
+	}
+	return t, nil
+}
+
+func (r *Registry) unmarshalLegacy(data []byte) (Event, error) {
+	var legacy OrderEvent
+	err := json.Unmarshal(data, &legacy)
+	if err != nil {
+		return nil, err
+	}
+	event, err := FromOrderEvent(legacy)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	// FromOrderEvent builds version 1 payloads, the upcasters take it from there
+	envelope, err := json.Marshal(Envelope{Type: event.EventType(), Version: 1, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	return r.Unmarshal(envelope)
+}
+
+// dereference returns the value newEvent points to, so decoded events compare like built ones.
+func dereference(event Event) Event {
+	value := reflect.ValueOf(event)
+	if value.Kind() != reflect.Pointer {
+		return event
+	}
+	return value.Elem().Interface().(Event)
+}
+
+// FromOrderEvent returns the typed event the status of event stands for.
+func FromOrderEvent(event OrderEvent) (Event, error) {
+	switch event.Status {
+	case "", model.OrderStatusPending:
+		return OrderCreated{
+			OrderID:    event.OrderID,
+			CustomerID: event.CustomerID,
+			ProductID:  event.ProductID,
+			Amount:     event.Amount,
+			PromoCode:  event.PromoCode,
+		}, nil
+	case model.OrderStatusTimedOut:
+		return OrderTimedOut{
+			OrderID:    event.OrderID,
+			CustomerID: event.CustomerID,
+			ProductID:  event.ProductID,
+			Amount:     event.Amount,
+			Cost:       event.Cost,
+			Reason:     event.Reason,
+		}, nil
+	case model.OrderStatusPrepared:
+		return InventoryReserved{
+			OrderID:    event.OrderID,
+			CustomerID: event.CustomerID,
+			ProductID:  event.ProductID,
+			Amount:     event.Amount,
+			PromoCode:  event.PromoCode,
+			Cost:       event.Cost,
+		}, nil
+	case model.OrderStatusFailedOutOfStock:
+		return InventoryRejected{
+			OrderID:    event.OrderID,
+			CustomerID: event.CustomerID,
+			ProductID:  event.ProductID,
+			Amount:     event.Amount,
+		}, nil
+	case model.OrderStatusBilled:
+		return PaymentCharged{
+			OrderID:    event.OrderID,
+			CustomerID: event.CustomerID,
+			ProductID:  event.ProductID,
+			Amount:     event.Amount,
+			Cost:       event.Cost,
+		}, nil
+	case model.OrderStatusFailedExceedCreditLimit,
+		model.OrderStatusFailedPaymentDeclined,
+		model.OrderStatusFailedPaymentTimeout:
+		return PaymentRejected{
+			OrderID:    event.OrderID,
+			CustomerID: event.CustomerID,
+			ProductID:  event.ProductID,
+			Amount:     event.Amount,
+			Cost:       event.Cost,
+			Status:     event.Status,
+			Reason:     event.Reason,
+		}, nil
+	case model.OrderStatusShipped:
+		return ShipmentDispatched{
+			OrderID:    event.OrderID,
+			CustomerID: event.CustomerID,
+			ProductID:  event.ProductID,
+			Amount:     event.Amount,
+			Cost:       event.Cost,
+		}, nil
+	case model.OrderStatusFailedShipping:
+		return ShipmentFailed{
+			OrderID:    event.OrderID,
+			CustomerID: event.CustomerID,
+			ProductID:  event.ProductID,
+			Amount:     event.Amount,
+			Cost:       event.Cost,
+			Reason:     event.Reason,
+		}, nil
+	default:
+		return nil, fmt.Errorf("saga_event: no event type for status %q", event.Status)
+	}
+}
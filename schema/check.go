@@ -0,0 +1,56 @@
+package schema
+
+import (
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+)
+
+// Current returns the schema of the current version of the event type name, generated from its struct.
+func Current(events *saga_event.Registry, name string) (*Schema, error) {
+	version, ok := events.Version(name)
+	if !ok {
+		return nil, fmt.Errorf("schema: unknown event type %q", name)
+	}
+	event, _ := events.New(name)
+	return Generate(name, version, event)
+}
+
+// Check compares the struct of every event type of events with the registry:
+//   - the schema of its current version must be registered, and the struct must stay compatible
+//     with it both ways, services on the same version read each other whichever deploys first
+//   - readers of the current version must read the previous version, unless an upcaster rewrites it
+func Check(registry *Registry, events *saga_event.Registry) []error {
+	var errs []error
+	for _, name := range events.Types() {
+		current, err := Current(events, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		version := current.Version
+
+		registered, ok := registry.Get(name, version)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s version %d: no schema registered", name, version))
+			continue
+		}
+		errs = append(errs, prefix(name, version, "backward", Backward(current, registered))...)
+		errs = append(errs, prefix(name, version, "forward", Forward(current, registered))...)
+
+		previous, ok := registry.Get(name, version-1)
+		if !ok || events.HasUpcaster(name, version-1) {
+			continue
+		}
+		errs = append(errs, prefix(name, version, fmt.Sprintf("backward from version %d", version-1),
+			Backward(current, previous))...)
+	}
+	return errs
+}
+
+func prefix(name string, version int, check string, errs []error) []error {
+	res := make([]error, 0, len(errs))
+	for _, err := range errs {
+		res = append(res, fmt.Errorf("%s version %d: %s: %w", name, version, check, err))
+	}
+	return res
+}
@@ -0,0 +1,51 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+)
+
+type validatingCodec struct {
+	saga_event.Codec
+	registry *Registry
+	events   *saga_event.Registry
+}
+
+// Validating checks every event against the registered schema of its type and version before
+// codec marshals it, so an event the registry does not describe never reaches an outbox.
+func Validating(codec saga_event.Codec, registry *Registry, events *saga_event.Registry) saga_event.Codec {
+	return validatingCodec{Codec: codec, registry: registry, events: events}
+}
+
+func (c validatingCodec) Marshal(event saga_event.Event) ([]byte, error) {
+	err := c.Validate(event)
+	if err != nil {
+		return nil, err
+	}
+	return c.Codec.Marshal(event)
+}
+
+// Validate checks the JSON payload of event, whatever the codec, the schemas describe its fields.
+func (c validatingCodec) Validate(event saga_event.Event) error {
+	name := event.EventType()
+	version, ok := c.events.Version(name)
+	if !ok {
+		return fmt.Errorf("schema: unknown event type %q", name)
+	}
+	schema, ok := c.registry.Get(name, version)
+	if !ok {
+		return fmt.Errorf("schema: no schema registered for %s version %d", name, version)
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	errs := schema.Validate(payload)
+	if len(errs) > 0 {
+		return fmt.Errorf("schema: invalid %s version %d: %w", name, version, errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Backward reports why readers of next could fail on events written with previous, nil when they
+// read every one of them.
+func Backward(next *Schema, previous *Schema) []error {
+	return reads(next, previous, "")
+}
+
+// Forward reports why readers of previous could fail on events written with next, nil when they
+// read every one of them.
+func Forward(next *Schema, previous *Schema) []error {
+	return reads(previous, next, "")
+}
+
+// reads compares what writer may write with what reader expects, property by property. Value
+// constraints are left out, they are checked on the events themselves before they are written.
+func reads(reader *Schema, writer *Schema, path string) []error {
+	if reader.Type != writer.Type {
+		return []error{fmt.Errorf("%s: read as %s, written as %s", at(path), reader.Type, writer.Type)}
+	}
+	if reader.Type != TypeObject {
+		return nil
+	}
+
+	names := map[string]bool{}
+	for name := range reader.Properties {
+		names[name] = true
+	}
+	for name := range writer.Properties {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var errs []error
+	for _, name := range sorted {
+		readProperty, read := reader.Properties[name]
+		writeProperty, written := writer.Properties[name]
+		switch {
+		case read && written:
+			if reader.required(name) && !writer.required(name) {
+				errs = append(errs, fmt.Errorf("%s: required by the reader, optional for the writer", at(join(path, name))))
+			}
+			errs = append(errs, reads(readProperty, writeProperty, join(path, name))...)
+		case read:
+			if reader.required(name) {
+				errs = append(errs, fmt.Errorf("%s: required by the reader, never written", at(join(path, name))))
+			}
+		case written:
+			if !reader.additionalProperties() {
+				errs = append(errs, fmt.Errorf("%s: written, not allowed by the reader", at(join(path, name))))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,145 @@
+package schema
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Dir is where the schemas are registered, relative to the root of the repo.
+const Dir = "schema/events"
+
+//go:embed events
+var events embed.FS
+
+// Default holds the schemas registered in Dir, as they were when the binary was built.
+var Default = mustLoadDefault()
+
+func mustLoadDefault() *Registry {
+	dir, err := fs.Sub(events, "events")
+	if err != nil {
+		panic(err)
+	}
+	registry, err := Load(dir)
+	if err != nil {
+		panic(err)
+	}
+	return registry
+}
+
+// fileName matches the <type>.v<version>.json files of a registry
+var fileName = regexp.MustCompile(`^([A-Za-z0-9]+)\.v([0-9]+)\.json$`)
+
+// FileName is where the schema of version of the type name is registered.
+func FileName(name string, version int) string {
+	return fmt.Sprintf("%s.v%d.json", name, version)
+}
+
+// Registry holds the JSON Schema of every event type at every version, one file each.
+type Registry struct {
+	schemas map[string]map[int]*Schema
+}
+
+func NewRegistry() *Registry {
+	return &Registry{schemas: map[string]map[int]*Schema{}}
+}
+
+// Load reads every <type>.v<version>.json file of fsys.
+func Load(fsys fs.FS) (*Registry, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	registry := NewRegistry()
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("schema: %s is not named <type>.v<version>.json", entry.Name())
+		}
+		version, err := strconv.Atoi(match[2])
+		if err != nil {
+			return nil, fmt.Errorf("schema: %s: %w", entry.Name(), err)
+		}
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		var schema Schema
+		err = json.Unmarshal(content, &schema)
+		if err != nil {
+			return nil, fmt.Errorf("schema: %s: %w", entry.Name(), err)
+		}
+		if schema.Title != match[1] || schema.Version != version {
+			return nil, fmt.Errorf("schema: %s describes %s version %d", entry.Name(), schema.Title, schema.Version)
+		}
+		registry.Add(match[1], version, &schema)
+	}
+	return registry, nil
+}
+
+// LoadDir is Load of a directory, a missing one is an empty registry.
+func LoadDir(dir string) (*Registry, error) {
+	_, err := os.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewRegistry(), nil
+	}
+	return Load(os.DirFS(dir))
+}
+
+func (r *Registry) Add(name string, version int, schema *Schema) {
+	versions, ok := r.schemas[name]
+	if !ok {
+		versions = map[int]*Schema{}
+		r.schemas[name] = versions
+	}
+	versions[version] = schema
+}
+
+func (r *Registry) Get(name string, version int) (*Schema, bool) {
+	schema, ok := r.schemas[name][version]
+	return schema, ok
+}
+
+// Versions lists the registered versions of the type name, oldest first.
+func (r *Registry) Versions(name string) []int {
+	var res []int
+	for version := range r.schemas[name] {
+		res = append(res, version)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// Write registers schema in dir, it never replaces a registered schema.
+func Write(dir string, schema *Schema) error {
+	content, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, FileName(schema.Title, schema.Version)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(content, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
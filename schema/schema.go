@@ -0,0 +1,239 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const draft = "https://json-schema.org/draft/2020-12/schema"
+
+const (
+	TypeObject  = "object"
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+)
+
+// Schema is the subset of JSON Schema the saga events need: typed properties, required ones,
+// whether properties the schema does not list are allowed, and a few value constraints.
+// Generate never sets the constraints, they are added by hand to the registered files.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Version              int                `json:"version,omitempty"`
+	Type                 string             `json:"type"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *int64             `json:"minimum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+}
+
+// Generate returns the schema of the JSON encoding of v, fields without omitempty are required.
+// Readers of the saga ignore unknown fields, so objects allow additional properties.
+func Generate(name string, version int, v interface{}) (*Schema, error) {
+	res, err := generate(reflect.TypeOf(v))
+	if err != nil {
+		return nil, fmt.Errorf("schema: %s: %w", name, err)
+	}
+	res.Schema = draft
+	res.Title = name
+	res.Version = version
+	return res, nil
+}
+
+func generate(t reflect.Type) (*Schema, error) {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return generate(t.Elem())
+	case reflect.String:
+		return &Schema{Type: TypeString}, nil
+	case reflect.Bool:
+		return &Schema{Type: TypeBoolean}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: TypeInteger}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: TypeNumber}, nil
+	case reflect.Struct:
+	default:
+		return nil, fmt.Errorf("cannot describe %s", t)
+	}
+
+	res := &Schema{Type: TypeObject, Properties: map[string]*Schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, omitEmpty := jsonName(field)
+		if name == "-" {
+			continue
+		}
+		property, err := generate(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		res.Properties[name] = property
+		if !omitEmpty {
+			res.Required = append(res.Required, name)
+		}
+	}
+	return res, nil
+}
+
+func jsonName(field reflect.StructField) (string, bool) {
+	tag, ok := field.Tag.Lookup("json")
+	if !ok {
+		return field.Name, false
+	}
+	name, options, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, strings.Contains(","+options+",", ",omitempty,")
+}
+
+// Validate reports every way the JSON document data does not follow the schema.
+func (s *Schema) Validate(data []byte) []error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return []error{err}
+	}
+	return s.validate(value, "")
+}
+
+func (s *Schema) validate(value interface{}, path string) []error {
+	switch s.Type {
+	case TypeString:
+		str, ok := value.(string)
+		if !ok {
+			return []error{mismatch(path, s.Type, value)}
+		}
+		if len(s.Enum) > 0 && !contains(s.Enum, str) {
+			return []error{fmt.Errorf("%s: %q is not one of %q", at(path), str, s.Enum)}
+		}
+		if s.MinLength != nil && len(str) < *s.MinLength {
+			return []error{fmt.Errorf("%s: %q is shorter than %d", at(path), str, *s.MinLength)}
+		}
+	case TypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return []error{mismatch(path, s.Type, value)}
+		}
+	case TypeInteger:
+		number, ok := value.(json.Number)
+		if !ok {
+			return []error{mismatch(path, s.Type, value)}
+		}
+		integer, err := number.Int64()
+		if err != nil {
+			return []error{fmt.Errorf("%s: %s is not an integer", at(path), number)}
+		}
+		if s.Minimum != nil && integer < *s.Minimum {
+			return []error{fmt.Errorf("%s: %d is less than %d", at(path), integer, *s.Minimum)}
+		}
+	case TypeNumber:
+		if _, ok := value.(json.Number); !ok {
+			return []error{mismatch(path, s.Type, value)}
+		}
+	case TypeObject:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []error{mismatch(path, s.Type, value)}
+		}
+		return s.validateObject(object, path)
+	default:
+		return []error{fmt.Errorf("%s: unsupported type %q", at(path), s.Type)}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(object map[string]interface{}, path string) []error {
+	var errs []error
+	for _, name := range s.Required {
+		if _, ok := object[name]; !ok {
+			errs = append(errs, fmt.Errorf("%s: required", at(join(path, name))))
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property, ok := s.Properties[name]
+		if !ok {
+			if !s.additionalProperties() {
+				errs = append(errs, fmt.Errorf("%s: not allowed", at(join(path, name))))
+			}
+			continue
+		}
+		errs = append(errs, property.validate(object[name], join(path, name))...)
+	}
+	return errs
+}
+
+func (s *Schema) additionalProperties() bool {
+	return s.AdditionalProperties == nil || *s.AdditionalProperties
+}
+
+func (s *Schema) required(name string) bool {
+	return contains(s.Required, name)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func mismatch(path string, expected string, value interface{}) error {
+	return fmt.Errorf("%s: expected %s, got %s", at(path), expected, jsonType(value))
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return TypeString
+	case bool:
+		return TypeBoolean
+	case json.Number:
+		return TypeNumber
+	case map[string]interface{}:
+		return TypeObject
+	case []interface{}:
+		return "array"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// at names the document itself when path is empty.
+func at(path string) string {
+	if path == "" {
+		return "event"
+	}
+	return path
+}
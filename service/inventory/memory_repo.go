@@ -0,0 +1,186 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/storage/memory"
+	"time"
+)
+
+// NewMemoryRepo keeps inventory in memory, it behaves like the MySQL repo for tests.
+func NewMemoryRepo() IRepo {
+	store := memory.NewStore()
+	return &memoryRepo{
+		store:        store,
+		inventory:    map[int64]model.Inventory{},
+		reservations: map[int64]model.Reservation{},
+		outboxes:     memory.NewOutboxes(store),
+		audit:        memory.NewAuditLog(store),
+		inbox:        memory.NewInbox(store),
+	}
+}
+
+type memoryRepo struct {
+	store        *memory.Store
+	inventory    map[int64]model.Inventory
+	reservations map[int64]model.Reservation
+	outboxes     *memory.Outboxes
+	audit        *memory.AuditLog
+	inbox        *memory.Inbox
+}
+
+func inventoryKey(productID int64) string {
+	return fmt.Sprintf("inventory:%d", productID)
+}
+
+func reservationKey(orderID int64) string {
+	return fmt.Sprintf("reservation:%d", orderID)
+}
+
+func (r *memoryRepo) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.store.Transact(ctx, fn)
+}
+
+func (r *memoryRepo) CreateOutbox(ctx context.Context, outbox model.Outbox) error {
+	return r.outboxes.Create(ctx, outbox)
+}
+
+func (r *memoryRepo) LockInventoryForUpdate(ctx context.Context, productID int64) (model.Inventory, error) {
+	err := r.store.Lock(ctx, inventoryKey(productID))
+	if err != nil {
+		return model.Inventory{}, err
+	}
+	return r.GetInventory(ctx, productID)
+}
+
+func (r *memoryRepo) UpdateInventory(ctx context.Context, productID int64, left int) error {
+	return r.store.Write(ctx, inventoryKey(productID), func() (func(), error) {
+		old, ok := r.inventory[productID]
+		if !ok {
+			return nil, nil
+		}
+		updated := old
+		updated.Amount = left
+		updated.UpdatedAt = memory.Now()
+		r.inventory[productID] = updated
+		return func() { r.inventory[productID] = old }, nil
+	})
+}
+
+func (r *memoryRepo) CreateInventory(ctx context.Context, inventory model.Inventory) error {
+	return r.store.Write(ctx, inventoryKey(inventory.ProductID), func() (func(), error) {
+		if _, ok := r.inventory[inventory.ProductID]; ok {
+			return nil, fmt.Errorf("inventory %d: %w", inventory.ProductID, memory.ErrDuplicateKey)
+		}
+		r.inventory[inventory.ProductID] = model.Inventory{
+			ProductID: inventory.ProductID,
+			UnitPrice: inventory.UnitPrice,
+			Amount:    inventory.Amount,
+			CreatedAt: memory.Now(),
+		}
+		return func() { delete(r.inventory, inventory.ProductID) }, nil
+	})
+}
+
+func (r *memoryRepo) GetInventory(ctx context.Context, productID int64) (model.Inventory, error) {
+	var res model.Inventory
+	var ok bool
+	r.store.Read(func() {
+		res, ok = r.inventory[productID]
+	})
+	if !ok {
+		return model.Inventory{}, sql.ErrNoRows
+	}
+	return res, nil
+}
+
+func (r *memoryRepo) CreateReservation(ctx context.Context, reservation model.Reservation) error {
+	return r.store.Write(ctx, reservationKey(reservation.OrderID), func() (func(), error) {
+		if _, ok := r.reservations[reservation.OrderID]; ok {
+			return nil, fmt.Errorf("reservation %d: %w", reservation.OrderID, memory.ErrDuplicateKey)
+		}
+		r.reservations[reservation.OrderID] = model.Reservation{
+			OrderID:   reservation.OrderID,
+			ProductID: reservation.ProductID,
+			Amount:    reservation.Amount,
+			CreatedAt: memory.Now(),
+		}
+		return func() { delete(r.reservations, reservation.OrderID) }, nil
+	})
+}
+
+func (r *memoryRepo) LockReservationForUpdate(ctx context.Context, orderID int64) (model.Reservation, error) {
+	err := r.store.Lock(ctx, reservationKey(orderID))
+	if err != nil {
+		return model.Reservation{}, err
+	}
+
+	var res model.Reservation
+	var ok bool
+	r.store.Read(func() {
+		res, ok = r.reservations[orderID]
+	})
+	if !ok {
+		return model.Reservation{}, sql.ErrNoRows
+	}
+	return res, nil
+}
+
+func (r *memoryRepo) MarkReservationReleased(ctx context.Context, orderID int64) error {
+	return r.store.Write(ctx, reservationKey(orderID), func() (func(), error) {
+		old, ok := r.reservations[orderID]
+		if !ok {
+			return nil, nil
+		}
+		updated := old
+		updated.ReleasedAt = memory.Now()
+		r.reservations[orderID] = updated
+		return func() { r.reservations[orderID] = old }, nil
+	})
+}
+
+func (r *memoryRepo) GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	return r.outboxes.Pending(limit), nil
+}
+
+func (r *memoryRepo) GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	return r.outboxes.Retried(limit), nil
+}
+
+func (r *memoryRepo) CountPendingOutbox(ctx context.Context) (int, error) {
+	return r.outboxes.CountPending(), nil
+}
+
+func (r *memoryRepo) MarkDoneOutboxes(ctx context.Context, ids []int64) error {
+	return r.outboxes.MarkDone(ctx, ids)
+}
+
+func (r *memoryRepo) RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error {
+	return r.outboxes.RecordAttempt(ctx, outbox)
+}
+
+func (r *memoryRepo) DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error) {
+	return r.outboxes.DeleteCompleted(ctx, before, limit)
+}
+
+func (r *memoryRepo) ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error) {
+	return r.inbox.Receive(ctx, message)
+}
+
+func (r *memoryRepo) IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error) {
+	return r.inbox.IsReceived(orderID, eventType), nil
+}
+
+func (r *memoryRepo) DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error) {
+	return r.inbox.Delete(ctx, before, limit)
+}
+
+func (r *memoryRepo) CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error {
+	return r.audit.Append(ctx, entry)
+}
+
+func (r *memoryRepo) GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error) {
+	return r.audit.ForOrder(orderID), nil
+}
@@ -0,0 +1,80 @@
+package inventory
+
+import (
+	"context"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"sort"
+)
+
+// IPricer computes the cost of an order at the moment inventory is reserved.
+type IPricer interface {
+	Price(ctx context.Context, inventory model.Inventory, event saga_event.OrderEvent) (model.Money, error)
+}
+
+// PriceTier overrides the inventory unit price once an order reaches MinAmount units.
+// UnitPrice is in minor units of the inventory currency.
+type PriceTier struct {
+	MinAmount int
+	UnitPrice int64
+}
+
+// Promotion is a discount applied to the whole order when its code is used.
+// PercentOff is applied before AmountOff, which is in minor units of the inventory currency.
+type Promotion struct {
+	Code       string
+	PercentOff int64
+	AmountOff  int64
+}
+
+type pricer struct {
+	tiers      map[int64][]PriceTier
+	promotions map[string]Promotion
+}
+
+// NewPricer returns a pricer applying quantity tiers per product and promo codes.
+// With no tiers and no promotions the cost is UnitPrice * Amount.
+func NewPricer(tiers map[int64][]PriceTier, promotions []Promotion) IPricer {
+	sortedTiers := make(map[int64][]PriceTier, len(tiers))
+	for productID, productTiers := range tiers {
+		sorted := append([]PriceTier(nil), productTiers...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].MinAmount > sorted[j].MinAmount
+		})
+		sortedTiers[productID] = sorted
+	}
+
+	promotionsByCode := make(map[string]Promotion, len(promotions))
+	for _, promotion := range promotions {
+		promotionsByCode[promotion.Code] = promotion
+	}
+
+	return &pricer{
+		tiers:      sortedTiers,
+		promotions: promotionsByCode,
+	}
+}
+
+func (p pricer) Price(ctx context.Context, inventory model.Inventory, event saga_event.OrderEvent) (model.Money, error) {
+	unitPrice := inventory.UnitPrice
+	for _, tier := range p.tiers[inventory.ProductID] {
+		if event.Amount >= tier.MinAmount {
+			unitPrice = model.NewMoney(tier.UnitPrice, inventory.UnitPrice.Currency)
+			break
+		}
+	}
+	cost := unitPrice.Mul(event.Amount)
+
+	// unknown promo codes are ignored, the order is charged the full price
+	promotion, ok := p.promotions[event.PromoCode]
+	if event.PromoCode == "" || !ok {
+		return cost, nil
+	}
+
+	cost.Amount -= cost.Amount * promotion.PercentOff / 100
+	cost.Amount -= promotion.AmountOff
+	if cost.Amount < 0 {
+		cost.Amount = 0
+	}
+	return cost, nil
+}
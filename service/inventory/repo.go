@@ -4,19 +4,31 @@ import (
 	"context"
 	"github.com/jmoiron/sqlx"
 	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/storage"
+	"time"
 )
 
 type IRepo interface {
 	Transact(ctx context.Context, fn func(ctx context.Context) error) error
+	ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error)
+	IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error)
 	CreateOutbox(ctx context.Context, outbox model.Outbox) error
-	IsProcessed(ctx context.Context, orderID int64) (bool, error)
 	LockInventoryForUpdate(ctx context.Context, productID int64) (model.Inventory, error)
 	UpdateInventory(ctx context.Context, productID int64, left int) error
 	CreateInventory(ctx context.Context, inventory model.Inventory) error
 	GetInventory(ctx context.Context, productID int64) (model.Inventory, error)
+	CreateReservation(ctx context.Context, reservation model.Reservation) error
+	LockReservationForUpdate(ctx context.Context, orderID int64) (model.Reservation, error)
+	MarkReservationReleased(ctx context.Context, orderID int64) error
 	GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error)
+	GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error)
+	CountPendingOutbox(ctx context.Context) (int, error)
+	CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error
+	GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error)
 	MarkDoneOutboxes(ctx context.Context, ids []int64) error
-	MarkProcessedOrder(ctx context.Context, orderID int64) error
+	RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error
+	DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error)
+	DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error)
 }
 type repo struct {
 	db *sqlx.DB
@@ -29,76 +41,102 @@ func NewRepo(db *sqlx.DB) IRepo {
 }
 
 func (r repo) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
-	tx, err := r.db.BeginTxx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			err = tx.Rollback()
-			panic(r)
-		} else if err != nil {
-			_ = tx.Rollback()
-		}
-	}()
-
-	err = fn(ctx)
-	if err != nil {
-		return err
-	}
-	return tx.Commit()
+	return storage.Transact(ctx, r.db, fn)
+}
+
+// conn runs queries in the transaction of ctx, if any
+func (r repo) conn(ctx context.Context) storage.Querier {
+	return storage.Conn(ctx, r.db)
 }
 
-var createOutboxQuery = "INSERT INTO inventory_outboxes(content) VALUES (:content)"
+var createOutboxQuery = "INSERT INTO inventory_outboxes(content, content_type, headers) VALUES (:content, :content_type, :headers)"
 
 func (r repo) CreateOutbox(ctx context.Context, outbox model.Outbox) error {
-	_, err := r.db.NamedExecContext(ctx, createOutboxQuery, outbox)
+	_, err := r.conn(ctx).NamedExecContext(ctx, createOutboxQuery, outbox)
 	return err
 }
 
-var isProcessedQuery = "SELECT count(*) FROM processed_orders WHERE order_id = ?"
+// unit price columns are aliased so sqlx maps them into model.Money
+var inventoryColumns = "product_id, unit_price AS \"unit_price.amount\", currency AS \"unit_price.currency\", " +
+	"amount, created_at, updated_at"
 
-func (r repo) IsProcessed(ctx context.Context, orderID int64) (bool, error) {
-	var res int
-	err := r.db.GetContext(ctx, &res, isProcessedQuery, orderID)
-	return res > 0, err
-}
-
-var lockInventoryForUpdateQuery = "SELECT * FROM inventory WHERE product_id = ? FOR UPDATE"
+var lockInventoryForUpdateQuery = "SELECT " + inventoryColumns + " FROM inventory WHERE product_id = ? FOR UPDATE"
 
 func (r repo) LockInventoryForUpdate(ctx context.Context, productID int64) (model.Inventory, error) {
 	var res model.Inventory
-	err := r.db.GetContext(ctx, &res, lockInventoryForUpdateQuery, productID)
+	err := r.conn(ctx).GetContext(ctx, &res, lockInventoryForUpdateQuery, productID)
 	return res, err
 }
 
 var updateInventoryQuery = "UPDATE inventory SET amount = ? WHERE product_id = ?"
 
 func (r repo) UpdateInventory(ctx context.Context, productID int64, left int) error {
-	_, err := r.db.ExecContext(ctx, updateInventoryQuery, left, productID)
+	_, err := r.conn(ctx).ExecContext(ctx, updateInventoryQuery, left, productID)
 	return err
 }
 
-var createInventoryQuery = "INSERT INTO inventory (product_id, unit_price, amount) VALUES (:product_id, :unit_price, :amount)"
+var createInventoryQuery = "INSERT INTO inventory (product_id, unit_price, currency, amount) " +
+	"VALUES (:product_id, :unit_price.amount, :unit_price.currency, :amount)"
 
 func (r repo) CreateInventory(ctx context.Context, inventory model.Inventory) error {
-	_, err := r.db.NamedExecContext(ctx, createInventoryQuery, inventory)
+	_, err := r.conn(ctx).NamedExecContext(ctx, createInventoryQuery, inventory)
 	return err
 }
 
-var getInventoryQuery = "SELECT * FROM inventory WHERE product_id = ?"
+var getInventoryQuery = "SELECT " + inventoryColumns + " FROM inventory WHERE product_id = ?"
 
 func (r repo) GetInventory(ctx context.Context, productID int64) (model.Inventory, error) {
 	var res model.Inventory
-	err := r.db.GetContext(ctx, &res, lockInventoryForUpdateQuery, productID)
+	err := r.conn(ctx).GetContext(ctx, &res, getInventoryQuery, productID)
 	return res, err
 }
 
-var getPendingOutboxQuery = "SELECT * FROM inventory_outboxes WHERE status = ? LIMIT ?"
+var createReservationQuery = "INSERT INTO reservations (order_id, product_id, amount) " +
+	"VALUES (:order_id, :product_id, :amount)"
+
+func (r repo) CreateReservation(ctx context.Context, reservation model.Reservation) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, createReservationQuery, reservation)
+	return err
+}
+
+var lockReservationForUpdateQuery = "SELECT * FROM reservations WHERE order_id = ? FOR UPDATE"
+
+func (r repo) LockReservationForUpdate(ctx context.Context, orderID int64) (model.Reservation, error) {
+	var res model.Reservation
+	err := r.conn(ctx).GetContext(ctx, &res, lockReservationForUpdateQuery, orderID)
+	return res, err
+}
+
+var markReservationReleasedQuery = "UPDATE reservations SET released_at = CURRENT_TIMESTAMP WHERE order_id = ?"
+
+func (r repo) MarkReservationReleased(ctx context.Context, orderID int64) error {
+	_, err := r.conn(ctx).ExecContext(ctx, markReservationReleasedQuery, orderID)
+	return err
+}
+
+var getPendingOutboxQuery = "SELECT * FROM inventory_outboxes " +
+	"WHERE status = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?) ORDER BY id LIMIT ?"
 
 func (r repo) GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
 	var res []model.Outbox
-	err := r.db.SelectContext(ctx, &res, getPendingOutboxQuery, model.OutboxPending, limit)
+	err := r.conn(ctx).SelectContext(ctx, &res, getPendingOutboxQuery, model.OutboxPending, time.Now(), limit)
+	return res, err
+}
+
+var getRetriedOutboxQuery = "SELECT * FROM inventory_outboxes " +
+	"WHERE status = ? AND attempts > 0 AND next_attempt_at <= ? ORDER BY id LIMIT ?"
+
+func (r repo) GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	var res []model.Outbox
+	err := r.conn(ctx).SelectContext(ctx, &res, getRetriedOutboxQuery, model.OutboxPending, time.Now(), limit)
+	return res, err
+}
+
+var countPendingOutboxQuery = "SELECT COUNT(*) FROM inventory_outboxes WHERE status = ?"
+
+func (r repo) CountPendingOutbox(ctx context.Context) (int, error) {
+	var res int
+	err := r.conn(ctx).GetContext(ctx, &res, countPendingOutboxQuery, model.OutboxPending)
 	return res, err
 }
 
@@ -114,13 +152,84 @@ func (r repo) MarkDoneOutboxes(ctx context.Context, ids []int64) error {
 		return err
 	}
 
-	_, err = r.db.ExecContext(ctx, query, args...)
+	_, err = r.conn(ctx).ExecContext(ctx, query, args...)
 	return err
 }
 
-var markProcessedOrderQuery = "INSERT INTO processed_orders (order_id) VALUES (?)"
+var recordOutboxAttemptQuery = "UPDATE inventory_outboxes SET status = :status, attempts = :attempts, " +
+	"last_error = :last_error, next_attempt_at = :next_attempt_at WHERE id = :id"
 
-func (r repo) MarkProcessedOrder(ctx context.Context, orderID int64) error {
-	_, err := r.db.Exec(markProcessedOrderQuery, orderID)
+// RecordOutboxAttempt stores the status, attempts, last error and next attempt of a rejected outbox row.
+func (r repo) RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, recordOutboxAttemptQuery, outbox)
 	return err
 }
+
+var deleteCompletedOutboxesQuery = "DELETE FROM inventory_outboxes WHERE id IN (SELECT id FROM (" +
+	"SELECT id FROM inventory_outboxes WHERE status = ? AND updated_at < ? ORDER BY id LIMIT ?) AS batch)"
+
+// DeleteCompletedOutboxes deletes at most limit outbox rows completed before before, it returns how
+// many rows were deleted.
+func (r repo) DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := r.conn(ctx).ExecContext(ctx, deleteCompletedOutboxesQuery, model.OutboxCompleted, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+var receiveMessageCountQuery = "SELECT count(*) FROM inbox WHERE message_id = ? AND event_type = ?"
+
+var receiveMessageQuery = "INSERT INTO inbox (message_id, event_type, order_id) VALUES (:message_id, :event_type, :order_id)"
+
+// ReceiveMessage stores message in the inbox, it returns false when it was already received. The
+// primary key fails the transaction of a concurrent duplicate.
+func (r repo) ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error) {
+	var count int
+	err := r.conn(ctx).GetContext(ctx, &count, receiveMessageCountQuery, message.MessageID, message.EventType)
+	if err != nil || count > 0 {
+		return false, err
+	}
+	_, err = r.conn(ctx).NamedExecContext(ctx, receiveMessageQuery, message)
+	return err == nil, err
+}
+
+var isReceivedQuery = "SELECT count(*) FROM inbox WHERE order_id = ? AND event_type = ?"
+
+func (r repo) IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error) {
+	var res int
+	err := r.conn(ctx).GetContext(ctx, &res, isReceivedQuery, orderID, eventType)
+	return res > 0, err
+}
+
+var deleteInboxMessagesQuery = "DELETE FROM inbox WHERE (message_id, event_type) IN (" +
+	"SELECT message_id, event_type FROM (" +
+	"SELECT message_id, event_type FROM inbox WHERE received_at < ? ORDER BY received_at LIMIT ?) AS batch)"
+
+// DeleteInboxMessages deletes at most limit messages received before before, it returns how many
+// messages were deleted.
+func (r repo) DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := r.conn(ctx).ExecContext(ctx, deleteInboxMessagesQuery, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+var createAuditEntryQuery = "INSERT INTO saga_audit(order_id, service, kind, status, detail, occurred_at) " +
+	"VALUES (:order_id, :service, :kind, :status, :detail, :occurred_at)"
+
+func (r repo) CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, createAuditEntryQuery, entry)
+	return err
+}
+
+var getAuditEntriesQuery = "SELECT * FROM saga_audit WHERE order_id = ? ORDER BY id"
+
+func (r repo) GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error) {
+	var res []model.AuditEntry
+	err := r.conn(ctx).SelectContext(ctx, &res, getAuditEntriesQuery, orderID)
+	return res, err
+}
@@ -2,78 +2,134 @@ package inventory
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/consume"
 	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
 	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/relay"
 	"github.com/rafata1/sagas-pattern-thesis/saga_event"
-	"log"
+	"github.com/rafata1/sagas-pattern-thesis/tracing"
+	"log/slog"
 	"time"
 )
 
+const (
+	serviceName = "inventory"
+	outboxTable = "inventory_outboxes"
+)
+
 type IService interface {
 	ConsumeOrders(ctx context.Context, stopAfter time.Duration)
 	ConsumeBills(ctx context.Context, stopAfter time.Duration)
+	ConsumeShipments(ctx context.Context, stopAfter time.Duration)
 	RelayMessage(ctx context.Context, limit int) error
 }
 
 type service struct {
-	ordersConsumer kafka.IConsumer
-	billConsumer   kafka.IConsumer
-	producer       kafka.IProducer
-	repo           IRepo
+	ordersConsumer   kafka.IConsumer
+	billConsumer     kafka.IConsumer
+	shipmentConsumer kafka.IConsumer
+	producer         kafka.IProducer
+	repo             IRepo
+	pricer           IPricer
+	logger           *slog.Logger
+	codec            saga_event.Codec
+	retry            relay.Retry
+	publisher        *relay.Publisher
+}
+
+type Option func(s *service)
+
+// WithPricer replaces the default UnitPrice * Amount pricing.
+func WithPricer(pricer IPricer) Option {
+	return func(s *service) {
+		s.pricer = pricer
+	}
+}
+
+// WithLogger replaces the default text logger, the service adds the message and order fields.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *service) {
+		s.logger = logger
+	}
+}
+
+// WithCodec sets how the events of the outbox are encoded, JSON by default.
+func WithCodec(codec saga_event.Codec) Option {
+	return func(s *service) {
+		s.codec = codec
+	}
+}
+
+// WithRelayRetry sets how outbox rows Kafka rejected are attempted again, relay.DefaultRetry by default.
+func WithRelayRetry(retry relay.Retry) Option {
+	return func(s *service) {
+		s.retry = retry
+	}
 }
 
 func NewService(
-	repo IRepo, ordersConsumer kafka.IConsumer, billConsumer kafka.IConsumer, producer kafka.IProducer,
+	repo IRepo,
+	ordersConsumer kafka.IConsumer,
+	billConsumer kafka.IConsumer,
+	shipmentConsumer kafka.IConsumer,
+	producer kafka.IProducer,
+	opts ...Option,
 ) IService {
-	return &service{
-		ordersConsumer: ordersConsumer,
-		repo:           repo,
-		producer:       producer,
-		billConsumer:   billConsumer,
+	s := &service{
+		ordersConsumer:   ordersConsumer,
+		repo:             repo,
+		producer:         producer,
+		billConsumer:     billConsumer,
+		shipmentConsumer: shipmentConsumer,
+		pricer:           NewPricer(nil, nil),
+		logger:           logging.Default(),
+		codec:            saga_event.JSON,
+		retry:            relay.DefaultRetry,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.publisher = relay.NewPublisher(outboxTable, s.repo, s.producer, s.retry, s.logger)
+	return s
 }
 
 func (s service) ConsumeOrders(ctx context.Context, stopAfter time.Duration) {
-	startTime := time.Now()
-	for {
-		select {
-		case msg := <-s.ordersConsumer.Messages():
-			fmt.Printf("Received message: Topic: %s, Partition: %d, Offset: %d, Key: %s, Value: %s\n",
-				msg.Topic, msg.Partition, msg.Offset, string(msg.Key), string(msg.Value),
-			)
-			var event saga_event.OrderEvent
-			err := json.Unmarshal(msg.Value, &event)
-			if err != nil {
-				panic(err)
-				// mark message on queue as not done
-			}
-			err = s.PrepareInventory(ctx, event)
-			if err != nil {
-				panic(err)
-				// mark message on queue as not done
+	consume.Loop(ctx, s.ordersConsumer, stopAfter, serviceName, "ConsumeOrders", s.logger,
+		func(ctx context.Context, event saga_event.OrderEvent) error {
+			if event.Status == model.OrderStatusTimedOut {
+				return s.TimeOut(ctx, event)
 			}
-		case err := <-s.ordersConsumer.Errors():
-			log.Printf("Failed to consume message: %s", err)
-		default:
-			if stopAfter != 0 && time.Now().After(startTime.Add(stopAfter)) {
-				return
-			}
-		}
-	}
+			return s.PrepareInventory(ctx, event)
+		})
 }
 
 func (s service) PrepareInventory(ctx context.Context, event saga_event.OrderEvent) error {
+	// only prepare created orders, the order topic also carries their confirmations for shipping
+	if event.Status != model.OrderStatusPending {
+		return nil
+	}
+
 	return s.repo.Transact(ctx, func(ctx context.Context) error {
-		isOrderProcessed, err := s.repo.IsProcessed(ctx, event.OrderID)
-		if err != nil {
+		received, err := s.receive(ctx, event)
+		if err != nil || !received {
 			return err
 		}
 
-		// order is already processed
-		if isOrderProcessed {
-			return nil
+		// the order timed out before it came, its timeout was passed on without a reservation
+		timedOut, err := s.repo.IsReceived(ctx, event.OrderID, saga_event.TypeOrderTimedOut)
+		if err != nil || timedOut {
+			return err
+		}
+
+		err = s.audit(ctx, event.OrderID, model.AuditReceived, event.Status,
+			fmt.Sprintf("%d x product %d", event.Amount, event.ProductID))
+		if err != nil {
+			return err
 		}
 
 		// lock and check inventory
@@ -82,111 +138,201 @@ func (s service) PrepareInventory(ctx context.Context, event saga_event.OrderEve
 			return err
 		}
 
-		var publishedEvent saga_event.OrderEvent
+		var publishedEvent saga_event.Event
+		var detail string
 		if inventory.Amount >= event.Amount {
+			cost, err := s.pricer.Price(ctx, inventory, event)
+			if err != nil {
+				return err
+			}
+
 			err = s.repo.UpdateInventory(ctx, event.ProductID, inventory.Amount-event.Amount)
 			if err != nil {
 				return err
 			}
 
-			publishedEvent = saga_event.OrderEvent{
+			err = s.repo.CreateReservation(ctx, model.Reservation{
+				OrderID:   event.OrderID,
+				ProductID: event.ProductID,
+				Amount:    event.Amount,
+			})
+			if err != nil {
+				return err
+			}
+
+			publishedEvent = saga_event.InventoryReserved{
 				OrderID:    event.OrderID,
 				CustomerID: event.CustomerID,
 				ProductID:  event.ProductID,
 				Amount:     event.Amount,
-				Status:     model.OrderStatusPrepared,
-				Cost:       inventory.UnitPrice * event.Amount,
+				PromoCode:  event.PromoCode,
+				Cost:       cost,
 			}
+			detail = "reserved, cost " + cost.String()
 		} else {
-			publishedEvent = saga_event.OrderEvent{
+			publishedEvent = saga_event.InventoryRejected{
 				OrderID:    event.OrderID,
 				CustomerID: event.CustomerID,
 				ProductID:  event.ProductID,
 				Amount:     event.Amount,
-				Status:     model.OrderStatusFailedOutOfStock,
 			}
+			detail = fmt.Sprintf("%d left in stock", inventory.Amount)
+		}
+
+		status := publishedEvent.OrderEvent().Status
+		err = s.audit(ctx, event.OrderID, model.AuditDecision, status, detail)
+		if err != nil {
+			return err
 		}
 
-		content, _ := json.Marshal(publishedEvent)
+		content, err := s.codec.Marshal(publishedEvent)
+		if err != nil {
+			return err
+		}
 
-		err = s.repo.MarkProcessedOrder(ctx, event.OrderID)
+		err = s.audit(ctx, event.OrderID, model.AuditEmitted, status, "")
 		if err != nil {
 			return err
 		}
 
 		return s.repo.CreateOutbox(ctx, model.Outbox{
-			Content: content,
+			Content:     content,
+			ContentType: s.codec.ContentType(),
+			Headers:     tracing.Inject(ctx),
 		})
 	})
 }
 
 func (s service) RelayMessage(ctx context.Context, limit int) error {
-	outboxes, err := s.repo.GetPendingOutbox(ctx, limit)
-	if err != nil {
-		return err
-	}
-	err = s.producer.Push(extractContents(outboxes))
-	if err != nil {
-		return err
-	}
-
-	err = s.repo.MarkDoneOutboxes(ctx, extractIDs(outboxes))
-	return err
+	return s.publisher.Relay(ctx, limit)
 }
 
-func extractIDs(outboxes []model.Outbox) []int64 {
-	var res []int64
-	for _, outbox := range outboxes {
-		res = append(res, outbox.ID)
-	}
-	return res
+func (s service) ConsumeBills(ctx context.Context, stopAfter time.Duration) {
+	consume.Loop(ctx, s.billConsumer, stopAfter, serviceName, "ConsumeBills", s.logger,
+		func(ctx context.Context, event saga_event.OrderEvent) error {
+			if event.Status == model.OrderStatusBilled {
+				return nil
+			}
+			return s.RestoreInventory(ctx, event)
+		})
 }
 
-func extractContents(outboxes []model.Outbox) [][]byte {
-	var res [][]byte
-	for _, outbox := range outboxes {
-		res = append(res, outbox.Content)
-	}
-	return res
+func (s service) ConsumeShipments(ctx context.Context, stopAfter time.Duration) {
+	consume.Loop(ctx, s.shipmentConsumer, stopAfter, serviceName, "ConsumeShipments", s.logger,
+		func(ctx context.Context, event saga_event.OrderEvent) error {
+			if event.Status != model.OrderStatusFailedShipping {
+				return nil
+			}
+			return s.RestoreInventory(ctx, event)
+		})
 }
 
-func (s service) ConsumeBills(ctx context.Context, stopAfter time.Duration) {
-	startTime := time.Now()
-	for {
-		select {
-		case msg := <-s.billConsumer.Messages():
-			fmt.Printf("Received message: Topic: %s, Partition: %d, Offset: %d, Key: %s, Value: %s\n",
-				msg.Topic, msg.Partition, msg.Offset, string(msg.Key), string(msg.Value),
-			)
-			var event saga_event.OrderEvent
-			err := json.Unmarshal(msg.Value, &event)
-			if err != nil {
-				panic(err)
-				// mark message on queue as not done
-			}
-			if event.Status != model.OrderStatusBilled {
-				err = s.RestoreInventory(ctx, event)
-				if err != nil {
-					panic(err)
-				}
-			}
-		case err := <-s.billConsumer.Errors():
-			log.Printf("Failed to consume message: %s", err)
-		default:
-			if stopAfter != 0 && time.Now().After(startTime.Add(stopAfter)) {
-				return
-			}
+func (s service) RestoreInventory(ctx context.Context, event saga_event.OrderEvent) error {
+	var restored bool
+	err := s.repo.Transact(ctx, func(ctx context.Context) error {
+		received, err := s.receive(ctx, event)
+		if err != nil || !received {
+			return err
 		}
+
+		restored, err = s.release(ctx, event)
+		return err
+	})
+	if err == nil && restored {
+		metrics.Compensations.WithLabelValues(serviceName, "restore_inventory").Inc()
 	}
+	return err
 }
 
-func (s service) RestoreInventory(ctx context.Context, event saga_event.OrderEvent) error {
-	return s.repo.Transact(ctx, func(ctx context.Context) error {
-		inventory, err := s.repo.LockInventoryForUpdate(ctx, event.ProductID)
+// TimeOut releases the stock reserved for an order the order service timed out and passes the
+// timeout on to payment. The timeout stays in the inbox, so the order is not prepared when it comes late.
+func (s service) TimeOut(ctx context.Context, event saga_event.OrderEvent) error {
+	var released bool
+	err := s.repo.Transact(ctx, func(ctx context.Context) error {
+		received, err := s.receive(ctx, event)
+		if err != nil || !received {
+			return err
+		}
+
+		err = s.audit(ctx, event.OrderID, model.AuditReceived, event.Status, event.Reason)
+		if err != nil {
+			return err
+		}
+
+		released, err = s.release(ctx, event)
+		if err != nil {
+			return err
+		}
+
+		err = s.audit(ctx, event.OrderID, model.AuditEmitted, event.Status, "")
 		if err != nil {
 			return err
 		}
 
-		return s.repo.UpdateInventory(ctx, event.ProductID, inventory.Amount+event.Amount)
+		content, err := s.codec.Marshal(saga_event.OrderTimedOut{
+			OrderID:    event.OrderID,
+			CustomerID: event.CustomerID,
+			ProductID:  event.ProductID,
+			Amount:     event.Amount,
+			Cost:       event.Cost,
+			Reason:     event.Reason,
+		})
+		if err != nil {
+			return err
+		}
+		return s.repo.CreateOutbox(ctx, model.Outbox{
+			Content:     content,
+			ContentType: s.codec.ContentType(),
+			Headers:     tracing.Inject(ctx),
+		})
 	})
+	if err == nil && released {
+		metrics.Compensations.WithLabelValues(serviceName, "restore_inventory").Inc()
+	}
+	return err
+}
+
+// release puts back the stock reserved for the order of event, unless it was never reserved or
+// was put back already, by a timeout or an earlier compensation.
+func (s service) release(ctx context.Context, event saga_event.OrderEvent) (bool, error) {
+	reservation, err := s.repo.LockReservationForUpdate(ctx, event.OrderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if reservation.ReleasedAt.Valid {
+		return false, nil
+	}
+
+	inventory, err := s.repo.LockInventoryForUpdate(ctx, reservation.ProductID)
+	if err != nil {
+		return false, err
+	}
+	err = s.repo.UpdateInventory(ctx, reservation.ProductID, inventory.Amount+reservation.Amount)
+	if err != nil {
+		return false, err
+	}
+	err = s.repo.MarkReservationReleased(ctx, event.OrderID)
+	if err != nil {
+		return false, err
+	}
+	return true, s.audit(ctx, event.OrderID, model.AuditCompensated, event.Status,
+		fmt.Sprintf("restored %d x product %d", reservation.Amount, reservation.ProductID))
+}
+
+// receive stores the message of event in the inbox, in the transaction of ctx. It returns false
+// when the message was already received and must not be handled again.
+func (s service) receive(ctx context.Context, event saga_event.OrderEvent) (bool, error) {
+	message, err := saga_event.InboxMessage(ctx, event)
+	if err != nil {
+		return false, err
+	}
+	return s.repo.ReceiveMessage(ctx, message)
+}
+
+// audit appends a step of the saga of orderID to saga_audit, in the transaction of ctx.
+func (s service) audit(ctx context.Context, orderID int64, kind model.AuditKind, status model.OrderStatus, detail string) error {
+	return s.repo.CreateAuditEntry(ctx, model.NewAuditEntry(orderID, serviceName, kind, status, detail))
 }
@@ -0,0 +1,175 @@
+package order
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/storage/memory"
+	"sort"
+	"time"
+)
+
+// NewMemoryRepo keeps orders in memory, it behaves like the MySQL repo for tests.
+func NewMemoryRepo() IRepo {
+	store := memory.NewStore()
+	return &memoryRepo{
+		store:    store,
+		orders:   map[int64]model.Order{},
+		nextID:   1,
+		outboxes: memory.NewOutboxes(store),
+		audit:    memory.NewAuditLog(store),
+		inbox:    memory.NewInbox(store),
+	}
+}
+
+type memoryRepo struct {
+	store    *memory.Store
+	orders   map[int64]model.Order
+	nextID   int64
+	outboxes *memory.Outboxes
+	audit    *memory.AuditLog
+	inbox    *memory.Inbox
+}
+
+func (r *memoryRepo) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.store.Transact(ctx, fn)
+}
+
+func (r *memoryRepo) CreateOrder(ctx context.Context, order model.Order) (int64, error) {
+	var id int64
+	err := r.store.Write(ctx, "", func() (func(), error) {
+		id = r.nextID
+		r.nextID++
+		r.orders[id] = model.Order{
+			ID:         id,
+			CustomerID: order.CustomerID,
+			ProductID:  order.ProductID,
+			Amount:     order.Amount,
+			PromoCode:  order.PromoCode,
+			Status:     model.OrderStatusPending,
+			CreatedAt:  memory.Now(),
+		}
+		return func() { delete(r.orders, id) }, nil
+	})
+	return id, err
+}
+
+func (r *memoryRepo) GetOrder(ctx context.Context, id int64) (model.Order, error) {
+	var res model.Order
+	var ok bool
+	r.store.Read(func() {
+		res, ok = r.orders[id]
+	})
+	if !ok {
+		return model.Order{}, sql.ErrNoRows
+	}
+	return res, nil
+}
+
+func (r *memoryRepo) UpdateStatus(ctx context.Context, order model.Order) error {
+	return r.store.Write(ctx, fmt.Sprintf("order:%d", order.ID), func() (func(), error) {
+		old, ok := r.orders[order.ID]
+		if !ok {
+			return nil, nil
+		}
+		updated := old
+		updated.Status = order.Status
+		updated.FailureReason = order.FailureReason
+		// a cost without currency keeps the price already stored, like the MySQL repo
+		if order.Cost.Currency != "" {
+			updated.Cost = order.Cost
+		}
+		updated.UpdatedAt = memory.Now()
+		r.orders[order.ID] = updated
+		return func() { r.orders[order.ID] = old }, nil
+	})
+}
+
+func (r *memoryRepo) UpdateStatusFrom(ctx context.Context, order model.Order, from model.OrderStatus) (bool, error) {
+	var updated bool
+	err := r.store.Write(ctx, fmt.Sprintf("order:%d", order.ID), func() (func(), error) {
+		old, ok := r.orders[order.ID]
+		if !ok || old.Status != from {
+			return nil, nil
+		}
+		updated = true
+		changed := old
+		changed.Status = order.Status
+		changed.FailureReason = order.FailureReason
+		changed.UpdatedAt = memory.Now()
+		r.orders[order.ID] = changed
+		return func() { r.orders[order.ID] = old }, nil
+	})
+	return updated, err
+}
+
+func (r *memoryRepo) GetStuckOrders(
+	ctx context.Context, status model.OrderStatus, before time.Time, limit int,
+) ([]model.Order, error) {
+	var res []model.Order
+	r.store.Read(func() {
+		for _, order := range r.orders {
+			since := order.CreatedAt
+			if order.UpdatedAt.Valid {
+				since = order.UpdatedAt
+			}
+			if order.Status == status && since.Time.Before(before) {
+				res = append(res, order)
+			}
+		}
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+func (r *memoryRepo) CreateOutbox(ctx context.Context, outbox model.Outbox) error {
+	return r.outboxes.Create(ctx, outbox)
+}
+
+func (r *memoryRepo) GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	return r.outboxes.Pending(limit), nil
+}
+
+func (r *memoryRepo) GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	return r.outboxes.Retried(limit), nil
+}
+
+func (r *memoryRepo) CountPendingOutbox(ctx context.Context) (int, error) {
+	return r.outboxes.CountPending(), nil
+}
+
+func (r *memoryRepo) MarkDoneOutboxes(ctx context.Context, ids []int64) error {
+	return r.outboxes.MarkDone(ctx, ids)
+}
+
+func (r *memoryRepo) RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error {
+	return r.outboxes.RecordAttempt(ctx, outbox)
+}
+
+func (r *memoryRepo) DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error) {
+	return r.outboxes.DeleteCompleted(ctx, before, limit)
+}
+
+func (r *memoryRepo) ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error) {
+	return r.inbox.Receive(ctx, message)
+}
+
+func (r *memoryRepo) IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error) {
+	return r.inbox.IsReceived(orderID, eventType), nil
+}
+
+func (r *memoryRepo) DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error) {
+	return r.inbox.Delete(ctx, before, limit)
+}
+
+func (r *memoryRepo) CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error {
+	return r.audit.Append(ctx, entry)
+}
+
+func (r *memoryRepo) GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error) {
+	return r.audit.ForOrder(orderID), nil
+}
@@ -2,19 +2,32 @@ package order
 
 import (
 	"context"
-	_ "github.com/go-sql-driver/mysql"
+	"database/sql"
 	"github.com/jmoiron/sqlx"
 	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/storage"
+	"time"
 )
 
 type IRepo interface {
 	Transact(ctx context.Context, fn func(ctx context.Context) error) error
 	CreateOrder(ctx context.Context, order model.Order) (int64, error)
 	GetOrder(ctx context.Context, id int64) (model.Order, error)
-	UpdateStatus(ctx context.Context, id int64, status model.OrderStatus) error
+	UpdateStatus(ctx context.Context, order model.Order) error
+	UpdateStatusFrom(ctx context.Context, order model.Order, from model.OrderStatus) (bool, error)
+	GetStuckOrders(ctx context.Context, status model.OrderStatus, before time.Time, limit int) ([]model.Order, error)
+	ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error)
+	IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error)
 	CreateOutbox(ctx context.Context, outbox model.Outbox) error
 	GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error)
+	GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error)
+	CountPendingOutbox(ctx context.Context) (int, error)
+	CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error
+	GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error)
 	MarkDoneOutboxes(ctx context.Context, ids []int64) error
+	RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error
+	DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error)
+	DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error)
 }
 
 func NewRepo(db *sqlx.DB) IRepo {
@@ -27,64 +40,131 @@ type repo struct {
 	db *sqlx.DB
 }
 
-var getOrderQuery = "SELECT * FROM orders WHERE id = ?"
+// cost columns are aliased so sqlx maps them into model.Money
+var orderColumns = "id, customer_id, product_id, amount, promo_code, " +
+	"cost AS \"cost.amount\", currency AS \"cost.currency\", status, failure_reason, created_at, updated_at"
+
+var getOrderQuery = "SELECT " + orderColumns + " FROM orders WHERE id = ?"
 
 func (r repo) GetOrder(ctx context.Context, id int64) (model.Order, error) {
 	var res model.Order
-	err := r.db.GetContext(ctx, &res, getOrderQuery, id)
+	err := r.conn(ctx).GetContext(ctx, &res, getOrderQuery, id)
 	return res, err
 }
 
-var createOrderQuery = "INSERT INTO orders (customer_id, product_id, amount) VALUES (:customer_id, :product_id, :amount)"
+var createOrderQuery = "INSERT INTO orders (customer_id, product_id, amount, promo_code) " +
+	"VALUES (:customer_id, :product_id, :amount, :promo_code)"
 
 func (r repo) CreateOrder(ctx context.Context, order model.Order) (int64, error) {
-	res, err := r.db.NamedExecContext(ctx, createOrderQuery, order)
+	if !storage.SupportsLastInsertID(r.db) {
+		return r.createOrderReturning(ctx, order)
+	}
+
+	res, err := r.conn(ctx).NamedExecContext(ctx, createOrderQuery, order)
 	if err != nil {
 		return 0, err
 	}
 	return res.LastInsertId()
 }
 
-var updateStatusQuery = "UPDATE orders SET status = ? WHERE id = ?"
+func (r repo) createOrderReturning(ctx context.Context, order model.Order) (int64, error) {
+	rows, err := sqlx.NamedQueryContext(ctx, r.conn(ctx), createOrderQuery+" RETURNING id", order)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var id int64
+	if !rows.Next() {
+		return 0, sql.ErrNoRows
+	}
+	err = rows.Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, rows.Close()
+}
+
+// a NULL cost keeps the price already stored, events which do not carry the price must not erase it
+var updateStatusQuery = "UPDATE orders SET status = ?, failure_reason = ?, " +
+	"cost = COALESCE(?, cost), currency = COALESCE(?, currency) WHERE id = ?"
 
-func (r repo) UpdateStatus(ctx context.Context, id int64, status model.OrderStatus) error {
-	_, err := r.db.ExecContext(ctx, updateStatusQuery, status, id)
+// UpdateStatus stores the cost of order only when it has a currency, the price of a free order is a
+// zero cost with its currency.
+func (r repo) UpdateStatus(ctx context.Context, order model.Order) error {
+	var cost sql.NullInt64
+	var currency sql.NullString
+	if order.Cost.Currency != "" {
+		cost = sql.NullInt64{Int64: order.Cost.Amount, Valid: true}
+		currency = sql.NullString{String: order.Cost.Currency, Valid: true}
+	}
+	_, err := r.conn(ctx).ExecContext(ctx, updateStatusQuery, order.Status, order.FailureReason, cost, currency, order.ID)
 	return err
 }
 
-var createOutboxQuery = "INSERT INTO order_outboxes(content) VALUES (:content)"
+var updateStatusFromQuery = "UPDATE orders SET status = ?, failure_reason = ? WHERE id = ? AND status = ?"
+
+// UpdateStatusFrom only updates an order still in status from, updated is false otherwise.
+func (r repo) UpdateStatusFrom(ctx context.Context, order model.Order, from model.OrderStatus) (bool, error) {
+	res, err := r.conn(ctx).ExecContext(ctx, updateStatusFromQuery, order.Status, order.FailureReason, order.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// an order is stuck in its status since it was last updated, or created for PENDING
+var getStuckOrdersQuery = "SELECT " + orderColumns +
+	" FROM orders WHERE status = ? AND COALESCE(updated_at, created_at) < ? ORDER BY id LIMIT ?"
+
+func (r repo) GetStuckOrders(
+	ctx context.Context, status model.OrderStatus, before time.Time, limit int,
+) ([]model.Order, error) {
+	var res []model.Order
+	err := r.conn(ctx).SelectContext(ctx, &res, getStuckOrdersQuery, status, before, limit)
+	return res, err
+}
+
+var createOutboxQuery = "INSERT INTO order_outboxes(content, content_type, headers) VALUES (:content, :content_type, :headers)"
 
 func (r repo) CreateOutbox(ctx context.Context, outbox model.Outbox) error {
-	_, err := r.db.NamedExecContext(ctx, createOutboxQuery, outbox)
+	_, err := r.conn(ctx).NamedExecContext(ctx, createOutboxQuery, outbox)
 	return err
 }
 
 func (r repo) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
-	tx, err := r.db.BeginTxx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			err = tx.Rollback()
-			panic(r)
-		} else if err != nil {
-			_ = tx.Rollback()
-		}
-	}()
-
-	err = fn(ctx)
-	if err != nil {
-		return err
-	}
-	return tx.Commit()
+	return storage.Transact(ctx, r.db, fn)
 }
 
-var getPendingOutboxQuery = "SELECT * FROM order_outboxes WHERE status = ? LIMIT ?"
+// conn runs queries in the transaction of ctx, if any
+func (r repo) conn(ctx context.Context) storage.Querier {
+	return storage.Conn(ctx, r.db)
+}
+
+var getPendingOutboxQuery = "SELECT * FROM order_outboxes " +
+	"WHERE status = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?) ORDER BY id LIMIT ?"
 
 func (r repo) GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
 	var res []model.Outbox
-	err := r.db.SelectContext(ctx, &res, getPendingOutboxQuery, model.OutboxPending, limit)
+	err := r.conn(ctx).SelectContext(ctx, &res, getPendingOutboxQuery, model.OutboxPending, time.Now(), limit)
+	return res, err
+}
+
+var getRetriedOutboxQuery = "SELECT * FROM order_outboxes " +
+	"WHERE status = ? AND attempts > 0 AND next_attempt_at <= ? ORDER BY id LIMIT ?"
+
+func (r repo) GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	var res []model.Outbox
+	err := r.conn(ctx).SelectContext(ctx, &res, getRetriedOutboxQuery, model.OutboxPending, time.Now(), limit)
+	return res, err
+}
+
+var countPendingOutboxQuery = "SELECT COUNT(*) FROM order_outboxes WHERE status = ?"
+
+func (r repo) CountPendingOutbox(ctx context.Context) (int, error) {
+	var res int
+	err := r.conn(ctx).GetContext(ctx, &res, countPendingOutboxQuery, model.OutboxPending)
 	return res, err
 }
 
@@ -100,6 +180,86 @@ func (r repo) MarkDoneOutboxes(ctx context.Context, ids []int64) error {
 		return err
 	}
 
-	_, err = r.db.ExecContext(ctx, query, args...)
+	_, err = r.conn(ctx).ExecContext(ctx, query, args...)
+	return err
+}
+
+var recordOutboxAttemptQuery = "UPDATE order_outboxes SET status = :status, attempts = :attempts, " +
+	"last_error = :last_error, next_attempt_at = :next_attempt_at WHERE id = :id"
+
+// RecordOutboxAttempt stores the status, attempts, last error and next attempt of a rejected outbox row.
+func (r repo) RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, recordOutboxAttemptQuery, outbox)
+	return err
+}
+
+// the inner select is wrapped in a derived table, MySQL cannot LIMIT a subquery of IN nor select
+// from the table it deletes from
+var deleteCompletedOutboxesQuery = "DELETE FROM order_outboxes WHERE id IN (SELECT id FROM (" +
+	"SELECT id FROM order_outboxes WHERE status = ? AND updated_at < ? ORDER BY id LIMIT ?) AS batch)"
+
+// DeleteCompletedOutboxes deletes at most limit outbox rows completed before before, it returns how
+// many rows were deleted.
+func (r repo) DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := r.conn(ctx).ExecContext(ctx, deleteCompletedOutboxesQuery, model.OutboxCompleted, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+var receiveMessageCountQuery = "SELECT count(*) FROM inbox WHERE message_id = ? AND event_type = ?"
+
+var receiveMessageQuery = "INSERT INTO inbox (message_id, event_type, order_id) VALUES (:message_id, :event_type, :order_id)"
+
+// ReceiveMessage stores message in the inbox, it returns false when it was already received. The
+// primary key fails the transaction of a concurrent duplicate.
+func (r repo) ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error) {
+	var count int
+	err := r.conn(ctx).GetContext(ctx, &count, receiveMessageCountQuery, message.MessageID, message.EventType)
+	if err != nil || count > 0 {
+		return false, err
+	}
+	_, err = r.conn(ctx).NamedExecContext(ctx, receiveMessageQuery, message)
+	return err == nil, err
+}
+
+var isReceivedQuery = "SELECT count(*) FROM inbox WHERE order_id = ? AND event_type = ?"
+
+func (r repo) IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error) {
+	var res int
+	err := r.conn(ctx).GetContext(ctx, &res, isReceivedQuery, orderID, eventType)
+	return res > 0, err
+}
+
+var deleteInboxMessagesQuery = "DELETE FROM inbox WHERE (message_id, event_type) IN (" +
+	"SELECT message_id, event_type FROM (" +
+	"SELECT message_id, event_type FROM inbox WHERE received_at < ? ORDER BY received_at LIMIT ?) AS batch)"
+
+// DeleteInboxMessages deletes at most limit messages received before before, it returns how many
+// messages were deleted.
+func (r repo) DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := r.conn(ctx).ExecContext(ctx, deleteInboxMessagesQuery, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+var createAuditEntryQuery = "INSERT INTO saga_audit(order_id, service, kind, status, detail, occurred_at) " +
+	"VALUES (:order_id, :service, :kind, :status, :detail, :occurred_at)"
+
+func (r repo) CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, createAuditEntryQuery, entry)
 	return err
 }
+
+var getAuditEntriesQuery = "SELECT * FROM saga_audit WHERE order_id = ? ORDER BY id"
+
+func (r repo) GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error) {
+	var res []model.AuditEntry
+	err := r.conn(ctx).SelectContext(ctx, &res, getAuditEntriesQuery, orderID)
+	return res, err
+}
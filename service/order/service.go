@@ -2,21 +2,38 @@ package order
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/consume"
 	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
 	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/relay"
 	"github.com/rafata1/sagas-pattern-thesis/saga_event"
-	"log"
+	"github.com/rafata1/sagas-pattern-thesis/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sort"
 	"time"
 )
 
+const (
+	serviceName = "order"
+	outboxTable = "order_outboxes"
+)
+
 type IService interface {
 	CreateOrder(ctx context.Context, order model.Order) (int64, error)
 	RelayMessage(ctx context.Context, limit int) error
 	ConsumeBills(ctx context.Context, stopAfter time.Duration)
-	UpdateStatus(ctx context.Context, orderID int64, status model.OrderStatus) error
+	UpdateStatus(ctx context.Context, event saga_event.OrderEvent) error
 	ConsumeInventory(ctx context.Context, stopAfter time.Duration)
+	ConsumeShipments(ctx context.Context, stopAfter time.Duration)
+	GetTimeline(ctx context.Context, orderID int64) ([]model.AuditEntry, error)
+	TimeOutStuckOrders(ctx context.Context, limit int) error
 }
 
 func NewService(
@@ -24,23 +41,89 @@ func NewService(
 	producer kafka.IProducer,
 	billConsumer kafka.IConsumer,
 	inventoryConsumer kafka.IConsumer,
+	shipmentConsumer kafka.IConsumer,
+	opts ...Option,
 ) IService {
-	return &service{
+	s := &service{
 		repo:              repo,
 		producer:          producer,
 		billConsumer:      billConsumer,
 		inventoryConsumer: inventoryConsumer,
+		shipmentConsumer:  shipmentConsumer,
+		logger:            logging.Default(),
+		codec:             saga_event.JSON,
+		retry:             relay.DefaultRetry,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.publisher = relay.NewPublisher(outboxTable, s.repo, s.producer, s.retry, s.logger)
+	return s
 }
 
 type service struct {
 	repo              IRepo
 	billConsumer      kafka.IConsumer
 	inventoryConsumer kafka.IConsumer
+	shipmentConsumer  kafka.IConsumer
 	producer          kafka.IProducer
+	logger            *slog.Logger
+	codec             saga_event.Codec
+	retry             relay.Retry
+	publisher         *relay.Publisher
+	auditSources      []AuditSource
+	timeouts          map[model.OrderStatus]time.Duration
+}
+
+type Option func(s *service)
+
+// WithLogger replaces the default text logger, the service adds the message and order fields.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *service) {
+		s.logger = logger
+	}
 }
 
+// WithCodec sets how the events of the outbox are encoded, JSON by default.
+func WithCodec(codec saga_event.Codec) Option {
+	return func(s *service) {
+		s.codec = codec
+	}
+}
+
+// WithRelayRetry sets how outbox rows Kafka rejected are attempted again, relay.DefaultRetry by default.
+func WithRelayRetry(retry relay.Retry) Option {
+	return func(s *service) {
+		s.retry = retry
+	}
+}
+
+// AuditSource gives the saga_audit entries of another participant, usually its repo.
+type AuditSource interface {
+	GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error)
+}
+
+// WithAuditSources adds the audit logs of the other participants to the timelines of GetTimeline.
+func WithAuditSources(sources ...AuditSource) Option {
+	return func(s *service) {
+		s.auditSources = append(s.auditSources, sources...)
+	}
+}
+
+// WithTimeouts sets how long an order may wait in a status before TimeOutStuckOrders times it out,
+// orders in other statuses are never timed out.
+func WithTimeouts(timeouts map[model.OrderStatus]time.Duration) Option {
+	return func(s *service) {
+		s.timeouts = timeouts
+	}
+}
+
+// CreateOrder starts the trace of the saga, the outbox row carries it to the next services.
 func (s service) CreateOrder(ctx context.Context, order model.Order) (int64, error) {
+	ctx, span := tracing.Start(ctx, "order.CreateOrder", trace.WithAttributes(
+		attribute.Int64("order.customer_id", order.CustomerID),
+		attribute.Int64("order.product_id", order.ProductID),
+	))
 	var id int64
 	err := s.repo.Transact(ctx, func(ctx context.Context) error {
 		var err error
@@ -50,109 +133,258 @@ func (s service) CreateOrder(ctx context.Context, order model.Order) (int64, err
 			return err
 		}
 		// INSERT EVENT INTO OUTBOX
-		content, err := json.Marshal(saga_event.OrderEvent{
+		content, err := s.codec.Marshal(saga_event.OrderCreated{
 			OrderID:    id,
 			CustomerID: order.CustomerID,
 			ProductID:  order.ProductID,
 			Amount:     order.Amount,
+			PromoCode:  order.PromoCode,
 		})
 		if err != nil {
 			return err
 		}
 
-		return s.repo.CreateOutbox(ctx, model.Outbox{Content: content})
+		err = s.repo.CreateAuditEntry(ctx, model.NewAuditEntry(id, serviceName, model.AuditEmitted, model.OrderStatusPending,
+			fmt.Sprintf("%d x product %d for customer %d", order.Amount, order.ProductID, order.CustomerID)))
+		if err != nil {
+			return err
+		}
+
+		return s.repo.CreateOutbox(ctx, model.Outbox{
+			Content:     content,
+			ContentType: s.codec.ContentType(),
+			Headers:     tracing.Inject(ctx),
+		})
 	})
+	if err == nil {
+		metrics.Orders.WithLabelValues(model.OrderStatusPending).Inc()
+		span.SetAttributes(attribute.Int64("order.id", id))
+	}
+	tracing.End(span, err)
 	return id, err
 }
 
 func (s service) RelayMessage(ctx context.Context, limit int) error {
-	outboxes, err := s.repo.GetPendingOutbox(ctx, limit)
+	return s.publisher.Relay(ctx, limit)
+}
+
+func (s service) ConsumeBills(ctx context.Context, stopAfter time.Duration) {
+	consume.Loop(ctx, s.billConsumer, stopAfter, serviceName, "ConsumeBills", s.logger, s.UpdateStatus)
+}
+
+func (s service) UpdateStatus(ctx context.Context, event saga_event.OrderEvent) error {
+	var before model.Order
+	var changed bool
+	err := s.repo.Transact(ctx, func(ctx context.Context) error {
+		message, err := saga_event.InboxMessage(ctx, event)
+		if err != nil {
+			return err
+		}
+		received, err := s.repo.ReceiveMessage(ctx, message)
+		if err != nil || !received {
+			return err
+		}
+
+		before, err = s.repo.GetOrder(ctx, event.OrderID)
+		// like the update, an unknown order is ignored
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// the answers coming after a timeout are compensated by it, the order keeps TIMED_OUT
+		if before.Status == model.OrderStatusTimedOut {
+			if event.Status == model.OrderStatusTimedOut {
+				return nil
+			}
+			return s.repo.CreateAuditEntry(ctx, model.NewAuditEntry(event.OrderID, serviceName, model.AuditReceived,
+				event.Status, "ignored, the order timed out"))
+		}
+		// inventory and payment answer on two topics, a reservation read after the bill does not
+		// move the order back to PREPARED, where the watchdog could time it out after its confirmation
+		if event.Status == model.OrderStatusPrepared && before.Status != model.OrderStatusPending {
+			return nil
+		}
+		err = s.repo.UpdateStatus(ctx, model.Order{
+			ID:            event.OrderID,
+			Status:        event.Status,
+			FailureReason: event.Reason,
+			Cost:          event.Cost,
+		})
+		if err != nil || before.Status == event.Status {
+			return err
+		}
+		changed = true
+		err = s.repo.CreateAuditEntry(ctx, model.NewAuditEntry(event.OrderID, serviceName, model.AuditReceived,
+			event.Status, event.Reason))
+		if err != nil || event.Status != model.OrderStatusBilled {
+			return err
+		}
+		return s.confirm(ctx, before, event.Cost)
+	})
+	if err != nil {
+		return err
+	}
+
+	// a redelivered event is not received again, nor one that does not change the status, so
+	// neither is counted twice
+	if !changed {
+		return nil
+	}
+	metrics.Orders.WithLabelValues(string(event.Status)).Inc()
+	if event.Status.IsTerminal() && before.CreatedAt.Valid {
+		metrics.SagaDuration.WithLabelValues(string(event.Status)).Observe(time.Since(before.CreatedAt.Time).Seconds())
+	}
+	return nil
+}
+
+// confirm publishes the order billed for shipping, in the transaction that moved it to BILLED. The
+// watchdog does not time out billed orders, so a confirmed order is never compensated by a timeout.
+func (s service) confirm(ctx context.Context, order model.Order, cost model.Money) error {
+	content, err := s.codec.Marshal(saga_event.OrderConfirmed{
+		OrderID:    order.ID,
+		CustomerID: order.CustomerID,
+		ProductID:  order.ProductID,
+		Amount:     order.Amount,
+		Cost:       cost,
+	})
 	if err != nil {
 		return err
 	}
-	err = s.producer.Push(extractContents(outboxes))
+
+	err = s.repo.CreateAuditEntry(ctx, model.NewAuditEntry(order.ID, serviceName, model.AuditEmitted,
+		model.OrderStatusBilled, ""))
 	if err != nil {
 		return err
 	}
+	return s.repo.CreateOutbox(ctx, model.Outbox{
+		Content:     content,
+		ContentType: s.codec.ContentType(),
+		Headers:     tracing.Inject(ctx),
+	})
+}
 
-	err = s.repo.MarkDoneOutboxes(ctx, extractIDs(outboxes))
-	return err
+func (s service) ConsumeInventory(ctx context.Context, stopAfter time.Duration) {
+	consume.Loop(ctx, s.inventoryConsumer, stopAfter, serviceName, "ConsumeInventory", s.logger, s.UpdateStatus)
 }
 
-func extractIDs(outboxes []model.Outbox) []int64 {
-	var res []int64
-	for _, outbox := range outboxes {
-		res = append(res, outbox.ID)
-	}
-	return res
+func (s service) ConsumeShipments(ctx context.Context, stopAfter time.Duration) {
+	consume.Loop(ctx, s.shipmentConsumer, stopAfter, serviceName, "ConsumeShipments", s.logger, s.UpdateStatus)
 }
 
-func extractContents(outboxes []model.Outbox) [][]byte {
-	var res [][]byte
-	for _, outbox := range outboxes {
-		res = append(res, outbox.Content)
+// GetTimeline merges the audit entries of the order from every participant in the order they occurred,
+// sql.ErrNoRows is returned for an unknown order.
+func (s service) GetTimeline(ctx context.Context, orderID int64) ([]model.AuditEntry, error) {
+	_, err := s.repo.GetOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
 	}
-	return res
+
+	res, err := s.repo.GetAuditEntries(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range s.auditSources {
+		entries, err := source.GetAuditEntries(ctx, orderID)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entries...)
+	}
+	// entries of one participant written at the same microsecond keep their id order
+	sort.SliceStable(res, func(i, j int) bool { return res[i].OccurredAt.Before(res[j].OccurredAt.Time) })
+	return res, nil
 }
 
-func (s service) ConsumeBills(ctx context.Context, stopAfter time.Duration) {
-	startTime := time.Now()
-	for {
-		select {
-		case msg := <-s.billConsumer.Messages():
-			fmt.Printf("Received message: Topic: %s, Partition: %d, Offset: %d, Key: %s, Value: %s\n",
-				msg.Topic, msg.Partition, msg.Offset, string(msg.Key), string(msg.Value),
-			)
-			var event saga_event.OrderEvent
-			err := json.Unmarshal(msg.Value, &event)
-			if err != nil {
-				panic(err)
-				// mark message on queue as not done
-			}
-			err = s.UpdateStatus(ctx, event.OrderID, event.Status)
+// TimeOutStuckOrders moves the orders waiting in a status for longer than its timeout to TIMED_OUT
+// and publishes the timeout, inventory releases the stock it reserved and payment refunds the order.
+// An order failing to time out does not hold back the others, the errors are returned together.
+func (s service) TimeOutStuckOrders(ctx context.Context, limit int) error {
+	statuses := make([]model.OrderStatus, 0, len(s.timeouts))
+	for status := range s.timeouts {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i] < statuses[j] })
+
+	var errs []error
+	for _, status := range statuses {
+		timeout := s.timeouts[status]
+		if timeout <= 0 {
+			continue
+		}
+		stuck, err := s.repo.GetStuckOrders(ctx, status, time.Now().UTC().Add(-timeout), limit)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, order := range stuck {
+			err = s.timeOut(ctx, order, fmt.Sprintf("no answer in %s for %s", status, timeout))
 			if err != nil {
-				panic(err)
-				// mark message on queue as not done
-			}
-		case err := <-s.billConsumer.Errors():
-			log.Printf("Failed to consume message: %s", err)
-		default:
-			if stopAfter != 0 && time.Now().After(startTime.Add(stopAfter)) {
-				return
+				s.logger.Error("Failed to time out order",
+					slog.Int64("order_id", order.ID), slog.String("status", string(status)), slog.Any("error", err),
+				)
+				metrics.TimeoutErrors.WithLabelValues(string(status)).Inc()
+				errs = append(errs, fmt.Errorf("order %d: %w", order.ID, err))
 			}
 		}
 	}
+	return errors.Join(errs...)
 }
 
-func (s service) UpdateStatus(ctx context.Context, orderID int64, status model.OrderStatus) error {
-	return s.repo.UpdateStatus(ctx, orderID, status)
-}
+func (s service) timeOut(ctx context.Context, order model.Order, reason string) error {
+	ctx, span := tracing.Start(ctx, "order.TimeOut", trace.WithAttributes(
+		attribute.Int64("order.id", order.ID),
+		attribute.String("order.status", string(order.Status)),
+	))
+	var timedOut bool
+	err := s.repo.Transact(ctx, func(ctx context.Context) error {
+		var err error
+		// an answer may have moved the order on since it was found stuck
+		timedOut, err = s.repo.UpdateStatusFrom(ctx, model.Order{
+			ID:            order.ID,
+			Status:        model.OrderStatusTimedOut,
+			FailureReason: reason,
+		}, order.Status)
+		if err != nil || !timedOut {
+			return err
+		}
 
-func (s service) ConsumeInventory(ctx context.Context, stopAfter time.Duration) {
-	startTime := time.Now()
-	for {
-		select {
-		case msg := <-s.inventoryConsumer.Messages():
-			fmt.Printf("Received message: Topic: %s, Partition: %d, Offset: %d, Key: %s, Value: %s\n",
-				msg.Topic, msg.Partition, msg.Offset, string(msg.Key), string(msg.Value),
-			)
-			var event saga_event.OrderEvent
-			err := json.Unmarshal(msg.Value, &event)
-			if err != nil {
-				panic(err)
-				// mark message on queue as not done
-			}
-			err = s.UpdateStatus(ctx, event.OrderID, event.Status)
-			if err != nil {
-				panic(err)
-				// mark message on queue as not done
-			}
-		case err := <-s.inventoryConsumer.Errors():
-			log.Printf("Failed to consume message: %s", err)
-		default:
-			if stopAfter != 0 && time.Now().After(startTime.Add(stopAfter)) {
-				return
-			}
+		content, err := s.codec.Marshal(saga_event.OrderTimedOut{
+			OrderID:    order.ID,
+			CustomerID: order.CustomerID,
+			ProductID:  order.ProductID,
+			Amount:     order.Amount,
+			Cost:       order.Cost,
+			Reason:     reason,
+		})
+		if err != nil {
+			return err
 		}
+
+		err = s.repo.CreateAuditEntry(ctx, model.NewAuditEntry(order.ID, serviceName, model.AuditEmitted,
+			model.OrderStatusTimedOut, reason))
+		if err != nil {
+			return err
+		}
+		return s.repo.CreateOutbox(ctx, model.Outbox{
+			Content:     content,
+			ContentType: s.codec.ContentType(),
+			Headers:     tracing.Inject(ctx),
+		})
+	})
+	tracing.End(span, err)
+	if err != nil || !timedOut {
+		return err
+	}
+
+	s.logger.Warn("Timed out order",
+		slog.Int64("order_id", order.ID), slog.String("status", string(order.Status)), slog.String("reason", reason),
+	)
+	metrics.Timeouts.WithLabelValues(string(order.Status)).Inc()
+	metrics.Orders.WithLabelValues(model.OrderStatusTimedOut).Inc()
+	if order.CreatedAt.Valid {
+		metrics.SagaDuration.WithLabelValues(model.OrderStatusTimedOut).Observe(time.Since(order.CreatedAt.Time).Seconds())
 	}
+	return nil
 }
@@ -0,0 +1,65 @@
+package order
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimelinePath is where NewTimelineHandler is mounted, it serves GET /orders/{id}/timeline.
+const TimelinePath = "/orders/"
+
+type timelineEntry struct {
+	OccurredAt time.Time         `json:"occurred_at"`
+	Service    string            `json:"service"`
+	Kind       model.AuditKind   `json:"kind"`
+	Status     model.OrderStatus `json:"status,omitempty"`
+	Detail     string            `json:"detail,omitempty"`
+}
+
+// NewTimelineHandler serves the timeline of GetTimeline as JSON, the entries of every participant
+// in the order they occurred. Failures are logged to logger.
+func NewTimelineHandler(svc IService, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, TimelinePath), "/")
+		orderID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || rest != "timeline" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		timeline, err := svc.GetTimeline(r.Context(), orderID)
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to get timeline", slog.Int64("order_id", orderID), slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res := make([]timelineEntry, 0, len(timeline))
+		for _, entry := range timeline {
+			res = append(res, timelineEntry{
+				OccurredAt: entry.OccurredAt.Time,
+				Service:    entry.Service,
+				Kind:       entry.Kind,
+				Status:     entry.Status,
+				Detail:     entry.Detail,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
@@ -0,0 +1,71 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	// CallbackSignatureHeader carries the SignCallback signature of the body of a callback.
+	CallbackSignatureHeader = "X-Signature"
+	maxCallbackBytes        = 1 << 20
+)
+
+// SignCallback is the signature the gateway sends with a callback body, the hex HMAC-SHA256 of the
+// body with the secret shared with the gateway.
+func SignCallback(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewCallbackHandler serves the webhook the payment gateway posts GatewayCallback to. Callbacks
+// without the signature of secret are refused before they are read.
+func NewCallbackHandler(svc IService, secret string, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxCallbackBytes))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		signature := r.Header.Get(CallbackSignatureHeader)
+		if secret == "" || !hmac.Equal([]byte(signature), []byte(SignCallback(secret, body))) {
+			logger.Warn("Refused gateway callback with a wrong signature", slog.String("remote_addr", r.RemoteAddr))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var callback GatewayCallback
+		err = json.Unmarshal(body, &callback)
+		if err != nil || callback.AuthorizationID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = svc.HandleGatewayCallback(r.Context(), callback)
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to handle gateway callback",
+				slog.String("authorization_id", callback.AuthorizationID), slog.Any("error", err),
+			)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,108 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"sync"
+)
+
+var ErrUnknownAuthorization = errors.New("unknown authorization")
+var ErrInvalidAuthorizationState = errors.New("invalid authorization state")
+
+const DeclineReasonCardDeclined = "CARD_DECLINED"
+
+// FakeGateway is an in-process PaymentGateway for tests. In async mode every
+// authorization stays pending until the test settles it with a callback.
+type FakeGateway struct {
+	mu             sync.Mutex
+	async          bool
+	declined       map[int64]bool
+	authorizations map[string]model.AuthorizationStatus
+	orders         map[int64]string
+	nextID         int
+}
+
+func NewFakeGateway(async bool) *FakeGateway {
+	return &FakeGateway{
+		async:          async,
+		declined:       map[int64]bool{},
+		authorizations: map[string]model.AuthorizationStatus{},
+		orders:         map[int64]string{},
+	}
+}
+
+// DeclineCustomer makes every following authorization of the customer fail.
+func (g *FakeGateway) DeclineCustomer(customerID int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.declined[customerID] = true
+}
+
+// AuthorizationID returns the last authorization made for the order.
+func (g *FakeGateway) AuthorizationID(orderID int64) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.orders[orderID]
+}
+
+// Status returns the state of an authorization as seen by the gateway.
+func (g *FakeGateway) Status(authorizationID string) model.AuthorizationStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.authorizations[authorizationID]
+}
+
+func (g *FakeGateway) Authorize(
+	ctx context.Context, orderID int64, customerID int64, amount model.Money,
+) (Authorization, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.nextID++
+	id := fmt.Sprintf("fake-%d-%d", orderID, g.nextID)
+	g.orders[orderID] = id
+
+	if g.declined[customerID] {
+		g.authorizations[id] = model.AuthorizationDeclined
+		return Authorization{ID: id, Result: AuthorizationResultDeclined, DeclineReason: DeclineReasonCardDeclined}, nil
+	}
+
+	g.authorizations[id] = model.AuthorizationPending
+	if g.async {
+		return Authorization{ID: id, Result: AuthorizationResultPending}, nil
+	}
+	return Authorization{ID: id, Result: AuthorizationResultApproved}, nil
+}
+
+func (g *FakeGateway) Capture(ctx context.Context, authorizationID string) error {
+	return g.transition(authorizationID, model.AuthorizationPending, model.AuthorizationCaptured)
+}
+
+func (g *FakeGateway) Void(ctx context.Context, authorizationID string) error {
+	return g.transition(authorizationID, model.AuthorizationPending, model.AuthorizationVoided)
+}
+
+func (g *FakeGateway) Refund(ctx context.Context, authorizationID string, amount model.Money) error {
+	return g.transition(authorizationID, model.AuthorizationCaptured, model.AuthorizationRefunded)
+}
+
+func (g *FakeGateway) transition(authorizationID string, from model.AuthorizationStatus, to model.AuthorizationStatus) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	status, ok := g.authorizations[authorizationID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownAuthorization, authorizationID)
+	}
+	// a call retried after the gateway did it changes nothing
+	if status == to {
+		return nil
+	}
+	if status != from {
+		return fmt.Errorf("%w: %s is %s", ErrInvalidAuthorizationState, authorizationID, status)
+	}
+	g.authorizations[authorizationID] = to
+	return nil
+}
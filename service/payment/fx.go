@@ -0,0 +1,70 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"math"
+)
+
+var ErrRateNotFound = errors.New("exchange rate not found")
+
+// IRateProvider returns how many units of the target currency one unit of the source currency buys.
+type IRateProvider interface {
+	Rate(ctx context.Context, from string, to string) (float64, error)
+}
+
+// Rate is one entry of a static rate table, its inverse is derived automatically.
+type Rate struct {
+	From string
+	To   string
+	Rate float64
+}
+
+type staticRateProvider struct {
+	rates map[string]float64
+}
+
+// NewStaticRateProvider serves rates from a fixed table, a stand-in for a real FX feed.
+func NewStaticRateProvider(rates ...Rate) IRateProvider {
+	table := make(map[string]float64, 2*len(rates))
+	for _, rate := range rates {
+		table[rateKey(rate.From, rate.To)] = rate.Rate
+		if _, ok := table[rateKey(rate.To, rate.From)]; !ok && rate.Rate != 0 {
+			table[rateKey(rate.To, rate.From)] = 1 / rate.Rate
+		}
+	}
+	return &staticRateProvider{rates: table}
+}
+
+func (p staticRateProvider) Rate(ctx context.Context, from string, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	rate, ok := p.rates[rateKey(from, to)]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s to %s", ErrRateNotFound, from, to)
+	}
+	return rate, nil
+}
+
+func rateKey(from string, to string) string {
+	return from + "/" + to
+}
+
+// Convert converts money into currency, rounding to the nearest minor unit of currency.
+func Convert(ctx context.Context, provider IRateProvider, money model.Money, currency string) (model.Money, error) {
+	if money.Currency == currency {
+		return money, nil
+	}
+
+	rate, err := provider.Rate(ctx, money.Currency, currency)
+	if err != nil {
+		return model.Money{}, err
+	}
+
+	major := float64(money.Amount) / math.Pow10(model.MinorUnitExponent(money.Currency))
+	minor := math.Round(major * rate * math.Pow10(model.MinorUnitExponent(currency)))
+	return model.NewMoney(int64(minor), currency), nil
+}
@@ -0,0 +1,37 @@
+package payment
+
+import (
+	"context"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+)
+
+type AuthorizationResult string
+
+const (
+	AuthorizationResultApproved AuthorizationResult = "APPROVED"
+	AuthorizationResultPending  AuthorizationResult = "PENDING"
+	AuthorizationResultDeclined AuthorizationResult = "DECLINED"
+)
+
+// Authorization is the gateway answer to an authorization request. A pending
+// authorization is settled later through a callback, see GatewayCallback.
+type Authorization struct {
+	ID            string
+	Result        AuthorizationResult
+	DeclineReason string
+}
+
+// PaymentGateway charges customers through an external payment provider.
+type PaymentGateway interface {
+	Authorize(ctx context.Context, orderID int64, customerID int64, amount model.Money) (Authorization, error)
+	Capture(ctx context.Context, authorizationID string) error
+	Void(ctx context.Context, authorizationID string) error
+	Refund(ctx context.Context, authorizationID string, amount model.Money) error
+}
+
+// GatewayCallback is sent by the gateway once a pending authorization is settled.
+type GatewayCallback struct {
+	AuthorizationID string `json:"authorization_id"`
+	Approved        bool   `json:"approved"`
+	Reason          string `json:"reason"`
+}
@@ -0,0 +1,333 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/storage/memory"
+	"sort"
+	"time"
+)
+
+// NewMemoryRepo keeps accounts, charges and authorizations in memory, it behaves like the MySQL
+// repo for tests.
+func NewMemoryRepo() IRepo {
+	store := memory.NewStore()
+	return &memoryRepo{
+		store:          store,
+		accounts:       map[int64]model.Account{},
+		charges:        map[int64]model.Charge{},
+		authorizations: map[string]model.PaymentAuthorization{},
+		outboxes:       memory.NewOutboxes(store),
+		audit:          memory.NewAuditLog(store),
+		inbox:          memory.NewInbox(store),
+	}
+}
+
+type memoryRepo struct {
+	store          *memory.Store
+	accounts       map[int64]model.Account
+	charges        map[int64]model.Charge
+	authorizations map[string]model.PaymentAuthorization
+	outboxes       *memory.Outboxes
+	audit          *memory.AuditLog
+	inbox          *memory.Inbox
+}
+
+func accountKey(customerID int64) string {
+	return fmt.Sprintf("account:%d", customerID)
+}
+
+func chargeKey(orderID int64) string {
+	return fmt.Sprintf("charge:%d", orderID)
+}
+
+func authorizationKey(authorizationID string) string {
+	return "authorization:" + authorizationID
+}
+
+func (r *memoryRepo) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.store.Transact(ctx, fn)
+}
+
+func (r *memoryRepo) LockAccountForUpdate(ctx context.Context, customerID int64) (model.Account, error) {
+	err := r.store.Lock(ctx, accountKey(customerID))
+	if err != nil {
+		return model.Account{}, err
+	}
+	return r.GetAccount(ctx, customerID)
+}
+
+func (r *memoryRepo) UpdateBalance(ctx context.Context, customerID int64, balance model.Money) error {
+	return r.store.Write(ctx, accountKey(customerID), func() (func(), error) {
+		old, ok := r.accounts[customerID]
+		if !ok {
+			return nil, nil
+		}
+		updated := old
+		updated.Balance = balance
+		updated.UpdatedAt = memory.Now()
+		r.accounts[customerID] = updated
+		return func() { r.accounts[customerID] = old }, nil
+	})
+}
+
+func (r *memoryRepo) CreateOutbox(ctx context.Context, outbox model.Outbox) error {
+	return r.outboxes.Create(ctx, outbox)
+}
+
+func (r *memoryRepo) CreateAccount(ctx context.Context, account model.Account) error {
+	return r.store.Write(ctx, accountKey(account.CustomerID), func() (func(), error) {
+		if _, ok := r.accounts[account.CustomerID]; ok {
+			return nil, fmt.Errorf("account %d: %w", account.CustomerID, memory.ErrDuplicateKey)
+		}
+		r.accounts[account.CustomerID] = model.Account{
+			CustomerID:       account.CustomerID,
+			Balance:          account.Balance,
+			CreditLimit:      account.CreditLimit,
+			DailySpendingCap: account.DailySpendingCap,
+			CreatedAt:        memory.Now(),
+		}
+		return func() { delete(r.accounts, account.CustomerID) }, nil
+	})
+}
+
+func (r *memoryRepo) GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	return r.outboxes.Pending(limit), nil
+}
+
+func (r *memoryRepo) GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	return r.outboxes.Retried(limit), nil
+}
+
+func (r *memoryRepo) CountPendingOutbox(ctx context.Context) (int, error) {
+	return r.outboxes.CountPending(), nil
+}
+
+func (r *memoryRepo) MarkDoneOutboxes(ctx context.Context, ids []int64) error {
+	return r.outboxes.MarkDone(ctx, ids)
+}
+
+func (r *memoryRepo) RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error {
+	return r.outboxes.RecordAttempt(ctx, outbox)
+}
+
+func (r *memoryRepo) DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error) {
+	return r.outboxes.DeleteCompleted(ctx, before, limit)
+}
+
+func (r *memoryRepo) GetAccount(ctx context.Context, customerID int64) (model.Account, error) {
+	var res model.Account
+	var ok bool
+	r.store.Read(func() {
+		res, ok = r.accounts[customerID]
+	})
+	if !ok {
+		return model.Account{}, sql.ErrNoRows
+	}
+	return res, nil
+}
+
+func (r *memoryRepo) CreateCharge(ctx context.Context, charge model.Charge) error {
+	return r.store.Write(ctx, chargeKey(charge.OrderID), func() (func(), error) {
+		if _, ok := r.charges[charge.OrderID]; ok {
+			return nil, fmt.Errorf("charge %d: %w", charge.OrderID, memory.ErrDuplicateKey)
+		}
+		r.charges[charge.OrderID] = model.Charge{
+			OrderID:    charge.OrderID,
+			CustomerID: charge.CustomerID,
+			Cost:       charge.Cost,
+			CreatedAt:  memory.Now(),
+		}
+		return func() { delete(r.charges, charge.OrderID) }, nil
+	})
+}
+
+func (r *memoryRepo) GetSpentSince(ctx context.Context, customerID int64, since time.Time) (int64, error) {
+	var res int64
+	r.store.Read(func() {
+		for _, charge := range r.charges {
+			if charge.CustomerID == customerID && !charge.CreatedAt.Time.Before(since) && !charge.RefundedAt.Valid {
+				res += charge.Cost.Amount
+			}
+		}
+	})
+	return res, nil
+}
+
+func (r *memoryRepo) CreateAuthorization(ctx context.Context, authorization model.PaymentAuthorization) error {
+	key := authorizationKey(authorization.AuthorizationID)
+	return r.store.Write(ctx, key, func() (func(), error) {
+		if _, ok := r.authorizations[authorization.AuthorizationID]; ok {
+			return nil, fmt.Errorf("authorization %s: %w", authorization.AuthorizationID, memory.ErrDuplicateKey)
+		}
+		for _, other := range r.authorizations {
+			if other.OrderID == authorization.OrderID {
+				return nil, fmt.Errorf("authorization of order %d: %w", authorization.OrderID, memory.ErrDuplicateKey)
+			}
+		}
+		created := authorization
+		created.Event = append([]byte(nil), authorization.Event...)
+		created.CreatedAt = memory.Now()
+		created.UpdatedAt = sql.NullTime{}
+		r.authorizations[authorization.AuthorizationID] = created
+		return func() { delete(r.authorizations, authorization.AuthorizationID) }, nil
+	})
+}
+
+func (r *memoryRepo) LockAuthorizationForUpdate(
+	ctx context.Context, authorizationID string,
+) (model.PaymentAuthorization, error) {
+	err := r.store.Lock(ctx, authorizationKey(authorizationID))
+	if err != nil {
+		return model.PaymentAuthorization{}, err
+	}
+
+	var res model.PaymentAuthorization
+	var ok bool
+	r.store.Read(func() {
+		res, ok = r.authorizations[authorizationID]
+	})
+	if !ok {
+		return model.PaymentAuthorization{}, sql.ErrNoRows
+	}
+	return res, nil
+}
+
+func (r *memoryRepo) UpdateAuthorizationStatus(
+	ctx context.Context, authorizationID string, status model.AuthorizationStatus,
+) error {
+	return r.store.Write(ctx, authorizationKey(authorizationID), func() (func(), error) {
+		old, ok := r.authorizations[authorizationID]
+		if !ok {
+			return nil, nil
+		}
+		updated := old
+		updated.Status = status
+		updated.UpdatedAt = memory.Now()
+		r.authorizations[authorizationID] = updated
+		return func() { r.authorizations[authorizationID] = old }, nil
+	})
+}
+
+func (r *memoryRepo) RecordAuthorization(ctx context.Context, authorization model.PaymentAuthorization) error {
+	requested, err := r.LockAuthorizationByOrderForUpdate(ctx, authorization.OrderID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the authorizations are keyed by their id, the requested one moves to the id of the gateway
+	return r.store.Write(ctx, authorizationKey(requested.AuthorizationID), func() (func(), error) {
+		old := r.authorizations[requested.AuthorizationID]
+		updated := old
+		updated.AuthorizationID = authorization.AuthorizationID
+		updated.Status = authorization.Status
+		updated.ExpiresAt = authorization.ExpiresAt
+		updated.UpdatedAt = memory.Now()
+		delete(r.authorizations, old.AuthorizationID)
+		r.authorizations[updated.AuthorizationID] = updated
+		return func() {
+			delete(r.authorizations, updated.AuthorizationID)
+			r.authorizations[old.AuthorizationID] = old
+		}, nil
+	})
+}
+
+func (r *memoryRepo) GetExpiredAuthorizations(
+	ctx context.Context, now time.Time, limit int,
+) ([]model.PaymentAuthorization, error) {
+	var res []model.PaymentAuthorization
+	r.store.Read(func() {
+		for _, authorization := range r.authorizations {
+			if expiring(authorization.Status) && authorization.ExpiresAt.Valid && !authorization.ExpiresAt.Time.After(now) {
+				res = append(res, authorization)
+			}
+		}
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].OrderID < res[j].OrderID })
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+func expiring(status model.AuthorizationStatus) bool {
+	switch status {
+	case model.AuthorizationRequested, model.AuthorizationPending,
+		model.AuthorizationCapturing, model.AuthorizationVoiding, model.AuthorizationRefunding:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *memoryRepo) LockAuthorizationByOrderForUpdate(
+	ctx context.Context, orderID int64,
+) (model.PaymentAuthorization, error) {
+	var authorizationID string
+	r.store.Read(func() {
+		for id, authorization := range r.authorizations {
+			if authorization.OrderID == orderID {
+				authorizationID = id
+			}
+		}
+	})
+	if authorizationID == "" {
+		return model.PaymentAuthorization{}, sql.ErrNoRows
+	}
+	return r.LockAuthorizationForUpdate(ctx, authorizationID)
+}
+
+func (r *memoryRepo) LockChargeForUpdate(ctx context.Context, orderID int64) (model.Charge, error) {
+	err := r.store.Lock(ctx, chargeKey(orderID))
+	if err != nil {
+		return model.Charge{}, err
+	}
+
+	var res model.Charge
+	var ok bool
+	r.store.Read(func() {
+		res, ok = r.charges[orderID]
+	})
+	if !ok {
+		return model.Charge{}, sql.ErrNoRows
+	}
+	return res, nil
+}
+
+func (r *memoryRepo) MarkChargeRefunded(ctx context.Context, orderID int64) error {
+	return r.store.Write(ctx, chargeKey(orderID), func() (func(), error) {
+		old, ok := r.charges[orderID]
+		if !ok {
+			return nil, nil
+		}
+		updated := old
+		updated.RefundedAt = memory.Now()
+		r.charges[orderID] = updated
+		return func() { r.charges[orderID] = old }, nil
+	})
+}
+
+func (r *memoryRepo) ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error) {
+	return r.inbox.Receive(ctx, message)
+}
+
+func (r *memoryRepo) IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error) {
+	return r.inbox.IsReceived(orderID, eventType), nil
+}
+
+func (r *memoryRepo) DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error) {
+	return r.inbox.Delete(ctx, before, limit)
+}
+
+func (r *memoryRepo) CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error {
+	return r.audit.Append(ctx, entry)
+}
+
+func (r *memoryRepo) GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error) {
+	return r.audit.ForOrder(orderID), nil
+}
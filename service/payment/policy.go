@@ -0,0 +1,71 @@
+package payment
+
+import "github.com/rafata1/sagas-pattern-thesis/model"
+
+const (
+	RejectReasonInsufficientBalance  = "INSUFFICIENT_BALANCE"
+	RejectReasonCreditLimitExceeded  = "CREDIT_LIMIT_EXCEEDED"
+	RejectReasonDailyCapExceeded     = "DAILY_SPENDING_CAP_EXCEEDED"
+	RejectReasonUnsupportedCurrency  = "UNSUPPORTED_CURRENCY"
+	RejectReasonAuthorizationTimeout = "AUTHORIZATION_TIMEOUT"
+)
+
+// CreditCheck is what a policy gets to decide on, read inside the locked transaction.
+// Cost and SpentToday are already converted to the account currency.
+type CreditCheck struct {
+	Account    model.Account
+	Cost       model.Money
+	SpentToday int64
+}
+
+// ICreditPolicy decides whether an account may be charged.
+// An empty reason means the charge is allowed.
+type ICreditPolicy interface {
+	Check(check CreditCheck) (reason string)
+}
+
+type strictPrepaidPolicy struct{}
+
+// NewStrictPrepaidPolicy only allows charges covered by the current balance.
+func NewStrictPrepaidPolicy() ICreditPolicy {
+	return strictPrepaidPolicy{}
+}
+
+func (strictPrepaidPolicy) Check(check CreditCheck) string {
+	if check.Account.Balance.Amount < check.Cost.Amount {
+		return RejectReasonInsufficientBalance
+	}
+	return ""
+}
+
+type overdraftPolicy struct{}
+
+// NewOverdraftPolicy lets the balance go negative down to the account credit limit.
+func NewOverdraftPolicy() ICreditPolicy {
+	return overdraftPolicy{}
+}
+
+func (overdraftPolicy) Check(check CreditCheck) string {
+	if check.Account.Balance.Amount+check.Account.CreditLimit < check.Cost.Amount {
+		return RejectReasonCreditLimitExceeded
+	}
+	return ""
+}
+
+type dailyCapPolicy struct {
+	next ICreditPolicy
+}
+
+// NewDailyCapPolicy rejects charges which would take the spending of the day over
+// the account daily cap, then defers to next. A zero cap means no cap.
+func NewDailyCapPolicy(next ICreditPolicy) ICreditPolicy {
+	return dailyCapPolicy{next: next}
+}
+
+func (p dailyCapPolicy) Check(check CreditCheck) string {
+	dailyCap := check.Account.DailySpendingCap
+	if dailyCap > 0 && check.SpentToday+check.Cost.Amount > dailyCap {
+		return RejectReasonDailyCapExceeded
+	}
+	return p.next.Check(check)
+}
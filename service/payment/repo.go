@@ -4,19 +4,38 @@ import (
 	"context"
 	"github.com/jmoiron/sqlx"
 	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/storage"
+	"time"
 )
 
 type IRepo interface {
 	Transact(ctx context.Context, fn func(ctx context.Context) error) error
 	LockAccountForUpdate(ctx context.Context, customerID int64) (model.Account, error)
-	UpdateBalance(ctx context.Context, customerID int64, balance int) error
+	UpdateBalance(ctx context.Context, customerID int64, balance model.Money) error
+	ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error)
+	IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error)
 	CreateOutbox(ctx context.Context, outbox model.Outbox) error
-	IsProcessed(ctx context.Context, orderID int64) (bool, error)
-	MarkProcessedOrder(ctx context.Context, orderID int64) error
 	CreateAccount(ctx context.Context, account model.Account) error
 	GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error)
+	GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error)
+	CountPendingOutbox(ctx context.Context) (int, error)
+	CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error
+	GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error)
 	MarkDoneOutboxes(ctx context.Context, ids []int64) error
+	RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error
+	DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error)
+	DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error)
 	GetAccount(ctx context.Context, customerID int64) (model.Account, error)
+	CreateCharge(ctx context.Context, charge model.Charge) error
+	GetSpentSince(ctx context.Context, customerID int64, since time.Time) (int64, error)
+	CreateAuthorization(ctx context.Context, authorization model.PaymentAuthorization) error
+	LockAuthorizationForUpdate(ctx context.Context, authorizationID string) (model.PaymentAuthorization, error)
+	UpdateAuthorizationStatus(ctx context.Context, authorizationID string, status model.AuthorizationStatus) error
+	RecordAuthorization(ctx context.Context, authorization model.PaymentAuthorization) error
+	GetExpiredAuthorizations(ctx context.Context, now time.Time, limit int) ([]model.PaymentAuthorization, error)
+	LockAuthorizationByOrderForUpdate(ctx context.Context, orderID int64) (model.PaymentAuthorization, error)
+	LockChargeForUpdate(ctx context.Context, orderID int64) (model.Charge, error)
+	MarkChargeRefunded(ctx context.Context, orderID int64) error
 }
 
 type repo struct {
@@ -30,75 +49,71 @@ func NewRepo(db *sqlx.DB) IRepo {
 }
 
 func (r repo) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
-	tx, err := r.db.BeginTxx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			err = tx.Rollback()
-			panic(r)
-		} else if err != nil {
-			_ = tx.Rollback()
-		}
-	}()
-
-	err = fn(ctx)
-	if err != nil {
-		return err
-	}
-	return tx.Commit()
+	return storage.Transact(ctx, r.db, fn)
 }
 
-var lockAccountForUpdateQuery = "SELECT * FROM accounts WHERE customer_id = ? FOR UPDATE"
+// conn runs queries in the transaction of ctx, if any
+func (r repo) conn(ctx context.Context) storage.Querier {
+	return storage.Conn(ctx, r.db)
+}
+
+// balance columns are aliased so sqlx maps them into model.Money
+var accountColumns = "customer_id, balance AS \"balance.amount\", currency AS \"balance.currency\", " +
+	"credit_limit, daily_spending_cap, created_at, updated_at"
+
+var lockAccountForUpdateQuery = "SELECT " + accountColumns + " FROM accounts WHERE customer_id = ? FOR UPDATE"
 
 func (r repo) LockAccountForUpdate(ctx context.Context, customerID int64) (model.Account, error) {
 	var res model.Account
-	err := r.db.GetContext(ctx, &res, lockAccountForUpdateQuery, customerID)
+	err := r.conn(ctx).GetContext(ctx, &res, lockAccountForUpdateQuery, customerID)
 	return res, err
 }
 
-var updateBalanceQuery = "UPDATE accounts SET balance = ? WHERE customer_id = ?"
+var updateBalanceQuery = "UPDATE accounts SET balance = ?, currency = ? WHERE customer_id = ?"
 
-func (r repo) UpdateBalance(ctx context.Context, customerID int64, balance int) error {
-	_, err := r.db.ExecContext(ctx, updateBalanceQuery, balance, customerID)
+func (r repo) UpdateBalance(ctx context.Context, customerID int64, balance model.Money) error {
+	_, err := r.conn(ctx).ExecContext(ctx, updateBalanceQuery, balance.Amount, balance.Currency, customerID)
 	return err
 }
 
-var createOutboxQuery = "INSERT INTO payment_outboxes(content) VALUES (:content)"
+var createOutboxQuery = "INSERT INTO payment_outboxes(content, content_type, headers) VALUES (:content, :content_type, :headers)"
 
 func (r repo) CreateOutbox(ctx context.Context, outbox model.Outbox) error {
-	_, err := r.db.NamedExecContext(ctx, createOutboxQuery, outbox)
+	_, err := r.conn(ctx).NamedExecContext(ctx, createOutboxQuery, outbox)
 	return err
 }
 
-var isProcessedQuery = "SELECT count(*) FROM processed_orders WHERE order_id = ?"
+var createAccountQuery = "INSERT INTO accounts (customer_id, balance, currency, credit_limit, daily_spending_cap) " +
+	"VALUES (:customer_id, :balance.amount, :balance.currency, :credit_limit, :daily_spending_cap)"
 
-func (r repo) IsProcessed(ctx context.Context, orderID int64) (bool, error) {
-	var res int
-	err := r.db.GetContext(ctx, &res, isProcessedQuery, orderID)
-	return res > 0, err
+func (r repo) CreateAccount(ctx context.Context, account model.Account) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, createAccountQuery, account)
+	return err
 }
 
-var markProcessedOrderQuery = "INSERT INTO processed_orders (order_id) VALUES (?)"
+var getPendingOutboxQuery = "SELECT * FROM payment_outboxes " +
+	"WHERE status = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?) ORDER BY id LIMIT ?"
 
-func (r repo) MarkProcessedOrder(ctx context.Context, orderID int64) error {
-	_, err := r.db.Exec(markProcessedOrderQuery, orderID)
-	return err
+func (r repo) GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	var res []model.Outbox
+	err := r.conn(ctx).SelectContext(ctx, &res, getPendingOutboxQuery, model.OutboxPending, time.Now(), limit)
+	return res, err
 }
 
-var createAccountQuery = "INSERT INTO accounts (customer_id, balance) VALUES (:customer_id, :balance)"
+var getRetriedOutboxQuery = "SELECT * FROM payment_outboxes " +
+	"WHERE status = ? AND attempts > 0 AND next_attempt_at <= ? ORDER BY id LIMIT ?"
 
-func (r repo) CreateAccount(ctx context.Context, account model.Account) error {
-	_, err := r.db.NamedExecContext(ctx, createAccountQuery, account)
-	return err
+func (r repo) GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	var res []model.Outbox
+	err := r.conn(ctx).SelectContext(ctx, &res, getRetriedOutboxQuery, model.OutboxPending, time.Now(), limit)
+	return res, err
 }
 
-var getPendingOutboxQuery = "SELECT * FROM payment_outboxes WHERE status = ? LIMIT ?"
+var countPendingOutboxQuery = "SELECT COUNT(*) FROM payment_outboxes WHERE status = ?"
 
-func (r repo) GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
-	var res []model.Outbox
-	err := r.db.SelectContext(ctx, &res, getPendingOutboxQuery, model.OutboxPending, limit)
+func (r repo) CountPendingOutbox(ctx context.Context) (int, error) {
+	var res int
+	err := r.conn(ctx).GetContext(ctx, &res, countPendingOutboxQuery, model.OutboxPending)
 	return res, err
 }
 
@@ -114,14 +129,199 @@ func (r repo) MarkDoneOutboxes(ctx context.Context, ids []int64) error {
 		return err
 	}
 
-	_, err = r.db.ExecContext(ctx, query, args...)
+	_, err = r.conn(ctx).ExecContext(ctx, query, args...)
 	return err
 }
 
-var getAccountQuery = "SELECT * FROM accounts WHERE customer_id = ?"
+var recordOutboxAttemptQuery = "UPDATE payment_outboxes SET status = :status, attempts = :attempts, " +
+	"last_error = :last_error, next_attempt_at = :next_attempt_at WHERE id = :id"
+
+// RecordOutboxAttempt stores the status, attempts, last error and next attempt of a rejected outbox row.
+func (r repo) RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, recordOutboxAttemptQuery, outbox)
+	return err
+}
+
+var deleteCompletedOutboxesQuery = "DELETE FROM payment_outboxes WHERE id IN (SELECT id FROM (" +
+	"SELECT id FROM payment_outboxes WHERE status = ? AND updated_at < ? ORDER BY id LIMIT ?) AS batch)"
+
+// DeleteCompletedOutboxes deletes at most limit outbox rows completed before before, it returns how
+// many rows were deleted.
+func (r repo) DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := r.conn(ctx).ExecContext(ctx, deleteCompletedOutboxesQuery, model.OutboxCompleted, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+var getAccountQuery = "SELECT " + accountColumns + " FROM accounts WHERE customer_id = ?"
 
 func (r repo) GetAccount(ctx context.Context, customerID int64) (model.Account, error) {
 	var res model.Account
-	err := r.db.GetContext(ctx, &res, getAccountQuery, customerID)
+	err := r.conn(ctx).GetContext(ctx, &res, getAccountQuery, customerID)
+	return res, err
+}
+
+var createChargeQuery = "INSERT INTO charges (order_id, customer_id, cost, currency) " +
+	"VALUES (:order_id, :customer_id, :cost.amount, :cost.currency)"
+
+func (r repo) CreateCharge(ctx context.Context, charge model.Charge) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, createChargeQuery, charge)
+	return err
+}
+
+// charges are recorded in the account currency so they can be summed as is, refunded ones were given
+// back and are not spent
+var getSpentSinceQuery = "SELECT COALESCE(SUM(cost), 0) FROM charges " +
+	"WHERE customer_id = ? AND created_at >= ? AND refunded_at IS NULL"
+
+func (r repo) GetSpentSince(ctx context.Context, customerID int64, since time.Time) (int64, error) {
+	var res int64
+	err := r.conn(ctx).GetContext(ctx, &res, getSpentSinceQuery, customerID, since)
+	return res, err
+}
+
+var createAuthorizationQuery = "INSERT INTO payment_authorizations " +
+	"(authorization_id, order_id, customer_id, cost, currency, status, event, expires_at) " +
+	"VALUES (:authorization_id, :order_id, :customer_id, :cost.amount, :cost.currency, :status, :event, :expires_at)"
+
+func (r repo) CreateAuthorization(ctx context.Context, authorization model.PaymentAuthorization) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, createAuthorizationQuery, authorization)
+	return err
+}
+
+// cost columns are aliased so sqlx maps them into model.Money
+var authorizationColumns = "authorization_id, order_id, customer_id, " +
+	"cost AS \"cost.amount\", currency AS \"cost.currency\", status, event, expires_at, created_at, updated_at"
+
+var lockAuthorizationForUpdateQuery = "SELECT " + authorizationColumns +
+	" FROM payment_authorizations WHERE authorization_id = ? FOR UPDATE"
+
+func (r repo) LockAuthorizationForUpdate(
+	ctx context.Context, authorizationID string,
+) (model.PaymentAuthorization, error) {
+	var res model.PaymentAuthorization
+	err := r.conn(ctx).GetContext(ctx, &res, lockAuthorizationForUpdateQuery, authorizationID)
+	return res, err
+}
+
+var updateAuthorizationStatusQuery = "UPDATE payment_authorizations SET status = ? WHERE authorization_id = ?"
+
+func (r repo) UpdateAuthorizationStatus(
+	ctx context.Context, authorizationID string, status model.AuthorizationStatus,
+) error {
+	_, err := r.conn(ctx).ExecContext(ctx, updateAuthorizationStatusQuery, status, authorizationID)
+	return err
+}
+
+var recordAuthorizationQuery = "UPDATE payment_authorizations SET authorization_id = :authorization_id, " +
+	"status = :status, expires_at = :expires_at WHERE order_id = :order_id"
+
+// RecordAuthorization stores the gateway answer to the requested authorization of the order, its id,
+// status and expiry.
+func (r repo) RecordAuthorization(ctx context.Context, authorization model.PaymentAuthorization) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, recordAuthorizationQuery, authorization)
+	return err
+}
+
+// requested authorizations expire too, when the gateway never answered, and so do the captures,
+// voids and refunds the gateway was not asked for successfully
+var getExpiredAuthorizationsQuery = "SELECT " + authorizationColumns +
+	" FROM payment_authorizations WHERE status IN (?, ?, ?, ?, ?) AND expires_at <= ? LIMIT ?"
+
+func (r repo) GetExpiredAuthorizations(
+	ctx context.Context, now time.Time, limit int,
+) ([]model.PaymentAuthorization, error) {
+	var res []model.PaymentAuthorization
+	err := r.conn(ctx).SelectContext(ctx, &res, getExpiredAuthorizationsQuery,
+		model.AuthorizationRequested, model.AuthorizationPending,
+		model.AuthorizationCapturing, model.AuthorizationVoiding, model.AuthorizationRefunding, now, limit)
+	return res, err
+}
+
+var lockAuthorizationByOrderForUpdateQuery = "SELECT " + authorizationColumns +
+	" FROM payment_authorizations WHERE order_id = ? FOR UPDATE"
+
+func (r repo) LockAuthorizationByOrderForUpdate(
+	ctx context.Context, orderID int64,
+) (model.PaymentAuthorization, error) {
+	var res model.PaymentAuthorization
+	err := r.conn(ctx).GetContext(ctx, &res, lockAuthorizationByOrderForUpdateQuery, orderID)
+	return res, err
+}
+
+// cost columns are aliased so sqlx maps them into model.Money
+var chargeColumns = "order_id, customer_id, cost AS \"cost.amount\", currency AS \"cost.currency\", " +
+	"refunded_at, created_at"
+
+var lockChargeForUpdateQuery = "SELECT " + chargeColumns + " FROM charges WHERE order_id = ? FOR UPDATE"
+
+func (r repo) LockChargeForUpdate(ctx context.Context, orderID int64) (model.Charge, error) {
+	var res model.Charge
+	err := r.conn(ctx).GetContext(ctx, &res, lockChargeForUpdateQuery, orderID)
+	return res, err
+}
+
+var markChargeRefundedQuery = "UPDATE charges SET refunded_at = CURRENT_TIMESTAMP WHERE order_id = ?"
+
+func (r repo) MarkChargeRefunded(ctx context.Context, orderID int64) error {
+	_, err := r.conn(ctx).ExecContext(ctx, markChargeRefundedQuery, orderID)
+	return err
+}
+
+var receiveMessageCountQuery = "SELECT count(*) FROM inbox WHERE message_id = ? AND event_type = ?"
+
+var receiveMessageQuery = "INSERT INTO inbox (message_id, event_type, order_id) VALUES (:message_id, :event_type, :order_id)"
+
+// ReceiveMessage stores message in the inbox, it returns false when it was already received. The
+// primary key fails the transaction of a concurrent duplicate.
+func (r repo) ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error) {
+	var count int
+	err := r.conn(ctx).GetContext(ctx, &count, receiveMessageCountQuery, message.MessageID, message.EventType)
+	if err != nil || count > 0 {
+		return false, err
+	}
+	_, err = r.conn(ctx).NamedExecContext(ctx, receiveMessageQuery, message)
+	return err == nil, err
+}
+
+var isReceivedQuery = "SELECT count(*) FROM inbox WHERE order_id = ? AND event_type = ?"
+
+func (r repo) IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error) {
+	var res int
+	err := r.conn(ctx).GetContext(ctx, &res, isReceivedQuery, orderID, eventType)
+	return res > 0, err
+}
+
+var deleteInboxMessagesQuery = "DELETE FROM inbox WHERE (message_id, event_type) IN (" +
+	"SELECT message_id, event_type FROM (" +
+	"SELECT message_id, event_type FROM inbox WHERE received_at < ? ORDER BY received_at LIMIT ?) AS batch)"
+
+// DeleteInboxMessages deletes at most limit messages received before before, it returns how many
+// messages were deleted.
+func (r repo) DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := r.conn(ctx).ExecContext(ctx, deleteInboxMessagesQuery, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+var createAuditEntryQuery = "INSERT INTO saga_audit(order_id, service, kind, status, detail, occurred_at) " +
+	"VALUES (:order_id, :service, :kind, :status, :detail, :occurred_at)"
+
+func (r repo) CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, createAuditEntryQuery, entry)
+	return err
+}
+
+var getAuditEntriesQuery = "SELECT * FROM saga_audit WHERE order_id = ? ORDER BY id"
+
+func (r repo) GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error) {
+	var res []model.AuditEntry
+	err := r.conn(ctx).SelectContext(ctx, &res, getAuditEntriesQuery, orderID)
 	return res, err
 }
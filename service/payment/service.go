@@ -2,140 +2,814 @@ package payment
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/consume"
 	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
 	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/relay"
 	"github.com/rafata1/sagas-pattern-thesis/saga_event"
-	"log"
+	"github.com/rafata1/sagas-pattern-thesis/tracing"
+	"log/slog"
 	"time"
 )
 
+const (
+	serviceName = "payment"
+	outboxTable = "payment_outboxes"
+)
+
 type IService interface {
 	ConsumePreparedOrders(ctx context.Context, stopAfter time.Duration)
+	ConsumeShipments(ctx context.Context, stopAfter time.Duration)
 	Pay(ctx context.Context, event saga_event.OrderEvent) error
+	Refund(ctx context.Context, event saga_event.OrderEvent) error
+	HandleGatewayCallback(ctx context.Context, callback GatewayCallback) error
+	ExpireAuthorizations(ctx context.Context, limit int) error
 	RelayMessage(ctx context.Context, limit int) error
 }
 
 type service struct {
-	ordersConsumer kafka.IConsumer
-	producer       kafka.IProducer
-	repo           IRepo
+	ordersConsumer   kafka.IConsumer
+	shipmentConsumer kafka.IConsumer
+	producer         kafka.IProducer
+	repo             IRepo
+	policy           ICreditPolicy
+	rates            IRateProvider
+	gateway          PaymentGateway
+	logger           *slog.Logger
+	codec            saga_event.Codec
+	retry            relay.Retry
+	publisher        *relay.Publisher
+
+	authorizationTimeout time.Duration
+}
+
+const defaultAuthorizationTimeout = 15 * time.Minute
+
+type Option func(s *service)
+
+// WithCreditPolicy replaces the default strict prepaid policy.
+func WithCreditPolicy(policy ICreditPolicy) Option {
+	return func(s *service) {
+		s.policy = policy
+	}
+}
+
+// WithRateProvider allows charging accounts in a different currency than the product price.
+func WithRateProvider(rates IRateProvider) Option {
+	return func(s *service) {
+		s.rates = rates
+	}
+}
+
+// WithGateway charges orders through a payment gateway instead of the account balance.
+// Pending authorizations not called back within authorizationTimeout are voided.
+func WithGateway(gateway PaymentGateway, authorizationTimeout time.Duration) Option {
+	return func(s *service) {
+		s.gateway = gateway
+		s.authorizationTimeout = authorizationTimeout
+	}
+}
+
+// WithLogger replaces the default text logger, the service adds the message and order fields.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *service) {
+		s.logger = logger
+	}
+}
+
+// WithCodec sets how the events of the outbox are encoded, JSON by default.
+func WithCodec(codec saga_event.Codec) Option {
+	return func(s *service) {
+		s.codec = codec
+	}
 }
 
-func NewService(repo IRepo, orderConsumer kafka.IConsumer, producer kafka.IProducer) IService {
-	return &service{
-		ordersConsumer: orderConsumer,
-		producer:       producer,
-		repo:           repo,
+// WithRelayRetry sets how outbox rows Kafka rejected are attempted again, relay.DefaultRetry by default.
+func WithRelayRetry(retry relay.Retry) Option {
+	return func(s *service) {
+		s.retry = retry
 	}
 }
 
+func NewService(
+	repo IRepo, orderConsumer kafka.IConsumer, shipmentConsumer kafka.IConsumer, producer kafka.IProducer,
+	opts ...Option,
+) IService {
+	s := &service{
+		ordersConsumer:   orderConsumer,
+		shipmentConsumer: shipmentConsumer,
+		producer:         producer,
+		repo:             repo,
+		policy:           NewStrictPrepaidPolicy(),
+		rates:            NewStaticRateProvider(),
+		logger:           logging.Default(),
+		codec:            saga_event.JSON,
+		retry:            relay.DefaultRetry,
+
+		authorizationTimeout: defaultAuthorizationTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.publisher = relay.NewPublisher(outboxTable, s.repo, s.producer, s.retry, s.logger)
+	return s
+}
+
 func (s service) ConsumePreparedOrders(ctx context.Context, stopAfter time.Duration) {
-	startTime := time.Now()
-	for {
-		select {
-		case msg := <-s.ordersConsumer.Messages():
-			fmt.Printf("Received message: Topic: %s, Partition: %d, Offset: %d, Key: %s, Value: %s\n",
-				msg.Topic, msg.Partition, msg.Offset, string(msg.Key), string(msg.Value),
-			)
-			var event saga_event.OrderEvent
-			err := json.Unmarshal(msg.Value, &event)
-			if err != nil {
-				panic(err)
-				// mark message on queue as not done
+	consume.Loop(ctx, s.ordersConsumer, stopAfter, serviceName, "ConsumePreparedOrders", s.logger,
+		func(ctx context.Context, event saga_event.OrderEvent) error {
+			if event.Status == model.OrderStatusTimedOut {
+				return s.TimeOut(ctx, event)
+			}
+			return s.Pay(ctx, event)
+		})
+}
+
+func (s service) Pay(ctx context.Context, event saga_event.OrderEvent) error {
+	// only pay with prepared order
+	if event.Status != model.OrderStatusPrepared {
+		return nil
+	}
+
+	var requested bool
+	err := s.repo.Transact(ctx, func(ctx context.Context) error {
+		received, err := s.receive(ctx, event)
+		if err != nil || !received {
+			return err
+		}
+
+		// the order timed out before it was reserved, its timeout was passed on without a payment
+		timedOut, err := s.repo.IsReceived(ctx, event.OrderID, saga_event.TypeOrderTimedOut)
+		if err != nil || timedOut {
+			return err
+		}
+
+		err = s.audit(ctx, event.OrderID, model.AuditReceived, event.Status, "cost "+event.Cost.String())
+		if err != nil {
+			return err
+		}
+
+		if s.gateway != nil {
+			requested = true
+			return s.requestAuthorization(ctx, event)
+		}
+		return s.payFromBalance(ctx, event)
+	})
+	if err != nil || !requested {
+		return err
+	}
+	return s.payWithGateway(ctx, event)
+}
+
+func (s service) payFromBalance(ctx context.Context, event saga_event.OrderEvent) error {
+	account, err := s.repo.LockAccountForUpdate(ctx, event.CustomerID)
+	if err != nil {
+		return err
+	}
+
+	reason, charge, err := s.checkCredit(ctx, account, event.Cost)
+	if err != nil {
+		return err
+	}
+
+	if reason != "" {
+		err = s.audit(ctx, event.OrderID, model.AuditDecision, model.OrderStatusFailedExceedCreditLimit, reason)
+		if err != nil {
+			return err
+		}
+		return s.publish(ctx, rejectedEvent(event, model.OrderStatusFailedExceedCreditLimit, reason))
+	}
+
+	balance, err := account.Balance.Sub(charge)
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.UpdateBalance(ctx, event.CustomerID, balance)
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.CreateCharge(ctx, model.Charge{
+		OrderID:    event.OrderID,
+		CustomerID: event.CustomerID,
+		Cost:       charge,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.audit(ctx, event.OrderID, model.AuditDecision, model.OrderStatusBilled, "charged "+charge.String())
+	if err != nil {
+		return err
+	}
+	return s.publish(ctx, billedEvent(event))
+}
+
+// requestAuthorization records that the order is about to be authorized on the gateway, before the
+// gateway is asked. A request the gateway never answered expires like a pending authorization.
+func (s service) requestAuthorization(ctx context.Context, event saga_event.OrderEvent) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.CreateAuthorization(ctx, model.PaymentAuthorization{
+		AuthorizationID: requestID(event.OrderID),
+		OrderID:         event.OrderID,
+		CustomerID:      event.CustomerID,
+		Cost:            event.Cost,
+		Status:          model.AuthorizationRequested,
+		Event:           content,
+		ExpiresAt:       sql.NullTime{Time: time.Now().Add(s.authorizationTimeout), Valid: true},
+	})
+	if err != nil {
+		return err
+	}
+	return s.audit(ctx, event.OrderID, model.AuditDecision, "", "authorization requested")
+}
+
+// requestID stands for the authorization of the order until the gateway gave it an id.
+func requestID(orderID int64) string {
+	return fmt.Sprintf("request:%d", orderID)
+}
+
+// payWithGateway authorizes the requested order on the gateway, outside of any transaction so no
+// row stays locked while the gateway answers. Pending authorizations are settled by
+// HandleGatewayCallback or voided by ExpireAuthorizations. When the gateway fails, the request
+// is left to expire.
+func (s service) payWithGateway(ctx context.Context, event saga_event.OrderEvent) error {
+	authorization, err := s.gateway.Authorize(ctx, event.OrderID, event.CustomerID, event.Cost)
+	if err != nil {
+		return err
+	}
+
+	record := model.PaymentAuthorization{
+		AuthorizationID: authorization.ID,
+		OrderID:         event.OrderID,
+	}
+	switch authorization.Result {
+	case AuthorizationResultApproved:
+		err = s.gateway.Capture(ctx, authorization.ID)
+		if err != nil {
+			return err
+		}
+		record.Status = model.AuthorizationCaptured
+	case AuthorizationResultDeclined:
+		record.Status = model.AuthorizationDeclined
+	default:
+		record.Status = model.AuthorizationPending
+		record.ExpiresAt = sql.NullTime{Time: time.Now().Add(s.authorizationTimeout), Valid: true}
+	}
+
+	var withdrawn bool
+	err = s.repo.Transact(ctx, func(ctx context.Context) error {
+		requested, err := s.repo.LockAuthorizationByOrderForUpdate(ctx, event.OrderID)
+		if err != nil {
+			return err
+		}
+
+		// the order timed out or the request expired while the gateway answered, what the gateway
+		// did is given back once the transaction is committed
+		if requested.Status != model.AuthorizationRequested {
+			switch record.Status {
+			case model.AuthorizationCaptured:
+				withdrawn = true
+				err = s.intend(ctx, record, model.AuthorizationRefunding)
+			case model.AuthorizationPending:
+				withdrawn = true
+				err = s.intend(ctx, record, model.AuthorizationVoiding)
+			default:
+				err = s.repo.RecordAuthorization(ctx, record)
 			}
-			err = s.Pay(ctx, event)
 			if err != nil {
-				panic(err)
-				// mark message on queue as not done
+				return err
 			}
-		case err := <-s.ordersConsumer.Errors():
-			log.Printf("Failed to consume message: %s", err)
+			return s.audit(ctx, event.OrderID, model.AuditCompensated, "",
+				fmt.Sprintf("authorization %s withdrawn after %s", authorization.ID, record.Status))
+		}
+
+		err = s.repo.RecordAuthorization(ctx, record)
+		if err != nil {
+			return err
+		}
+
+		err = s.audit(ctx, event.OrderID, model.AuditDecision, "",
+			fmt.Sprintf("authorization %s %s", authorization.ID, record.Status))
+		if err != nil {
+			return err
+		}
+
+		switch record.Status {
+		case model.AuthorizationCaptured:
+			return s.publish(ctx, billedEvent(event))
+		case model.AuthorizationDeclined:
+			return s.publish(ctx, rejectedEvent(event, model.OrderStatusFailedPaymentDeclined, authorization.DeclineReason))
+		default:
+			return nil
+		}
+	})
+	if err == nil && withdrawn {
+		s.trySettle(ctx, authorization.ID)
+	}
+	return err
+}
+
+// intend records in the transaction of ctx that the gateway is about to be asked to capture, void or
+// refund authorization. The gateway is asked by settle once the transaction is committed, an intent
+// still recorded after AuthorizationTimeout is settled again by ExpireAuthorizations.
+func (s service) intend(ctx context.Context, authorization model.PaymentAuthorization, status model.AuthorizationStatus) error {
+	authorization.Status = status
+	authorization.ExpiresAt = sql.NullTime{Time: time.Now().Add(s.authorizationTimeout), Valid: true}
+	return s.repo.RecordAuthorization(ctx, authorization)
+}
+
+// settling tells whether the gateway is still to be asked for what status records.
+func settling(status model.AuthorizationStatus) bool {
+	return status == model.AuthorizationCapturing || status == model.AuthorizationVoiding ||
+		status == model.AuthorizationRefunding
+}
+
+// settle asks the gateway for the capture, void or refund intended for the authorization, outside of
+// any transaction, then records it was done. A capture is billed then, unless the order timed out
+// meanwhile: the capture is refunded instead.
+func (s service) settle(ctx context.Context, authorizationID string) error {
+	for {
+		var authorization model.PaymentAuthorization
+		err := s.repo.Transact(ctx, func(ctx context.Context) error {
+			var err error
+			authorization, err = s.repo.LockAuthorizationForUpdate(ctx, authorizationID)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		switch authorization.Status {
+		case model.AuthorizationCapturing:
+			err = s.gateway.Capture(ctx, authorizationID)
+		case model.AuthorizationVoiding:
+			err = s.gateway.Void(ctx, authorizationID)
+		case model.AuthorizationRefunding:
+			err = s.gateway.Refund(ctx, authorizationID, authorization.Cost)
 		default:
-			if stopAfter != 0 && time.Now().After(startTime.Add(stopAfter)) {
-				return
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var again bool
+		err = s.repo.Transact(ctx, func(ctx context.Context) error {
+			locked, err := s.repo.LockAuthorizationForUpdate(ctx, authorizationID)
+			if err != nil {
+				return err
 			}
+			if locked.Status != authorization.Status {
+				again = true
+				return nil
+			}
+			return s.settled(ctx, locked, &again)
+		})
+		if err != nil || !again {
+			return err
 		}
 	}
 }
 
-func (s service) Pay(ctx context.Context, event saga_event.OrderEvent) error {
-	// only pay with prepared order
-	if event.Status != model.OrderStatusPrepared {
-		return nil
+// settled records in the transaction of ctx what the gateway did for authorization. again is set
+// when a new intent replaced it.
+func (s service) settled(ctx context.Context, authorization model.PaymentAuthorization, again *bool) error {
+	authorization.ExpiresAt = sql.NullTime{}
+	switch authorization.Status {
+	case model.AuthorizationVoiding:
+		authorization.Status = model.AuthorizationVoided
+		return s.repo.RecordAuthorization(ctx, authorization)
+	case model.AuthorizationRefunding:
+		authorization.Status = model.AuthorizationRefunded
+		return s.repo.RecordAuthorization(ctx, authorization)
 	}
 
-	return s.repo.Transact(ctx, func(ctx context.Context) error {
-		isProcessedOrder, err := s.repo.IsProcessed(ctx, event.OrderID)
+	var event saga_event.OrderEvent
+	err := json.Unmarshal(authorization.Event, &event)
+	if err != nil {
+		return err
+	}
+
+	timedOut, err := s.repo.IsReceived(ctx, authorization.OrderID, saga_event.TypeOrderTimedOut)
+	if err != nil {
+		return err
+	}
+	if timedOut {
+		*again = true
+		err = s.intend(ctx, authorization, model.AuthorizationRefunding)
+		if err != nil {
+			return err
+		}
+		return s.audit(ctx, authorization.OrderID, model.AuditCompensated, model.OrderStatusTimedOut,
+			fmt.Sprintf("authorization %s captured after the timeout", authorization.AuthorizationID))
+	}
+
+	authorization.Status = model.AuthorizationCaptured
+	err = s.repo.RecordAuthorization(ctx, authorization)
+	if err != nil {
+		return err
+	}
+	err = s.audit(ctx, authorization.OrderID, model.AuditDecision, model.OrderStatusBilled,
+		fmt.Sprintf("authorization %s captured", authorization.AuthorizationID))
+	if err != nil {
+		return err
+	}
+	return s.publish(ctx, billedEvent(event))
+}
+
+// trySettle settles the intent of a handler which already committed, a gateway failure is left to
+// ExpireAuthorizations.
+func (s service) trySettle(ctx context.Context, authorizationID string) {
+	err := s.settle(ctx, authorizationID)
+	if err != nil {
+		s.logger.Warn("Failed to settle authorization, it is settled again once expired",
+			slog.String("authorization_id", authorizationID), slog.Any("error", err))
+	}
+}
+
+// HandleGatewayCallback records the settlement of a pending authorization, an approval is captured
+// on the gateway once the capture is recorded.
+func (s service) HandleGatewayCallback(ctx context.Context, callback GatewayCallback) error {
+	var capture bool
+	err := s.repo.Transact(ctx, func(ctx context.Context) error {
+		authorization, err := s.repo.LockAuthorizationForUpdate(ctx, callback.AuthorizationID)
 		if err != nil {
 			return err
 		}
 
-		if isProcessedOrder {
+		// gateways deliver callbacks at least once: a capture which failed is asked again, and a
+		// timed out authorization is already voided
+		if authorization.Status == model.AuthorizationCapturing && callback.Approved {
+			capture = true
+			return nil
+		}
+		if authorization.Status != model.AuthorizationPending {
 			return nil
 		}
 
-		account, err := s.repo.LockAccountForUpdate(ctx, event.CustomerID)
+		if callback.Approved {
+			capture = true
+			return s.intend(ctx, authorization, model.AuthorizationCapturing)
+		}
+
+		var event saga_event.OrderEvent
+		err = json.Unmarshal(authorization.Event, &event)
 		if err != nil {
 			return err
 		}
 
-		var publishEvent saga_event.OrderEvent
-		if account.Balance >= event.Cost {
-			err = s.repo.UpdateBalance(ctx, event.CustomerID, account.Balance-event.Cost)
+		err = s.repo.UpdateAuthorizationStatus(ctx, authorization.AuthorizationID, model.AuthorizationDeclined)
+		if err != nil {
+			return err
+		}
+		err = s.audit(ctx, event.OrderID, model.AuditDecision, model.OrderStatusFailedPaymentDeclined,
+			fmt.Sprintf("authorization %s declined by callback", authorization.AuthorizationID))
+		if err != nil {
+			return err
+		}
+		return s.publish(ctx, rejectedEvent(event, model.OrderStatusFailedPaymentDeclined, callback.Reason))
+	})
+	if err != nil || !capture {
+		return err
+	}
+	// the gateway posts the callback again until the capture is recorded
+	return s.settle(ctx, callback.AuthorizationID)
+}
+
+// ExpireAuthorizations voids pending authorizations the gateway never called back for,
+// the published failure makes inventory release the reserved stock. Captures, voids and refunds
+// the gateway was not asked for successfully are asked again.
+func (s service) ExpireAuthorizations(ctx context.Context, limit int) error {
+	expired, err := s.repo.GetExpiredAuthorizations(ctx, time.Now(), limit)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, authorization := range expired {
+		if settling(authorization.Status) {
+			errs = append(errs, s.settle(ctx, authorization.AuthorizationID))
+			continue
+		}
+
+		var voided, void bool
+		err = s.repo.Transact(ctx, func(ctx context.Context) error {
+			locked, err := s.repo.LockAuthorizationForUpdate(ctx, authorization.AuthorizationID)
 			if err != nil {
 				return err
 			}
-			publishEvent = saga_event.OrderEvent{
-				OrderID: event.OrderID,
-				Status:  model.OrderStatusBilled,
+
+			// a request has no authorization on the gateway yet, payWithGateway gives back what the
+			// gateway answers late
+			switch locked.Status {
+			case model.AuthorizationRequested:
+				err = s.repo.UpdateAuthorizationStatus(ctx, locked.AuthorizationID, model.AuthorizationVoided)
+			case model.AuthorizationPending:
+				void = true
+				err = s.intend(ctx, locked, model.AuthorizationVoiding)
+			default:
+				// the callback or the gateway answer won the race
+				return nil
 			}
-		} else {
-			publishEvent = saga_event.OrderEvent{
-				OrderID:   event.OrderID,
-				Status:    model.OrderStatusFailedExceedCreditLimit,
-				ProductID: event.ProductID,
-				Amount:    event.Amount,
+			if err != nil {
+				return err
+			}
+			voided = true
+
+			var event saga_event.OrderEvent
+			err = json.Unmarshal(locked.Event, &event)
+			if err != nil {
+				return err
+			}
+			err = s.audit(ctx, event.OrderID, model.AuditCompensated, model.OrderStatusFailedPaymentTimeout,
+				fmt.Sprintf("authorization %s voided", locked.AuthorizationID))
+			if err != nil {
+				return err
 			}
+			return s.publish(ctx, rejectedEvent(event, model.OrderStatusFailedPaymentTimeout, RejectReasonAuthorizationTimeout))
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if voided {
+			metrics.Compensations.WithLabelValues(serviceName, "void_authorization").Inc()
+		}
+		if void {
+			errs = append(errs, s.settle(ctx, authorization.AuthorizationID))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s service) ConsumeShipments(ctx context.Context, stopAfter time.Duration) {
+	consume.Loop(ctx, s.shipmentConsumer, stopAfter, serviceName, "ConsumeShipments", s.logger, s.Refund)
+}
+
+// Refund gives the money of an order back once shipping failed.
+func (s service) Refund(ctx context.Context, event saga_event.OrderEvent) error {
+	if event.Status != model.OrderStatusFailedShipping {
+		return nil
+	}
+
+	var refunded bool
+	var authorizationID string
+	err := s.repo.Transact(ctx, func(ctx context.Context) error {
+		received, err := s.receive(ctx, event)
+		if err != nil || !received {
+			return err
+		}
+
+		// the order cost was converted to the account currency when it was charged
+		var cost model.Money
+		if s.gateway != nil {
+			var authorization model.PaymentAuthorization
+			authorization, refunded, err = s.refundGateway(ctx, event.OrderID)
+			authorizationID, cost = authorization.AuthorizationID, authorization.Cost
+		} else {
+			cost, refunded, err = s.refundBalance(ctx, event.OrderID)
+		}
+		if err != nil || !refunded {
+			return err
+		}
+		return s.audit(ctx, event.OrderID, model.AuditCompensated, event.Status, "refunded "+cost.String())
+	})
+	if err == nil && refunded {
+		metrics.Compensations.WithLabelValues(serviceName, "refund").Inc()
+	}
+	if err == nil && authorizationID != "" {
+		s.trySettle(ctx, authorizationID)
+	}
+	return err
+}
+
+// TimeOut gives back what was paid for an order the order service timed out, a pending authorization
+// is voided. The timeout stays in the inbox, so the order is not paid when it comes late.
+func (s service) TimeOut(ctx context.Context, event saga_event.OrderEvent) error {
+	var action, authorizationID string
+	err := s.repo.Transact(ctx, func(ctx context.Context) error {
+		received, err := s.receive(ctx, event)
+		if err != nil || !received {
+			return err
 		}
 
-		err = s.repo.MarkProcessedOrder(ctx, event.OrderID)
+		reserved, err := s.repo.IsReceived(ctx, event.OrderID, saga_event.TypeInventoryReserved)
 		if err != nil {
 			return err
 		}
 
-		content, _ := json.Marshal(publishEvent)
-		return s.repo.CreateOutbox(ctx, model.Outbox{Content: content})
+		err = s.audit(ctx, event.OrderID, model.AuditReceived, event.Status, event.Reason)
+		if err != nil || !reserved {
+			return err
+		}
+
+		if s.gateway != nil {
+			authorizationID, err = s.voidPending(ctx, event.OrderID)
+			if err != nil {
+				return err
+			}
+			if authorizationID != "" {
+				action = "void_authorization"
+				return nil
+			}
+		}
+
+		var refunded bool
+		var cost model.Money
+		if s.gateway != nil {
+			var authorization model.PaymentAuthorization
+			authorization, refunded, err = s.refundGateway(ctx, event.OrderID)
+			authorizationID, cost = authorization.AuthorizationID, authorization.Cost
+		} else {
+			cost, refunded, err = s.refundBalance(ctx, event.OrderID)
+		}
+		if err != nil || !refunded {
+			return err
+		}
+		action = "refund"
+		return s.audit(ctx, event.OrderID, model.AuditCompensated, event.Status, "refunded "+cost.String())
 	})
+	if err == nil && action != "" {
+		metrics.Compensations.WithLabelValues(serviceName, action).Inc()
+	}
+	if err == nil && authorizationID != "" {
+		s.trySettle(ctx, authorizationID)
+	}
+	return err
 }
 
-func (s service) RelayMessage(ctx context.Context, limit int) error {
-	outboxes, err := s.repo.GetPendingOutbox(ctx, limit)
+// voidPending voids the authorization of an order still waiting for the gateway answer or callback
+// and returns its id, the gateway is asked to void it once the transaction is committed. A capture
+// still to be asked for is refunded by settle, which sees the timeout.
+func (s service) voidPending(ctx context.Context, orderID int64) (string, error) {
+	authorization, err := s.repo.LockAuthorizationByOrderForUpdate(ctx, orderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch authorization.Status {
+	case model.AuthorizationPending:
+		err = s.intend(ctx, authorization, model.AuthorizationVoiding)
+	case model.AuthorizationRequested:
+		// the gateway has not answered a request yet, payWithGateway gives back what it answers
+		err = s.repo.UpdateAuthorizationStatus(ctx, authorization.AuthorizationID, model.AuthorizationVoided)
+	default:
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return authorization.AuthorizationID, s.audit(ctx, orderID, model.AuditCompensated, model.OrderStatusTimedOut,
+		fmt.Sprintf("authorization %s voided", authorization.AuthorizationID))
+}
+
+// refundBalance gives the charge of an order back to the account and returns the refunded cost.
+func (s service) refundBalance(ctx context.Context, orderID int64) (model.Money, bool, error) {
+	charge, err := s.repo.LockChargeForUpdate(ctx, orderID)
+	// the order was never charged
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Money{}, false, nil
+	}
+	if err != nil {
+		return model.Money{}, false, err
+	}
+
+	if charge.RefundedAt.Valid {
+		return model.Money{}, false, nil
+	}
+
+	account, err := s.repo.LockAccountForUpdate(ctx, charge.CustomerID)
+	if err != nil {
+		return model.Money{}, false, err
+	}
+
+	balance, err := account.Balance.Add(charge.Cost)
+	if err != nil {
+		return model.Money{}, false, err
+	}
+
+	err = s.repo.UpdateBalance(ctx, charge.CustomerID, balance)
+	if err != nil {
+		return model.Money{}, false, err
+	}
+	return charge.Cost, true, s.repo.MarkChargeRefunded(ctx, orderID)
+}
+
+// refundGateway records the refund of the captured authorization of an order and returns it, the
+// gateway is asked to refund it once the transaction is committed.
+func (s service) refundGateway(ctx context.Context, orderID int64) (model.PaymentAuthorization, bool, error) {
+	authorization, err := s.repo.LockAuthorizationByOrderForUpdate(ctx, orderID)
+	// the order was never authorized
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.PaymentAuthorization{}, false, nil
+	}
+	if err != nil {
+		return model.PaymentAuthorization{}, false, err
+	}
+
+	if authorization.Status != model.AuthorizationCaptured {
+		return model.PaymentAuthorization{}, false, nil
+	}
+	return authorization, true, s.intend(ctx, authorization, model.AuthorizationRefunding)
+}
+
+func (s service) publish(ctx context.Context, event saga_event.Event) error {
+	content, err := s.codec.Marshal(event)
 	if err != nil {
 		return err
 	}
-	err = s.producer.Push(extractContents(outboxes))
+	view := event.OrderEvent()
+	err = s.audit(ctx, view.OrderID, model.AuditEmitted, view.Status, "")
 	if err != nil {
 		return err
 	}
+	return s.repo.CreateOutbox(ctx, model.Outbox{
+		Content:     content,
+		ContentType: s.codec.ContentType(),
+		Headers:     tracing.Inject(ctx),
+	})
+}
+
+// billedEvent carries the order lines so shipping can dispatch them.
+func billedEvent(event saga_event.OrderEvent) saga_event.PaymentCharged {
+	return saga_event.PaymentCharged{
+		OrderID:    event.OrderID,
+		CustomerID: event.CustomerID,
+		ProductID:  event.ProductID,
+		Amount:     event.Amount,
+		Cost:       event.Cost,
+	}
+}
 
-	err = s.repo.MarkDoneOutboxes(ctx, extractIDs(outboxes))
-	return err
+// rejectedEvent carries the product and amount so inventory can release the stock.
+func rejectedEvent(event saga_event.OrderEvent, status model.OrderStatus, reason string) saga_event.PaymentRejected {
+	return saga_event.PaymentRejected{
+		OrderID:    event.OrderID,
+		CustomerID: event.CustomerID,
+		ProductID:  event.ProductID,
+		Amount:     event.Amount,
+		Cost:       event.Cost,
+		Status:     status,
+		Reason:     reason,
+	}
 }
 
-func extractIDs(outboxes []model.Outbox) []int64 {
-	var res []int64
-	for _, outbox := range outboxes {
-		res = append(res, outbox.ID)
+// checkCredit converts the cost to the account currency and asks the credit policy,
+// an empty reason means the account can be charged.
+func (s service) checkCredit(
+	ctx context.Context, account model.Account, cost model.Money,
+) (string, model.Money, error) {
+	charge, err := Convert(ctx, s.rates, cost, account.Balance.Currency)
+	if errors.Is(err, ErrRateNotFound) {
+		return RejectReasonUnsupportedCurrency, model.Money{}, nil
+	}
+	if err != nil {
+		return "", model.Money{}, err
 	}
-	return res
+
+	spentToday, err := s.repo.GetSpentSince(ctx, account.CustomerID, time.Now().Truncate(24*time.Hour))
+	if err != nil {
+		return "", model.Money{}, err
+	}
+
+	reason := s.policy.Check(CreditCheck{
+		Account:    account,
+		Cost:       charge,
+		SpentToday: spentToday,
+	})
+	return reason, charge, nil
 }
 
-func extractContents(outboxes []model.Outbox) [][]byte {
-	var res [][]byte
-	for _, outbox := range outboxes {
-		res = append(res, outbox.Content)
+func (s service) RelayMessage(ctx context.Context, limit int) error {
+	return s.publisher.Relay(ctx, limit)
+}
+
+// receive stores the message of event in the inbox, in the transaction of ctx. It returns false
+// when the message was already received and must not be handled again.
+func (s service) receive(ctx context.Context, event saga_event.OrderEvent) (bool, error) {
+	message, err := saga_event.InboxMessage(ctx, event)
+	if err != nil {
+		return false, err
 	}
-	return res
+	return s.repo.ReceiveMessage(ctx, message)
+}
+
+// audit appends a step of the saga of orderID to saga_audit, in the transaction of ctx.
+func (s service) audit(ctx context.Context, orderID int64, kind model.AuditKind, status model.OrderStatus, detail string) error {
+	return s.repo.CreateAuditEntry(ctx, model.NewAuditEntry(orderID, serviceName, kind, status, detail))
 }
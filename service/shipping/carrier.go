@@ -0,0 +1,50 @@
+package shipping
+
+import (
+	"context"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"sync"
+)
+
+// Dispatch is the carrier answer to a shipment request. A non empty RejectReason
+// means the carrier will not ship the order and the saga has to be compensated.
+type Dispatch struct {
+	TrackingNumber string
+	RejectReason   string
+}
+
+// ICarrier hands shipments over to a delivery company. Errors are treated as
+// transient, the message is consumed again.
+type ICarrier interface {
+	Ship(ctx context.Context, shipment model.Shipment) (Dispatch, error)
+}
+
+// FakeCarrier is an in-process carrier for tests and local runs.
+type FakeCarrier struct {
+	mu       sync.Mutex
+	rejected map[int64]string
+}
+
+func NewFakeCarrier() *FakeCarrier {
+	return &FakeCarrier{
+		rejected: map[int64]string{},
+	}
+}
+
+// RejectProduct makes every following shipment of the product fail with reason.
+func (c *FakeCarrier) RejectProduct(productID int64, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rejected[productID] = reason
+}
+
+func (c *FakeCarrier) Ship(ctx context.Context, shipment model.Shipment) (Dispatch, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if reason, ok := c.rejected[shipment.ProductID]; ok {
+		return Dispatch{RejectReason: reason}, nil
+	}
+	return Dispatch{TrackingNumber: fmt.Sprintf("FAKE-%d", shipment.OrderID)}, nil
+}
@@ -0,0 +1,107 @@
+package shipping
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/storage/memory"
+	"time"
+)
+
+// NewMemoryRepo keeps shipments in memory, it behaves like the MySQL repo for tests.
+func NewMemoryRepo() IRepo {
+	store := memory.NewStore()
+	return &memoryRepo{
+		store:     store,
+		shipments: map[int64]model.Shipment{},
+		outboxes:  memory.NewOutboxes(store),
+		audit:     memory.NewAuditLog(store),
+		inbox:     memory.NewInbox(store),
+	}
+}
+
+type memoryRepo struct {
+	store     *memory.Store
+	shipments map[int64]model.Shipment
+	outboxes  *memory.Outboxes
+	audit     *memory.AuditLog
+	inbox     *memory.Inbox
+}
+
+func (r *memoryRepo) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.store.Transact(ctx, fn)
+}
+
+func (r *memoryRepo) CreateShipment(ctx context.Context, shipment model.Shipment) error {
+	return r.store.Write(ctx, fmt.Sprintf("shipment:%d", shipment.OrderID), func() (func(), error) {
+		if _, ok := r.shipments[shipment.OrderID]; ok {
+			return nil, fmt.Errorf("shipment %d: %w", shipment.OrderID, memory.ErrDuplicateKey)
+		}
+		created := shipment
+		created.CreatedAt = memory.Now()
+		created.UpdatedAt = sql.NullTime{}
+		r.shipments[shipment.OrderID] = created
+		return func() { delete(r.shipments, shipment.OrderID) }, nil
+	})
+}
+
+func (r *memoryRepo) GetShipment(ctx context.Context, orderID int64) (model.Shipment, error) {
+	var res model.Shipment
+	var ok bool
+	r.store.Read(func() {
+		res, ok = r.shipments[orderID]
+	})
+	if !ok {
+		return model.Shipment{}, sql.ErrNoRows
+	}
+	return res, nil
+}
+
+func (r *memoryRepo) CreateOutbox(ctx context.Context, outbox model.Outbox) error {
+	return r.outboxes.Create(ctx, outbox)
+}
+
+func (r *memoryRepo) GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	return r.outboxes.Pending(limit), nil
+}
+
+func (r *memoryRepo) GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	return r.outboxes.Retried(limit), nil
+}
+
+func (r *memoryRepo) CountPendingOutbox(ctx context.Context) (int, error) {
+	return r.outboxes.CountPending(), nil
+}
+
+func (r *memoryRepo) MarkDoneOutboxes(ctx context.Context, ids []int64) error {
+	return r.outboxes.MarkDone(ctx, ids)
+}
+
+func (r *memoryRepo) RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error {
+	return r.outboxes.RecordAttempt(ctx, outbox)
+}
+
+func (r *memoryRepo) DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error) {
+	return r.outboxes.DeleteCompleted(ctx, before, limit)
+}
+
+func (r *memoryRepo) ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error) {
+	return r.inbox.Receive(ctx, message)
+}
+
+func (r *memoryRepo) IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error) {
+	return r.inbox.IsReceived(orderID, eventType), nil
+}
+
+func (r *memoryRepo) DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error) {
+	return r.inbox.Delete(ctx, before, limit)
+}
+
+func (r *memoryRepo) CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error {
+	return r.audit.Append(ctx, entry)
+}
+
+func (r *memoryRepo) GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error) {
+	return r.audit.ForOrder(orderID), nil
+}
@@ -0,0 +1,190 @@
+package shipping
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/storage"
+	"time"
+)
+
+type IRepo interface {
+	Transact(ctx context.Context, fn func(ctx context.Context) error) error
+	CreateShipment(ctx context.Context, shipment model.Shipment) error
+	GetShipment(ctx context.Context, orderID int64) (model.Shipment, error)
+	ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error)
+	IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error)
+	CreateOutbox(ctx context.Context, outbox model.Outbox) error
+	GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error)
+	GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error)
+	CountPendingOutbox(ctx context.Context) (int, error)
+	CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error
+	GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error)
+	MarkDoneOutboxes(ctx context.Context, ids []int64) error
+	RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error
+	DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error)
+	DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+type repo struct {
+	db *sqlx.DB
+}
+
+func NewRepo(db *sqlx.DB) IRepo {
+	return &repo{
+		db: db,
+	}
+}
+
+func (r repo) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	return storage.Transact(ctx, r.db, fn)
+}
+
+// conn runs queries in the transaction of ctx, if any
+func (r repo) conn(ctx context.Context) storage.Querier {
+	return storage.Conn(ctx, r.db)
+}
+
+var createShipmentQuery = "INSERT INTO shipments " +
+	"(order_id, customer_id, product_id, amount, tracking_number, status, failure_reason) " +
+	"VALUES (:order_id, :customer_id, :product_id, :amount, :tracking_number, :status, :failure_reason)"
+
+func (r repo) CreateShipment(ctx context.Context, shipment model.Shipment) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, createShipmentQuery, shipment)
+	return err
+}
+
+var getShipmentQuery = "SELECT * FROM shipments WHERE order_id = ?"
+
+func (r repo) GetShipment(ctx context.Context, orderID int64) (model.Shipment, error) {
+	var res model.Shipment
+	err := r.conn(ctx).GetContext(ctx, &res, getShipmentQuery, orderID)
+	return res, err
+}
+
+var createOutboxQuery = "INSERT INTO shipping_outboxes(content, content_type, headers) VALUES (:content, :content_type, :headers)"
+
+func (r repo) CreateOutbox(ctx context.Context, outbox model.Outbox) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, createOutboxQuery, outbox)
+	return err
+}
+
+var getPendingOutboxQuery = "SELECT * FROM shipping_outboxes " +
+	"WHERE status = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?) ORDER BY id LIMIT ?"
+
+func (r repo) GetPendingOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	var res []model.Outbox
+	err := r.conn(ctx).SelectContext(ctx, &res, getPendingOutboxQuery, model.OutboxPending, time.Now(), limit)
+	return res, err
+}
+
+var getRetriedOutboxQuery = "SELECT * FROM shipping_outboxes " +
+	"WHERE status = ? AND attempts > 0 AND next_attempt_at <= ? ORDER BY id LIMIT ?"
+
+func (r repo) GetRetriedOutbox(ctx context.Context, limit int) ([]model.Outbox, error) {
+	var res []model.Outbox
+	err := r.conn(ctx).SelectContext(ctx, &res, getRetriedOutboxQuery, model.OutboxPending, time.Now(), limit)
+	return res, err
+}
+
+var countPendingOutboxQuery = "SELECT COUNT(*) FROM shipping_outboxes WHERE status = ?"
+
+func (r repo) CountPendingOutbox(ctx context.Context) (int, error) {
+	var res int
+	err := r.conn(ctx).GetContext(ctx, &res, countPendingOutboxQuery, model.OutboxPending)
+	return res, err
+}
+
+var markDoneOutboxesQuery = "UPDATE shipping_outboxes SET status = ? WHERE id IN (?)"
+
+func (r repo) MarkDoneOutboxes(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In(markDoneOutboxesQuery, model.OutboxCompleted, ids)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.conn(ctx).ExecContext(ctx, query, args...)
+	return err
+}
+
+var recordOutboxAttemptQuery = "UPDATE shipping_outboxes SET status = :status, attempts = :attempts, " +
+	"last_error = :last_error, next_attempt_at = :next_attempt_at WHERE id = :id"
+
+// RecordOutboxAttempt stores the status, attempts, last error and next attempt of a rejected outbox row.
+func (r repo) RecordOutboxAttempt(ctx context.Context, outbox model.Outbox) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, recordOutboxAttemptQuery, outbox)
+	return err
+}
+
+var deleteCompletedOutboxesQuery = "DELETE FROM shipping_outboxes WHERE id IN (SELECT id FROM (" +
+	"SELECT id FROM shipping_outboxes WHERE status = ? AND updated_at < ? ORDER BY id LIMIT ?) AS batch)"
+
+// DeleteCompletedOutboxes deletes at most limit outbox rows completed before before, it returns how
+// many rows were deleted.
+func (r repo) DeleteCompletedOutboxes(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := r.conn(ctx).ExecContext(ctx, deleteCompletedOutboxesQuery, model.OutboxCompleted, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+var receiveMessageCountQuery = "SELECT count(*) FROM inbox WHERE message_id = ? AND event_type = ?"
+
+var receiveMessageQuery = "INSERT INTO inbox (message_id, event_type, order_id) VALUES (:message_id, :event_type, :order_id)"
+
+// ReceiveMessage stores message in the inbox, it returns false when it was already received. The
+// primary key fails the transaction of a concurrent duplicate.
+func (r repo) ReceiveMessage(ctx context.Context, message model.InboxMessage) (bool, error) {
+	var count int
+	err := r.conn(ctx).GetContext(ctx, &count, receiveMessageCountQuery, message.MessageID, message.EventType)
+	if err != nil || count > 0 {
+		return false, err
+	}
+	_, err = r.conn(ctx).NamedExecContext(ctx, receiveMessageQuery, message)
+	return err == nil, err
+}
+
+var isReceivedQuery = "SELECT count(*) FROM inbox WHERE order_id = ? AND event_type = ?"
+
+func (r repo) IsReceived(ctx context.Context, orderID int64, eventType string) (bool, error) {
+	var res int
+	err := r.conn(ctx).GetContext(ctx, &res, isReceivedQuery, orderID, eventType)
+	return res > 0, err
+}
+
+var deleteInboxMessagesQuery = "DELETE FROM inbox WHERE (message_id, event_type) IN (" +
+	"SELECT message_id, event_type FROM (" +
+	"SELECT message_id, event_type FROM inbox WHERE received_at < ? ORDER BY received_at LIMIT ?) AS batch)"
+
+// DeleteInboxMessages deletes at most limit messages received before before, it returns how many
+// messages were deleted.
+func (r repo) DeleteInboxMessages(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := r.conn(ctx).ExecContext(ctx, deleteInboxMessagesQuery, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+var createAuditEntryQuery = "INSERT INTO saga_audit(order_id, service, kind, status, detail, occurred_at) " +
+	"VALUES (:order_id, :service, :kind, :status, :detail, :occurred_at)"
+
+func (r repo) CreateAuditEntry(ctx context.Context, entry model.AuditEntry) error {
+	_, err := r.conn(ctx).NamedExecContext(ctx, createAuditEntryQuery, entry)
+	return err
+}
+
+var getAuditEntriesQuery = "SELECT * FROM saga_audit WHERE order_id = ? ORDER BY id"
+
+func (r repo) GetAuditEntries(ctx context.Context, orderID int64) ([]model.AuditEntry, error) {
+	var res []model.AuditEntry
+	err := r.conn(ctx).SelectContext(ctx, &res, getAuditEntriesQuery, orderID)
+	return res, err
+}
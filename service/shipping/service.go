@@ -0,0 +1,187 @@
+package shipping
+
+import (
+	"context"
+	"github.com/rafata1/sagas-pattern-thesis/consume"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/relay"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/tracing"
+	"log/slog"
+	"time"
+)
+
+const (
+	serviceName = "shipping"
+	outboxTable = "shipping_outboxes"
+)
+
+type IService interface {
+	ConsumeOrders(ctx context.Context, stopAfter time.Duration)
+	Ship(ctx context.Context, event saga_event.OrderEvent) error
+	RelayMessage(ctx context.Context, limit int) error
+}
+
+type service struct {
+	ordersConsumer kafka.IConsumer
+	producer       kafka.IProducer
+	repo           IRepo
+	carrier        ICarrier
+	logger         *slog.Logger
+	codec          saga_event.Codec
+	retry          relay.Retry
+	publisher      *relay.Publisher
+}
+
+type Option func(s *service)
+
+// WithLogger replaces the default text logger, the service adds the message and order fields.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *service) {
+		s.logger = logger
+	}
+}
+
+// WithCodec sets how the events of the outbox are encoded, JSON by default.
+func WithCodec(codec saga_event.Codec) Option {
+	return func(s *service) {
+		s.codec = codec
+	}
+}
+
+// WithRelayRetry sets how outbox rows Kafka rejected are attempted again, relay.DefaultRetry by default.
+func WithRelayRetry(retry relay.Retry) Option {
+	return func(s *service) {
+		s.retry = retry
+	}
+}
+
+func NewService(
+	repo IRepo, ordersConsumer kafka.IConsumer, producer kafka.IProducer, carrier ICarrier, opts ...Option,
+) IService {
+	s := &service{
+		ordersConsumer: ordersConsumer,
+		producer:       producer,
+		repo:           repo,
+		carrier:        carrier,
+		logger:         logging.Default(),
+		codec:          saga_event.JSON,
+		retry:          relay.DefaultRetry,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.publisher = relay.NewPublisher(outboxTable, s.repo, s.producer, s.retry, s.logger)
+	return s
+}
+
+// ConsumeOrders ships the orders the order service confirmed. Shipping does not take the bills of
+// payment, the order service only confirms the bills it took before the order timed out.
+func (s service) ConsumeOrders(ctx context.Context, stopAfter time.Duration) {
+	consume.Loop(ctx, s.ordersConsumer, stopAfter, serviceName, "ConsumeOrders", s.logger, s.Ship)
+}
+
+func (s service) Ship(ctx context.Context, event saga_event.OrderEvent) error {
+	// only ship confirmed orders
+	if event.Status != model.OrderStatusBilled {
+		return nil
+	}
+
+	return s.repo.Transact(ctx, func(ctx context.Context) error {
+		received, err := s.receive(ctx, event)
+		if err != nil || !received {
+			return err
+		}
+
+		err = s.audit(ctx, event.OrderID, model.AuditReceived, event.Status, "")
+		if err != nil {
+			return err
+		}
+
+		shipment := model.Shipment{
+			OrderID:    event.OrderID,
+			CustomerID: event.CustomerID,
+			ProductID:  event.ProductID,
+			Amount:     event.Amount,
+		}
+		dispatch, err := s.carrier.Ship(ctx, shipment)
+		if err != nil {
+			return err
+		}
+
+		var publishedEvent saga_event.Event
+		if dispatch.RejectReason == "" {
+			shipment.Status = model.ShipmentStatusShipped
+			shipment.TrackingNumber = dispatch.TrackingNumber
+			publishedEvent = saga_event.ShipmentDispatched{
+				OrderID:    event.OrderID,
+				CustomerID: event.CustomerID,
+				ProductID:  event.ProductID,
+				Amount:     event.Amount,
+				Cost:       event.Cost,
+			}
+		} else {
+			shipment.Status = model.ShipmentStatusFailed
+			shipment.FailureReason = dispatch.RejectReason
+			publishedEvent = saga_event.ShipmentFailed{
+				OrderID:    event.OrderID,
+				CustomerID: event.CustomerID,
+				ProductID:  event.ProductID,
+				Amount:     event.Amount,
+				Cost:       event.Cost,
+				Reason:     dispatch.RejectReason,
+			}
+		}
+
+		err = s.repo.CreateShipment(ctx, shipment)
+		if err != nil {
+			return err
+		}
+
+		detail := "tracking number " + dispatch.TrackingNumber
+		if dispatch.RejectReason != "" {
+			detail = dispatch.RejectReason
+		}
+		status := publishedEvent.OrderEvent().Status
+		err = s.audit(ctx, event.OrderID, model.AuditDecision, status, detail)
+		if err != nil {
+			return err
+		}
+
+		err = s.audit(ctx, event.OrderID, model.AuditEmitted, status, "")
+		if err != nil {
+			return err
+		}
+
+		content, err := s.codec.Marshal(publishedEvent)
+		if err != nil {
+			return err
+		}
+		return s.repo.CreateOutbox(ctx, model.Outbox{
+			Content:     content,
+			ContentType: s.codec.ContentType(),
+			Headers:     tracing.Inject(ctx),
+		})
+	})
+}
+
+func (s service) RelayMessage(ctx context.Context, limit int) error {
+	return s.publisher.Relay(ctx, limit)
+}
+
+// receive stores the message of event in the inbox, in the transaction of ctx. It returns false
+// when the message was already received and must not be handled again.
+func (s service) receive(ctx context.Context, event saga_event.OrderEvent) (bool, error) {
+	message, err := saga_event.InboxMessage(ctx, event)
+	if err != nil {
+		return false, err
+	}
+	return s.repo.ReceiveMessage(ctx, message)
+}
+
+// audit appends a step of the saga of orderID to saga_audit, in the transaction of ctx.
+func (s service) audit(ctx context.Context, orderID int64, kind model.AuditKind, status model.OrderStatus, detail string) error {
+	return s.repo.CreateAuditEntry(ctx, model.NewAuditEntry(orderID, serviceName, kind, status, detail))
+}
@@ -0,0 +1,123 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrDuplicateKey = errors.New("memory: duplicate key")
+
+// Store gives in-memory repos the transaction semantics they rely on in MySQL: writes made in
+// Transact are undone when it fails, and rows locked or written in a transaction stay locked
+// until it ends. Plain reads do not wait for locks and see uncommitted writes, repos are expected
+// to lock the rows they read for an update, as they do with SELECT ... FOR UPDATE.
+// Unlike MySQL there is no deadlock detection, a transaction waiting for a lock stops when its ctx is done.
+type Store struct {
+	mu    sync.Mutex
+	locks map[string]*txn
+}
+
+type txn struct {
+	store *Store
+	undo  []func()
+	held  []string
+	done  chan struct{}
+}
+
+type txKey struct {
+	store *Store
+}
+
+func NewStore() *Store {
+	return &Store{
+		locks: map[string]*txn{},
+	}
+}
+
+// Transact runs fn in a transaction carried by its ctx, fn joins the transaction of ctx if there is one.
+func (s *Store) Transact(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	if _, ok := ctx.Value(txKey{s}).(*txn); ok {
+		return fn(ctx)
+	}
+
+	tx := &txn{store: s, done: make(chan struct{})}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.end(true)
+			panic(r)
+		}
+		tx.end(err != nil)
+	}()
+
+	return fn(context.WithValue(ctx, txKey{s}, tx))
+}
+
+// Lock takes the row lock key for the transaction of ctx, waiting for the transaction holding it.
+// Outside of Transact it only waits for the row to be released, like an autocommit statement.
+func (s *Store) Lock(ctx context.Context, key string) error {
+	tx, _ := ctx.Value(txKey{s}).(*txn)
+	for {
+		s.mu.Lock()
+		owner, locked := s.locks[key]
+		if !locked || owner == tx {
+			if tx != nil && !locked {
+				s.locks[key] = tx
+				tx.held = append(tx.held, key)
+			}
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-owner.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Write locks the row key and runs apply, which returns how to undo it if the transaction fails.
+// An empty key writes without a row lock, like an insert into an auto increment table.
+func (s *Store) Write(ctx context.Context, key string, apply func() (undo func(), err error)) error {
+	if key != "" {
+		err := s.Lock(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	undo, err := apply()
+	if err != nil {
+		return err
+	}
+	if tx, ok := ctx.Value(txKey{s}).(*txn); ok && undo != nil {
+		tx.undo = append(tx.undo, undo)
+	}
+	return nil
+}
+
+// Read runs fn while no write is applied.
+func (s *Store) Read(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+func (tx *txn) end(rollback bool) {
+	s := tx.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rollback {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+	}
+	for _, key := range tx.held {
+		delete(s.locks, key)
+	}
+	close(tx.done)
+}
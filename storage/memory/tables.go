@@ -0,0 +1,297 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"sort"
+	"time"
+)
+
+// Outboxes is an in-memory outbox table with an auto increment id.
+type Outboxes struct {
+	store  *Store
+	rows   map[int64]model.Outbox
+	nextID int64
+}
+
+func NewOutboxes(store *Store) *Outboxes {
+	return &Outboxes{
+		store:  store,
+		rows:   map[int64]model.Outbox{},
+		nextID: 1,
+	}
+}
+
+func (o *Outboxes) Create(ctx context.Context, outbox model.Outbox) error {
+	return o.store.Write(ctx, "", func() (func(), error) {
+		id := o.nextID
+		o.nextID++
+		o.rows[id] = model.Outbox{
+			ID:          id,
+			Content:     append([]byte(nil), outbox.Content...),
+			ContentType: outbox.ContentType,
+			Headers:     copyHeaders(outbox.Headers),
+			Status:      model.OutboxPending,
+			CreatedAt:   Now(),
+		}
+		return func() { delete(o.rows, id) }, nil
+	})
+}
+
+func copyHeaders(headers model.Headers) model.Headers {
+	if len(headers) == 0 {
+		return nil
+	}
+	res := make(model.Headers, len(headers))
+	for key, value := range headers {
+		res[key] = value
+	}
+	return res
+}
+
+// Pending returns at most limit pending rows due for an attempt, oldest id first.
+func (o *Outboxes) Pending(limit int) []model.Outbox {
+	return o.due(limit, func(outbox model.Outbox) bool { return true })
+}
+
+// Retried is Pending restricted to the rows attempted before.
+func (o *Outboxes) Retried(limit int) []model.Outbox {
+	return o.due(limit, func(outbox model.Outbox) bool { return outbox.Attempts > 0 })
+}
+
+func (o *Outboxes) due(limit int, keep func(outbox model.Outbox) bool) []model.Outbox {
+	var res []model.Outbox
+	now := time.Now()
+	o.store.Read(func() {
+		for _, outbox := range o.rows {
+			if outbox.Status != model.OutboxPending || (outbox.NextAttemptAt.Valid && outbox.NextAttemptAt.Time.After(now)) {
+				continue
+			}
+			if keep(outbox) {
+				res = append(res, outbox)
+			}
+		}
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+func (o *Outboxes) CountPending() int {
+	var res int
+	o.store.Read(func() {
+		for _, outbox := range o.rows {
+			if outbox.Status == model.OutboxPending {
+				res++
+			}
+		}
+	})
+	return res
+}
+
+func (o *Outboxes) MarkDone(ctx context.Context, ids []int64) error {
+	for _, id := range ids {
+		id := id
+		err := o.store.Write(ctx, fmt.Sprintf("outbox:%d", id), func() (func(), error) {
+			old, ok := o.rows[id]
+			if !ok {
+				return nil, nil
+			}
+			updated := old
+			updated.Status = model.OutboxCompleted
+			updated.UpdatedAt = Now()
+			o.rows[id] = updated
+			return func() { o.rows[id] = old }, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordAttempt stores the status, attempts, last error and next attempt of outbox.
+func (o *Outboxes) RecordAttempt(ctx context.Context, outbox model.Outbox) error {
+	return o.store.Write(ctx, fmt.Sprintf("outbox:%d", outbox.ID), func() (func(), error) {
+		old, ok := o.rows[outbox.ID]
+		if !ok {
+			return nil, nil
+		}
+		updated := old
+		updated.Status = outbox.Status
+		updated.Attempts = outbox.Attempts
+		updated.LastError = outbox.LastError
+		updated.NextAttemptAt = outbox.NextAttemptAt
+		updated.UpdatedAt = Now()
+		o.rows[outbox.ID] = updated
+		return func() { o.rows[outbox.ID] = old }, nil
+	})
+}
+
+// DeleteCompleted deletes at most limit rows completed before before, oldest id first. It returns
+// how many rows were deleted.
+func (o *Outboxes) DeleteCompleted(ctx context.Context, before time.Time, limit int) (int, error) {
+	var ids []int64
+	o.store.Read(func() {
+		for _, outbox := range o.rows {
+			if isCompletedBefore(outbox, before) {
+				ids = append(ids, outbox.ID)
+			}
+		}
+	})
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	var res int
+	for _, id := range ids {
+		id := id
+		err := o.store.Write(ctx, fmt.Sprintf("outbox:%d", id), func() (func(), error) {
+			old, ok := o.rows[id]
+			if !ok || !isCompletedBefore(old, before) {
+				return nil, nil
+			}
+			res++
+			delete(o.rows, id)
+			return func() { o.rows[id] = old }, nil
+		})
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func isCompletedBefore(outbox model.Outbox, before time.Time) bool {
+	return outbox.Status == model.OutboxCompleted && outbox.UpdatedAt.Valid && outbox.UpdatedAt.Time.Before(before)
+}
+
+// Inbox is an in-memory inbox table, a message is received once per event type.
+type Inbox struct {
+	store *Store
+	rows  map[inboxKey]model.InboxMessage
+}
+
+type inboxKey struct {
+	messageID string
+	eventType string
+}
+
+func NewInbox(store *Store) *Inbox {
+	return &Inbox{
+		store: store,
+		rows:  map[inboxKey]model.InboxMessage{},
+	}
+}
+
+// Receive stores message, it returns false when it was already received.
+func (i *Inbox) Receive(ctx context.Context, message model.InboxMessage) (bool, error) {
+	key := inboxKey{messageID: message.MessageID, eventType: message.EventType}
+	var received bool
+	err := i.store.Write(ctx, fmt.Sprintf("inbox:%s:%s", key.messageID, key.eventType), func() (func(), error) {
+		if _, ok := i.rows[key]; ok {
+			return nil, nil
+		}
+		received = true
+		message.ReceivedAt = Now()
+		i.rows[key] = message
+		return func() { delete(i.rows, key) }, nil
+	})
+	return received, err
+}
+
+// IsReceived tells if a message of eventType was received for orderID.
+func (i *Inbox) IsReceived(orderID int64, eventType string) bool {
+	var ok bool
+	i.store.Read(func() {
+		for _, row := range i.rows {
+			if row.OrderID == orderID && row.EventType == eventType {
+				ok = true
+				return
+			}
+		}
+	})
+	return ok
+}
+
+// Delete deletes at most limit messages received before before, oldest first. It returns how many
+// messages were deleted.
+func (i *Inbox) Delete(ctx context.Context, before time.Time, limit int) (int, error) {
+	var messages []model.InboxMessage
+	i.store.Read(func() {
+		for _, row := range i.rows {
+			if row.ReceivedAt.Time.Before(before) {
+				messages = append(messages, row)
+			}
+		}
+	})
+	sort.Slice(messages, func(a, b int) bool { return messages[a].ReceivedAt.Time.Before(messages[b].ReceivedAt.Time) })
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+
+	var res int
+	for _, message := range messages {
+		key := inboxKey{messageID: message.MessageID, eventType: message.EventType}
+		err := i.store.Write(ctx, fmt.Sprintf("inbox:%s:%s", key.messageID, key.eventType), func() (func(), error) {
+			old, ok := i.rows[key]
+			if !ok || !old.ReceivedAt.Time.Before(before) {
+				return nil, nil
+			}
+			res++
+			delete(i.rows, key)
+			return func() { i.rows[key] = old }, nil
+		})
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// AuditLog is an in-memory saga_audit table, entries are only ever appended.
+type AuditLog struct {
+	store  *Store
+	rows   []model.AuditEntry
+	nextID int64
+}
+
+func NewAuditLog(store *Store) *AuditLog {
+	return &AuditLog{
+		store:  store,
+		nextID: 1,
+	}
+}
+
+func (a *AuditLog) Append(ctx context.Context, entry model.AuditEntry) error {
+	return a.store.Write(ctx, "", func() (func(), error) {
+		entry.ID = a.nextID
+		a.nextID++
+		a.rows = append(a.rows, entry)
+		n := len(a.rows) - 1
+		return func() { a.rows = a.rows[:n] }, nil
+	})
+}
+
+// ForOrder returns the entries of orderID in id order.
+func (a *AuditLog) ForOrder(orderID int64) []model.AuditEntry {
+	var res []model.AuditEntry
+	a.store.Read(func() {
+		for _, entry := range a.rows {
+			if entry.OrderID == orderID {
+				res = append(res, entry)
+			}
+		}
+	})
+	return res
+}
+
+// Now is the value MySQL gives CURRENT_TIMESTAMP columns, truncated to seconds like a timestamp column.
+func Now() sql.NullTime {
+	return sql.NullTime{Time: time.Now().UTC().Truncate(time.Second), Valid: true}
+}
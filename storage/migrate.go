@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/mysql"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/golang-migrate/migrate/v4/database/sqlite"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+)
+
+// MigrateUp applies every migration of the service, changed is false when it was already up to date.
+func MigrateUp(conf config.ServiceConfig) (changed bool, err error) {
+	err = createSQLiteDir(conf)
+	if err != nil {
+		return false, err
+	}
+
+	m, err := migrate.New(fmt.Sprintf("file://%s", conf.MigrationDir), databaseURL(conf))
+	if err != nil {
+		return false, err
+	}
+	defer m.Close()
+
+	err = m.Up()
+	if errors.Is(err, migrate.ErrNoChange) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// databaseURL is the DSN in the form golang-migrate expects, Postgres DSNs are already URLs.
+func databaseURL(conf config.ServiceConfig) string {
+	switch conf.DriverName() {
+	case config.DriverPostgres:
+		return conf.DatabaseDSN
+	case config.DriverSQLite:
+		return fmt.Sprintf("sqlite://%s", conf.DatabaseDSN)
+	default:
+		return fmt.Sprintf("mysql://%s", conf.DatabaseDSN)
+	}
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	_ "modernc.org/sqlite"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	sqlx.BindDriver(config.DriverSQLite, sqlx.QUESTION)
+}
+
+// Open connects to the database of a service with its driver.
+// SQLite gets a single connection: it has no SELECT ... FOR UPDATE, so transactions are serialized
+// instead, a transaction holds the connection until it ends and every other query waits for it.
+func Open(conf config.ServiceConfig) (*sqlx.DB, error) {
+	err := createSQLiteDir(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sqlx.Open(conf.DriverName(), conf.DatabaseDSN)
+	if err != nil {
+		return nil, err
+	}
+	if conf.DriverName() == config.DriverSQLite {
+		db.SetMaxOpenConns(1)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// SupportsLastInsertID is false for Postgres, inserts there read generated ids with RETURNING.
+func SupportsLastInsertID(db *sqlx.DB) bool {
+	return db.DriverName() != config.DriverPostgres
+}
+
+// createSQLiteDir creates the directory of a SQLite file, SQLite only creates the file itself.
+func createSQLiteDir(conf config.ServiceConfig) error {
+	if conf.DriverName() != config.DriverSQLite || strings.HasPrefix(conf.DatabaseDSN, "file:") {
+		return nil
+	}
+	return os.MkdirAll(filepath.Dir(conf.DatabaseDSN), 0755)
+}
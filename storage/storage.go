@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"time"
+)
+
+// Querier is what sqlx.DB and sqlx.Tx have in common, repos run every query through it.
+// Queries are written with ? placeholders and rebound to the placeholders of the driver.
+type Querier interface {
+	sqlx.ExtContext
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error)
+}
+
+// txKey is keyed by database, so a transaction of one service never leaks into another one.
+type txKey struct {
+	db *sqlx.DB
+}
+
+// Transact runs fn in a transaction carried by its ctx, committed when fn returns nil and rolled
+// back otherwise. fn joins the transaction of ctx if there is already one.
+func Transact(ctx context.Context, db *sqlx.DB, fn func(ctx context.Context) error) (err error) {
+	if _, ok := ctx.Value(txKey{db}).(*sqlx.Tx); ok {
+		return fn(ctx)
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			_ = tx.Rollback()
+			panic(r)
+		} else if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = fn(context.WithValue(ctx, txKey{db}, tx))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Conn returns the transaction of ctx, or db outside of Transact.
+func Conn(ctx context.Context, db *sqlx.DB) Querier {
+	if tx, ok := ctx.Value(txKey{db}).(*sqlx.Tx); ok {
+		return rebinder{tx}
+	}
+	return rebinder{db}
+}
+
+type rebinder struct {
+	sqlx.ExtContext
+}
+
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// prepare rebinds query for the driver. SQLite has no FOR UPDATE, its transactions are serialized
+// by Open instead, and compares times as text, so times are sent in the CURRENT_TIMESTAMP format.
+func (r rebinder) prepare(query string, args []interface{}) (string, []interface{}, error) {
+	query = r.Rebind(query)
+	if r.DriverName() != config.DriverSQLite {
+		return query, args, nil
+	}
+
+	query = strings.Replace(query, " FOR UPDATE", "", 1)
+	res := make([]interface{}, len(args))
+	for i, arg := range args {
+		if valuer, ok := arg.(driver.Valuer); ok {
+			var err error
+			arg, err = valuer.Value()
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		if t, ok := arg.(time.Time); ok {
+			arg = t.UTC().Format(sqliteTimeFormat)
+		}
+		res[i] = arg
+	}
+	return query, res, nil
+}
+
+// startQuery starts the span of one query, named after its operation like SELECT.
+func (r rebinder) startQuery(ctx context.Context, query string) (context.Context, trace.Span) {
+	operation, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	return tracing.Start(ctx, strings.ToUpper(operation),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemKey.String(r.DriverName()),
+			semconv.DBStatement(query),
+		),
+	)
+}
+
+// endQuery does not mark a span failed for sql.ErrNoRows, repos use it as a not found answer.
+func endQuery(span trace.Span, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	tracing.End(span, err)
+}
+
+func (r rebinder) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	query, args, err := r.prepare(query, args)
+	if err != nil {
+		return err
+	}
+	ctx, span := r.startQuery(ctx, query)
+	err = sqlx.GetContext(ctx, r.ExtContext, dest, query, args...)
+	endQuery(span, err)
+	return err
+}
+
+func (r rebinder) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	query, args, err := r.prepare(query, args)
+	if err != nil {
+		return err
+	}
+	ctx, span := r.startQuery(ctx, query)
+	err = sqlx.SelectContext(ctx, r.ExtContext, dest, query, args...)
+	endQuery(span, err)
+	return err
+}
+
+func (r rebinder) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	query, args, err := r.prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := r.startQuery(ctx, query)
+	res, err := r.ExtContext.ExecContext(ctx, query, args...)
+	endQuery(span, err)
+	return res, err
+}
+
+func (r rebinder) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	query, args, err := r.prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := r.startQuery(ctx, query)
+	rows, err := r.ExtContext.QueryxContext(ctx, query, args...)
+	endQuery(span, err)
+	return rows, err
+}
+
+// NamedExecContext binds named parameters with the placeholders of the driver, then runs as ExecContext.
+func (r rebinder) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	query, args, err := r.BindNamed(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return r.ExecContext(ctx, query, args...)
+}
@@ -0,0 +1,142 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test_Audit_Timeline runs a saga payment rejects, the timeline must show every step of the three
+// participants and the compensation in the order they happened.
+func Test_Audit_Timeline(t *testing.T) {
+	ctx := context.Background()
+	conf := config.DefaultConfig
+	broker := memory.NewBroker()
+	consumeFor := 200 * time.Millisecond
+
+	inventoryRepo := inventory.NewMemoryRepo()
+	err := inventoryRepo.CreateInventory(ctx, model.Inventory{ProductID: 2, UnitPrice: usd(5), Amount: 100})
+	assert.Nil(t, err)
+	inventoryService := inventory.NewService(
+		inventoryRepo,
+		broker.Consumer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.PrepareInventoryTopic),
+	)
+
+	paymentRepo := payment.NewMemoryRepo()
+	err = paymentRepo.CreateAccount(ctx, model.Account{CustomerID: 1, Balance: usd(10)})
+	assert.Nil(t, err)
+	paymentService := payment.NewService(
+		paymentRepo,
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.OrderBillTopic),
+	)
+
+	orderService := order.NewService(
+		order.NewMemoryRepo(),
+		broker.Producer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		order.WithAuditSources(inventoryRepo, paymentRepo),
+	)
+
+	id, err := orderService.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 3})
+	assert.Nil(t, err)
+	assert.Nil(t, orderService.RelayMessage(ctx, 10))
+
+	inventoryService.ConsumeOrders(ctx, consumeFor)
+	assert.Nil(t, inventoryService.RelayMessage(ctx, 10))
+	orderService.ConsumeInventory(ctx, consumeFor)
+
+	paymentService.ConsumePreparedOrders(ctx, consumeFor)
+	assert.Nil(t, paymentService.RelayMessage(ctx, 10))
+	inventoryService.ConsumeBills(ctx, consumeFor)
+	orderService.ConsumeBills(ctx, consumeFor)
+
+	timeline, err := orderService.GetTimeline(ctx, id)
+	assert.Nil(t, err)
+
+	type step struct {
+		service string
+		kind    model.AuditKind
+		status  model.OrderStatus
+	}
+	var actual []step
+	for i, entry := range timeline {
+		assert.Equal(t, id, entry.OrderID)
+		if i > 0 {
+			assert.False(t, entry.OccurredAt.Before(timeline[i-1].OccurredAt.Time))
+		}
+		actual = append(actual, step{entry.Service, entry.Kind, entry.Status})
+	}
+	assert.Equal(t, []step{
+		{"order", model.AuditEmitted, model.OrderStatusPending},
+		{"inventory", model.AuditReceived, model.OrderStatusPending},
+		{"inventory", model.AuditDecision, model.OrderStatusPrepared},
+		{"inventory", model.AuditEmitted, model.OrderStatusPrepared},
+		{"order", model.AuditReceived, model.OrderStatusPrepared},
+		{"payment", model.AuditReceived, model.OrderStatusPrepared},
+		{"payment", model.AuditDecision, model.OrderStatusFailedExceedCreditLimit},
+		{"payment", model.AuditEmitted, model.OrderStatusFailedExceedCreditLimit},
+		{"inventory", model.AuditCompensated, model.OrderStatusFailedExceedCreditLimit},
+		{"order", model.AuditReceived, model.OrderStatusFailedExceedCreditLimit},
+	}, actual)
+	assert.Equal(t, "reserved, cost "+usd(15).String(), timeline[2].Detail)
+	assert.Equal(t, "restored 3 x product 2", timeline[8].Detail)
+
+	_, err = orderService.GetTimeline(ctx, id+100)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// the order service serves the same timeline over HTTP
+	handler := order.NewTimelineHandler(orderService, logging.Default())
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/orders/%d/timeline", id), nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var served []struct {
+		OccurredAt time.Time         `json:"occurred_at"`
+		Service    string            `json:"service"`
+		Kind       model.AuditKind   `json:"kind"`
+		Status     model.OrderStatus `json:"status"`
+		Detail     string            `json:"detail"`
+	}
+	assert.Nil(t, json.NewDecoder(recorder.Body).Decode(&served))
+	var servedSteps []step
+	for i, entry := range served {
+		assert.True(t, timeline[i].OccurredAt.Equal(entry.OccurredAt))
+		servedSteps = append(servedSteps, step{entry.Service, entry.Kind, entry.Status})
+	}
+	assert.Equal(t, actual, servedSteps)
+	assert.Equal(t, "restored 3 x product 2", served[8].Detail)
+
+	for path, code := range map[string]int{
+		fmt.Sprintf("/orders/%d/timeline", id+100): http.StatusNotFound,
+		"/orders/abc/timeline":                     http.StatusNotFound,
+		fmt.Sprintf("/orders/%d", id):              http.StatusNotFound,
+	} {
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, code, recorder.Code, path)
+	}
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/orders/%d/timeline", id), nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
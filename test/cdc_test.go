@@ -0,0 +1,230 @@
+package test
+
+import (
+	"context"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/rafata1/sagas-pattern-thesis/cdc"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/relay"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var outboxColumns = [][]byte{
+	[]byte("id"), []byte("content"), []byte("content_type"), []byte("headers"),
+	[]byte("status"), []byte("created_at"), []byte("updated_at"),
+}
+
+func insertEvent(schema string, table string, logPos uint32, rows ...[]interface{}) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2, LogPos: logPos},
+		Event: &replication.RowsEvent{
+			Table: &replication.TableMapEvent{
+				Schema:     []byte(schema),
+				Table:      []byte(table),
+				ColumnName: outboxColumns,
+			},
+			Rows: rows,
+		},
+	}
+}
+
+func xidEvent(logPos uint32) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.XID_EVENT, LogPos: logPos},
+		Event:  &replication.XIDEvent{},
+	}
+}
+
+func newPublisher(repo relay.Repo, broker *memory.Broker) *relay.Publisher {
+	return relay.NewPublisher("order_outboxes", repo, broker.Producer("TOPIC"), relay.DefaultRetry, logging.Default())
+}
+
+func outboxRow(outbox model.Outbox) []interface{} {
+	return []interface{}{
+		int32(outbox.ID), outbox.Content, outbox.ContentType, `{"traceparent":"00-1-2-01"}`,
+		int8(outbox.Status), outbox.CreatedAt.Time, nil,
+	}
+}
+
+// Test_Cdc_Relay feeds the relay the binlog of two transactions, the outbox rows are published
+// at their commit, marked done and the position is saved after each one.
+func Test_Cdc_Relay(t *testing.T) {
+	ctx := context.Background()
+	broker := memory.NewBroker()
+	repo := order.NewMemoryRepo()
+	for _, content := range []string{"1", "2", "3"} {
+		err := repo.CreateOutbox(ctx, model.Outbox{Content: []byte(content), ContentType: "application/json"})
+		assert.Nil(t, err)
+	}
+	outboxes, err := repo.GetPendingOutbox(ctx, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(outboxes))
+
+	store := cdc.NewFileStore(filepath.Join(t.TempDir(), "binlog", "order.json"))
+	relay := cdc.NewRelay("saga", "order_outboxes", nil, repo, newPublisher(repo, broker), store)
+
+	rotate := &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.ROTATE_EVENT, Timestamp: uint32(time.Now().Unix())},
+		Event:  &replication.RotateEvent{NextLogName: []byte("binlog.000002"), Position: 4},
+	}
+	events := []*replication.BinlogEvent{
+		rotate,
+		insertEvent("saga", "order_outboxes", 200, outboxRow(outboxes[0]), outboxRow(outboxes[1])),
+		// rows of other tables and schemas are left out
+		insertEvent("saga", "order_audit", 300, outboxRow(outboxes[2])),
+		insertEvent("other", "order_outboxes", 400, outboxRow(outboxes[2])),
+		xidEvent(500),
+		// a transaction without outbox rows moves the position without saving it
+		xidEvent(600),
+	}
+	for _, event := range events {
+		err = relay.Handle(ctx, event)
+		assert.Nil(t, err)
+	}
+
+	messages := broker.Messages("TOPIC", 0)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, []byte("1"), messages[0].Value)
+	assert.Equal(t, []byte("2"), messages[1].Value)
+	pending, err := repo.CountPendingOutbox(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pending)
+	assert.Equal(t, cdc.Position{Name: "binlog.000002", Pos: 600}, relay.Position())
+
+	saved, ok, err := store.Load()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, cdc.Position{Name: "binlog.000002", Pos: 500}, saved)
+
+	err = relay.Handle(ctx, insertEvent("saga", "order_outboxes", 700, outboxRow(outboxes[2])))
+	assert.Nil(t, err)
+	err = relay.Handle(ctx, xidEvent(800))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(broker.Messages("TOPIC", 0)))
+	pending, err = repo.CountPendingOutbox(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pending)
+}
+
+// Test_Cdc_Relay_Aborted feeds the relay a transaction with a row Kafka rejects, in a transaction
+// that aborts the push. The other rows are still published, the rejected one is published again
+// once due although the binlog does not show it again.
+func Test_Cdc_Relay_Aborted(t *testing.T) {
+	ctx := context.Background()
+	broker := memory.NewBroker()
+	broker.SetMaxMessageBytes("TOPIC", 4)
+	broker.SetTransactional("TOPIC")
+	repo := order.NewMemoryRepo()
+	for _, content := range []string{"1", "too large", "3"} {
+		err := repo.CreateOutbox(ctx, model.Outbox{Content: []byte(content), ContentType: "application/json"})
+		assert.Nil(t, err)
+	}
+	outboxes, err := repo.GetPendingOutbox(ctx, 10)
+	assert.Nil(t, err)
+
+	// the rejected row is not due yet at the first check below
+	retry := relay.Retry{MaxAttempts: 3, InitialBackoff: 50 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	publisher := relay.NewPublisher("order_outboxes", repo, broker.Producer("TOPIC"), retry, logging.Default())
+	store := cdc.NewFileStore(filepath.Join(t.TempDir(), "order.json"))
+	binlog := cdc.NewRelay("saga", "order_outboxes", nil, repo, publisher, store)
+
+	rows := insertEvent("saga", "order_outboxes", 200, outboxRow(outboxes[0]), outboxRow(outboxes[1]), outboxRow(outboxes[2]))
+	for _, event := range []*replication.BinlogEvent{rows, xidEvent(300)} {
+		err = binlog.Handle(ctx, event)
+		assert.Nil(t, err)
+	}
+	messages := broker.Messages("TOPIC", 0)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, []byte("1"), messages[0].Value)
+	assert.Equal(t, []byte("3"), messages[1].Value)
+
+	retried, err := repo.GetRetriedOutbox(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, retried, 0)
+	time.Sleep(60 * time.Millisecond)
+	retried, err = repo.GetRetriedOutbox(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, retried, 1)
+	assert.Equal(t, 1, retried[0].Attempts)
+}
+
+// Test_Cdc_Relay_Columns needs the column names from the binlog when the relay has no database.
+func Test_Cdc_Relay_Columns(t *testing.T) {
+	ctx := context.Background()
+	store := cdc.NewFileStore(filepath.Join(t.TempDir(), "order.json"))
+	repo := order.NewMemoryRepo()
+	relay := cdc.NewRelay("saga", "order_outboxes", nil, repo, newPublisher(repo, memory.NewBroker()), store)
+
+	event := insertEvent("saga", "order_outboxes", 200, []interface{}{int32(1), []byte("1")})
+	event.Event.(*replication.RowsEvent).Table.ColumnName = nil
+	err := relay.Handle(ctx, event)
+	assert.NotNil(t, err)
+}
+
+func Test_Cdc_FileStore(t *testing.T) {
+	store := cdc.NewFileStore(filepath.Join(t.TempDir(), "binlog", "order.json"))
+	_, ok, err := store.Load()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	err = store.Save(cdc.Position{Name: "binlog.000001", Pos: 157})
+	assert.Nil(t, err)
+	err = store.Save(cdc.Position{Name: "binlog.000001", Pos: 900})
+	assert.Nil(t, err)
+
+	position, ok, err := store.Load()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, cdc.Position{Name: "binlog.000001", Pos: 900}, position)
+}
+
+func Test_Config_Relay_Validation(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+payment:
+  driver: postgres
+relay:
+  mode: binlog
+  server_id: 0
+`)
+	setDSNs(t, "order", "inventory", "payment", "shipping")
+	_, err := config.Load(path)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "relay: server_id is required by the binlog mode")
+	assert.Contains(t, err.Error(), "relay: the binlog mode needs MySQL, payment runs on postgres")
+
+	path = writeConfigFile(t, "config.yaml", `
+relay:
+  mode: stream
+`)
+	_, err = config.Load(path)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `relay: unknown mode "stream"`)
+
+	path = writeConfigFile(t, "config.yaml", `
+relay:
+  retry:
+    max_attempts: 0
+    initial_backoff: 10m
+`)
+	_, err = config.Load(path)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "relay: retry max_attempts must be positive")
+	assert.Contains(t, err.Error(), "relay: retry initial_backoff must be positive and not greater than max_backoff")
+
+	path = writeConfigFile(t, "config.yaml", `
+relay:
+  mode: binlog
+  position_dir: /var/lib/saga/binlog
+`)
+	conf, err := config.Load(path)
+	assert.Nil(t, err)
+	assert.True(t, conf.Relay.Binlog())
+	assert.Equal(t, uint32(1001), conf.Relay.ServerID)
+}
@@ -0,0 +1,241 @@
+package test
+
+import (
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
+
+// setDSNs gives services a DSN through the environment, a config needs one for every service.
+func setDSNs(t *testing.T, services ...string) {
+	for _, service := range services {
+		t.Setenv("SAGA_"+strings.ToUpper(service)+"_DSN", service+"-dsn")
+	}
+}
+
+func Test_Config_Defaults(t *testing.T) {
+	// no database is built in
+	_, err := config.Load("")
+	assert.EqualError(t, err, "invalid config: order: database_dsn or database_dsn_file is required\n"+
+		"inventory: database_dsn or database_dsn_file is required\n"+
+		"payment: database_dsn or database_dsn_file is required\n"+
+		"shipping: database_dsn or database_dsn_file is required")
+
+	conf, err := config.Load(filepath.Join("..", "config.mysql.yaml"))
+	if err != nil {
+		panic(err)
+	}
+	expected := config.DefaultConfig
+	expected.OrderConfig.DatabaseDSN = "root:1@tcp(localhost:3306)/saga_order?parseTime=true"
+	expected.InventoryConfig.DatabaseDSN = "root:1@tcp(localhost:3306)/saga_inventory?parseTime=true"
+	expected.PaymentConfig.DatabaseDSN = "root:1@tcp(localhost:3306)/saga_payment?parseTime=true"
+	expected.ShippingConfig.DatabaseDSN = "root:1@tcp(localhost:3306)/saga_shipping?parseTime=true"
+	assert.Equal(t, expected, conf)
+}
+
+func Test_Config_YAML_And_Env(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+order:
+  database_dsn: file-order-dsn
+kafka:
+  brokers: [kafka:9092]
+  client_id: order-service
+  producer:
+    retry_backoff: 250ms
+shipment_topic: SHIPPED
+watchdog:
+  prepared_timeout: 2m
+encodings:
+  SHIPPED: protobuf
+`)
+	t.Setenv("SAGA_KAFKA_BROKERS", "broker-1:9092, broker-2:9092")
+	t.Setenv("SAGA_PAYMENT_DSN", "env-payment-dsn")
+	setDSNs(t, "inventory", "shipping")
+	t.Setenv("SAGA_GATEWAY_PROVIDER", config.GatewayFake)
+	t.Setenv("SAGA_GATEWAY_CALLBACK_SECRET", "callback-secret")
+	t.Setenv("SAGA_CREDIT_POLICY", config.CreditOverdraft)
+
+	conf, err := config.Load(path)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, "file-order-dsn", conf.OrderConfig.DatabaseDSN)
+	assert.Equal(t, "env-payment-dsn", conf.PaymentConfig.DatabaseDSN)
+	assert.Equal(t, []string{"broker-1:9092", "broker-2:9092"}, conf.Kafka.Brokers)
+	assert.Equal(t, "order-service", conf.Kafka.ClientID)
+	assert.Equal(t, 250*time.Millisecond, conf.Kafka.Producer.RetryBackoff)
+	assert.Equal(t, "SHIPPED", conf.ShipmentTopic)
+	assert.Equal(t, 2*time.Minute, conf.Watchdog.PreparedTimeout)
+	assert.Equal(t, config.DefaultConfig.Watchdog.PendingTimeout, conf.Watchdog.PendingTimeout)
+	assert.Equal(t, config.EncodingProtobuf, conf.Encoding("SHIPPED"))
+	assert.Equal(t, config.EncodingJSON, conf.Encoding(conf.OrderBillTopic))
+	assert.True(t, conf.Gateway.Enabled())
+	assert.Equal(t, config.DefaultConfig.Gateway.CallbackPath, conf.Gateway.CallbackPath)
+	assert.Equal(t, "callback-secret", conf.Gateway.CallbackSecret)
+	assert.Equal(t, config.CreditOverdraft, conf.Credit.Policy)
+	// untouched keys keep their defaults
+	inventory := config.DefaultConfig.InventoryConfig
+	inventory.DatabaseDSN = "inventory-dsn"
+	assert.Equal(t, inventory, conf.InventoryConfig)
+}
+
+func Test_Config_TOML_With_Secret_File(t *testing.T) {
+	secret := writeConfigFile(t, "order_dsn", "user:secret@tcp(db:3306)/saga_order?parseTime=true\n")
+	password := writeConfigFile(t, "kafka_password", "kafka-secret\n")
+	callbackSecret := writeConfigFile(t, "callback_secret", "callback-secret\n")
+	path := writeConfigFile(t, "config.toml", `
+[order]
+database_dsn_file = "`+secret+`"
+
+[kafka]
+brokers = ["kafka-1:9093", "kafka-2:9093"]
+
+[kafka.sasl]
+mechanism = "SCRAM-SHA-512"
+username = "saga"
+password_file = "`+password+`"
+
+[gateway]
+provider = "fake"
+callback_secret_file = "`+callbackSecret+`"
+`)
+	setDSNs(t, "inventory", "payment", "shipping")
+
+	conf, err := config.Load(path)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, "user:secret@tcp(db:3306)/saga_order?parseTime=true", conf.OrderConfig.DatabaseDSN)
+	assert.Equal(t, []string{"kafka-1:9093", "kafka-2:9093"}, conf.Kafka.Brokers)
+	assert.Equal(t, "kafka-secret", conf.Kafka.SASL.Password)
+	assert.Equal(t, "callback-secret", conf.Gateway.CallbackSecret)
+
+	// callbacks are not taken unsigned
+	t.Setenv("SAGA_GATEWAY_CALLBACK_SECRET", "")
+	_, err = config.Load(path)
+	assert.EqualError(t, err, "invalid config: gateway: callback_secret or callback_secret_file is required")
+}
+
+func Test_Config_Validation(t *testing.T) {
+	path := writeConfigFile(t, "config.yml", `
+order:
+  database_dsn: ""
+payment:
+  driver: oracle
+kafka:
+  sasl:
+    mechanism: GSSAPI
+  consumer:
+    isolation_level: serializable
+tracing:
+  exporter: jaeger
+logging:
+  level: loud
+  format: xml
+watchdog:
+  pending_timeout: -1m
+  batch_size: 0
+gateway:
+  provider: stripe
+credit:
+  policy: loan
+order_bill_topic: ORDER_CREATED_TOPIC
+encodings:
+  SHIPMENT_TOPIC: avro
+  SHIPPED: protobuf
+`)
+	t.Setenv("SAGA_KAFKA_BROKERS", "")
+	setDSNs(t, "inventory", "payment", "shipping")
+
+	_, err := config.Load(path)
+	assert.EqualError(t, err, "invalid config: order: database_dsn or database_dsn_file is required\n"+
+		"payment: unknown driver \"oracle\"\n"+
+		"kafka: brokers is required\n"+
+		"kafka: unknown sasl mechanism \"GSSAPI\"\n"+
+		"kafka: unknown consumer isolation_level \"serializable\"\n"+
+		"watchdog: timeouts cannot be negative\n"+
+		"watchdog: batch_size must be positive\n"+
+		"gateway: unknown provider \"stripe\"\n"+
+		"credit: unknown policy \"loan\"\n"+
+		"logging: unknown level \"loud\"\n"+
+		"logging: unknown format \"xml\"\n"+
+		"tracing: unknown exporter \"jaeger\"\n"+
+		"order_created_topic and order_bill_topic both use topic \"ORDER_CREATED_TOPIC\"\n"+
+		"encodings: unknown encoding \"avro\" for topic \"SHIPMENT_TOPIC\"\n"+
+		"encodings: unknown topic \"SHIPPED\"")
+
+	_, err = config.Load(writeConfigFile(t, "config.json", "{}"))
+	assert.Error(t, err)
+
+	// an in-memory broker needs no broker list
+	path = writeConfigFile(t, "config.yaml", `
+order:
+  driver: sqlite
+  database_dsn: data/saga_order.db
+kafka:
+  in_memory: true
+`)
+	conf, err := config.Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, config.DriverSQLite, conf.OrderConfig.DriverName())
+	assert.Equal(t, config.DriverMySQL, conf.PaymentConfig.DriverName())
+
+	t.Setenv("SAGA_KAFKA_BROKERS", "kafka:9092")
+	t.Setenv("SAGA_INVENTORY_DSN_FILE", filepath.Join(t.TempDir(), "missing"))
+	_, err = config.Load("")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func Test_Config_Kafka_Validation(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+kafka:
+  brokers: [kafka:9092]
+  sasl:
+    mechanism: SCRAM-SHA-512
+  tls:
+    enabled: true
+    cert_file: client.pem
+  consumer:
+    initial_offset: latest
+  startup:
+    initial_backoff: 10s
+    max_backoff: 1s
+`)
+	setDSNs(t, "order", "inventory", "payment", "shipping")
+
+	_, err := config.Load(path)
+	assert.EqualError(t, err, "invalid config: kafka: sasl username is required\n"+
+		"kafka: tls cert_file and key_file go together\n"+
+		"kafka: unknown consumer initial_offset \"latest\"\n"+
+		"kafka: startup initial_backoff is greater than max_backoff")
+
+	// a client certificate with its key and a sasl username pass
+	path = writeConfigFile(t, "config.yaml", `
+kafka:
+  brokers: [kafka:9092]
+  sasl:
+    mechanism: PLAIN
+    username: saga
+  tls:
+    enabled: true
+    cert_file: client.pem
+    key_file: client-key.pem
+`)
+	_, err = config.Load(path)
+	assert.Nil(t, err)
+}
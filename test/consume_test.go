@@ -0,0 +1,107 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rafata1/sagas-pattern-thesis/consume"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test_Consume_Loop_Retries_Failures checks a message that cannot be decoded is counted and skipped,
+// a message the handler fails is handled again before the messages after it.
+func Test_Consume_Loop_Retries_Failures(t *testing.T) {
+	broker := memory.NewBroker()
+	first, err := json.Marshal(saga_event.OrderEvent{OrderID: 1})
+	assert.Nil(t, err)
+	second, err := json.Marshal(saga_event.OrderEvent{OrderID: 2})
+	assert.Nil(t, err)
+	assert.Nil(t, broker.Producer("consume").Push(kafka.Values([]byte("{"), first, second)))
+
+	consumer := broker.Consumer("consume")
+	defer consumer.Close()
+	failures := testutil.ToFloat64(metrics.HandlerErrors.WithLabelValues("test", "consume"))
+	var handled []int64
+	consume.Loop(context.Background(), consumer, 500*time.Millisecond, "test", "Consume", logging.Default(),
+		func(ctx context.Context, event saga_event.OrderEvent) error {
+			handled = append(handled, event.OrderID)
+			if len(handled) == 1 {
+				return errors.New("database is down")
+			}
+			return nil
+		})
+
+	assert.Equal(t, []int64{1, 1, 2}, handled)
+	assert.Equal(t, failures+2, testutil.ToFloat64(metrics.HandlerErrors.WithLabelValues("test", "consume")))
+}
+
+// Test_Consume_Loop_Stops_On_Failure checks the loop stopping while a message keeps failing does not
+// move past it.
+func Test_Consume_Loop_Stops_On_Failure(t *testing.T) {
+	broker := memory.NewBroker()
+	first, err := json.Marshal(saga_event.OrderEvent{OrderID: 1})
+	assert.Nil(t, err)
+	second, err := json.Marshal(saga_event.OrderEvent{OrderID: 2})
+	assert.Nil(t, err)
+	assert.Nil(t, broker.Producer("consume").Push(kafka.Values(first, second)))
+
+	consumer := broker.Consumer("consume")
+	defer consumer.Close()
+	var handled []int64
+	consume.Loop(context.Background(), consumer, 300*time.Millisecond, "test", "Consume", logging.Default(),
+		func(ctx context.Context, event saga_event.OrderEvent) error {
+			handled = append(handled, event.OrderID)
+			return errors.New("database is down")
+		})
+
+	assert.NotContains(t, handled, int64(2))
+	assert.Greater(t, len(handled), 1)
+}
+
+// Test_Consume_Loop_Context checks the loop without a deadline returns once its context is done.
+func Test_Consume_Loop_Context(t *testing.T) {
+	broker := memory.NewBroker()
+	consumer := broker.Consumer("consume")
+	defer consumer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		consume.Loop(ctx, consumer, 0, "test", "Consume", logging.Default(),
+			func(ctx context.Context, event saga_event.OrderEvent) error { return nil })
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("consume loop did not stop")
+	}
+}
+
+// Test_Consume_Loop_Closed_Consumer checks the loop returns once its consumer is closed.
+func Test_Consume_Loop_Closed_Consumer(t *testing.T) {
+	consumer := memory.NewBroker().Consumer("consume")
+	done := make(chan struct{})
+	go func() {
+		consume.Loop(context.Background(), consumer, 0, "test", "Consume", logging.Default(),
+			func(ctx context.Context, event saga_event.OrderEvent) error { return nil })
+		close(done)
+	}()
+
+	assert.Nil(t, consumer.Close())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("consume loop did not stop")
+	}
+}
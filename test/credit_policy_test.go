@@ -0,0 +1,269 @@
+package test
+
+import (
+	"context"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_CreditPolicies(t *testing.T) {
+	account := model.Account{
+		CustomerID:       1,
+		Balance:          model.NewMoney(10, model.DefaultCurrency),
+		CreditLimit:      20,
+		DailySpendingCap: 50,
+	}
+
+	cases := []struct {
+		name     string
+		policy   payment.ICreditPolicy
+		check    payment.CreditCheck
+		expected string
+	}{
+		{
+			name:     "prepaid within balance",
+			policy:   payment.NewStrictPrepaidPolicy(),
+			check:    payment.CreditCheck{Account: account, Cost: usd(10)},
+			expected: "",
+		},
+		{
+			name:     "prepaid over balance",
+			policy:   payment.NewStrictPrepaidPolicy(),
+			check:    payment.CreditCheck{Account: account, Cost: usd(11)},
+			expected: payment.RejectReasonInsufficientBalance,
+		},
+		{
+			name:     "overdraft within credit limit",
+			policy:   payment.NewOverdraftPolicy(),
+			check:    payment.CreditCheck{Account: account, Cost: usd(30)},
+			expected: "",
+		},
+		{
+			name:     "overdraft over credit limit",
+			policy:   payment.NewOverdraftPolicy(),
+			check:    payment.CreditCheck{Account: account, Cost: usd(31)},
+			expected: payment.RejectReasonCreditLimitExceeded,
+		},
+		{
+			name:     "daily cap reached",
+			policy:   payment.NewDailyCapPolicy(payment.NewOverdraftPolicy()),
+			check:    payment.CreditCheck{Account: account, Cost: usd(10), SpentToday: 45},
+			expected: payment.RejectReasonDailyCapExceeded,
+		},
+		{
+			name:     "daily cap defers to next policy",
+			policy:   payment.NewDailyCapPolicy(payment.NewStrictPrepaidPolicy()),
+			check:    payment.CreditCheck{Account: account, Cost: usd(20), SpentToday: 5},
+			expected: payment.RejectReasonInsufficientBalance,
+		},
+		{
+			name:   "zero daily cap means no cap",
+			policy: payment.NewDailyCapPolicy(payment.NewOverdraftPolicy()),
+			check: payment.CreditCheck{
+				Account:    model.Account{Balance: model.NewMoney(1000, model.DefaultCurrency)},
+				Cost:       model.NewMoney(500, model.DefaultCurrency),
+				SpentToday: 10000,
+			},
+			expected: "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, c.policy.Check(c.check))
+		})
+	}
+}
+
+// newAccountPaymentService pays from the balance of account, kept in a memory repo.
+func newAccountPaymentService(account model.Account, opts ...payment.Option) (payment.IService, payment.IRepo) {
+	repo := payment.NewMemoryRepo()
+	err := repo.CreateAccount(context.Background(), account)
+	if err != nil {
+		panic(err)
+	}
+	return payment.NewService(repo, nil, nil, nil, opts...), repo
+}
+
+func payOrder(ctx context.Context, paymentService payment.IService, orderID int64, cost model.Money) {
+	err := paymentService.Pay(ctx, saga_event.OrderEvent{
+		OrderID:    orderID,
+		CustomerID: 1,
+		ProductID:  2,
+		Amount:     1,
+		Cost:       cost,
+		Status:     model.OrderStatusPrepared,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type payDecision struct {
+	status model.OrderStatus
+	reason string
+}
+
+func publishedDecisions(ctx context.Context, repo payment.IRepo) []payDecision {
+	var res []payDecision
+	for _, event := range getPublishedEvents(ctx, repo) {
+		res = append(res, payDecision{status: event.Status, reason: event.Reason})
+	}
+	return res
+}
+
+func Test_Pay_Overdraft(t *testing.T) {
+	ctx := context.Background()
+	paymentService, repo := newAccountPaymentService(model.Account{
+		CustomerID:  1,
+		Balance:     usd(10),
+		CreditLimit: 20,
+	}, payment.WithCreditPolicy(payment.NewOverdraftPolicy()))
+
+	// the balance goes negative down to the credit limit
+	payOrder(ctx, paymentService, 1, usd(25))
+	payOrder(ctx, paymentService, 2, usd(10))
+	payOrder(ctx, paymentService, 3, usd(5))
+
+	assert.Equal(t, []payDecision{
+		{status: model.OrderStatusBilled},
+		{status: model.OrderStatusFailedExceedCreditLimit, reason: payment.RejectReasonCreditLimitExceeded},
+		{status: model.OrderStatusBilled},
+	}, publishedDecisions(ctx, repo))
+
+	account, err := repo.GetAccount(ctx, 1)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, usd(-20), account.Balance)
+}
+
+func Test_Pay_Daily_Cap(t *testing.T) {
+	ctx := context.Background()
+	paymentService, repo := newAccountPaymentService(model.Account{
+		CustomerID:       1,
+		Balance:          usd(100),
+		DailySpendingCap: 30,
+	}, payment.WithCreditPolicy(payment.NewDailyCapPolicy(payment.NewStrictPrepaidPolicy())))
+
+	// the charges of the day count against the cap, a rejected order does not
+	payOrder(ctx, paymentService, 1, usd(20))
+	payOrder(ctx, paymentService, 2, usd(15))
+	payOrder(ctx, paymentService, 3, usd(10))
+
+	assert.Equal(t, []payDecision{
+		{status: model.OrderStatusBilled},
+		{status: model.OrderStatusFailedExceedCreditLimit, reason: payment.RejectReasonDailyCapExceeded},
+		{status: model.OrderStatusBilled},
+	}, publishedDecisions(ctx, repo))
+
+	spent, err := repo.GetSpentSince(ctx, 1, time.Now().Truncate(24*time.Hour))
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, int64(30), spent)
+
+	account, err := repo.GetAccount(ctx, 1)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, usd(70), account.Balance)
+}
+
+// Test_Pay_Cross_Currency pays a USD order from a EUR account, the account is debited the converted
+// cost and a refund gives back what was debited.
+func Test_Pay_Cross_Currency(t *testing.T) {
+	ctx := context.Background()
+	paymentService, repo := newAccountPaymentService(model.Account{
+		CustomerID: 1,
+		Balance:    model.NewMoney(2000, "EUR"),
+	}, payment.WithRateProvider(payment.NewStaticRateProvider(payment.Rate{From: "EUR", To: "USD", Rate: 1.1})))
+
+	payOrder(ctx, paymentService, 1, usd(1100))
+	// no rate converts GBP to EUR
+	payOrder(ctx, paymentService, 2, model.NewMoney(100, "GBP"))
+
+	assert.Equal(t, []payDecision{
+		{status: model.OrderStatusBilled},
+		{status: model.OrderStatusFailedExceedCreditLimit, reason: payment.RejectReasonUnsupportedCurrency},
+	}, publishedDecisions(ctx, repo))
+	// the events keep the cost of the order
+	assert.Equal(t, usd(1100), getPublishedEvents(ctx, repo)[0].Cost)
+
+	account, err := repo.GetAccount(ctx, 1)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, model.NewMoney(1000, "EUR"), account.Balance)
+
+	err = repo.Transact(ctx, func(ctx context.Context) error {
+		charge, err := repo.LockChargeForUpdate(ctx, 1)
+		assert.Equal(t, model.NewMoney(1000, "EUR"), charge.Cost)
+		return err
+	})
+	assert.Nil(t, err)
+
+	err = paymentService.Refund(ctx, saga_event.OrderEvent{
+		OrderID:    1,
+		CustomerID: 1,
+		ProductID:  2,
+		Amount:     1,
+		Cost:       usd(1100),
+		Status:     model.OrderStatusFailedShipping,
+	})
+	assert.Nil(t, err)
+
+	account, err = repo.GetAccount(ctx, 1)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, model.NewMoney(2000, "EUR"), account.Balance)
+
+	// the audit logs what was given back, not the cost of the order
+	entries, err := repo.GetAuditEntries(ctx, 1)
+	assert.Nil(t, err)
+	last := entries[len(entries)-1]
+	assert.Equal(t, model.AuditCompensated, last.Kind)
+	assert.Equal(t, "refunded "+model.NewMoney(1000, "EUR").String(), last.Detail)
+}
+
+func usd(amount int64) model.Money {
+	return model.NewMoney(amount, model.DefaultCurrency)
+}
+
+func Test_Convert(t *testing.T) {
+	rates := payment.NewStaticRateProvider(
+		payment.Rate{From: "EUR", To: "USD", Rate: 1.1},
+		payment.Rate{From: "USD", To: "JPY", Rate: 130},
+	)
+	ctx := context.Background()
+
+	cases := []struct {
+		name     string
+		money    model.Money
+		currency string
+		expected model.Money
+	}{
+		{name: "same currency", money: model.NewMoney(1500, "USD"), currency: "USD", expected: model.NewMoney(1500, "USD")},
+		{name: "direct rate", money: model.NewMoney(1000, "EUR"), currency: "USD", expected: model.NewMoney(1100, "USD")},
+		{name: "inverse rate", money: model.NewMoney(1100, "USD"), currency: "EUR", expected: model.NewMoney(1000, "EUR")},
+		{name: "zero decimal currency", money: model.NewMoney(250, "USD"), currency: "JPY", expected: model.NewMoney(325, "JPY")},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := payment.Convert(ctx, rates, c.money, c.currency)
+			if err != nil {
+				panic(err)
+			}
+			assert.Equal(t, c.expected, actual)
+		})
+	}
+
+	_, err := payment.Convert(ctx, rates, model.NewMoney(100, "GBP"), "USD")
+	assert.ErrorIs(t, err, payment.ErrRateNotFound)
+}
@@ -0,0 +1,172 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+var (
+	protoComment = regexp.MustCompile(`//.*`)
+	protoMessage = regexp.MustCompile(`message (\w+) \{([^}]*)\}`)
+	protoField   = regexp.MustCompile(`([\w.]+) (\w+) = (\d+);`)
+)
+
+// parseEventsProto builds the descriptor of saga_event/events.proto. It reads the messages of
+// scalar, Money and Timestamp fields the file is made of, what other languages generate code from.
+func parseEventsProto(t *testing.T) protoreflect.FileDescriptor {
+	content, err := os.ReadFile("../saga_event/events.proto")
+	assert.Nil(t, err)
+	source := protoComment.ReplaceAllString(string(content), "")
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("saga_event/events.proto"),
+		Package:    proto.String("saga_event"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		Syntax:     proto.String("proto3"),
+	}
+	for _, message := range protoMessage.FindAllStringSubmatch(source, -1) {
+		descriptor := &descriptorpb.DescriptorProto{Name: proto.String(message[1])}
+		for _, field := range protoField.FindAllStringSubmatch(message[2], -1) {
+			number, err := strconv.Atoi(field[3])
+			assert.Nil(t, err)
+			fieldDescriptor := &descriptorpb.FieldDescriptorProto{
+				Name:   proto.String(field[2]),
+				Number: proto.Int32(int32(number)),
+				Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}
+			switch field[1] {
+			case "int64":
+				fieldDescriptor.Type = descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()
+			case "int32":
+				fieldDescriptor.Type = descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum()
+			case "string":
+				fieldDescriptor.Type = descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+			case "bytes":
+				fieldDescriptor.Type = descriptorpb.FieldDescriptorProto_TYPE_BYTES.Enum()
+			case "Money":
+				fieldDescriptor.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				fieldDescriptor.TypeName = proto.String(".saga_event.Money")
+			case "google.protobuf.Timestamp":
+				fieldDescriptor.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				fieldDescriptor.TypeName = proto.String(".google.protobuf.Timestamp")
+			default:
+				t.Fatalf("events.proto: unexpected type %s of %s.%s", field[1], message[1], field[2])
+			}
+			descriptor.Field = append(descriptor.Field, fieldDescriptor)
+		}
+		file.MessageType = append(file.MessageType, descriptor)
+	}
+
+	res, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatalf("events.proto: %s", err)
+	}
+	return res
+}
+
+// protoValues returns the fields set on message by name, numbers as float64 like encoding/json.
+func protoValues(t *testing.T, message protoreflect.Message) map[string]interface{} {
+	assert.Empty(t, message.GetUnknown(), "%s has fields events.proto does not declare", message.Descriptor().Name())
+	res := map[string]interface{}{}
+	message.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		switch field.Kind() {
+		case protoreflect.Int64Kind, protoreflect.Int32Kind:
+			res[string(field.Name())] = float64(value.Int())
+		case protoreflect.StringKind:
+			res[string(field.Name())] = value.String()
+		case protoreflect.MessageKind:
+			res[string(field.Name())] = protoValues(t, value.Message())
+		default:
+			t.Errorf("unexpected field %s", field.FullName())
+		}
+		return true
+	})
+	return res
+}
+
+// jsonValues returns the fields of the JSON payload of event, without the zero values proto3 does
+// not write.
+func jsonValues(t *testing.T, event saga_event.Event) map[string]interface{} {
+	content, err := json.Marshal(event)
+	assert.Nil(t, err)
+	var res map[string]interface{}
+	assert.Nil(t, json.Unmarshal(content, &res))
+	return withoutZeros(res)
+}
+
+func withoutZeros(values map[string]interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	for name, value := range values {
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = withoutZeros(nested)
+			if len(nested) == 0 {
+				continue
+			}
+		}
+		if value == 0.0 || value == "" {
+			continue
+		}
+		res[name] = value
+	}
+	return res
+}
+
+// Test_Event_Protobuf_Descriptor decodes what the protobuf codec writes with the messages of
+// events.proto, the proto tags of the events must match the schema other languages read.
+func Test_Event_Protobuf_Descriptor(t *testing.T) {
+	file := parseEventsProto(t)
+	cost := model.NewMoney(15, model.DefaultCurrency)
+	events := []saga_event.Event{
+		saga_event.OrderCreated{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, PromoCode: "VIP"},
+		saga_event.OrderTimedOut{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, Cost: cost, Reason: "no answer"},
+		saga_event.OrderConfirmed{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, Cost: cost},
+		saga_event.InventoryReserved{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, PromoCode: "VIP", Cost: cost},
+		saga_event.InventoryRejected{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4},
+		saga_event.PaymentCharged{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, Cost: cost},
+		saga_event.PaymentRejected{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, Cost: cost,
+			Status: model.OrderStatusFailedPaymentDeclined, Reason: "CARD_DECLINED"},
+		saga_event.ShipmentDispatched{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, Cost: cost},
+		saga_event.ShipmentFailed{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, Cost: cost,
+			Reason: "UNDELIVERABLE_ADDRESS"},
+	}
+
+	var types []string
+	for _, event := range events {
+		types = append(types, event.EventType())
+	}
+	assert.ElementsMatch(t, saga_event.DefaultRegistry.Types(), types)
+
+	for _, event := range events {
+		content, err := saga_event.Protobuf.Marshal(event)
+		assert.Nil(t, err)
+
+		envelope := dynamicpb.NewMessage(file.Messages().ByName("Envelope"))
+		assert.Nil(t, proto.Unmarshal(content, envelope))
+		fields := envelope.Descriptor().Fields()
+		assert.Equal(t, event.EventType(), envelope.Get(fields.ByName("type")).String())
+		assert.Equal(t, int64(1), envelope.Get(fields.ByName("version")).Int())
+		assert.NotEmpty(t, envelope.Get(fields.ByName("id")).String())
+		assert.True(t, envelope.Has(fields.ByName("occurred_at")))
+
+		descriptor := file.Messages().ByName(protoreflect.Name(event.EventType()))
+		if !assert.NotNil(t, descriptor, "events.proto has no message %s", event.EventType()) {
+			continue
+		}
+		payload := dynamicpb.NewMessage(descriptor)
+		assert.Nil(t, proto.Unmarshal(envelope.Get(fields.ByName("payload")).Bytes(), payload))
+		assert.Equal(t, jsonValues(t, event), protoValues(t, payload), event.EventType())
+	}
+}
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"context"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Test_Inbox_Inventory redelivers the creation and the timeout of the same order, inventory
+// handles each message once: it reserves the stock, releases it and passes the timeout on.
+func Test_Inbox_Inventory(t *testing.T) {
+	ctx := context.Background()
+	conf := config.DefaultConfig
+	broker := memory.NewBroker()
+	repo := inventory.NewMemoryRepo()
+	err := repo.CreateInventory(ctx, model.Inventory{ProductID: 2, UnitPrice: usd(5), Amount: 10})
+	assert.Nil(t, err)
+	service := inventory.NewService(
+		repo,
+		broker.Consumer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.PrepareInventoryTopic),
+	)
+
+	created := mustMarshalEvent(t, saga_event.OrderCreated{OrderID: 1, CustomerID: 1, ProductID: 2, Amount: 3})
+	timedOut := mustMarshalEvent(t, saga_event.OrderTimedOut{
+		OrderID: 1, CustomerID: 1, ProductID: 2, Amount: 3, Cost: usd(15), Reason: "no answer",
+	})
+	err = broker.Producer(conf.OrderCreatedTopic).Push(kafka.Values(created, created, timedOut, timedOut))
+	assert.Nil(t, err)
+	service.ConsumeOrders(ctx, consumeFor)
+
+	actual, err := repo.GetInventory(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, actual.Amount)
+	pending, err := repo.CountPendingOutbox(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, pending)
+
+	// an order timed out before it came is passed on without a reservation
+	timedOut = mustMarshalEvent(t, saga_event.OrderTimedOut{
+		OrderID: 2, CustomerID: 1, ProductID: 2, Amount: 4, Reason: "no answer",
+	})
+	created = mustMarshalEvent(t, saga_event.OrderCreated{OrderID: 2, CustomerID: 1, ProductID: 2, Amount: 4})
+	err = broker.Producer(conf.OrderCreatedTopic).Push(kafka.Values(timedOut, created))
+	assert.Nil(t, err)
+	service.ConsumeOrders(ctx, consumeFor)
+
+	actual, err = repo.GetInventory(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, actual.Amount)
+	pending, err = repo.CountPendingOutbox(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, pending)
+
+	received, err := repo.IsReceived(ctx, 2, saga_event.TypeOrderCreated)
+	assert.Nil(t, err)
+	assert.True(t, received)
+}
+
+// Test_Inbox_Restore_Inventory republishes the decline of an order, each copy is a new message the
+// inbox lets through. The stock comes back once, the reservation of the order is released once.
+func Test_Inbox_Restore_Inventory(t *testing.T) {
+	ctx := context.Background()
+	conf := config.DefaultConfig
+	broker := memory.NewBroker()
+	repo := inventory.NewMemoryRepo()
+	err := repo.CreateInventory(ctx, model.Inventory{ProductID: 2, UnitPrice: usd(5), Amount: 10})
+	assert.Nil(t, err)
+	service := inventory.NewService(
+		repo,
+		broker.Consumer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.PrepareInventoryTopic),
+	)
+
+	created := mustMarshalEvent(t, saga_event.OrderCreated{OrderID: 1, CustomerID: 1, ProductID: 2, Amount: 3})
+	assert.Nil(t, broker.Producer(conf.OrderCreatedTopic).Push(kafka.Values(created)))
+	service.ConsumeOrders(ctx, consumeFor)
+
+	actual, err := repo.GetInventory(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, actual.Amount)
+
+	// each copy is marshaled into an envelope of its own id
+	declined := saga_event.PaymentRejected{
+		OrderID: 1, CustomerID: 1, ProductID: 2, Amount: 3, Cost: usd(15),
+		Status: model.OrderStatusFailedPaymentDeclined, Reason: "CARD_DECLINED",
+	}
+	err = broker.Producer(conf.OrderBillTopic).Push(kafka.Values(
+		mustMarshalEvent(t, declined), mustMarshalEvent(t, declined),
+	))
+	assert.Nil(t, err)
+	service.ConsumeBills(ctx, consumeFor)
+
+	actual, err = repo.GetInventory(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, actual.Amount)
+
+	// the timeout of the declined order has nothing left to release
+	timedOut := mustMarshalEvent(t, saga_event.OrderTimedOut{
+		OrderID: 1, CustomerID: 1, ProductID: 2, Amount: 3, Cost: usd(15), Reason: "no answer",
+	})
+	assert.Nil(t, broker.Producer(conf.OrderCreatedTopic).Push(kafka.Values(timedOut)))
+	service.ConsumeOrders(ctx, consumeFor)
+
+	actual, err = repo.GetInventory(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, actual.Amount)
+
+	entries, err := repo.GetAuditEntries(ctx, 1)
+	assert.Nil(t, err)
+	var compensations int
+	for _, entry := range entries {
+		if entry.Kind == model.AuditCompensated {
+			compensations++
+		}
+	}
+	assert.Equal(t, 1, compensations)
+}
@@ -0,0 +1,303 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/xdg-go/scram"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// saslAuthenticateKey is the api key of SaslAuthenticate requests.
+const saslAuthenticateKey = 36
+
+// scramListener runs the server side of a SCRAM exchange on each connection. The mock broker
+// answers SaslAuthenticate requests with fixed bytes, the connection sets them from the client
+// message before the broker reads the request to the end.
+type scramListener struct {
+	net.Listener
+	server   *scram.Server
+	response *sarama.MockSaslAuthenticateResponse
+}
+
+func (l *scramListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &scramConn{Conn: conn, conversation: l.server.NewConversation(), response: l.response}, nil
+}
+
+type scramConn struct {
+	net.Conn
+	conversation *scram.ServerConversation
+	response     *sarama.MockSaslAuthenticateResponse
+	buffer       []byte
+	valid        bool
+}
+
+func (c *scramConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buffer = append(c.buffer, p[:n]...)
+	for len(c.buffer) >= 4 {
+		size := int(binary.BigEndian.Uint32(c.buffer))
+		if len(c.buffer) < 4+size {
+			break
+		}
+		c.step(c.buffer[4 : 4+size])
+		c.buffer = c.buffer[4+size:]
+	}
+	return n, err
+}
+
+// step answers the auth bytes of a SaslAuthenticate request, what follows the api key, version,
+// correlation id and client id of the request header.
+func (c *scramConn) step(request []byte) {
+	if int16(binary.BigEndian.Uint16(request)) != saslAuthenticateKey {
+		return
+	}
+	offset := 10
+	if clientID := int16(binary.BigEndian.Uint16(request[8:])); clientID > 0 {
+		offset += int(clientID)
+	}
+	size := int(binary.BigEndian.Uint32(request[offset:]))
+	message := string(request[offset+4 : offset+4+size])
+
+	// a failed exchange still answers the client with the e= message
+	response, _ := c.conversation.Step(message)
+	c.response.SetAuthBytes([]byte(response))
+}
+
+// newSCRAMMockBroker accepts username and password with SCRAM on the mechanism of hash.
+func newSCRAMMockBroker(
+	t *testing.T, topic string, mechanism string, hash scram.HashGeneratorFcn, username string, password string,
+) *sarama.MockBroker {
+	client, err := hash.NewClient(username, password, "")
+	if err != nil {
+		panic(err)
+	}
+	credentials := client.GetStoredCredentials(scram.KeyFactors{Salt: "saga-salt", Iters: 4096})
+	server, err := hash.NewServer(func(user string) (scram.StoredCredentials, error) {
+		return credentials, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	response := sarama.NewMockSaslAuthenticateResponse(t)
+	broker := sarama.NewMockBrokerListener(t, 1, &scramListener{Listener: listener, server: server, response: response})
+
+	handlers := mockBrokerHandlers(t, broker, topic)
+	handlers["SaslHandshakeRequest"] = sarama.NewMockSaslHandshakeResponse(t).SetEnabledMechanisms([]string{mechanism})
+	handlers["SaslAuthenticateRequest"] = response
+	broker.SetHandlerByMap(handlers)
+	return broker
+}
+
+func saslRequests(broker *sarama.MockBroker) ([]string, [][]byte) {
+	var mechanisms []string
+	var authBytes [][]byte
+	for _, item := range broker.History() {
+		switch request := item.Request.(type) {
+		case *sarama.SaslHandshakeRequest:
+			mechanisms = append(mechanisms, request.Mechanism)
+		case *sarama.SaslAuthenticateRequest:
+			authBytes = append(authBytes, request.SaslAuthBytes)
+		}
+	}
+	return mechanisms, authBytes
+}
+
+func Test_Kafka_SASL_Plain(t *testing.T) {
+	topic := "KAFKA_TEST_TOPIC"
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	handlers := mockBrokerHandlers(t, broker, topic)
+	handlers["SaslHandshakeRequest"] = sarama.NewMockSaslHandshakeResponse(t).SetEnabledMechanisms([]string{"PLAIN"})
+	handlers["SaslAuthenticateRequest"] = sarama.NewMockSaslAuthenticateResponse(t)
+	broker.SetHandlerByMap(handlers)
+
+	conf := config.KafkaConfig{
+		Brokers: []string{broker.Addr()},
+		SASL: config.SASLConfig{
+			Mechanism: config.SASLMechanismPlain,
+			Username:  "saga",
+			Password:  "secret",
+		},
+	}
+	producer, err := kafka.NewProducer(conf, topic)
+	if err != nil {
+		panic(err)
+	}
+	defer producer.Close()
+	assert.Nil(t, producer.Push(kafka.Values([]byte("hello"))))
+
+	mechanisms, authBytes := saslRequests(broker)
+	assert.NotEmpty(t, mechanisms)
+	for i := range mechanisms {
+		assert.Equal(t, "PLAIN", mechanisms[i])
+		assert.Equal(t, "\x00saga\x00secret", string(authBytes[i]))
+	}
+}
+
+func Test_Kafka_SASL_SCRAM(t *testing.T) {
+	topic := "KAFKA_TEST_TOPIC"
+	tests := []struct {
+		mechanism string
+		hash      scram.HashGeneratorFcn
+	}{
+		{mechanism: config.SASLMechanismScramSHA256, hash: scram.SHA256},
+		{mechanism: config.SASLMechanismScramSHA512, hash: scram.SHA512},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mechanism, func(t *testing.T) {
+			broker := newSCRAMMockBroker(t, topic, test.mechanism, test.hash, "saga", "secret")
+			defer broker.Close()
+
+			conf := config.KafkaConfig{
+				Brokers: []string{broker.Addr()},
+				SASL: config.SASLConfig{
+					Mechanism: test.mechanism,
+					Username:  "saga",
+					Password:  "secret",
+				},
+			}
+			producer, err := kafka.NewProducer(conf, topic)
+			if err != nil {
+				panic(err)
+			}
+			defer producer.Close()
+			assert.Nil(t, producer.Push(kafka.Values([]byte("hello"))))
+
+			// each connection sends the client first and the client final message
+			mechanisms, authBytes := saslRequests(broker)
+			assert.NotEmpty(t, mechanisms)
+			assert.Len(t, authBytes, 2*len(mechanisms))
+			for _, mechanism := range mechanisms {
+				assert.Equal(t, test.mechanism, mechanism)
+			}
+			assert.Contains(t, string(authBytes[0]), "n=saga,")
+
+			// the broker proves the password was wrong, the client gives up on the broker
+			conf.SASL.Password = "wrong"
+			conf.Producer.Retries = 1
+			_, err = kafka.NewProducer(conf, topic)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// newCertificate returns a certificate signed by parent, or self-signed without one, and its
+// PEM encoding.
+func newCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		panic(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func newCA(t *testing.T, name string) (tls.Certificate, []byte) {
+	return newCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil)
+}
+
+// newTLSMockBroker serves the mock broker over TLS with a certificate of 127.0.0.1 signed by ca.
+func newTLSMockBroker(t *testing.T, topic string, ca tls.Certificate) *sarama.MockBroker {
+	cert, _ := newCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kafka"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		panic(err)
+	}
+	broker := sarama.NewMockBrokerListener(t, 1, listener)
+	broker.SetHandlerByMap(mockBrokerHandlers(t, broker, topic))
+	return broker
+}
+
+func Test_Kafka_TLS(t *testing.T) {
+	topic := "KAFKA_TEST_TOPIC"
+	ca, caPEM := newCA(t, "saga-ca")
+	broker := newTLSMockBroker(t, topic, ca)
+	defer broker.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, os.WriteFile(caFile, caPEM, 0644))
+
+	conf := config.KafkaConfig{
+		Brokers: []string{broker.Addr()},
+		TLS:     config.TLSConfig{Enabled: true, CAFile: caFile},
+	}
+	producer, err := kafka.NewProducer(conf, topic)
+	if err != nil {
+		panic(err)
+	}
+	defer producer.Close()
+	assert.Nil(t, producer.Push(kafka.Values([]byte("hello"))))
+
+	// the broker certificate is not signed by another ca
+	_, otherPEM := newCA(t, "other-ca")
+	otherFile := filepath.Join(dir, "other.pem")
+	assert.Nil(t, os.WriteFile(otherFile, otherPEM, 0644))
+	conf.TLS.CAFile = otherFile
+	_, err = kafka.NewProducer(conf, topic)
+	assert.Error(t, err)
+
+	emptyFile := filepath.Join(dir, "empty.pem")
+	assert.Nil(t, os.WriteFile(emptyFile, []byte("not a certificate"), 0644))
+	conf.TLS.CAFile = emptyFile
+	_, err = kafka.NewProducer(conf, topic)
+	assert.EqualError(t, err, "kafka ca file "+emptyFile+" has no certificate")
+
+	conf.TLS.CAFile = filepath.Join(dir, "missing.pem")
+	_, err = kafka.NewProducer(conf, topic)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
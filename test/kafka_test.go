@@ -0,0 +1,270 @@
+package test
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/health"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newMockBroker(t *testing.T, topic string) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(mockBrokerHandlers(t, broker, topic))
+	return broker
+}
+
+// mockBrokerHandlers answers the requests a producer and a consumer of topic send, the broker
+// leads the only partition.
+func mockBrokerHandlers(t *testing.T, broker *sarama.MockBroker, topic string) map[string]sarama.MockResponse {
+	fetchResponse := &sarama.FetchResponse{Version: 4}
+	fetchResponse.AddMessage(topic, 0, nil, sarama.StringEncoder("hello"), 0)
+
+	return map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(t),
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		// response versions match the requests of the default sarama protocol version
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset(topic, 0, sarama.OffsetOldest, 0).
+			SetOffset(topic, 0, sarama.OffsetNewest, 1),
+		"FetchRequest": sarama.NewMockWrapper(fetchResponse),
+	}
+}
+
+func Test_Kafka_Broker_List(t *testing.T) {
+	topic := "KAFKA_TEST_TOPIC"
+	broker := newMockBroker(t, topic)
+	defer broker.Close()
+
+	conf := config.KafkaConfig{
+		// the first broker is down, the client moves on to the next one
+		Brokers:  []string{"127.0.0.1:1", broker.Addr()},
+		ClientID: "kafka-test",
+		Producer: config.ProducerConfig{
+			Retries:      1,
+			RetryBackoff: 10 * time.Millisecond,
+			Compression:  "gzip",
+		},
+		Consumer: config.ConsumerConfig{
+			InitialOffset: "oldest",
+			FetchMaxWait:  50 * time.Millisecond,
+		},
+	}
+
+	producer, err := kafka.NewProducer(conf, topic)
+	if err != nil {
+		panic(err)
+	}
+	defer producer.Close()
+
+	err = producer.Push(kafka.Values([]byte("hello")))
+	if err != nil {
+		panic(err)
+	}
+
+	consumer, err := kafka.NewConsumer(conf, topic)
+	if err != nil {
+		panic(err)
+	}
+	defer consumer.Close()
+
+	select {
+	case msg := <-consumer.Messages():
+		assert.Equal(t, "hello", string(msg.Value))
+	case err := <-consumer.Errors():
+		panic(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message consumed")
+	}
+
+	// a consume loop sees the consumer is closed on both channels
+	assert.Nil(t, consumer.Close())
+	_, ok := <-consumer.Messages()
+	assert.False(t, ok)
+	_, ok = <-consumer.Errors()
+	assert.False(t, ok)
+}
+
+func Test_Kafka_Dial_Waits_For_Broker(t *testing.T) {
+	topic := "KAFKA_TEST_TOPIC"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	conf := config.KafkaConfig{
+		Brokers: []string{addr},
+		Startup: config.StartupConfig{
+			InitialBackoff: 50 * time.Millisecond,
+			MaxBackoff:     100 * time.Millisecond,
+			Timeout:        10 * time.Second,
+		},
+	}
+	registry := health.NewRegistry()
+
+	// the broker comes up after the first attempts failed
+	started := make(chan *sarama.MockBroker)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		broker := sarama.NewMockBrokerAddr(t, 1, addr)
+		broker.SetHandlerByMap(map[string]sarama.MockResponse{
+			"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(t),
+			"MetadataRequest": sarama.NewMockMetadataResponse(t).
+				SetBroker(broker.Addr(), broker.BrokerID()).
+				SetLeader(topic, 0, broker.BrokerID()),
+		})
+		started <- broker
+	}()
+	defer func() { (<-started).Close() }()
+
+	producer, err := kafka.DialProducer(context.Background(), conf, topic, registry, "producer")
+	assert.Nil(t, err)
+	defer producer.Close()
+	assert.True(t, registry.Status().Healthy)
+}
+
+func Test_Kafka_Dial_Timeout(t *testing.T) {
+	conf := config.KafkaConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Startup: config.StartupConfig{
+			InitialBackoff: 50 * time.Millisecond,
+			Timeout:        100 * time.Millisecond,
+		},
+	}
+	registry := health.NewRegistry()
+
+	_, err := kafka.DialConsumer(context.Background(), conf, "KAFKA_TEST_TOPIC", registry, "consumer")
+	assert.NotNil(t, err)
+
+	status := registry.Status()
+	assert.False(t, status.Healthy)
+	assert.Contains(t, status.Components["consumer"], "attempt 1")
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
+
+// Test_Kafka_Transactional_Producer pushes a batch in a transaction, the mock broker records the
+// requests of the transaction in order.
+func Test_Kafka_Transactional_Producer(t *testing.T) {
+	topic := "KAFKA_TEST_TOPIC"
+	broker := newTransactionalMockBroker(t, topic)
+	defer broker.Close()
+	producer := newTransactionalProducer(broker, topic)
+	defer producer.Close()
+
+	err := producer.Push(kafka.Values([]byte("a"), []byte("b")))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"add partitions relay." + topic, "produce relay." + topic, "commit relay." + topic}, transactionRequests(broker))
+}
+
+// Test_Kafka_Transactional_Producer_Aborted pushes a message larger than the producer takes in a
+// transaction, the transaction is aborted and the push error tells none of the messages was sent.
+func Test_Kafka_Transactional_Producer_Aborted(t *testing.T) {
+	topic := "KAFKA_TEST_TOPIC"
+	broker := newTransactionalMockBroker(t, topic)
+	defer broker.Close()
+	producer := newTransactionalProducer(broker, topic)
+	defer producer.Close()
+
+	tooLarge := make([]byte, sarama.NewConfig().Producer.MaxMessageBytes+1)
+	err := producer.Push(kafka.Values([]byte("a"), tooLarge, []byte("c")))
+	var pushErr *kafka.PushError
+	assert.ErrorAs(t, err, &pushErr)
+	assert.True(t, pushErr.Aborted)
+	assert.Equal(t, map[int]error{1: sarama.ErrMessageSizeTooLarge}, pushErr.Rejected)
+	assert.NotContains(t, transactionRequests(broker), "commit relay."+topic)
+}
+
+func newTransactionalMockBroker(t *testing.T, topic string) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(t),
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorTransaction, "relay."+topic, broker),
+		"InitProducerIDRequest": sarama.NewMockWrapper(&sarama.InitProducerIDResponse{ProducerID: 1}),
+		"AddPartitionsToTxnRequest": sarama.NewMockWrapper(&sarama.AddPartitionsToTxnResponse{
+			Errors: map[string][]*sarama.PartitionError{topic: {{Partition: 0, Err: sarama.ErrNoError}}},
+		}),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+		"EndTxnRequest":  sarama.NewMockWrapper(&sarama.EndTxnResponse{}),
+	})
+	return broker
+}
+
+func newTransactionalProducer(broker *sarama.MockBroker, topic string) kafka.IProducer {
+	conf := config.KafkaConfig{
+		Brokers:  []string{broker.Addr()},
+		Version:  "2.1.0",
+		Producer: config.ProducerConfig{TransactionalID: "relay"},
+		Consumer: config.ConsumerConfig{IsolationLevel: config.IsolationReadCommitted},
+	}
+	producer, err := kafka.NewProducer(conf, topic)
+	if err != nil {
+		panic(err)
+	}
+	return producer
+}
+
+// transactionRequests lists the requests of the transactions the mock broker got, in order.
+func transactionRequests(broker *sarama.MockBroker) []string {
+	var res []string
+	for _, pair := range broker.History() {
+		switch request := pair.Request.(type) {
+		case *sarama.AddPartitionsToTxnRequest:
+			res = append(res, "add partitions "+request.TransactionalID)
+		case *sarama.ProduceRequest:
+			res = append(res, "produce "+*request.TransactionalID)
+		case *sarama.EndTxnRequest:
+			if request.TransactionResult {
+				res = append(res, "commit "+request.TransactionalID)
+			} else {
+				res = append(res, "abort "+request.TransactionalID)
+			}
+		}
+	}
+	return res
+}
+
+// Test_Kafka_Producer_Rejected pushes a message larger than the producer takes between two others,
+// the push error tells which one was rejected and the others are produced.
+func Test_Kafka_Producer_Rejected(t *testing.T) {
+	topic := "KAFKA_TEST_TOPIC"
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(t),
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+
+	producer, err := kafka.NewProducer(config.KafkaConfig{Brokers: []string{broker.Addr()}, Version: "2.1.0"}, topic)
+	if err != nil {
+		panic(err)
+	}
+	defer producer.Close()
+
+	tooLarge := make([]byte, sarama.NewConfig().Producer.MaxMessageBytes+1)
+	err = producer.Push(kafka.Values([]byte("a"), tooLarge, []byte("c")))
+	var pushErr *kafka.PushError
+	assert.ErrorAs(t, err, &pushErr)
+	assert.False(t, pushErr.Aborted)
+	assert.Equal(t, map[int]error{1: sarama.ErrMessageSizeTooLarge}, pushErr.Rejected)
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logLines decodes the JSON lines written by a logger.
+func logLines(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+		res = append(res, entry)
+	}
+	return res
+}
+
+func Test_Logging_Redaction(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := logging.New(config.LoggingConfig{
+		Format: config.LogFormatJSON,
+		Redact: []string{"promo_code", "Token"},
+	}, &out)
+	assert.Nil(t, err)
+
+	logger.Info("payload",
+		slog.Any("payload", logging.Payload(`{"order_id": 1, "promo_code": "VIP", "cards": [{"token": "tok_1", "last4": "4242"}]}`)),
+		slog.String("token", "secret"),
+	)
+	logger.Info("not json", slog.Any("payload", logging.Payload("promo_code=VIP")))
+
+	lines := logLines(t, &out)
+	assert.Len(t, lines, 2)
+	assert.JSONEq(t,
+		`{"order_id": 1, "promo_code": "[REDACTED]", "cards": [{"token": "[REDACTED]", "last4": "4242"}]}`,
+		lines[0]["payload"].(string),
+	)
+	assert.Equal(t, "[REDACTED]", lines[0]["token"])
+	assert.Equal(t, "[14 bytes, not JSON]", lines[1]["payload"])
+}
+
+func Test_Logging_Config(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := logging.New(config.LoggingConfig{Level: "warn"}, &out)
+	assert.Nil(t, err)
+	logger.Info("dropped")
+	logger.Warn("kept", slog.Int("n", 1))
+	assert.NotContains(t, out.String(), "dropped")
+	assert.Contains(t, out.String(), "level=WARN msg=kept n=1")
+
+	_, err = logging.New(config.LoggingConfig{Level: "loud"}, &out)
+	assert.NotNil(t, err)
+	_, err = logging.New(config.LoggingConfig{Format: "xml"}, &out)
+	assert.EqualError(t, err, `logging: unknown format "xml"`)
+}
+
+func Test_Logging_Consumed_Message_Fields(t *testing.T) {
+	ctx := context.Background()
+	conf := config.DefaultConfig
+	broker := memory.NewBroker()
+	var out bytes.Buffer
+	logger, err := logging.New(config.LoggingConfig{
+		Level:  "debug",
+		Format: config.LogFormatJSON,
+		Redact: conf.Logging.Redact,
+	}, &out)
+	assert.Nil(t, err)
+
+	repo := order.NewMemoryRepo()
+	orderService := order.NewService(
+		repo,
+		broker.Producer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		order.WithLogger(logger),
+	)
+	id, err := orderService.CreateOrder(ctx, model.Order{CustomerID: 7, ProductID: 2, Amount: 1, PromoCode: "VIP"})
+	assert.Nil(t, err)
+
+	billed, err := json.Marshal(saga_event.OrderEvent{
+		OrderID:    id,
+		CustomerID: 7,
+		PromoCode:  "VIP",
+		Status:     model.OrderStatusBilled,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, broker.Producer(conf.OrderBillTopic).Push(kafka.Values(billed)))
+	orderService.ConsumeBills(ctx, 200*time.Millisecond)
+
+	lines := logLines(t, &out)
+	assert.Len(t, lines, 2)
+
+	received := lines[0]
+	assert.Equal(t, "DEBUG", received["level"])
+	assert.Equal(t, "Received message", received["msg"])
+	assert.Equal(t, conf.OrderBillTopic, received["topic"])
+	assert.Equal(t, 0.0, received["partition"])
+	assert.Equal(t, 0.0, received["offset"])
+	assert.NotContains(t, received["payload"], "VIP")
+
+	handled := lines[1]
+	assert.Equal(t, "Handled message", handled["msg"])
+	assert.Equal(t, float64(id), handled["order_id"])
+	assert.Equal(t, 7.0, handled["customer_id"])
+	assert.Equal(t, model.OrderStatusBilled, handled["status"])
+	assert.Equal(t, conf.OrderBillTopic, handled["topic"])
+}
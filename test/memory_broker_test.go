@@ -0,0 +1,116 @@
+package test
+
+import (
+	"errors"
+	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, consumer kafka.IConsumer) *sarama.ConsumerMessage {
+	select {
+	case msg := <-consumer.Messages():
+		return msg
+	case err := <-consumer.Errors():
+		t.Fatalf("unexpected consumer error: %s", err)
+	case <-time.After(time.Second):
+		t.Fatal("no message consumed")
+	}
+	return nil
+}
+
+func Test_Memory_Broker_Offsets(t *testing.T) {
+	broker := memory.NewBroker()
+	producer := broker.Producer("TOPIC")
+	err := producer.Push(kafka.Values([]byte("1"), []byte("2")))
+	assert.Nil(t, err)
+
+	oldest := broker.Consumer("TOPIC")
+	defer oldest.Close()
+	newest, err := broker.ConsumePartition("TOPIC", 0, sarama.OffsetNewest)
+	assert.Nil(t, err)
+	defer newest.Close()
+
+	err = producer.Push(kafka.Values([]byte("3")))
+	assert.Nil(t, err)
+
+	for i, value := range []string{"1", "2", "3"} {
+		msg := receive(t, oldest)
+		assert.Equal(t, value, string(msg.Value))
+		assert.Equal(t, int64(i), msg.Offset)
+	}
+	msg := receive(t, newest)
+	assert.Equal(t, "3", string(msg.Value))
+	assert.Equal(t, int64(2), msg.Offset)
+	assert.Equal(t, int64(3), broker.HighWaterMark("TOPIC", 0))
+
+	_, err = broker.ConsumePartition("TOPIC", 0, 4)
+	assert.Equal(t, sarama.ErrOffsetOutOfRange, err)
+}
+
+func Test_Memory_Broker_Partitions(t *testing.T) {
+	broker := memory.NewBroker()
+	err := broker.CreateTopic("TOPIC", 2)
+	assert.Nil(t, err)
+	assert.NotNil(t, broker.CreateTopic("TOPIC", 2))
+
+	err = broker.Producer("TOPIC").Push(kafka.Values([]byte("a"), []byte("b"), []byte("c")))
+	assert.Nil(t, err)
+
+	assert.Len(t, broker.Messages("TOPIC", 0), 2)
+	assert.Len(t, broker.Messages("TOPIC", 1), 1)
+
+	consumer, err := broker.ConsumePartition("TOPIC", 1, sarama.OffsetOldest)
+	assert.Nil(t, err)
+	defer consumer.Close()
+	msg := receive(t, consumer)
+	assert.Equal(t, "b", string(msg.Value))
+	assert.Equal(t, int32(1), msg.Partition)
+
+	_, err = broker.ConsumePartition("TOPIC", 2, sarama.OffsetOldest)
+	assert.Equal(t, memory.ErrUnknownPartition, err)
+}
+
+func Test_Memory_Broker_Error_Injection(t *testing.T) {
+	broker := memory.NewBroker()
+	producer := broker.Producer("TOPIC")
+	consumer := broker.Consumer("TOPIC")
+	defer consumer.Close()
+
+	pushErr := errors.New("leader not available")
+	broker.FailNextPush("TOPIC", pushErr)
+	assert.Equal(t, pushErr, producer.Push(kafka.Values([]byte("lost"))))
+	assert.Nil(t, producer.Push(kafka.Values([]byte("kept"))))
+	assert.Len(t, broker.Messages("TOPIC", 0), 1)
+
+	broker.InjectConsumerError("TOPIC", 0, sarama.ErrNotLeaderForPartition)
+	select {
+	case err := <-consumer.Errors():
+		assert.Equal(t, sarama.ErrNotLeaderForPartition, err.Err)
+	case <-time.After(time.Second):
+		t.Fatal("no error injected")
+	}
+	assert.Equal(t, "kept", string(receive(t, consumer).Value))
+
+	assert.Nil(t, producer.Close())
+	assert.Equal(t, memory.ErrClosed, producer.Push(kafka.Values([]byte("closed"))))
+}
+
+func Test_Memory_Broker_Consumer_Close(t *testing.T) {
+	broker := memory.NewBroker()
+	assert.Nil(t, broker.Producer("TOPIC").Push(kafka.Values([]byte("1"))))
+
+	consumer := broker.Consumer("TOPIC")
+	assert.Nil(t, consumer.Close())
+	assert.Nil(t, consumer.Close())
+	_, ok := <-consumer.Messages()
+	assert.False(t, ok)
+	_, ok = <-consumer.Errors()
+	assert.False(t, ok)
+
+	// errors injected after Close go nowhere
+	broker.InjectConsumerError("TOPIC", 0, errors.New("leader not available"))
+}
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"context"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/schema"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/rafata1/sagas-pattern-thesis/service/shipping"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test_Memory_Saga runs the whole saga on the in-memory broker and repos, it needs neither Kafka nor MySQL.
+func Test_Memory_Saga(t *testing.T) {
+	memorySaga(t, config.DefaultConfig)
+}
+
+// Test_Memory_Saga_Protobuf publishes some topics as protobuf, every consumer reads both encodings.
+func Test_Memory_Saga_Protobuf(t *testing.T) {
+	conf := config.DefaultConfig
+	conf.Encodings = map[string]string{
+		conf.OrderCreatedTopic: config.EncodingProtobuf,
+		conf.OrderBillTopic:    config.EncodingProtobuf,
+	}
+	memorySaga(t, conf)
+}
+
+func memorySaga(t *testing.T, conf config.Config) {
+	ctx := context.Background()
+	broker := memory.NewBroker()
+	consumeFor := 200 * time.Millisecond
+	codec := func(topic string) saga_event.Codec {
+		codec := saga_event.JSON
+		if conf.Encoding(topic) == config.EncodingProtobuf {
+			codec = saga_event.Protobuf
+		}
+		return schema.Validating(codec, schema.Default, saga_event.DefaultRegistry)
+	}
+
+	orderRepo := order.NewMemoryRepo()
+	orderService := order.NewService(
+		orderRepo,
+		broker.Producer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		order.WithCodec(codec(conf.OrderCreatedTopic)),
+	)
+
+	inventoryRepo := inventory.NewMemoryRepo()
+	err := inventoryRepo.CreateInventory(ctx, model.Inventory{ProductID: 2, UnitPrice: usd(5), Amount: 100})
+	assert.Nil(t, err)
+	inventoryService := inventory.NewService(
+		inventoryRepo,
+		broker.Consumer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.PrepareInventoryTopic),
+		inventory.WithCodec(codec(conf.PrepareInventoryTopic)),
+	)
+
+	paymentRepo := payment.NewMemoryRepo()
+	err = paymentRepo.CreateAccount(ctx, model.Account{CustomerID: 1, Balance: usd(100)})
+	assert.Nil(t, err)
+	paymentService := payment.NewService(
+		paymentRepo,
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.OrderBillTopic),
+		payment.WithCodec(codec(conf.OrderBillTopic)),
+	)
+
+	shippingRepo := shipping.NewMemoryRepo()
+	shippingService := shipping.NewService(
+		shippingRepo,
+		broker.Consumer(conf.OrderCreatedTopic),
+		broker.Producer(conf.ShipmentTopic),
+		shipping.NewFakeCarrier(),
+		shipping.WithCodec(codec(conf.ShipmentTopic)),
+	)
+
+	id, err := orderService.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 3})
+	assert.Nil(t, err)
+	assert.Nil(t, orderService.RelayMessage(ctx, 10))
+
+	inventoryService.ConsumeOrders(ctx, consumeFor)
+	assert.Nil(t, inventoryService.RelayMessage(ctx, 10))
+
+	paymentService.ConsumePreparedOrders(ctx, consumeFor)
+	assert.Nil(t, paymentService.RelayMessage(ctx, 10))
+
+	// the order service confirms the bill for shipping
+	orderService.ConsumeInventory(ctx, consumeFor)
+	orderService.ConsumeBills(ctx, consumeFor)
+	assert.Nil(t, orderService.RelayMessage(ctx, 10))
+
+	shippingService.ConsumeOrders(ctx, consumeFor)
+	assert.Nil(t, shippingService.RelayMessage(ctx, 10))
+
+	orderService.ConsumeShipments(ctx, consumeFor)
+
+	actualOrder, err := orderRepo.GetOrder(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusShipped), actualOrder.Status)
+	assert.Equal(t, usd(15), actualOrder.Cost)
+
+	actualInventory, err := inventoryRepo.GetInventory(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 97, actualInventory.Amount)
+
+	actualAccount, err := paymentRepo.GetAccount(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(85), actualAccount.Balance)
+
+	shipment, err := shippingRepo.GetShipment(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.ShipmentStatusShipped, shipment.Status)
+
+	assert.Len(t, broker.Messages(conf.OrderCreatedTopic, 0), 2)
+	for _, topic := range []string{conf.OrderCreatedTopic, conf.PrepareInventoryTopic, conf.OrderBillTopic, conf.ShipmentTopic} {
+		messages := broker.Messages(topic, 0)
+		assert.NotEmpty(t, messages)
+		for _, msg := range messages {
+			assert.Equal(t, codec(topic).ContentType(), kafka.ContentType(msg))
+		}
+	}
+}
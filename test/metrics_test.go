@@ -0,0 +1,143 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metrics are process wide, so the tests compare deltas
+func Test_Metrics_Order(t *testing.T) {
+	ctx := context.Background()
+	conf := config.DefaultConfig
+	broker := memory.NewBroker()
+	orderService := order.NewService(
+		order.NewMemoryRepo(),
+		broker.Producer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+	)
+
+	pending := testutil.ToFloat64(metrics.Orders.WithLabelValues(model.OrderStatusPending))
+	shipped := testutil.ToFloat64(metrics.Orders.WithLabelValues(model.OrderStatusShipped))
+	durations := histogramCount(t, "saga_duration_seconds", model.OrderStatusShipped)
+
+	id, err := orderService.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 3})
+	assert.Nil(t, err)
+	_, err = orderService.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, pending+2, testutil.ToFloat64(metrics.Orders.WithLabelValues(model.OrderStatusPending)))
+
+	assert.Nil(t, orderService.RelayMessage(ctx, 1))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.OutboxPending.WithLabelValues("order_outboxes")))
+	assert.Nil(t, orderService.RelayMessage(ctx, 10))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.OutboxPending.WithLabelValues("order_outboxes")))
+
+	// the redelivered event is counted once
+	event := saga_event.OrderEvent{OrderID: id, Status: model.OrderStatusShipped}
+	assert.Nil(t, orderService.UpdateStatus(ctx, event))
+	assert.Nil(t, orderService.UpdateStatus(ctx, event))
+	assert.Equal(t, shipped+1, testutil.ToFloat64(metrics.Orders.WithLabelValues(model.OrderStatusShipped)))
+	assert.Equal(t, durations+1, histogramCount(t, "saga_duration_seconds", model.OrderStatusShipped))
+
+	// an unknown order is still ignored
+	assert.Nil(t, orderService.UpdateStatus(ctx, saga_event.OrderEvent{OrderID: 404, Status: model.OrderStatusShipped}))
+	assert.Equal(t, shipped+1, testutil.ToFloat64(metrics.Orders.WithLabelValues(model.OrderStatusShipped)))
+}
+
+func Test_Metrics_Compensations(t *testing.T) {
+	ctx := context.Background()
+	conf := config.DefaultConfig
+	broker := memory.NewBroker()
+	repo := inventory.NewMemoryRepo()
+	err := repo.CreateInventory(ctx, model.Inventory{ProductID: 2, UnitPrice: usd(5), Amount: 7})
+	assert.Nil(t, err)
+	// the stock of the declined order was reserved
+	assert.Nil(t, repo.CreateReservation(ctx, model.Reservation{OrderID: 1, ProductID: 2, Amount: 3}))
+	inventoryService := inventory.NewService(
+		repo,
+		broker.Consumer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.PrepareInventoryTopic),
+	)
+
+	declined, err := json.Marshal(saga_event.OrderEvent{
+		OrderID:   1,
+		ProductID: 2,
+		Amount:    3,
+		Status:    model.OrderStatusFailedPaymentDeclined,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, broker.Producer(conf.OrderBillTopic).Push(kafka.Values(declined)))
+
+	restored := testutil.ToFloat64(metrics.Compensations.WithLabelValues("inventory", "restore_inventory"))
+	inventoryService.ConsumeBills(ctx, 200*time.Millisecond)
+	assert.Equal(t, restored+1, testutil.ToFloat64(metrics.Compensations.WithLabelValues("inventory", "restore_inventory")))
+
+	actual, err := repo.GetInventory(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, actual.Amount)
+}
+
+func Test_Metrics_Consumer_Lag(t *testing.T) {
+	broker := memory.NewBroker()
+	assert.Nil(t, broker.Producer("lag").Push(kafka.Values([]byte("1"), []byte("2"), []byte("3"))))
+
+	consumer := broker.Consumer("lag")
+	defer consumer.Close()
+	lag := func() float64 { return testutil.ToFloat64(metrics.ConsumerLag.WithLabelValues("lag", "0")) }
+
+	// the lag is recorded right after a message is taken
+	receive(t, consumer)
+	assert.Eventually(t, func() bool { return lag() == 2 }, time.Second, 10*time.Millisecond)
+	receive(t, consumer)
+	receive(t, consumer)
+	assert.Eventually(t, func() bool { return lag() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func Test_Metrics_Handler(t *testing.T) {
+	metrics.HandlerErrors.WithLabelValues("order", "handler").Inc()
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, recorder.Code)
+	body, err := io.ReadAll(recorder.Body)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(body), `saga_handler_errors_total{service="order",topic="handler"}`))
+	assert.True(t, strings.Contains(string(body), "go_goroutines"))
+}
+
+// histogramCount returns how many samples the histogram name observed for status.
+func histogramCount(t *testing.T, name string, status string) float64 {
+	families, err := metrics.Registry.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "status" && label.GetValue() == status {
+					return float64(metric.GetHistogram().GetSampleCount())
+				}
+			}
+		}
+	}
+	return 0
+}
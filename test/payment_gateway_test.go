@@ -0,0 +1,276 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func preparedOrderEvent() saga_event.OrderEvent {
+	return saga_event.OrderEvent{
+		OrderID:    1,
+		CustomerID: 1,
+		ProductID:  2,
+		Amount:     3,
+		Cost:       model.NewMoney(15, model.DefaultCurrency),
+		Status:     model.OrderStatusPrepared,
+	}
+}
+
+func getPublishedEvents(ctx context.Context, repo payment.IRepo) []saga_event.OrderEvent {
+	outboxes, err := repo.GetPendingOutbox(ctx, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	var res []saga_event.OrderEvent
+	for _, outbox := range outboxes {
+		event, err := saga_event.Decode(outbox.Content)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, event)
+	}
+	return res
+}
+
+func Test_Gateway_AsyncApproved(t *testing.T) {
+	ctx := context.Background()
+	paymentRepo := payment.NewRepo(getPaymentTestingDB())
+	gateway := payment.NewFakeGateway(true)
+	paymentService := payment.NewService(paymentRepo, nil, nil, nil, payment.WithGateway(gateway, time.Hour))
+
+	err := paymentService.Pay(ctx, preparedOrderEvent())
+	if err != nil {
+		panic(err)
+	}
+
+	// nothing is published until the gateway calls back
+	assert.Empty(t, getPublishedEvents(ctx, paymentRepo))
+
+	authorizationID := gateway.AuthorizationID(1)
+	body, _ := json.Marshal(payment.GatewayCallback{AuthorizationID: authorizationID, Approved: true})
+	handler := payment.NewCallbackHandler(paymentService, "callback-secret", logging.Default())
+	post := func(signature string) int {
+		request := httptest.NewRequest(http.MethodPost, "/callback", bytes.NewReader(body))
+		request.Header.Set(payment.CallbackSignatureHeader, signature)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// a callback not signed with the shared secret is refused
+	assert.Equal(t, http.StatusUnauthorized, post(""))
+	assert.Equal(t, http.StatusUnauthorized, post(payment.SignCallback("other-secret", body)))
+	assert.Empty(t, getPublishedEvents(ctx, paymentRepo))
+
+	assert.Equal(t, http.StatusNoContent, post(payment.SignCallback("callback-secret", body)))
+
+	// a duplicated callback is ignored
+	err = paymentService.HandleGatewayCallback(ctx, payment.GatewayCallback{AuthorizationID: authorizationID, Approved: true})
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, model.AuthorizationCaptured, gateway.Status(authorizationID))
+	assert.Equal(t,
+		[]saga_event.OrderEvent{{
+			OrderID:    1,
+			CustomerID: 1,
+			ProductID:  2,
+			Amount:     3,
+			Cost:       model.NewMoney(15, model.DefaultCurrency),
+			Status:     model.OrderStatusBilled,
+		}},
+		getPublishedEvents(ctx, paymentRepo),
+	)
+}
+
+func Test_Gateway_Declined(t *testing.T) {
+	ctx := context.Background()
+	paymentRepo := payment.NewRepo(getPaymentTestingDB())
+	gateway := payment.NewFakeGateway(false)
+	gateway.DeclineCustomer(1)
+	paymentService := payment.NewService(paymentRepo, nil, nil, nil, payment.WithGateway(gateway, time.Hour))
+
+	err := paymentService.Pay(ctx, preparedOrderEvent())
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t,
+		[]saga_event.OrderEvent{{
+			OrderID:    1,
+			CustomerID: 1,
+			ProductID:  2,
+			Amount:     3,
+			Cost:       model.NewMoney(15, model.DefaultCurrency),
+			Status:     model.OrderStatusFailedPaymentDeclined,
+			Reason:     payment.DeclineReasonCardDeclined,
+		}},
+		getPublishedEvents(ctx, paymentRepo),
+	)
+}
+
+func Test_Gateway_Timeout(t *testing.T) {
+	ctx := context.Background()
+	paymentRepo := payment.NewRepo(getPaymentTestingDB())
+	gateway := payment.NewFakeGateway(true)
+	// authorizations expire right away
+	paymentService := payment.NewService(paymentRepo, nil, nil, nil, payment.WithGateway(gateway, -time.Minute))
+
+	err := paymentService.Pay(ctx, preparedOrderEvent())
+	if err != nil {
+		panic(err)
+	}
+
+	err = paymentService.ExpireAuthorizations(ctx, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	// a late approval does not bill a voided authorization
+	authorizationID := gateway.AuthorizationID(1)
+	err = paymentService.HandleGatewayCallback(ctx, payment.GatewayCallback{AuthorizationID: authorizationID, Approved: true})
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, model.AuthorizationVoided, gateway.Status(authorizationID))
+	assert.Equal(t,
+		[]saga_event.OrderEvent{{
+			OrderID:    1,
+			CustomerID: 1,
+			ProductID:  2,
+			Amount:     3,
+			Cost:       model.NewMoney(15, model.DefaultCurrency),
+			Status:     model.OrderStatusFailedPaymentTimeout,
+			Reason:     payment.RejectReasonAuthorizationTimeout,
+		}},
+		getPublishedEvents(ctx, paymentRepo),
+	)
+}
+
+// slowGateway runs whileAuthorizing before it answers, as if the gateway took its time.
+type slowGateway struct {
+	*payment.FakeGateway
+	whileAuthorizing func()
+}
+
+func (g slowGateway) Authorize(
+	ctx context.Context, orderID int64, customerID int64, amount model.Money,
+) (payment.Authorization, error) {
+	g.whileAuthorizing()
+	return g.FakeGateway.Authorize(ctx, orderID, customerID, amount)
+}
+
+// Test_Gateway_Expired_While_Authorizing checks the gateway is asked outside of the transaction of
+// the request: the request expires while the gateway answers, the approved authorization is given
+// back and the order is not billed.
+func Test_Gateway_Expired_While_Authorizing(t *testing.T) {
+	ctx := context.Background()
+	paymentRepo := payment.NewMemoryRepo()
+	gateway := payment.NewFakeGateway(false)
+	var paymentService payment.IService
+	slow := slowGateway{FakeGateway: gateway, whileAuthorizing: func() {
+		assert.Nil(t, paymentService.ExpireAuthorizations(ctx, 10))
+	}}
+	// requests expire right away
+	paymentService = payment.NewService(paymentRepo, nil, nil, nil, payment.WithGateway(slow, -time.Minute))
+
+	assert.Nil(t, paymentService.Pay(ctx, preparedOrderEvent()))
+
+	authorizationID := gateway.AuthorizationID(1)
+	assert.Equal(t, model.AuthorizationRefunded, gateway.Status(authorizationID))
+	var authorization model.PaymentAuthorization
+	err := paymentRepo.Transact(ctx, func(ctx context.Context) error {
+		var err error
+		authorization, err = paymentRepo.LockAuthorizationByOrderForUpdate(ctx, 1)
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, authorizationID, authorization.AuthorizationID)
+	assert.Equal(t, model.AuthorizationRefunded, authorization.Status)
+	assert.Equal(t,
+		[]saga_event.OrderEvent{{
+			OrderID:    1,
+			CustomerID: 1,
+			ProductID:  2,
+			Amount:     3,
+			Cost:       model.NewMoney(15, model.DefaultCurrency),
+			Status:     model.OrderStatusFailedPaymentTimeout,
+			Reason:     payment.RejectReasonAuthorizationTimeout,
+		}},
+		getPublishedEvents(ctx, paymentRepo),
+	)
+}
+
+// failingVoidGateway fails the first void it is asked for.
+type failingVoidGateway struct {
+	*payment.FakeGateway
+	failed *bool
+}
+
+func (g failingVoidGateway) Void(ctx context.Context, authorizationID string) error {
+	if !*g.failed {
+		*g.failed = true
+		return errors.New("gateway unavailable")
+	}
+	return g.FakeGateway.Void(ctx, authorizationID)
+}
+
+// Test_Gateway_Void_Retried checks the void is recorded before the gateway is asked for it, a void
+// the gateway failed is asked again once it expired.
+func Test_Gateway_Void_Retried(t *testing.T) {
+	ctx := context.Background()
+	paymentRepo := payment.NewMemoryRepo()
+	gateway := payment.NewFakeGateway(true)
+	// authorizations and voids expire right away
+	paymentService := payment.NewService(paymentRepo, nil, nil, nil,
+		payment.WithGateway(failingVoidGateway{FakeGateway: gateway, failed: new(bool)}, -time.Minute))
+
+	assert.Nil(t, paymentService.Pay(ctx, preparedOrderEvent()))
+	assert.Error(t, paymentService.ExpireAuthorizations(ctx, 10))
+
+	getStatus := func() model.AuthorizationStatus {
+		var authorization model.PaymentAuthorization
+		err := paymentRepo.Transact(ctx, func(ctx context.Context) error {
+			var err error
+			authorization, err = paymentRepo.LockAuthorizationByOrderForUpdate(ctx, 1)
+			return err
+		})
+		assert.Nil(t, err)
+		return authorization.Status
+	}
+	authorizationID := gateway.AuthorizationID(1)
+	assert.Equal(t, model.AuthorizationVoiding, getStatus())
+	assert.Equal(t, model.AuthorizationPending, gateway.Status(authorizationID))
+
+	assert.Nil(t, paymentService.ExpireAuthorizations(ctx, 10))
+	assert.Equal(t, model.AuthorizationVoided, getStatus())
+	assert.Equal(t, model.AuthorizationVoided, gateway.Status(authorizationID))
+
+	// the failure is published once
+	assert.Equal(t,
+		[]saga_event.OrderEvent{{
+			OrderID:    1,
+			CustomerID: 1,
+			ProductID:  2,
+			Amount:     3,
+			Cost:       model.NewMoney(15, model.DefaultCurrency),
+			Status:     model.OrderStatusFailedPaymentTimeout,
+			Reason:     payment.RejectReasonAuthorizationTimeout,
+		}},
+		getPublishedEvents(ctx, paymentRepo),
+	)
+}
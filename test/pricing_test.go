@@ -0,0 +1,51 @@
+package test
+
+import (
+	"context"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_Pricing(t *testing.T) {
+	pricer := inventory.NewPricer(
+		map[int64][]inventory.PriceTier{
+			2: {
+				{MinAmount: 10, UnitPrice: 4},
+				{MinAmount: 50, UnitPrice: 3},
+			},
+		},
+		[]inventory.Promotion{
+			{Code: "TENOFF", PercentOff: 10},
+			{Code: "MINUS5", AmountOff: 5},
+			{Code: "FREE", AmountOff: 1000},
+		},
+	)
+	stock := model.Inventory{ProductID: 2, UnitPrice: model.NewMoney(5, "EUR"), Amount: 100}
+
+	cases := []struct {
+		name     string
+		event    saga_event.OrderEvent
+		expected int64
+	}{
+		{name: "base price", event: saga_event.OrderEvent{ProductID: 2, Amount: 3}, expected: 15},
+		{name: "first tier", event: saga_event.OrderEvent{ProductID: 2, Amount: 10}, expected: 40},
+		{name: "highest tier", event: saga_event.OrderEvent{ProductID: 2, Amount: 60}, expected: 180},
+		{name: "percent off", event: saga_event.OrderEvent{ProductID: 2, Amount: 10, PromoCode: "TENOFF"}, expected: 36},
+		{name: "amount off", event: saga_event.OrderEvent{ProductID: 2, Amount: 3, PromoCode: "MINUS5"}, expected: 10},
+		{name: "never negative", event: saga_event.OrderEvent{ProductID: 2, Amount: 3, PromoCode: "FREE"}, expected: 0},
+		{name: "unknown promo code", event: saga_event.OrderEvent{ProductID: 2, Amount: 3, PromoCode: "NOPE"}, expected: 15},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cost, err := pricer.Price(context.Background(), stock, c.event)
+			if err != nil {
+				panic(err)
+			}
+			assert.Equal(t, model.NewMoney(c.expected, "EUR"), cost)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"context"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/logging"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/relay"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test_Relay_Rejected_Row relays a row Kafka rejects between two it takes, the other rows are
+// relayed and the rejected one is attempted again until it is failed.
+func Test_Relay_Rejected_Row(t *testing.T) {
+	ctx := context.Background()
+	broker := memory.NewBroker()
+	broker.SetMaxMessageBytes("TOPIC", 4)
+	repo := order.NewMemoryRepo()
+	for _, content := range []string{"1", "too large", "3"} {
+		err := repo.CreateOutbox(ctx, model.Outbox{Content: []byte(content)})
+		assert.Nil(t, err)
+	}
+	retry := relay.Retry{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	publisher := relay.NewPublisher("order_outboxes", repo, broker.Producer("TOPIC"), retry, logging.Default())
+
+	err := publisher.Relay(ctx, 10)
+	assert.Nil(t, err)
+	messages := broker.Messages("TOPIC", 0)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, []byte("1"), messages[0].Value)
+	assert.Equal(t, []byte("3"), messages[1].Value)
+
+	time.Sleep(5 * time.Millisecond)
+	outboxes, err := repo.GetPendingOutbox(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 1)
+	assert.Equal(t, []byte("too large"), outboxes[0].Content)
+	assert.Equal(t, 1, outboxes[0].Attempts)
+	assert.Contains(t, outboxes[0].LastError.String, "too large")
+
+	err = publisher.Relay(ctx, 10)
+	assert.Nil(t, err)
+	pending, err := repo.CountPendingOutbox(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pending)
+	assert.Equal(t, 2, len(broker.Messages("TOPIC", 0)))
+}
+
+// Test_Relay_Aborted relays a row Kafka rejects in a transaction, which aborts the push. The rows
+// pushed with it are pushed again right away, the rejected one waits for its next attempt.
+func Test_Relay_Aborted(t *testing.T) {
+	ctx := context.Background()
+	broker := memory.NewBroker()
+	broker.SetMaxMessageBytes("TOPIC", 4)
+	broker.SetTransactional("TOPIC")
+	repo := order.NewMemoryRepo()
+	for _, content := range []string{"1", "too large", "3"} {
+		err := repo.CreateOutbox(ctx, model.Outbox{Content: []byte(content)})
+		assert.Nil(t, err)
+	}
+	publisher := relay.NewPublisher("order_outboxes", repo, broker.Producer("TOPIC"), relay.DefaultRetry, logging.Default())
+
+	err := publisher.Relay(ctx, 10)
+	assert.Nil(t, err)
+	messages := broker.Messages("TOPIC", 0)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, []byte("1"), messages[0].Value)
+	assert.Equal(t, []byte("3"), messages[1].Value)
+
+	pending, err := repo.CountPendingOutbox(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pending)
+	outboxes, err := repo.GetPendingOutbox(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 0)
+}
+
+// Test_Relay_Unreachable leaves the rows untouched when the whole push fails.
+func Test_Relay_Unreachable(t *testing.T) {
+	ctx := context.Background()
+	broker := memory.NewBroker()
+	broker.FailNextPush("TOPIC", memory.ErrClosed)
+	repo := order.NewMemoryRepo()
+	err := repo.CreateOutbox(ctx, model.Outbox{Content: []byte("1")})
+	assert.Nil(t, err)
+	publisher := relay.NewPublisher("order_outboxes", repo, broker.Producer("TOPIC"), relay.DefaultRetry, logging.Default())
+
+	err = publisher.Relay(ctx, 10)
+	assert.Equal(t, memory.ErrClosed, err)
+	outboxes, err := repo.GetPendingOutbox(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 1)
+	assert.Equal(t, 0, outboxes[0].Attempts)
+}
+
+func Test_Relay_Backoff(t *testing.T) {
+	retry := relay.Retry{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, retry.Backoff(1))
+	assert.Equal(t, 2*time.Second, retry.Backoff(2))
+	assert.Equal(t, 4*time.Second, retry.Backoff(3))
+	assert.Equal(t, 5*time.Second, retry.Backoff(4))
+	assert.Equal(t, 5*time.Second, retry.Backoff(20))
+}
@@ -0,0 +1,747 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/rafata1/sagas-pattern-thesis/service/shipping"
+	"github.com/rafata1/sagas-pattern-thesis/storage"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errRollback = errors.New("rollback")
+
+// requireMySQL skips the MySQL half of a conformance test when no database is running
+func requireMySQL(t *testing.T, dsn string) {
+	db, err := sqlx.Connect("mysql", dsn)
+	if err != nil {
+		t.Skipf("mysql is not reachable: %s", err)
+	}
+	_ = db.Close()
+}
+
+// getPostgresTestingDB connects to database on the Postgres of docker-compose.yaml, migrated with
+// migration/postgres, and empties tables. It skips the test when Postgres is not reachable.
+func getPostgresTestingDB(t *testing.T, database string, tables ...string) *sqlx.DB {
+	db, err := storage.Open(config.ServiceConfig{
+		Driver:      config.DriverPostgres,
+		DatabaseDSN: fmt.Sprintf("postgres://postgres:1@localhost:5432/%s?sslmode=disable", database),
+	})
+	if err != nil {
+		t.Skipf("postgres is not reachable: %s", err)
+	}
+	for _, table := range tables {
+		db.MustExec("TRUNCATE " + table)
+	}
+	return db
+}
+
+// getSQLiteTestingDB migrates a fresh SQLite database of service with migration/sqlite
+func getSQLiteTestingDB(t *testing.T, service string) *sqlx.DB {
+	conf := config.ServiceConfig{
+		Name:         service,
+		Driver:       config.DriverSQLite,
+		MigrationDir: filepath.Join("..", "migration", "sqlite", service),
+		DatabaseDSN:  filepath.Join(t.TempDir(), service+".db"),
+	}
+	_, err := storage.MigrateUp(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := storage.Open(conf)
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func Test_Order_Repo_Conformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testOrderRepo(t, order.NewMemoryRepo())
+	})
+	t.Run("mysql", func(t *testing.T) {
+		requireMySQL(t, mysqlConfig.OrderConfig.DatabaseDSN)
+		testOrderRepo(t, order.NewRepo(getOrderTestingDB()))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		db := getPostgresTestingDB(t, "saga_order", "orders", "order_outboxes", "saga_audit", "inbox")
+		testOrderRepo(t, order.NewRepo(db))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		testOrderRepo(t, order.NewRepo(getSQLiteTestingDB(t, "order")))
+	})
+}
+
+func testOrderRepo(t *testing.T, repo order.IRepo) {
+	ctx := context.Background()
+	id, err := repo.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 3, PromoCode: "SPRING"})
+	assert.Nil(t, err)
+
+	actual, err := repo.GetOrder(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusPending), actual.Status)
+	assert.Equal(t, "SPRING", actual.PromoCode)
+	assert.True(t, actual.CreatedAt.Valid)
+
+	_, err = repo.GetOrder(ctx, id+100)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// a cost without currency keeps the stored one
+	err = repo.UpdateStatus(ctx, model.Order{ID: id, Status: model.OrderStatusPrepared, Cost: usd(15)})
+	assert.Nil(t, err)
+	err = repo.UpdateStatus(ctx, model.Order{ID: id, Status: model.OrderStatusBilled})
+	assert.Nil(t, err)
+	actual, err = repo.GetOrder(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusBilled), actual.Status)
+	assert.Equal(t, usd(15), actual.Cost)
+
+	// the zero cost of a free order is stored
+	freeID, err := repo.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 3})
+	assert.Nil(t, err)
+	err = repo.UpdateStatus(ctx, model.Order{ID: freeID, Status: model.OrderStatusPending, Cost: usd(15)})
+	assert.Nil(t, err)
+	err = repo.UpdateStatus(ctx, model.Order{ID: freeID, Status: model.OrderStatusPrepared, Cost: usd(0)})
+	assert.Nil(t, err)
+	actual, err = repo.GetOrder(ctx, freeID)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(0), actual.Cost)
+
+	// the order and its outbox are rolled back together
+	var rolledBackID int64
+	err = repo.Transact(ctx, func(ctx context.Context) error {
+		rolledBackID, err = repo.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 3})
+		if err != nil {
+			return err
+		}
+		err = repo.CreateOutbox(ctx, model.Outbox{Content: []byte(`{"order_id": 0}`)})
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+	_, err = repo.GetOrder(ctx, rolledBackID)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	assert.Panics(t, func() {
+		_ = repo.Transact(ctx, func(ctx context.Context) error {
+			_ = repo.UpdateStatus(ctx, model.Order{ID: id, Status: model.OrderStatusShipped})
+			panic("boom")
+		})
+	})
+	actual, err = repo.GetOrder(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusBilled), actual.Status)
+
+	stuck, err := repo.GetStuckOrders(ctx, model.OrderStatusBilled, time.Now().UTC().Add(time.Minute), 10)
+	assert.Nil(t, err)
+	assert.Len(t, stuck, 1)
+	assert.Equal(t, id, stuck[0].ID)
+	stuck, err = repo.GetStuckOrders(ctx, model.OrderStatusBilled, time.Now().UTC().Add(-time.Minute), 10)
+	assert.Nil(t, err)
+	assert.Empty(t, stuck)
+
+	// only an order still in the expected status is updated
+	updated, err := repo.UpdateStatusFrom(ctx, model.Order{ID: id, Status: model.OrderStatusTimedOut}, model.OrderStatusPending)
+	assert.Nil(t, err)
+	assert.False(t, updated)
+	updated, err = repo.UpdateStatusFrom(ctx, model.Order{
+		ID: id, Status: model.OrderStatusTimedOut, FailureReason: "no answer",
+	}, model.OrderStatusBilled)
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	actual, err = repo.GetOrder(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusTimedOut), actual.Status)
+	assert.Equal(t, "no answer", actual.FailureReason)
+	assert.Equal(t, usd(15), actual.Cost)
+
+	testOutboxes(t, repo.CreateOutbox, repo.GetPendingOutbox, repo.CountPendingOutbox, repo.MarkDoneOutboxes)
+	testOutboxAttempts(t, repo.GetPendingOutbox, repo.GetRetriedOutbox, repo.CountPendingOutbox, repo.RecordOutboxAttempt)
+	testAuditLog(t, repo.Transact, repo.CreateAuditEntry, repo.GetAuditEntries)
+	testInbox(t, repo.Transact, repo.ReceiveMessage, repo.IsReceived)
+	testRetention(t, repo.DeleteCompletedOutboxes, repo.DeleteInboxMessages, repo.CountPendingOutbox)
+}
+
+// testOutboxes expects an empty outbox table
+func testOutboxes(
+	t *testing.T,
+	create func(ctx context.Context, outbox model.Outbox) error,
+	pending func(ctx context.Context, limit int) ([]model.Outbox, error),
+	count func(ctx context.Context) (int, error),
+	markDone func(ctx context.Context, ids []int64) error,
+) {
+	ctx := context.Background()
+	headers := model.Headers{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	err := create(ctx, model.Outbox{Content: []byte(`{"n": 1}`), ContentType: saga_event.ContentTypeJSON, Headers: headers})
+	assert.Nil(t, err)
+	for _, content := range []string{`{"n": 2}`, `{"n": 3}`} {
+		err := create(ctx, model.Outbox{Content: []byte(content)})
+		assert.Nil(t, err)
+	}
+
+	outboxes, err := pending(ctx, 2)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 2)
+	assert.Equal(t, model.OutboxPending, outboxes[0].Status)
+	assert.JSONEq(t, `{"n": 1}`, string(outboxes[0].Content))
+	assert.Equal(t, saga_event.ContentTypeJSON, outboxes[0].ContentType)
+	assert.Equal(t, headers, outboxes[0].Headers)
+	assert.Nil(t, outboxes[1].Headers)
+
+	err = markDone(ctx, []int64{outboxes[0].ID, outboxes[1].ID})
+	assert.Nil(t, err)
+	assert.Nil(t, markDone(ctx, nil))
+
+	outboxes, err = pending(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 1)
+	assert.JSONEq(t, `{"n": 3}`, string(outboxes[0].Content))
+
+	n, err := count(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+}
+
+// testOutboxAttempts expects the single pending row left by testOutboxes, and leaves it pending
+func testOutboxAttempts(
+	t *testing.T,
+	pending func(ctx context.Context, limit int) ([]model.Outbox, error),
+	retried func(ctx context.Context, limit int) ([]model.Outbox, error),
+	count func(ctx context.Context) (int, error),
+	recordAttempt func(ctx context.Context, outbox model.Outbox) error,
+) {
+	ctx := context.Background()
+	outboxes, err := pending(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 1)
+	outbox := outboxes[0]
+	assert.Equal(t, 0, outbox.Attempts)
+	assert.False(t, outbox.LastError.Valid)
+	assert.False(t, outbox.NextAttemptAt.Valid)
+	outboxes, err = retried(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 0)
+
+	// a row waiting for its next attempt is still pending but not relayed
+	outbox.Attempts = 1
+	outbox.LastError = sql.NullString{String: "message too large", Valid: true}
+	outbox.NextAttemptAt = sql.NullTime{Time: time.Now().Add(time.Hour), Valid: true}
+	err = recordAttempt(ctx, outbox)
+	assert.Nil(t, err)
+	outboxes, err = pending(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 0)
+	outboxes, err = retried(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 0)
+	n, err := count(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	outbox.Status = model.OutboxFailed
+	outbox.NextAttemptAt = sql.NullTime{}
+	err = recordAttempt(ctx, outbox)
+	assert.Nil(t, err)
+	n, err = count(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	outbox.Status = model.OutboxPending
+	outbox.Attempts = 2
+	outbox.NextAttemptAt = sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}
+	err = recordAttempt(ctx, outbox)
+	assert.Nil(t, err)
+	outboxes, err = pending(ctx, 10)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 1)
+	assert.Equal(t, 2, outboxes[0].Attempts)
+	assert.Equal(t, "message too large", outboxes[0].LastError.String)
+	assert.True(t, outboxes[0].NextAttemptAt.Valid)
+	outboxes, err = retried(ctx, 1)
+	assert.Nil(t, err)
+	assert.Len(t, outboxes, 1)
+	assert.Equal(t, 2, outboxes[0].Attempts)
+}
+
+// testAuditLog expects an empty saga_audit table
+func testAuditLog(
+	t *testing.T,
+	transact func(ctx context.Context, fn func(ctx context.Context) error) error,
+	create func(ctx context.Context, entry model.AuditEntry) error,
+	get func(ctx context.Context, orderID int64) ([]model.AuditEntry, error),
+) {
+	ctx := context.Background()
+	received := model.NewAuditEntry(9, "test", model.AuditReceived, model.OrderStatusPrepared, "")
+	decision := model.NewAuditEntry(9, "test", model.AuditDecision, model.OrderStatusBilled, "charged 10.00 USD")
+	assert.Nil(t, create(ctx, received))
+	assert.Nil(t, create(ctx, decision))
+	assert.Nil(t, create(ctx, model.NewAuditEntry(10, "test", model.AuditReceived, "", "")))
+
+	err := transact(ctx, func(ctx context.Context) error {
+		err := create(ctx, model.NewAuditEntry(9, "test", model.AuditEmitted, model.OrderStatusBilled, ""))
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+
+	entries, err := get(ctx, 9)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	for i, expected := range []model.AuditEntry{received, decision} {
+		expected.ID = entries[i].ID
+		assert.Equal(t, expected, entries[i])
+	}
+	assert.Less(t, entries[0].ID, entries[1].ID)
+
+	entries, err = get(ctx, 11)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func testInbox(
+	t *testing.T,
+	transact func(ctx context.Context, fn func(ctx context.Context) error) error,
+	receive func(ctx context.Context, message model.InboxMessage) (bool, error),
+	isReceived func(ctx context.Context, orderID int64, eventType string) (bool, error),
+) {
+	ctx := context.Background()
+	created := model.InboxMessage{MessageID: "order:7", EventType: saga_event.TypeOrderCreated, OrderID: 7}
+	timedOut := model.InboxMessage{MessageID: "order:7", EventType: saga_event.TypeOrderTimedOut, OrderID: 7}
+
+	received, err := isReceived(ctx, 7, saga_event.TypeOrderCreated)
+	assert.Nil(t, err)
+	assert.False(t, received)
+
+	received, err = receive(ctx, created)
+	assert.Nil(t, err)
+	assert.True(t, received)
+	received, err = receive(ctx, created)
+	assert.Nil(t, err)
+	assert.False(t, received)
+
+	// the same message id is received once per event type
+	received, err = isReceived(ctx, 7, saga_event.TypeOrderTimedOut)
+	assert.Nil(t, err)
+	assert.False(t, received)
+	received, err = receive(ctx, timedOut)
+	assert.Nil(t, err)
+	assert.True(t, received)
+
+	// a rolled back message is received again
+	rolledBack := model.InboxMessage{MessageID: "c0ffee", EventType: saga_event.TypeOrderCreated, OrderID: 8}
+	err = transact(ctx, func(ctx context.Context) error {
+		_, err := receive(ctx, rolledBack)
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+	received, err = isReceived(ctx, 8, saga_event.TypeOrderCreated)
+	assert.Nil(t, err)
+	assert.False(t, received)
+	received, err = receive(ctx, rolledBack)
+	assert.Nil(t, err)
+	assert.True(t, received)
+}
+
+// testRetention expects the rows left by testOutboxes and testInbox: two completed outbox rows, one
+// pending and three inbox messages
+func testRetention(
+	t *testing.T,
+	deleteOutboxes func(ctx context.Context, before time.Time, limit int) (int, error),
+	deleteInbox func(ctx context.Context, before time.Time, limit int) (int, error),
+	count func(ctx context.Context) (int, error),
+) {
+	ctx := context.Background()
+	// a day covers the time zone of the database session
+	past := time.Now().Add(-24 * time.Hour)
+	future := time.Now().Add(24 * time.Hour)
+
+	deleted, err := deleteOutboxes(ctx, past, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, deleted)
+	deleted, err = deleteOutboxes(ctx, future, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	deleted, err = deleteOutboxes(ctx, future, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	// pending rows are kept whatever their age
+	deleted, err = deleteOutboxes(ctx, future, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, deleted)
+	n, err := count(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	deleted, err = deleteInbox(ctx, past, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, deleted)
+	deleted, err = deleteInbox(ctx, future, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, deleted)
+	deleted, err = deleteInbox(ctx, future, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+}
+
+func Test_Inventory_Repo_Conformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testInventoryRepo(t, inventory.NewMemoryRepo())
+	})
+	t.Run("mysql", func(t *testing.T) {
+		requireMySQL(t, mysqlConfig.InventoryConfig.DatabaseDSN)
+		testInventoryRepo(t, inventory.NewRepo(getInventoryTestingDB()))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		db := getPostgresTestingDB(t, "saga_inventory", "inventory", "reservations", "inventory_outboxes", "inbox",
+			"saga_audit")
+		testInventoryRepo(t, inventory.NewRepo(db))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		testInventoryRepo(t, inventory.NewRepo(getSQLiteTestingDB(t, "inventory")))
+	})
+}
+
+func testInventoryRepo(t *testing.T, repo inventory.IRepo) {
+	ctx := context.Background()
+	err := repo.CreateInventory(ctx, model.Inventory{ProductID: 2, UnitPrice: usd(5), Amount: 10})
+	assert.Nil(t, err)
+	assert.NotNil(t, repo.CreateInventory(ctx, model.Inventory{ProductID: 2, UnitPrice: usd(5), Amount: 10}))
+
+	_, err = repo.GetInventory(ctx, 3)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// the update and the received message are rolled back together
+	err = repo.Transact(ctx, func(ctx context.Context) error {
+		current, err := repo.LockInventoryForUpdate(ctx, 2)
+		if err != nil {
+			return err
+		}
+		err = repo.UpdateInventory(ctx, 2, current.Amount-3)
+		if err != nil {
+			return err
+		}
+		_, err = repo.ReceiveMessage(ctx, model.InboxMessage{
+			MessageID: "order:1",
+			EventType: saga_event.TypeOrderCreated,
+			OrderID:   1,
+		})
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+	actual, err := repo.GetInventory(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, actual.Amount)
+	assert.Equal(t, usd(5), actual.UnitPrice)
+	received, err := repo.IsReceived(ctx, 1, saga_event.TypeOrderCreated)
+	assert.Nil(t, err)
+	assert.False(t, received)
+
+	testRowLock(t, repo.Transact,
+		func(ctx context.Context) (int, error) {
+			current, err := repo.LockInventoryForUpdate(ctx, 2)
+			return current.Amount, err
+		},
+		func(ctx context.Context, amount int) error {
+			return repo.UpdateInventory(ctx, 2, amount)
+		},
+	)
+
+	// reservations
+	assert.Nil(t, repo.CreateReservation(ctx, model.Reservation{OrderID: 1, ProductID: 2, Amount: 3}))
+	assert.NotNil(t, repo.CreateReservation(ctx, model.Reservation{OrderID: 1, ProductID: 2, Amount: 3}))
+	_, err = repo.LockReservationForUpdate(ctx, 2)
+	assert.Equal(t, sql.ErrNoRows, err)
+	reservation, err := repo.LockReservationForUpdate(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), reservation.ProductID)
+	assert.Equal(t, 3, reservation.Amount)
+	assert.False(t, reservation.ReleasedAt.Valid)
+	assert.Nil(t, repo.MarkReservationReleased(ctx, 1))
+	reservation, err = repo.LockReservationForUpdate(ctx, 1)
+	assert.Nil(t, err)
+	assert.True(t, reservation.ReleasedAt.Valid)
+
+	testOutboxes(t, repo.CreateOutbox, repo.GetPendingOutbox, repo.CountPendingOutbox, repo.MarkDoneOutboxes)
+	testOutboxAttempts(t, repo.GetPendingOutbox, repo.GetRetriedOutbox, repo.CountPendingOutbox, repo.RecordOutboxAttempt)
+	testAuditLog(t, repo.Transact, repo.CreateAuditEntry, repo.GetAuditEntries)
+	testInbox(t, repo.Transact, repo.ReceiveMessage, repo.IsReceived)
+	testRetention(t, repo.DeleteCompletedOutboxes, repo.DeleteInboxMessages, repo.CountPendingOutbox)
+}
+
+// testRowLock runs two transactions taking the same row lock, the second one must wait for
+// the first one to commit and then read its write.
+func testRowLock(
+	t *testing.T,
+	transact func(ctx context.Context, fn func(ctx context.Context) error) error,
+	lock func(ctx context.Context) (int, error),
+	update func(ctx context.Context, amount int) error,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	locked := make(chan struct{})
+	committed := make(chan time.Time, 1)
+	go func() {
+		err := transact(ctx, func(ctx context.Context) error {
+			amount, err := lock(ctx)
+			if err != nil {
+				return err
+			}
+			close(locked)
+			time.Sleep(300 * time.Millisecond)
+			err = update(ctx, amount+1)
+			committed <- time.Now()
+			return err
+		})
+		assert.Nil(t, err)
+	}()
+
+	<-locked
+	var seen int
+	var lockedAt time.Time
+	err := transact(ctx, func(ctx context.Context) error {
+		var err error
+		seen, err = lock(ctx)
+		lockedAt = time.Now()
+		return err
+	})
+	assert.Nil(t, err)
+
+	firstCommit := <-committed
+	assert.True(t, lockedAt.After(firstCommit), "the second transaction did not wait for the row lock")
+
+	after, err := lock(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, after, seen)
+}
+
+func Test_Payment_Repo_Conformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testPaymentRepo(t, payment.NewMemoryRepo())
+	})
+	t.Run("mysql", func(t *testing.T) {
+		requireMySQL(t, mysqlConfig.PaymentConfig.DatabaseDSN)
+		testPaymentRepo(t, payment.NewRepo(getPaymentTestingDB()))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		db := getPostgresTestingDB(t, "saga_payment",
+			"accounts", "charges", "payment_authorizations", "payment_outboxes", "inbox", "saga_audit",
+		)
+		testPaymentRepo(t, payment.NewRepo(db))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		testPaymentRepo(t, payment.NewRepo(getSQLiteTestingDB(t, "payment")))
+	})
+}
+
+func testPaymentRepo(t *testing.T, repo payment.IRepo) {
+	ctx := context.Background()
+	err := repo.CreateAccount(ctx, model.Account{CustomerID: 1, Balance: usd(100), CreditLimit: 20})
+	assert.Nil(t, err)
+	assert.NotNil(t, repo.CreateAccount(ctx, model.Account{CustomerID: 1, Balance: usd(100)}))
+
+	_, err = repo.GetAccount(ctx, 2)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// the balance and the charge are rolled back together
+	err = repo.Transact(ctx, func(ctx context.Context) error {
+		account, err := repo.LockAccountForUpdate(ctx, 1)
+		if err != nil {
+			return err
+		}
+		balance, err := account.Balance.Sub(usd(30))
+		if err != nil {
+			return err
+		}
+		err = repo.UpdateBalance(ctx, 1, balance)
+		if err != nil {
+			return err
+		}
+		err = repo.CreateCharge(ctx, model.Charge{OrderID: 1, CustomerID: 1, Cost: usd(30)})
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+	account, err := repo.GetAccount(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(100), account.Balance)
+	assert.Equal(t, int64(20), account.CreditLimit)
+	_, err = repo.LockChargeForUpdate(ctx, 1)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	testRowLock(t, repo.Transact,
+		func(ctx context.Context) (int, error) {
+			account, err := repo.LockAccountForUpdate(ctx, 1)
+			return int(account.Balance.Amount), err
+		},
+		func(ctx context.Context, amount int) error {
+			return repo.UpdateBalance(ctx, 1, usd(int64(amount)))
+		},
+	)
+
+	// charges
+	since := time.Now().Add(-time.Minute)
+	assert.Nil(t, repo.CreateCharge(ctx, model.Charge{OrderID: 2, CustomerID: 1, Cost: usd(30)}))
+	assert.Nil(t, repo.CreateCharge(ctx, model.Charge{OrderID: 3, CustomerID: 1, Cost: usd(12)}))
+	assert.Nil(t, repo.CreateCharge(ctx, model.Charge{OrderID: 4, CustomerID: 2, Cost: usd(50)}))
+	assert.NotNil(t, repo.CreateCharge(ctx, model.Charge{OrderID: 2, CustomerID: 1, Cost: usd(30)}))
+	spent, err := repo.GetSpentSince(ctx, 1, since)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), spent)
+	spent, err = repo.GetSpentSince(ctx, 1, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), spent)
+
+	assert.Nil(t, repo.MarkChargeRefunded(ctx, 2))
+	charge, err := repo.LockChargeForUpdate(ctx, 2)
+	assert.Nil(t, err)
+	assert.True(t, charge.RefundedAt.Valid)
+	assert.Equal(t, usd(30), charge.Cost)
+	// a refunded charge is not spent
+	spent, err = repo.GetSpentSince(ctx, 1, since)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), spent)
+
+	// authorizations
+	expired := sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}
+	later := sql.NullTime{Time: time.Now().Add(time.Hour), Valid: true}
+	for _, authorization := range []model.PaymentAuthorization{
+		{AuthorizationID: "auth-5", OrderID: 5, CustomerID: 1, Cost: usd(10), ExpiresAt: expired},
+		{AuthorizationID: "auth-6", OrderID: 6, CustomerID: 1, Cost: usd(10), ExpiresAt: later},
+		{AuthorizationID: "auth-7", OrderID: 7, CustomerID: 1, Cost: usd(10), ExpiresAt: expired},
+	} {
+		authorization.Status = model.AuthorizationPending
+		authorization.Event = []byte(`{"order_id": 0}`)
+		assert.Nil(t, repo.CreateAuthorization(ctx, authorization))
+	}
+	assert.NotNil(t, repo.CreateAuthorization(ctx, model.PaymentAuthorization{
+		AuthorizationID: "auth-other", OrderID: 5, CustomerID: 1, Cost: usd(10),
+		Status: model.AuthorizationPending, Event: []byte(`{}`),
+	}))
+
+	assert.Nil(t, repo.CreateAuthorization(ctx, model.PaymentAuthorization{
+		AuthorizationID: "request:8", OrderID: 8, CustomerID: 1, Cost: usd(10),
+		Status: model.AuthorizationRequested, Event: []byte(`{}`), ExpiresAt: expired,
+	}))
+
+	// a void the gateway was not asked for successfully expires as well
+	assert.Nil(t, repo.CreateAuthorization(ctx, model.PaymentAuthorization{
+		AuthorizationID: "auth-9", OrderID: 9, CustomerID: 1, Cost: usd(10),
+		Status: model.AuthorizationVoiding, Event: []byte(`{}`), ExpiresAt: expired,
+	}))
+
+	assert.Nil(t, repo.UpdateAuthorizationStatus(ctx, "auth-7", model.AuthorizationCaptured))
+	authorizations, err := repo.GetExpiredAuthorizations(ctx, time.Now(), 10)
+	assert.Nil(t, err)
+	var expiredIDs []string
+	for _, authorization := range authorizations {
+		expiredIDs = append(expiredIDs, authorization.AuthorizationID)
+	}
+	assert.ElementsMatch(t, []string{"auth-5", "request:8", "auth-9"}, expiredIDs)
+
+	// the gateway answer replaces the request
+	err = repo.Transact(ctx, func(ctx context.Context) error {
+		return repo.RecordAuthorization(ctx, model.PaymentAuthorization{
+			AuthorizationID: "auth-8", OrderID: 8, Status: model.AuthorizationPending, ExpiresAt: later,
+		})
+	})
+	assert.Nil(t, err)
+	_, err = repo.LockAuthorizationForUpdate(ctx, "request:8")
+	assert.Equal(t, sql.ErrNoRows, err)
+	authorization, err := repo.LockAuthorizationForUpdate(ctx, "auth-8")
+	assert.Nil(t, err)
+	assert.Equal(t, model.AuthorizationPending, authorization.Status)
+	assert.Equal(t, usd(10), authorization.Cost)
+	assert.True(t, authorization.ExpiresAt.Valid)
+
+	authorization, err = repo.LockAuthorizationByOrderForUpdate(ctx, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, model.AuthorizationCaptured, authorization.Status)
+	assert.Equal(t, usd(10), authorization.Cost)
+	_, err = repo.LockAuthorizationForUpdate(ctx, "auth-unknown")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	testOutboxes(t, repo.CreateOutbox, repo.GetPendingOutbox, repo.CountPendingOutbox, repo.MarkDoneOutboxes)
+	testOutboxAttempts(t, repo.GetPendingOutbox, repo.GetRetriedOutbox, repo.CountPendingOutbox, repo.RecordOutboxAttempt)
+	testAuditLog(t, repo.Transact, repo.CreateAuditEntry, repo.GetAuditEntries)
+	testInbox(t, repo.Transact, repo.ReceiveMessage, repo.IsReceived)
+	testRetention(t, repo.DeleteCompletedOutboxes, repo.DeleteInboxMessages, repo.CountPendingOutbox)
+}
+
+func Test_Shipping_Repo_Conformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testShippingRepo(t, shipping.NewMemoryRepo())
+	})
+	t.Run("mysql", func(t *testing.T) {
+		requireMySQL(t, mysqlConfig.ShippingConfig.DatabaseDSN)
+		testShippingRepo(t, shipping.NewRepo(getShippingTestingDB()))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		db := getPostgresTestingDB(t, "saga_shipping", "shipments", "shipping_outboxes", "inbox", "saga_audit")
+		testShippingRepo(t, shipping.NewRepo(db))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		testShippingRepo(t, shipping.NewRepo(getSQLiteTestingDB(t, "shipping")))
+	})
+}
+
+func testShippingRepo(t *testing.T, repo shipping.IRepo) {
+	ctx := context.Background()
+	shipment := model.Shipment{
+		OrderID:        1,
+		CustomerID:     2,
+		ProductID:      3,
+		Amount:         4,
+		TrackingNumber: "TRACK-1",
+		Status:         model.ShipmentStatusShipped,
+	}
+	assert.Nil(t, repo.CreateShipment(ctx, shipment))
+	assert.NotNil(t, repo.CreateShipment(ctx, shipment))
+
+	actual, err := repo.GetShipment(ctx, 1)
+	assert.Nil(t, err)
+	shipment.CreatedAt = actual.CreatedAt
+	assert.Equal(t, shipment, actual)
+
+	err = repo.Transact(ctx, func(ctx context.Context) error {
+		err := repo.CreateShipment(ctx, model.Shipment{OrderID: 2, Status: model.ShipmentStatusFailed})
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+	_, err = repo.GetShipment(ctx, 2)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	testOutboxes(t, repo.CreateOutbox, repo.GetPendingOutbox, repo.CountPendingOutbox, repo.MarkDoneOutboxes)
+	testOutboxAttempts(t, repo.GetPendingOutbox, repo.GetRetriedOutbox, repo.CountPendingOutbox, repo.RecordOutboxAttempt)
+	testAuditLog(t, repo.Transact, repo.CreateAuditEntry, repo.GetAuditEntries)
+	testInbox(t, repo.Transact, repo.ReceiveMessage, repo.IsReceived)
+	testRetention(t, repo.DeleteCompletedOutboxes, repo.DeleteInboxMessages, repo.CountPendingOutbox)
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/retention"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/service/shipping"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test_Retention_Prune deletes more rows than a batch, pending outbox rows and recent rows are kept.
+func Test_Retention_Prune(t *testing.T) {
+	ctx := context.Background()
+	repo := shipping.NewMemoryRepo()
+	for i := 0; i < 5; i++ {
+		err := repo.CreateOutbox(ctx, model.Outbox{Content: []byte("{}")})
+		assert.Nil(t, err)
+		_, err = repo.ReceiveMessage(ctx, model.InboxMessage{
+			MessageID: fmt.Sprintf("order:%d", i), EventType: saga_event.TypePaymentCharged, OrderID: int64(i),
+		})
+		assert.Nil(t, err)
+	}
+	outboxes, err := repo.GetPendingOutbox(ctx, 4)
+	assert.Nil(t, err)
+	err = repo.MarkDoneOutboxes(ctx, []int64{outboxes[0].ID, outboxes[1].ID, outboxes[2].ID, outboxes[3].ID})
+	assert.Nil(t, err)
+
+	policy := config.RetentionConfig{Interval: time.Hour, Outbox: time.Hour, Inbox: 2 * time.Hour, BatchSize: 3}
+	res, err := retention.Prune(ctx, repo, policy, time.Now().Add(90*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, retention.Result{Outboxes: 4, InboxMessages: 0}, res)
+	pending, err := repo.CountPendingOutbox(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pending)
+
+	res, err = retention.Prune(ctx, repo, policy, time.Now().Add(3*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, retention.Result{Outboxes: 0, InboxMessages: 5}, res)
+	received, err := repo.IsReceived(ctx, 4, saga_event.TypePaymentCharged)
+	assert.Nil(t, err)
+	assert.False(t, received)
+
+	// a zero retention keeps the table
+	policy.Outbox = 0
+	res, err = retention.Prune(ctx, repo, policy, time.Now().Add(24*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, retention.Result{}, res)
+}
+
+func Test_Config_Retention_Validation(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+retention:
+  interval: 0s
+  inbox: -1h
+  batch_size: 0
+`)
+	_, err := config.Load(path)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "retention: interval must be positive")
+	assert.Contains(t, err.Error(), "retention: retentions cannot be negative")
+	assert.Contains(t, err.Error(), "retention: batch_size must be positive")
+}
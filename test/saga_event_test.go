@@ -0,0 +1,233 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_Event_Envelope(t *testing.T) {
+	events := []saga_event.Event{
+		saga_event.OrderCreated{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, PromoCode: "VIP"},
+		saga_event.OrderTimedOut{OrderID: 1, Cost: usd(15), Reason: "no answer"},
+		saga_event.InventoryReserved{OrderID: 1, ProductID: 3, Amount: 4, Cost: usd(15)},
+		saga_event.InventoryRejected{OrderID: 1, ProductID: 3, Amount: 4},
+		saga_event.PaymentCharged{OrderID: 1, Cost: usd(15)},
+		saga_event.PaymentRejected{OrderID: 1, Status: model.OrderStatusFailedPaymentDeclined, Reason: "CARD_DECLINED"},
+		saga_event.ShipmentDispatched{OrderID: 1, Cost: usd(15)},
+		saga_event.ShipmentFailed{OrderID: 1, Reason: "UNDELIVERABLE_ADDRESS"},
+	}
+	for _, event := range events {
+		content, err := saga_event.Marshal(event)
+		assert.Nil(t, err)
+
+		var envelope saga_event.Envelope
+		assert.Nil(t, json.Unmarshal(content, &envelope))
+		assert.Equal(t, event.EventType(), envelope.Type)
+		assert.Equal(t, 1, envelope.Version)
+		assert.NotEmpty(t, envelope.ID)
+		assert.WithinDuration(t, time.Now(), envelope.OccurredAt, time.Minute)
+
+		decoded, err := saga_event.Unmarshal(content)
+		assert.Nil(t, err)
+		assert.Equal(t, event, decoded)
+	}
+
+	view, err := saga_event.Decode(mustMarshalEvent(t, saga_event.PaymentRejected{
+		OrderID: 1, Status: model.OrderStatusFailedExceedCreditLimit, Reason: "LIMIT",
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, saga_event.OrderEvent{
+		OrderID: 1, Status: model.OrderStatusFailedExceedCreditLimit, Reason: "LIMIT",
+	}, view)
+}
+
+// events published before the envelope are bare OrderEvents, their status gives their type
+func Test_Event_Legacy(t *testing.T) {
+	legacy, err := json.Marshal(saga_event.OrderEvent{
+		OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, Cost: usd(15), Status: model.OrderStatusBilled,
+	})
+	assert.Nil(t, err)
+	event, err := saga_event.Unmarshal(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, saga_event.PaymentCharged{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, Cost: usd(15)}, event)
+
+	event, err = saga_event.Unmarshal([]byte(`{"order_id": 1, "product_id": 3, "amount": 4}`))
+	assert.Nil(t, err)
+	assert.Equal(t, saga_event.OrderCreated{OrderID: 1, ProductID: 3, Amount: 4}, event)
+
+	_, err = saga_event.Unmarshal([]byte(`{"order_id": 1, "status": "LOST"}`))
+	assert.EqualError(t, err, `saga_event: no event type for status "LOST"`)
+}
+
+// shipmentDispatchedV2 renamed the cost of ShipmentDispatched, the total took a new field number
+type shipmentDispatchedV2 struct {
+	OrderID int64       `json:"order_id" proto:"1"`
+	Total   model.Money `json:"total" proto:"9"`
+}
+
+func (e shipmentDispatchedV2) EventType() string { return saga_event.TypeShipmentDispatched }
+
+func (e shipmentDispatchedV2) OrderEvent() saga_event.OrderEvent {
+	return saga_event.OrderEvent{OrderID: e.OrderID, Cost: e.Total, Status: model.OrderStatusShipped}
+}
+
+func renameCostToTotal(payload json.RawMessage) (json.RawMessage, error) {
+	var v1 map[string]json.RawMessage
+	err := json.Unmarshal(payload, &v1)
+	if err != nil {
+		return nil, err
+	}
+	v1["total"] = v1["cost"]
+	delete(v1, "cost")
+	return json.Marshal(v1)
+}
+
+func Test_Event_Upcast(t *testing.T) {
+	registry := saga_event.NewRegistry()
+	registry.Register(2, func() saga_event.Event { return &shipmentDispatchedV2{} })
+	registry.RegisterUpcaster(saga_event.TypeShipmentDispatched, 1, renameCostToTotal)
+
+	// version 1 as written by the default registry, and a bare legacy event
+	v1 := mustMarshalEvent(t, saga_event.ShipmentDispatched{OrderID: 1, Cost: usd(15)})
+	legacy, err := json.Marshal(saga_event.OrderEvent{OrderID: 1, Cost: usd(15), Status: model.OrderStatusShipped})
+	assert.Nil(t, err)
+	for _, content := range [][]byte{v1, legacy} {
+		event, err := registry.Unmarshal(content)
+		assert.Nil(t, err)
+		assert.Equal(t, shipmentDispatchedV2{OrderID: 1, Total: usd(15)}, event)
+	}
+
+	v2, err := registry.Marshal(shipmentDispatchedV2{OrderID: 1})
+	assert.Nil(t, err)
+	_, err = saga_event.Unmarshal(v2)
+	assert.EqualError(t, err, "saga_event: ShipmentDispatched version 2 is newer than 1")
+
+	_, err = registry.Unmarshal(mustMarshalEvent(t, saga_event.OrderCreated{OrderID: 1}))
+	assert.EqualError(t, err, `saga_event: unknown event type "OrderCreated"`)
+
+	registry.Register(3, func() saga_event.Event { return &shipmentDispatchedV2{} })
+	_, err = registry.Unmarshal(v2)
+	assert.EqualError(t, err, "saga_event: no upcaster for ShipmentDispatched version 2")
+}
+
+func Test_Event_Protobuf(t *testing.T) {
+	events := []saga_event.Event{
+		saga_event.OrderCreated{OrderID: 1, CustomerID: 2, ProductID: 3, Amount: 4, PromoCode: "VIP"},
+		saga_event.OrderTimedOut{OrderID: 1, Cost: usd(15), Reason: "no answer"},
+		saga_event.InventoryReserved{OrderID: 1, ProductID: 3, Amount: 4, Cost: usd(15)},
+		saga_event.InventoryRejected{OrderID: 1, ProductID: 3, Amount: 4},
+		saga_event.PaymentCharged{OrderID: 1, CustomerID: 2, Cost: usd(-15)},
+		saga_event.PaymentRejected{OrderID: 1, Status: model.OrderStatusFailedPaymentDeclined, Reason: "CARD_DECLINED"},
+		saga_event.ShipmentDispatched{OrderID: 1, Cost: usd(15)},
+		saga_event.ShipmentFailed{OrderID: 1, Reason: "UNDELIVERABLE_ADDRESS"},
+	}
+	for _, event := range events {
+		content, err := saga_event.Protobuf.Marshal(event)
+		assert.Nil(t, err)
+		assert.Less(t, len(content), len(mustMarshalEvent(t, event)))
+
+		decoded, err := saga_event.Protobuf.Unmarshal(content)
+		assert.Nil(t, err)
+		assert.Equal(t, event, decoded)
+
+		view, err := saga_event.DecodeContent(saga_event.ContentTypeProtobuf, content)
+		assert.Nil(t, err)
+		assert.Equal(t, event.OrderEvent(), view)
+	}
+
+	// no content type is JSON, messages published before content types have none
+	view, err := saga_event.DecodeContent("", mustMarshalEvent(t, saga_event.InventoryRejected{OrderID: 1}))
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusFailedOutOfStock), view.Status)
+
+	_, err = saga_event.DecodeContent("text/plain", []byte("hello"))
+	assert.EqualError(t, err, `saga_event: unknown content type "text/plain"`)
+
+	_, err = saga_event.Protobuf.Unmarshal(mustMarshalEvent(t, saga_event.OrderCreated{OrderID: 1}))
+	assert.NotNil(t, err)
+}
+
+// shipmentFailedV2 added a carrier to ShipmentFailed
+type shipmentFailedV2 struct {
+	OrderID int64  `proto:"1"`
+	Reason  string `proto:"8"`
+	Carrier string `proto:"9"`
+}
+
+func (e shipmentFailedV2) EventType() string { return saga_event.TypeShipmentFailed }
+
+func (e shipmentFailedV2) OrderEvent() saga_event.OrderEvent {
+	return saga_event.OrderEvent{OrderID: e.OrderID, Status: model.OrderStatusFailedShipping, Reason: e.Reason}
+}
+
+// protobuf payloads are read by field number, readers skip the fields they do not know
+func Test_Event_Protobuf_Versions(t *testing.T) {
+	registry := saga_event.NewRegistry()
+	registry.Register(2, func() saga_event.Event { return &shipmentFailedV2{} })
+
+	v1, err := saga_event.Protobuf.Marshal(saga_event.ShipmentFailed{OrderID: 1, Cost: usd(15), Reason: "LOST"})
+	assert.Nil(t, err)
+	event, err := saga_event.NewProtobufCodec(registry).Unmarshal(v1)
+	assert.Nil(t, err)
+	assert.Equal(t, shipmentFailedV2{OrderID: 1, Reason: "LOST"}, event)
+
+	v2, err := registry.MarshalProtobuf(shipmentFailedV2{OrderID: 1, Reason: "LOST", Carrier: "DHL"})
+	assert.Nil(t, err)
+	_, err = saga_event.Protobuf.Unmarshal(v2)
+	assert.EqualError(t, err, "saga_event: ShipmentFailed version 2 is newer than 1")
+
+	older := saga_event.NewRegistry()
+	older.Register(2, func() saga_event.Event { return &saga_event.ShipmentFailed{} })
+	event, err = older.UnmarshalProtobuf(v2)
+	assert.Nil(t, err)
+	assert.Equal(t, saga_event.ShipmentFailed{OrderID: 1, Reason: "LOST"}, event)
+}
+
+// older protobuf payloads are read into the struct of their version, then upcast like JSON
+func Test_Event_Protobuf_Upcast(t *testing.T) {
+	v1, err := saga_event.Protobuf.Marshal(saga_event.ShipmentDispatched{OrderID: 1, Cost: usd(15)})
+	assert.Nil(t, err)
+
+	registry := saga_event.NewRegistry()
+	registry.Register(1, func() saga_event.Event { return &saga_event.ShipmentDispatched{} })
+	registry.Register(2, func() saga_event.Event { return &shipmentDispatchedV2{} })
+	registry.RegisterUpcaster(saga_event.TypeShipmentDispatched, 1, renameCostToTotal)
+	event, err := registry.UnmarshalProtobuf(v1)
+	assert.Nil(t, err)
+	assert.Equal(t, shipmentDispatchedV2{OrderID: 1, Total: usd(15)}, event)
+
+	// without the struct of version 1 its payload cannot be upcast
+	registry = saga_event.NewRegistry()
+	registry.Register(2, func() saga_event.Event { return &shipmentDispatchedV2{} })
+	registry.RegisterUpcaster(saga_event.TypeShipmentDispatched, 1, renameCostToTotal)
+	_, err = registry.UnmarshalProtobuf(v1)
+	assert.EqualError(t, err, "saga_event: no struct registered to upcast ShipmentDispatched version 1")
+}
+
+// badTagEvent numbers its order id with something else than a field number
+type badTagEvent struct {
+	OrderID int64 `proto:"first"`
+}
+
+func (e badTagEvent) EventType() string { return "BadTag" }
+
+func (e badTagEvent) OrderEvent() saga_event.OrderEvent {
+	return saga_event.OrderEvent{OrderID: e.OrderID}
+}
+
+func Test_Event_Protobuf_Invalid_Tag(t *testing.T) {
+	registry := saga_event.NewRegistry()
+	registry.Register(1, func() saga_event.Event { return &badTagEvent{} })
+	_, err := registry.MarshalProtobuf(badTagEvent{OrderID: 1})
+	assert.EqualError(t, err, `saga_event: invalid proto tag "first" on OrderID`)
+}
+
+func mustMarshalEvent(t *testing.T, event saga_event.Event) []byte {
+	content, err := saga_event.Marshal(event)
+	assert.Nil(t, err)
+	return content
+}
@@ -0,0 +1,163 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/schema"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"testing/fstest"
+)
+
+// Test_Schema_Registered fails when a saga_event struct changes without its schema, see schema check.
+func Test_Schema_Registered(t *testing.T) {
+	assert.Empty(t, schema.Check(schema.Default, saga_event.DefaultRegistry))
+	for _, name := range saga_event.DefaultRegistry.Types() {
+		assert.Equal(t, []int{1}, schema.Default.Versions(name), name)
+	}
+}
+
+type orderPlacedV1 struct {
+	OrderID int64 `json:"order_id"`
+	Amount  int   `json:"amount"`
+}
+
+type orderPlacedOptionalNote struct {
+	OrderID int64  `json:"order_id"`
+	Amount  int    `json:"amount"`
+	Note    string `json:"note,omitempty"`
+}
+
+type orderPlacedRequiredNote struct {
+	OrderID int64  `json:"order_id"`
+	Amount  int    `json:"amount"`
+	Note    string `json:"note"`
+}
+
+type orderPlacedNoAmount struct {
+	OrderID int64 `json:"order_id"`
+}
+
+type orderPlacedStringAmount struct {
+	OrderID int64  `json:"order_id"`
+	Amount  string `json:"amount"`
+}
+
+func mustGenerate(t *testing.T, v interface{}) *schema.Schema {
+	res, err := schema.Generate("OrderPlaced", 1, v)
+	assert.Nil(t, err)
+	return res
+}
+
+func Test_Schema_Compatibility(t *testing.T) {
+	v1 := mustGenerate(t, orderPlacedV1{})
+
+	next := mustGenerate(t, orderPlacedOptionalNote{})
+	assert.Empty(t, schema.Backward(next, v1))
+	assert.Empty(t, schema.Forward(next, v1))
+
+	next = mustGenerate(t, orderPlacedRequiredNote{})
+	assert.Equal(t, []string{"note: required by the reader, never written"}, errorStrings(schema.Backward(next, v1)))
+	assert.Empty(t, schema.Forward(next, v1))
+
+	next = mustGenerate(t, orderPlacedNoAmount{})
+	assert.Empty(t, schema.Backward(next, v1))
+	assert.Equal(t, []string{"amount: required by the reader, never written"}, errorStrings(schema.Forward(next, v1)))
+
+	next = mustGenerate(t, orderPlacedStringAmount{})
+	assert.Equal(t, []string{"amount: read as string, written as integer"}, errorStrings(schema.Backward(next, v1)))
+	assert.Equal(t, []string{"amount: read as integer, written as string"}, errorStrings(schema.Forward(next, v1)))
+
+	closed := mustGenerate(t, orderPlacedV1{})
+	closed.AdditionalProperties = new(bool)
+	assert.Equal(t, []string{"note: written, not allowed by the reader"},
+		errorStrings(schema.Forward(mustGenerate(t, orderPlacedOptionalNote{}), closed)))
+}
+
+func Test_Schema_Check(t *testing.T) {
+	v1, ok := schema.Default.Get(saga_event.TypeShipmentDispatched, 1)
+	assert.True(t, ok)
+	registry := schema.NewRegistry()
+	registry.Add(saga_event.TypeShipmentDispatched, 1, v1)
+
+	events := saga_event.NewRegistry()
+	events.Register(2, func() saga_event.Event { return &shipmentDispatchedV2{} })
+	assert.Equal(t, []string{"ShipmentDispatched version 2: no schema registered"}, errorStrings(schema.Check(registry, events)))
+
+	// renaming cost to total breaks the readers of version 2 on version 1 events
+	v2, err := schema.Current(events, saga_event.TypeShipmentDispatched)
+	assert.Nil(t, err)
+	registry.Add(saga_event.TypeShipmentDispatched, 2, v2)
+	assert.Equal(t, []string{
+		"ShipmentDispatched version 2: backward from version 1: total: required by the reader, never written",
+	}, errorStrings(schema.Check(registry, events)))
+
+	// unless an upcaster rewrites them
+	events.RegisterUpcaster(saga_event.TypeShipmentDispatched, 1, func(payload json.RawMessage) (json.RawMessage, error) {
+		return payload, nil
+	})
+	assert.Empty(t, schema.Check(registry, events))
+
+	// the struct of a registered version cannot drift from its schema
+	drifted := mustGenerate(t, orderPlacedV1{})
+	drifted.Properties["total"] = v2.Properties["total"]
+	drifted.Required = append(drifted.Required, "total")
+	registry.Add(saga_event.TypeShipmentDispatched, 2, drifted)
+	assert.Equal(t, []string{
+		"ShipmentDispatched version 2: forward: amount: required by the reader, never written",
+	}, errorStrings(schema.Check(registry, events)))
+}
+
+func Test_Schema_Validating_Codec(t *testing.T) {
+	codec := schema.Validating(saga_event.Protobuf, schema.Default, saga_event.DefaultRegistry)
+	assert.Equal(t, saga_event.ContentTypeProtobuf, codec.ContentType())
+
+	event := saga_event.PaymentRejected{OrderID: 1, Cost: usd(15), Status: model.OrderStatusFailedPaymentDeclined}
+	content, err := codec.Marshal(event)
+	assert.Nil(t, err)
+	decoded, err := codec.Unmarshal(content)
+	assert.Nil(t, err)
+	assert.Equal(t, event, decoded)
+
+	_, err = codec.Marshal(saga_event.PaymentRejected{Status: model.OrderStatusShipped})
+	assert.EqualError(t, err, "schema: invalid PaymentRejected version 1: order_id: 0 is less than 1\n"+
+		`status: "SHIPPED" is not one of ["EXCEED_CREDIT_LIMIT" "PAYMENT_DECLINED" "PAYMENT_TIMED_OUT"]`)
+
+	_, err = codec.Marshal(saga_event.InventoryReserved{OrderID: 1})
+	assert.EqualError(t, err, `schema: invalid InventoryReserved version 1: cost.currency: "" is shorter than 3`)
+
+	codec = schema.Validating(saga_event.JSON, schema.NewRegistry(), saga_event.DefaultRegistry)
+	_, err = codec.Marshal(saga_event.OrderCreated{OrderID: 1, Amount: 1})
+	assert.EqualError(t, err, "schema: no schema registered for OrderCreated version 1")
+}
+
+func Test_Schema_Load(t *testing.T) {
+	registry, err := schema.Load(fstest.MapFS{
+		"OrderPlaced.v2.json": {Data: []byte(`{"title": "OrderPlaced", "version": 2, "type": "object"}`)},
+		"README.md":           {Data: []byte("not a schema")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2}, registry.Versions("OrderPlaced"))
+
+	_, err = schema.Load(fstest.MapFS{
+		"order_placed.json": {Data: []byte(`{"type": "object"}`)},
+	})
+	assert.EqualError(t, err, "schema: order_placed.json is not named <type>.v<version>.json")
+
+	_, err = schema.Load(fstest.MapFS{
+		"OrderPlaced.v2.json": {Data: []byte(`{"title": "OrderPlaced", "version": 1, "type": "object"}`)},
+	})
+	assert.EqualError(t, err, "schema: OrderPlaced.v2.json describes OrderPlaced version 1")
+
+	errs := mustGenerate(t, orderPlacedV1{}).Validate([]byte(`{"order_id": 1.5, "note": "x"}`))
+	assert.Equal(t, []string{"amount: required", "order_id: 1.5 is not an integer"}, errorStrings(errs))
+}
+
+func errorStrings(errs []error) []string {
+	var res []string
+	for _, err := range errs {
+		res = append(res, err.Error())
+	}
+	return res
+}
@@ -12,45 +12,81 @@ import (
 	"github.com/rafata1/sagas-pattern-thesis/service/payment"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
+// mysqlConfig points the MySQL tests to the databases of docker-compose.yaml, or to the
+// SAGA_<SERVICE>_DSN variables.
+var mysqlConfig = loadMySQLConfig()
+
+func loadMySQLConfig() config.Config {
+	conf, err := config.Load(filepath.Join("..", "config.mysql.yaml"))
+	if err != nil {
+		panic(err)
+	}
+	return conf
+}
+
 func getOrderTestingDB() *sqlx.DB {
-	db, err := sqlx.Connect("mysql", config.DefaultConfig.OrderConfig.DatabaseDSN)
+	db, err := sqlx.Connect("mysql", mysqlConfig.OrderConfig.DatabaseDSN)
 	if err != nil {
 		panic(err)
 	}
 
 	db.MustExec("TRUNCATE orders")
 	db.MustExec("TRUNCATE order_outboxes")
+	db.MustExec("TRUNCATE saga_audit")
+	db.MustExec("TRUNCATE inbox")
 	return db
 }
 
 func getInventoryTestingDB() *sqlx.DB {
-	db, err := sqlx.Connect("mysql", config.DefaultConfig.InventoryConfig.DatabaseDSN)
+	db, err := sqlx.Connect("mysql", mysqlConfig.InventoryConfig.DatabaseDSN)
 	if err != nil {
 		panic(err)
 	}
 
 	db.MustExec("TRUNCATE inventory")
+	db.MustExec("TRUNCATE reservations")
 	db.MustExec("TRUNCATE inventory_outboxes")
-	db.MustExec("TRUNCATE processed_orders")
+	db.MustExec("TRUNCATE saga_audit")
+	db.MustExec("TRUNCATE inbox")
 	return db
 }
 
 func getPaymentTestingDB() *sqlx.DB {
-	db, err := sqlx.Connect("mysql", config.DefaultConfig.PaymentConfig.DatabaseDSN)
+	db, err := sqlx.Connect("mysql", mysqlConfig.PaymentConfig.DatabaseDSN)
 	if err != nil {
 		panic(err)
 	}
 
 	db.MustExec("TRUNCATE accounts")
 	db.MustExec("TRUNCATE payment_outboxes")
-	db.MustExec("TRUNCATE processed_orders")
+	db.MustExec("TRUNCATE saga_audit")
+	db.MustExec("TRUNCATE inbox")
+	db.MustExec("TRUNCATE charges")
+	db.MustExec("TRUNCATE payment_authorizations")
 	return db
 }
 
+func newTestProducer(topic string) kafka.IProducer {
+	producer, err := kafka.NewProducer(config.DefaultConfig.Kafka, topic)
+	if err != nil {
+		panic(err)
+	}
+	return producer
+}
+
+func newTestConsumer(topic string) kafka.IConsumer {
+	consumer, err := kafka.NewConsumer(config.DefaultConfig.Kafka, topic)
+	if err != nil {
+		panic(err)
+	}
+	return consumer
+}
+
 func Test_Full_Flow(t *testing.T) {
 	repo := order.NewRepo(getOrderTestingDB())
 
@@ -59,9 +95,9 @@ func Test_Full_Flow(t *testing.T) {
 	prepareInventoryTopic := getTopicTest(config.DefaultConfig.PrepareInventoryTopic)
 	orderBillTopic := getTopicTest(config.DefaultConfig.OrderBillTopic)
 
-	orderProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, orderCreatedTopic)
-	billConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, orderBillTopic)
-	orderService := order.NewService(repo, orderProducer, billConsumer, nil)
+	orderProducer := newTestProducer(orderCreatedTopic)
+	billConsumer := newTestConsumer(orderBillTopic)
+	orderService := order.NewService(repo, orderProducer, billConsumer, nil, nil)
 	inputOrder := model.Order{
 		CustomerID: 1,
 		ProductID:  2,
@@ -96,19 +132,19 @@ func Test_Full_Flow(t *testing.T) {
 		panic(err)
 	}
 
-	ordersConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, orderCreatedTopic)
+	ordersConsumer := newTestConsumer(orderCreatedTopic)
 	inventoryRepo := inventory.NewRepo(getInventoryTestingDB())
 	err = inventoryRepo.CreateInventory(ctx, model.Inventory{
 		ProductID: 2,
-		UnitPrice: 5,
+		UnitPrice: model.NewMoney(5, model.DefaultCurrency),
 		Amount:    100,
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	inventoryProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, prepareInventoryTopic)
-	inventoryService := inventory.NewService(inventoryRepo, ordersConsumer, nil, inventoryProducer)
+	inventoryProducer := newTestProducer(prepareInventoryTopic)
+	inventoryService := inventory.NewService(inventoryRepo, ordersConsumer, nil, nil, inventoryProducer)
 	inventoryService.ConsumeOrders(ctx, 1*time.Second)
 
 	actualInventory, err := inventoryRepo.GetInventory(ctx, 2)
@@ -118,7 +154,7 @@ func Test_Full_Flow(t *testing.T) {
 
 	expectedInventory := model.Inventory{
 		ProductID: 2,
-		UnitPrice: 5,
+		UnitPrice: model.NewMoney(5, model.DefaultCurrency),
 		Amount:    97,
 		CreatedAt: actualInventory.CreatedAt,
 		UpdatedAt: actualInventory.UpdatedAt,
@@ -129,12 +165,12 @@ func Test_Full_Flow(t *testing.T) {
 	paymentRepo := payment.NewRepo(getPaymentTestingDB())
 	err = paymentRepo.CreateAccount(ctx, model.Account{
 		CustomerID: 1,
-		Balance:    100,
+		Balance:    model.NewMoney(100, model.DefaultCurrency),
 	})
 
-	paymentConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, prepareInventoryTopic)
-	paymentProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, orderBillTopic)
-	paymentService := payment.NewService(paymentRepo, paymentConsumer, paymentProducer)
+	paymentConsumer := newTestConsumer(prepareInventoryTopic)
+	paymentProducer := newTestProducer(orderBillTopic)
+	paymentService := payment.NewService(paymentRepo, paymentConsumer, nil, paymentProducer)
 	paymentService.ConsumePreparedOrders(ctx, 1*time.Second)
 	paymentService.RelayMessage(ctx, 10)
 
@@ -145,7 +181,7 @@ func Test_Full_Flow(t *testing.T) {
 
 	expectedAccount := model.Account{
 		CustomerID: 1,
-		Balance:    85,
+		Balance:    model.NewMoney(85, model.DefaultCurrency),
 		CreatedAt:  actualAccount.CreatedAt,
 		UpdatedAt:  actualAccount.UpdatedAt,
 	}
@@ -164,6 +200,7 @@ func Test_Full_Flow(t *testing.T) {
 		CustomerID: 1,
 		ProductID:  2,
 		Amount:     3,
+		Cost:       model.NewMoney(15, model.DefaultCurrency),
 		Status:     model.OrderStatusBilled,
 		CreatedAt:  actualOrder.CreatedAt,
 		UpdatedAt:  actualOrder.UpdatedAt,
@@ -183,9 +220,9 @@ func Test_Case_OutOfStock(t *testing.T) {
 	orderCreatedTopic := getTopicTest(config.DefaultConfig.OrderCreatedTopic)
 	prepareInventoryTopic := getTopicTest(config.DefaultConfig.PrepareInventoryTopic)
 
-	orderProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, orderCreatedTopic)
-	inventoryConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, prepareInventoryTopic)
-	orderService := order.NewService(repo, orderProducer, nil, inventoryConsumer)
+	orderProducer := newTestProducer(orderCreatedTopic)
+	inventoryConsumer := newTestConsumer(prepareInventoryTopic)
+	orderService := order.NewService(repo, orderProducer, nil, inventoryConsumer, nil)
 	inputOrder := model.Order{
 		CustomerID: 1,
 		ProductID:  2,
@@ -201,19 +238,19 @@ func Test_Case_OutOfStock(t *testing.T) {
 		panic(err)
 	}
 
-	ordersConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, orderCreatedTopic)
+	ordersConsumer := newTestConsumer(orderCreatedTopic)
 	inventoryRepo := inventory.NewRepo(getInventoryTestingDB())
 	err = inventoryRepo.CreateInventory(ctx, model.Inventory{
 		ProductID: 2,
-		UnitPrice: 5,
+		UnitPrice: model.NewMoney(5, model.DefaultCurrency),
 		Amount:    2, // 2 < 3 so this case is out of stock
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	inventoryProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, prepareInventoryTopic)
-	inventoryService := inventory.NewService(inventoryRepo, ordersConsumer, nil, inventoryProducer)
+	inventoryProducer := newTestProducer(prepareInventoryTopic)
+	inventoryService := inventory.NewService(inventoryRepo, ordersConsumer, nil, nil, inventoryProducer)
 	inventoryService.ConsumeOrders(ctx, 1*time.Second)
 
 	actualInventory, err := inventoryRepo.GetInventory(ctx, 2)
@@ -223,7 +260,7 @@ func Test_Case_OutOfStock(t *testing.T) {
 
 	expectedInventory := model.Inventory{
 		ProductID: 2,
-		UnitPrice: 5,
+		UnitPrice: model.NewMoney(5, model.DefaultCurrency),
 		Amount:    2,
 		CreatedAt: actualInventory.CreatedAt,
 		UpdatedAt: actualInventory.UpdatedAt,
@@ -259,9 +296,9 @@ func Test_Case_ExceedCreditLimit(t *testing.T) {
 	prepareInventoryTopic := getTopicTest(config.DefaultConfig.PrepareInventoryTopic)
 	orderBillTopic := getTopicTest(config.DefaultConfig.OrderBillTopic)
 
-	orderProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, orderCreatedTopic)
-	billConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, orderBillTopic)
-	orderService := order.NewService(repo, orderProducer, billConsumer, nil)
+	orderProducer := newTestProducer(orderCreatedTopic)
+	billConsumer := newTestConsumer(orderBillTopic)
+	orderService := order.NewService(repo, orderProducer, billConsumer, nil, nil)
 	inputOrder := model.Order{
 		CustomerID: 1,
 		ProductID:  2,
@@ -277,19 +314,19 @@ func Test_Case_ExceedCreditLimit(t *testing.T) {
 		panic(err)
 	}
 
-	ordersConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, orderCreatedTopic)
+	ordersConsumer := newTestConsumer(orderCreatedTopic)
 	inventoryRepo := inventory.NewRepo(getInventoryTestingDB())
 	err = inventoryRepo.CreateInventory(ctx, model.Inventory{
 		ProductID: 2,
-		UnitPrice: 5,
+		UnitPrice: model.NewMoney(5, model.DefaultCurrency),
 		Amount:    100,
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	inventoryProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, prepareInventoryTopic)
-	inventoryService := inventory.NewService(inventoryRepo, ordersConsumer, billConsumer, inventoryProducer)
+	inventoryProducer := newTestProducer(prepareInventoryTopic)
+	inventoryService := inventory.NewService(inventoryRepo, ordersConsumer, billConsumer, nil, inventoryProducer)
 	inventoryService.ConsumeOrders(ctx, 1*time.Second)
 
 	actualInventory, err := inventoryRepo.GetInventory(ctx, 2)
@@ -299,7 +336,7 @@ func Test_Case_ExceedCreditLimit(t *testing.T) {
 
 	expectedInventory := model.Inventory{
 		ProductID: 2,
-		UnitPrice: 5,
+		UnitPrice: model.NewMoney(5, model.DefaultCurrency),
 		Amount:    97,
 		CreatedAt: actualInventory.CreatedAt,
 		UpdatedAt: actualInventory.UpdatedAt,
@@ -310,12 +347,12 @@ func Test_Case_ExceedCreditLimit(t *testing.T) {
 	paymentRepo := payment.NewRepo(getPaymentTestingDB())
 	err = paymentRepo.CreateAccount(ctx, model.Account{
 		CustomerID: 1,
-		Balance:    14, // cost of order is 15, customer credit limit is 14 => ExceedCreditLimit
+		Balance:    model.NewMoney(14, model.DefaultCurrency), // cost of order is 15, customer credit limit is 14 => ExceedCreditLimit
 	})
 
-	paymentConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, prepareInventoryTopic)
-	paymentProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, orderBillTopic)
-	paymentService := payment.NewService(paymentRepo, paymentConsumer, paymentProducer)
+	paymentConsumer := newTestConsumer(prepareInventoryTopic)
+	paymentProducer := newTestProducer(orderBillTopic)
+	paymentService := payment.NewService(paymentRepo, paymentConsumer, nil, paymentProducer)
 	paymentService.ConsumePreparedOrders(ctx, 1*time.Second)
 	paymentService.RelayMessage(ctx, 10)
 
@@ -326,7 +363,7 @@ func Test_Case_ExceedCreditLimit(t *testing.T) {
 
 	expectedAccount := model.Account{
 		CustomerID: 1,
-		Balance:    14,
+		Balance:    model.NewMoney(14, model.DefaultCurrency),
 		CreatedAt:  actualAccount.CreatedAt,
 		UpdatedAt:  actualAccount.UpdatedAt,
 	}
@@ -341,13 +378,15 @@ func Test_Case_ExceedCreditLimit(t *testing.T) {
 	}
 
 	expectedOrder := model.Order{
-		ID:         orderID,
-		CustomerID: 1,
-		ProductID:  2,
-		Amount:     3,
-		Status:     model.OrderStatusFailedExceedCreditLimit,
-		CreatedAt:  actualOrder.CreatedAt,
-		UpdatedAt:  actualOrder.UpdatedAt,
+		ID:            orderID,
+		CustomerID:    1,
+		ProductID:     2,
+		Amount:        3,
+		Cost:          model.NewMoney(15, model.DefaultCurrency),
+		Status:        model.OrderStatusFailedExceedCreditLimit,
+		FailureReason: payment.RejectReasonInsufficientBalance,
+		CreatedAt:     actualOrder.CreatedAt,
+		UpdatedAt:     actualOrder.UpdatedAt,
 	}
 
 	assert.Equal(t, expectedOrder, actualOrder)
@@ -361,9 +400,9 @@ func Test_Full_Flow_Inventory_Idempotence(t *testing.T) {
 	prepareInventoryTopic := getTopicTest(config.DefaultConfig.PrepareInventoryTopic)
 	orderBillTopic := getTopicTest(config.DefaultConfig.OrderBillTopic)
 
-	orderProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, orderCreatedTopic)
-	billConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, orderBillTopic)
-	orderService := order.NewService(repo, orderProducer, billConsumer, nil)
+	orderProducer := newTestProducer(orderCreatedTopic)
+	billConsumer := newTestConsumer(orderBillTopic)
+	orderService := order.NewService(repo, orderProducer, billConsumer, nil, nil)
 	inputOrder := model.Order{
 		CustomerID: 1,
 		ProductID:  2,
@@ -398,19 +437,19 @@ func Test_Full_Flow_Inventory_Idempotence(t *testing.T) {
 		panic(err)
 	}
 
-	ordersConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, orderCreatedTopic)
+	ordersConsumer := newTestConsumer(orderCreatedTopic)
 	inventoryRepo := inventory.NewRepo(getInventoryTestingDB())
 	err = inventoryRepo.CreateInventory(ctx, model.Inventory{
 		ProductID: 2,
-		UnitPrice: 5,
+		UnitPrice: model.NewMoney(5, model.DefaultCurrency),
 		Amount:    100,
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	inventoryProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, prepareInventoryTopic)
-	inventoryService := inventory.NewService(inventoryRepo, ordersConsumer, nil, inventoryProducer)
+	inventoryProducer := newTestProducer(prepareInventoryTopic)
+	inventoryService := inventory.NewService(inventoryRepo, ordersConsumer, nil, nil, inventoryProducer)
 	// receive message 2 times
 	inventoryService.ConsumeOrders(ctx, 1*time.Second)
 	inventoryService.ConsumeOrders(ctx, 1*time.Second)
@@ -422,7 +461,7 @@ func Test_Full_Flow_Inventory_Idempotence(t *testing.T) {
 
 	expectedInventory := model.Inventory{
 		ProductID: 2,
-		UnitPrice: 5,
+		UnitPrice: model.NewMoney(5, model.DefaultCurrency),
 		Amount:    97,
 		CreatedAt: actualInventory.CreatedAt,
 		UpdatedAt: actualInventory.UpdatedAt,
@@ -433,12 +472,12 @@ func Test_Full_Flow_Inventory_Idempotence(t *testing.T) {
 	paymentRepo := payment.NewRepo(getPaymentTestingDB())
 	err = paymentRepo.CreateAccount(ctx, model.Account{
 		CustomerID: 1,
-		Balance:    100,
+		Balance:    model.NewMoney(100, model.DefaultCurrency),
 	})
 
-	paymentConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, prepareInventoryTopic)
-	paymentProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, orderBillTopic)
-	paymentService := payment.NewService(paymentRepo, paymentConsumer, paymentProducer)
+	paymentConsumer := newTestConsumer(prepareInventoryTopic)
+	paymentProducer := newTestProducer(orderBillTopic)
+	paymentService := payment.NewService(paymentRepo, paymentConsumer, nil, paymentProducer)
 	paymentService.ConsumePreparedOrders(ctx, 1*time.Second)
 	paymentService.RelayMessage(ctx, 10)
 
@@ -449,7 +488,7 @@ func Test_Full_Flow_Inventory_Idempotence(t *testing.T) {
 
 	expectedAccount := model.Account{
 		CustomerID: 1,
-		Balance:    85,
+		Balance:    model.NewMoney(85, model.DefaultCurrency),
 		CreatedAt:  actualAccount.CreatedAt,
 		UpdatedAt:  actualAccount.UpdatedAt,
 	}
@@ -468,6 +507,7 @@ func Test_Full_Flow_Inventory_Idempotence(t *testing.T) {
 		CustomerID: 1,
 		ProductID:  2,
 		Amount:     3,
+		Cost:       model.NewMoney(15, model.DefaultCurrency),
 		Status:     model.OrderStatusBilled,
 		CreatedAt:  actualOrder.CreatedAt,
 		UpdatedAt:  actualOrder.UpdatedAt,
@@ -484,9 +524,9 @@ func Test_Full_Flow_Payment_Idempotence(t *testing.T) {
 	prepareInventoryTopic := getTopicTest(config.DefaultConfig.PrepareInventoryTopic)
 	orderBillTopic := getTopicTest(config.DefaultConfig.OrderBillTopic)
 
-	orderProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, orderCreatedTopic)
-	billConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, orderBillTopic)
-	orderService := order.NewService(repo, orderProducer, billConsumer, nil)
+	orderProducer := newTestProducer(orderCreatedTopic)
+	billConsumer := newTestConsumer(orderBillTopic)
+	orderService := order.NewService(repo, orderProducer, billConsumer, nil, nil)
 	inputOrder := model.Order{
 		CustomerID: 1,
 		ProductID:  2,
@@ -521,19 +561,19 @@ func Test_Full_Flow_Payment_Idempotence(t *testing.T) {
 		panic(err)
 	}
 
-	ordersConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, orderCreatedTopic)
+	ordersConsumer := newTestConsumer(orderCreatedTopic)
 	inventoryRepo := inventory.NewRepo(getInventoryTestingDB())
 	err = inventoryRepo.CreateInventory(ctx, model.Inventory{
 		ProductID: 2,
-		UnitPrice: 5,
+		UnitPrice: model.NewMoney(5, model.DefaultCurrency),
 		Amount:    100,
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	inventoryProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, prepareInventoryTopic)
-	inventoryService := inventory.NewService(inventoryRepo, ordersConsumer, nil, inventoryProducer)
+	inventoryProducer := newTestProducer(prepareInventoryTopic)
+	inventoryService := inventory.NewService(inventoryRepo, ordersConsumer, nil, nil, inventoryProducer)
 	// receive message 2 times
 	inventoryService.ConsumeOrders(ctx, 1*time.Second)
 	inventoryService.ConsumeOrders(ctx, 1*time.Second)
@@ -545,7 +585,7 @@ func Test_Full_Flow_Payment_Idempotence(t *testing.T) {
 
 	expectedInventory := model.Inventory{
 		ProductID: 2,
-		UnitPrice: 5,
+		UnitPrice: model.NewMoney(5, model.DefaultCurrency),
 		Amount:    97,
 		CreatedAt: actualInventory.CreatedAt,
 		UpdatedAt: actualInventory.UpdatedAt,
@@ -556,12 +596,12 @@ func Test_Full_Flow_Payment_Idempotence(t *testing.T) {
 	paymentRepo := payment.NewRepo(getPaymentTestingDB())
 	err = paymentRepo.CreateAccount(ctx, model.Account{
 		CustomerID: 1,
-		Balance:    100,
+		Balance:    model.NewMoney(100, model.DefaultCurrency),
 	})
 
-	paymentConsumer := kafka.NewConsumer(config.DefaultConfig.KafkaHost, prepareInventoryTopic)
-	paymentProducer := kafka.NewProducer(config.DefaultConfig.KafkaHost, orderBillTopic)
-	paymentService := payment.NewService(paymentRepo, paymentConsumer, paymentProducer)
+	paymentConsumer := newTestConsumer(prepareInventoryTopic)
+	paymentProducer := newTestProducer(orderBillTopic)
+	paymentService := payment.NewService(paymentRepo, paymentConsumer, nil, paymentProducer)
 	// receive prepared order 2 times
 	paymentService.ConsumePreparedOrders(ctx, 1*time.Second)
 	paymentService.ConsumePreparedOrders(ctx, 1*time.Second)
@@ -574,7 +614,7 @@ func Test_Full_Flow_Payment_Idempotence(t *testing.T) {
 
 	expectedAccount := model.Account{
 		CustomerID: 1,
-		Balance:    85,
+		Balance:    model.NewMoney(85, model.DefaultCurrency),
 		CreatedAt:  actualAccount.CreatedAt,
 		UpdatedAt:  actualAccount.UpdatedAt,
 	}
@@ -593,6 +633,7 @@ func Test_Full_Flow_Payment_Idempotence(t *testing.T) {
 		CustomerID: 1,
 		ProductID:  2,
 		Amount:     3,
+		Cost:       model.NewMoney(15, model.DefaultCurrency),
 		Status:     model.OrderStatusBilled,
 		CreatedAt:  actualOrder.CreatedAt,
 		UpdatedAt:  actualOrder.UpdatedAt,
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/saga_event"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/rafata1/sagas-pattern-thesis/service/shipping"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func getShippingTestingDB() *sqlx.DB {
+	db, err := sqlx.Connect("mysql", mysqlConfig.ShippingConfig.DatabaseDSN)
+	if err != nil {
+		panic(err)
+	}
+
+	db.MustExec("TRUNCATE shipments")
+	db.MustExec("TRUNCATE shipping_outboxes")
+	db.MustExec("TRUNCATE saga_audit")
+	db.MustExec("TRUNCATE inbox")
+	return db
+}
+
+func billedOrderEvent() saga_event.OrderEvent {
+	return saga_event.OrderEvent{
+		OrderID:    1,
+		CustomerID: 1,
+		ProductID:  2,
+		Amount:     3,
+		Cost:       model.NewMoney(15, model.DefaultCurrency),
+		Status:     model.OrderStatusBilled,
+	}
+}
+
+func getShippingEvents(ctx context.Context, repo shipping.IRepo) []saga_event.OrderEvent {
+	outboxes, err := repo.GetPendingOutbox(ctx, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	var res []saga_event.OrderEvent
+	for _, outbox := range outboxes {
+		event, err := saga_event.Decode(outbox.Content)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, event)
+	}
+	return res
+}
+
+func Test_Shipping_Shipped(t *testing.T) {
+	ctx := context.Background()
+	shippingRepo := shipping.NewRepo(getShippingTestingDB())
+	shippingService := shipping.NewService(shippingRepo, nil, nil, shipping.NewFakeCarrier())
+
+	// receive billed order 2 times
+	err := shippingService.Ship(ctx, billedOrderEvent())
+	if err != nil {
+		panic(err)
+	}
+	err = shippingService.Ship(ctx, billedOrderEvent())
+	if err != nil {
+		panic(err)
+	}
+
+	actualShipment, err := shippingRepo.GetShipment(ctx, 1)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, model.Shipment{
+		OrderID:        1,
+		CustomerID:     1,
+		ProductID:      2,
+		Amount:         3,
+		TrackingNumber: "FAKE-1",
+		Status:         model.ShipmentStatusShipped,
+		CreatedAt:      actualShipment.CreatedAt,
+		UpdatedAt:      actualShipment.UpdatedAt,
+	}, actualShipment)
+
+	expectedEvent := billedOrderEvent()
+	expectedEvent.Status = model.OrderStatusShipped
+	assert.Equal(t, []saga_event.OrderEvent{expectedEvent}, getShippingEvents(ctx, shippingRepo))
+}
+
+func Test_Shipping_Failed_Refunds(t *testing.T) {
+	ctx := context.Background()
+	shippingRepo := shipping.NewRepo(getShippingTestingDB())
+	carrier := shipping.NewFakeCarrier()
+	carrier.RejectProduct(2, "UNDELIVERABLE_ADDRESS")
+	shippingService := shipping.NewService(shippingRepo, nil, nil, carrier)
+
+	err := shippingService.Ship(ctx, billedOrderEvent())
+	if err != nil {
+		panic(err)
+	}
+
+	expectedEvent := billedOrderEvent()
+	expectedEvent.Status = model.OrderStatusFailedShipping
+	expectedEvent.Reason = "UNDELIVERABLE_ADDRESS"
+	assert.Equal(t, []saga_event.OrderEvent{expectedEvent}, getShippingEvents(ctx, shippingRepo))
+
+	paymentRepo := payment.NewRepo(getPaymentTestingDB())
+	err = paymentRepo.CreateAccount(ctx, model.Account{
+		CustomerID: 1,
+		Balance:    model.NewMoney(100, model.DefaultCurrency),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	paymentService := payment.NewService(paymentRepo, nil, nil, nil)
+	preparedEvent := billedOrderEvent()
+	preparedEvent.Status = model.OrderStatusPrepared
+	err = paymentService.Pay(ctx, preparedEvent)
+	if err != nil {
+		panic(err)
+	}
+
+	// receive failed shipment 2 times
+	err = paymentService.Refund(ctx, expectedEvent)
+	if err != nil {
+		panic(err)
+	}
+	err = paymentService.Refund(ctx, expectedEvent)
+	if err != nil {
+		panic(err)
+	}
+
+	actualAccount, err := paymentRepo.GetAccount(ctx, 1)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, model.NewMoney(100, model.DefaultCurrency), actualAccount.Balance)
+}
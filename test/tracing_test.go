@@ -0,0 +1,139 @@
+package test
+
+import (
+	"context"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/rafata1/sagas-pattern-thesis/service/shipping"
+	"github.com/rafata1/sagas-pattern-thesis/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+	"time"
+)
+
+// useInMemoryExporter installs a tracer provider recording every span until the test ends.
+func useInMemoryExporter(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+	return exporter
+}
+
+func Test_Tracing_Headers(t *testing.T) {
+	useInMemoryExporter(t)
+	ctx, span := tracing.Start(context.Background(), "parent")
+	defer span.End()
+
+	headers := tracing.Inject(ctx)
+	assert.Contains(t, headers, "traceparent")
+
+	remote := trace.SpanContextFromContext(tracing.Extract(context.Background(), headers))
+	assert.True(t, remote.IsRemote())
+	assert.Equal(t, span.SpanContext().TraceID(), remote.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), remote.SpanID())
+
+	assert.Nil(t, tracing.Inject(context.Background()))
+}
+
+// Test_Tracing_Saga runs the saga on SQLite and the in-memory broker, one order must be one trace
+// from CreateOrder to the shipment coming back to the order service.
+func Test_Tracing_Saga(t *testing.T) {
+	exporter := useInMemoryExporter(t)
+	ctx := context.Background()
+	conf := config.DefaultConfig
+	broker := memory.NewBroker()
+	consumeFor := 200 * time.Millisecond
+
+	orderService := order.NewService(
+		order.NewRepo(getSQLiteTestingDB(t, "order")),
+		broker.Producer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+	)
+
+	inventoryRepo := inventory.NewRepo(getSQLiteTestingDB(t, "inventory"))
+	err := inventoryRepo.CreateInventory(ctx, model.Inventory{ProductID: 2, UnitPrice: usd(5), Amount: 100})
+	assert.Nil(t, err)
+	inventoryService := inventory.NewService(
+		inventoryRepo,
+		broker.Consumer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.PrepareInventoryTopic),
+	)
+
+	paymentRepo := payment.NewRepo(getSQLiteTestingDB(t, "payment"))
+	err = paymentRepo.CreateAccount(ctx, model.Account{CustomerID: 1, Balance: usd(100)})
+	assert.Nil(t, err)
+	paymentService := payment.NewService(
+		paymentRepo,
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.OrderBillTopic),
+	)
+
+	shippingService := shipping.NewService(
+		shipping.NewRepo(getSQLiteTestingDB(t, "shipping")),
+		broker.Consumer(conf.OrderCreatedTopic),
+		broker.Producer(conf.ShipmentTopic),
+		shipping.NewFakeCarrier(),
+	)
+
+	_, err = orderService.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 3})
+	assert.Nil(t, err)
+	assert.Nil(t, orderService.RelayMessage(ctx, 10))
+
+	inventoryService.ConsumeOrders(ctx, consumeFor)
+	assert.Nil(t, inventoryService.RelayMessage(ctx, 10))
+
+	paymentService.ConsumePreparedOrders(ctx, consumeFor)
+	assert.Nil(t, paymentService.RelayMessage(ctx, 10))
+
+	orderService.ConsumeBills(ctx, consumeFor)
+	assert.Nil(t, orderService.RelayMessage(ctx, 10))
+
+	shippingService.ConsumeOrders(ctx, consumeFor)
+	assert.Nil(t, shippingService.RelayMessage(ctx, 10))
+
+	orderService.ConsumeShipments(ctx, consumeFor)
+
+	spans := exporter.GetSpans()
+	var traceID trace.TraceID
+	for _, span := range spans {
+		if span.Name == "order.CreateOrder" {
+			traceID = span.SpanContext.TraceID()
+		}
+	}
+	assert.True(t, traceID.IsValid())
+
+	inTrace := map[string]bool{}
+	for _, span := range spans {
+		if span.SpanContext.TraceID() == traceID {
+			inTrace[span.Name] = true
+		}
+	}
+	for _, name := range []string{
+		"order.CreateOrder",
+		"INSERT",
+		"order_outboxes publish",
+		"inventory.ConsumeOrders",
+		"inventory_outboxes publish",
+		"payment.ConsumePreparedOrders",
+		"payment_outboxes publish",
+		"order.ConsumeBills",
+		"shipping.ConsumeOrders",
+		"shipping_outboxes publish",
+		"order.ConsumeShipments",
+	} {
+		assert.True(t, inTrace[name], "span %q is not in the trace of the order", name)
+	}
+}
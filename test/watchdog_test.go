@@ -0,0 +1,234 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/kafka/memory"
+	"github.com/rafata1/sagas-pattern-thesis/metrics"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"github.com/rafata1/sagas-pattern-thesis/service/inventory"
+	"github.com/rafata1/sagas-pattern-thesis/service/order"
+	"github.com/rafata1/sagas-pattern-thesis/service/payment"
+	"github.com/rafata1/sagas-pattern-thesis/service/shipping"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const consumeFor = 200 * time.Millisecond
+
+// watchdogSaga is the whole saga on the in-memory broker, every order is stuck as soon as it waits
+// in the status given to newWatchdogSaga.
+type watchdogSaga struct {
+	orderRepo        order.IRepo
+	orderService     order.IService
+	inventoryRepo    inventory.IRepo
+	inventoryService inventory.IService
+	paymentRepo      payment.IRepo
+	paymentService   payment.IService
+	shippingRepo     shipping.IRepo
+	shippingService  shipping.IService
+}
+
+func newWatchdogSaga(t *testing.T, stuckIn model.OrderStatus) watchdogSaga {
+	ctx := context.Background()
+	conf := config.DefaultConfig
+	broker := memory.NewBroker()
+	var saga watchdogSaga
+
+	saga.orderRepo = order.NewMemoryRepo()
+	saga.orderService = order.NewService(
+		saga.orderRepo,
+		broker.Producer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		order.WithTimeouts(map[model.OrderStatus]time.Duration{stuckIn: time.Nanosecond}),
+	)
+
+	saga.inventoryRepo = inventory.NewMemoryRepo()
+	err := saga.inventoryRepo.CreateInventory(ctx, model.Inventory{ProductID: 2, UnitPrice: usd(5), Amount: 100})
+	assert.Nil(t, err)
+	saga.inventoryService = inventory.NewService(
+		saga.inventoryRepo,
+		broker.Consumer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.PrepareInventoryTopic),
+	)
+
+	saga.paymentRepo = payment.NewMemoryRepo()
+	err = saga.paymentRepo.CreateAccount(ctx, model.Account{CustomerID: 1, Balance: usd(100)})
+	assert.Nil(t, err)
+	saga.paymentService = payment.NewService(
+		saga.paymentRepo,
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		broker.Producer(conf.OrderBillTopic),
+	)
+
+	saga.shippingRepo = shipping.NewMemoryRepo()
+	saga.shippingService = shipping.NewService(
+		saga.shippingRepo,
+		broker.Consumer(conf.OrderCreatedTopic),
+		broker.Producer(conf.ShipmentTopic),
+		shipping.NewFakeCarrier(),
+	)
+	return saga
+}
+
+// assertCompensated expects the order timed out with its stock and money given back, and not shipped.
+func (saga watchdogSaga) assertCompensated(t *testing.T, id int64) {
+	ctx := context.Background()
+	actualOrder, err := saga.orderRepo.GetOrder(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusTimedOut), actualOrder.Status)
+
+	actualInventory, err := saga.inventoryRepo.GetInventory(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, actualInventory.Amount)
+
+	actualAccount, err := saga.paymentRepo.GetAccount(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(100), actualAccount.Balance)
+
+	_, err = saga.shippingRepo.GetShipment(ctx, id)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+// Test_Watchdog_Pending times out an order inventory is slow to prepare, inventory reserves and
+// releases the stock, payment charges and refunds it. Its bill comes after the timeout, so the order
+// service does not confirm it and shipping does not ship it.
+func Test_Watchdog_Pending(t *testing.T) {
+	ctx := context.Background()
+	saga := newWatchdogSaga(t, model.OrderStatusPending)
+	timeouts := testutil.ToFloat64(metrics.Timeouts.WithLabelValues(model.OrderStatusPending))
+	restores := testutil.ToFloat64(metrics.Compensations.WithLabelValues("inventory", "restore_inventory"))
+
+	id, err := saga.orderService.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 3})
+	assert.Nil(t, err)
+	assert.Nil(t, saga.orderService.RelayMessage(ctx, 10))
+
+	assert.Nil(t, saga.orderService.TimeOutStuckOrders(ctx, 10))
+	// timing out twice publishes the timeout once
+	assert.Nil(t, saga.orderService.TimeOutStuckOrders(ctx, 10))
+	assert.Nil(t, saga.orderService.RelayMessage(ctx, 10))
+	assert.Equal(t, timeouts+1, testutil.ToFloat64(metrics.Timeouts.WithLabelValues(model.OrderStatusPending)))
+
+	saga.inventoryService.ConsumeOrders(ctx, consumeFor)
+	assert.Nil(t, saga.inventoryService.RelayMessage(ctx, 10))
+	assert.Equal(t, restores+1, testutil.ToFloat64(metrics.Compensations.WithLabelValues("inventory", "restore_inventory")))
+
+	saga.paymentService.ConsumePreparedOrders(ctx, consumeFor)
+	assert.Nil(t, saga.paymentService.RelayMessage(ctx, 10))
+
+	// the late answers do not move the order on, nor release the stock twice
+	saga.orderService.ConsumeInventory(ctx, consumeFor)
+	saga.orderService.ConsumeBills(ctx, consumeFor)
+	assert.Nil(t, saga.orderService.RelayMessage(ctx, 10))
+	saga.inventoryService.ConsumeBills(ctx, consumeFor)
+	saga.shippingService.ConsumeOrders(ctx, consumeFor)
+	saga.assertCompensated(t, id)
+}
+
+// Test_Watchdog_Prepared times out an order whose bill is not relayed yet, payment refunds it and
+// inventory releases its stock once.
+func Test_Watchdog_Prepared(t *testing.T) {
+	ctx := context.Background()
+	saga := newWatchdogSaga(t, model.OrderStatusPrepared)
+	refunds := testutil.ToFloat64(metrics.Compensations.WithLabelValues("payment", "refund"))
+
+	id, err := saga.orderService.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 3})
+	assert.Nil(t, err)
+	assert.Nil(t, saga.orderService.RelayMessage(ctx, 10))
+	saga.inventoryService.ConsumeOrders(ctx, consumeFor)
+	assert.Nil(t, saga.inventoryService.RelayMessage(ctx, 10))
+	saga.orderService.ConsumeInventory(ctx, consumeFor)
+	saga.paymentService.ConsumePreparedOrders(ctx, consumeFor)
+
+	// a PENDING order is not timed out by a PREPARED timeout
+	otherID, err := saga.orderService.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 1})
+	assert.Nil(t, err)
+
+	assert.Nil(t, saga.orderService.TimeOutStuckOrders(ctx, 10))
+	assert.Nil(t, saga.orderService.RelayMessage(ctx, 10))
+	other, err := saga.orderRepo.GetOrder(ctx, otherID)
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusPending), other.Status)
+
+	saga.inventoryService.ConsumeOrders(ctx, consumeFor)
+	assert.Nil(t, saga.inventoryService.RelayMessage(ctx, 10))
+	saga.paymentService.ConsumePreparedOrders(ctx, consumeFor)
+	assert.Nil(t, saga.paymentService.RelayMessage(ctx, 10))
+	assert.Equal(t, refunds+1, testutil.ToFloat64(metrics.Compensations.WithLabelValues("payment", "refund")))
+
+	saga.orderService.ConsumeBills(ctx, consumeFor)
+	assert.Nil(t, saga.orderService.RelayMessage(ctx, 10))
+	saga.inventoryService.ConsumeBills(ctx, consumeFor)
+	saga.shippingService.ConsumeOrders(ctx, consumeFor)
+
+	_, err = saga.shippingRepo.GetShipment(ctx, id)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	actualOrder, err := saga.orderRepo.GetOrder(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusTimedOut), actualOrder.Status)
+	assert.Contains(t, actualOrder.FailureReason, "no answer in PREPARED")
+
+	// the other order was prepared by inventory after the timeout, only its stock is still reserved
+	actualInventory, err := saga.inventoryRepo.GetInventory(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 99, actualInventory.Amount)
+	actualAccount, err := saga.paymentRepo.GetAccount(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(95), actualAccount.Balance)
+}
+
+// failingTimeOutRepo fails to time out the order failID.
+type failingTimeOutRepo struct {
+	order.IRepo
+	failID int64
+}
+
+func (r failingTimeOutRepo) UpdateStatusFrom(ctx context.Context, o model.Order, from model.OrderStatus) (bool, error) {
+	if o.ID == r.failID {
+		return false, errors.New("deadlock")
+	}
+	return r.IRepo.UpdateStatusFrom(ctx, o, from)
+}
+
+// Test_Watchdog_Failed_Order checks an order failing to time out does not hold back the next ones.
+func Test_Watchdog_Failed_Order(t *testing.T) {
+	ctx := context.Background()
+	conf := config.DefaultConfig
+	broker := memory.NewBroker()
+	repo := order.NewMemoryRepo()
+	failed := testutil.ToFloat64(metrics.TimeoutErrors.WithLabelValues(model.OrderStatusPending))
+
+	firstID, err := repo.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 3})
+	assert.Nil(t, err)
+	secondID, err := repo.CreateOrder(ctx, model.Order{CustomerID: 1, ProductID: 2, Amount: 1})
+	assert.Nil(t, err)
+
+	orderService := order.NewService(
+		failingTimeOutRepo{IRepo: repo, failID: firstID},
+		broker.Producer(conf.OrderCreatedTopic),
+		broker.Consumer(conf.OrderBillTopic),
+		broker.Consumer(conf.PrepareInventoryTopic),
+		broker.Consumer(conf.ShipmentTopic),
+		order.WithTimeouts(map[model.OrderStatus]time.Duration{model.OrderStatusPending: time.Nanosecond}),
+	)
+	err = orderService.TimeOutStuckOrders(ctx, 10)
+	assert.ErrorContains(t, err, fmt.Sprintf("order %d: deadlock", firstID))
+	assert.Equal(t, failed+1, testutil.ToFloat64(metrics.TimeoutErrors.WithLabelValues(model.OrderStatusPending)))
+
+	first, err := repo.GetOrder(ctx, firstID)
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusPending), first.Status)
+	second, err := repo.GetOrder(ctx, secondID)
+	assert.Nil(t, err)
+	assert.Equal(t, model.OrderStatus(model.OrderStatusTimedOut), second.Status)
+}
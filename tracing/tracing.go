@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/rafata1/sagas-pattern-thesis/config"
+	"github.com/rafata1/sagas-pattern-thesis/kafka"
+	"github.com/rafata1/sagas-pattern-thesis/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/rafata1/sagas-pattern-thesis"
+
+// propagator writes the W3C traceparent and tracestate headers
+var propagator = propagation.TraceContext{}
+
+// Start starts a span as a child of the span of ctx, spans go to the global tracer provider.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject returns the trace context of ctx as headers, nil when ctx carries no span.
+func Inject(ctx context.Context) model.Headers {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return model.Headers(carrier)
+}
+
+// Extract returns ctx with the remote span of headers as its parent.
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+	if len(headers) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// StartRelay starts one publish span per outbox, each one a child of the trace stored in its row,
+// and returns the messages to push carrying the publish spans and the content type of their rows.
+// end must be called with the push result.
+func StartRelay(ctx context.Context, table string, outboxes []model.Outbox) ([]kafka.Message, func(err error)) {
+	messages := make([]kafka.Message, 0, len(outboxes))
+	spans := make([]trace.Span, 0, len(outboxes))
+	for _, outbox := range outboxes {
+		publishCtx, span := Start(Extract(ctx, outbox.Headers), table+" publish",
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				semconv.MessagingSystem("kafka"),
+				attribute.Int64("outbox.id", outbox.ID),
+			),
+		)
+		spans = append(spans, span)
+		headers := Inject(publishCtx)
+		if outbox.ContentType != "" {
+			if headers == nil {
+				headers = model.Headers{}
+			}
+			headers[kafka.HeaderContentType] = outbox.ContentType
+		}
+		messages = append(messages, kafka.Message{Value: outbox.Content, Headers: headers})
+	}
+	return messages, func(err error) {
+		for _, span := range spans {
+			End(span, err)
+		}
+	}
+}
+
+// StartConsume starts the span of handling msg, as a child of the publish span in its headers.
+func StartConsume(ctx context.Context, name string, msg *sarama.ConsumerMessage) (context.Context, trace.Span) {
+	return Start(Extract(ctx, kafka.Headers(msg)), name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystem("kafka"),
+			semconv.MessagingSourceName(msg.Topic),
+			semconv.MessagingKafkaSourcePartition(int(msg.Partition)),
+			semconv.MessagingKafkaMessageOffset(int(msg.Offset)),
+		),
+	)
+}
+
+// Setup installs the tracer provider of conf as the global one, shutdown flushes the spans left.
+// With no exporter the no-op global provider is kept.
+func Setup(conf config.TracingConfig, serviceName string) (shutdown func(ctx context.Context) error, err error) {
+	var exporter sdktrace.SpanExporter
+	switch conf.Exporter {
+	case "", config.TracingExporterNone:
+		return func(ctx context.Context) error { return nil }, nil
+	case config.TracingExporterStdout:
+		exporter, err = stdouttrace.New()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", conf.Exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	return provider.Shutdown, nil
+}